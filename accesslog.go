@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AccessLog decides which requests are logged; a nil AccessLog logs all of them
+type AccessLog struct {
+	// Sample is the fraction of successful requests which are logged, all of them from 1
+	Sample float64
+	// Slow is the time from which a request is logged as slow with the time spent in datastore operations, 0 for never;
+	// the time a long-poll waits for a change is not counted
+	Slow time.Duration
+}
+
+// sampled reports whether a successful request which is not slow is logged
+func (a *AccessLog) sampled() bool {
+	return a == nil || a.Sample >= 1 || rand.Float64() < a.Sample
+}
+
+// secretHeaders carry credentials, they are not logged
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// loggedHeaders returns the headers of the request without the credentials
+func loggedHeaders(h http.Header) http.Header {
+	res := h.Clone()
+	for _, key := range secretHeaders {
+		res.Del(key)
+	}
+	return res
+}
+
+// access logs the arrival of a request; with sampling only the response is logged, as the outcome is not known yet
+func (a *AccessLog) access(r *http.Request) {
+	level := slog.LevelInfo
+	if a != nil && a.Sample < 1 {
+		level = slog.LevelDebug
+	}
+	slog.Log(r.Context(), level, "access", "method", r.Method, "path", r.URL.Path, "params", r.URL.Query(), "headers", loggedHeaders(r.Header), "user", RequestUser(r))
+}
+
+// response logs the response of a request: always errors and slow requests, successful ones if sampled
+func (a *AccessLog) response(r *http.Request, statuscode int, elapsed time.Duration, ops *opStats) {
+	attrs := []any{"status", http.StatusText(statuscode), "method", r.Method, "path", r.URL.Path, "elapsed", elapsed, "user", RequestUser(r)}
+	switch {
+	case a != nil && a.Slow > 0 && elapsed-ops.get("wait") >= a.Slow:
+		slog.Warn("response", append(attrs, "slow", true, ops.group())...)
+	case statuscode >= http.StatusBadRequest:
+		slog.Info("response", attrs...)
+	case a.sampled():
+		if a != nil && a.Sample < 1 {
+			attrs = append(attrs, "sample", a.Sample)
+		}
+		slog.Info("response", attrs...)
+	}
+}
+
+// opStats collects the time a request spends in datastore operations, by operation
+type opStats struct {
+	mu  sync.Mutex
+	ops map[string]time.Duration
+}
+
+type opStatsKey struct{}
+
+// withOpStats returns a context collecting the time of the datastore operations run with it
+func withOpStats(ctx context.Context) (context.Context, *opStats) {
+	res := &opStats{ops: map[string]time.Duration{}}
+	return context.WithValue(ctx, opStatsKey{}, res), res
+}
+
+// trackOp starts timing the operation, recorded when the returned function is called if the context collects them
+//
+// operations run inside others, such as reads from a walk, are counted in both.
+func trackOp(ctx context.Context, op string) func() {
+	res, ok := ctx.Value(opStatsKey{}).(*opStats)
+	if !ok {
+		return func() {}
+	}
+	st := time.Now()
+	return func() {
+		res.mu.Lock()
+		defer res.mu.Unlock()
+		res.ops[op] += time.Since(st)
+	}
+}
+
+// get returns the time collected for the operation
+func (s *opStats) get(op string) time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ops[op]
+}
+
+// group returns the collected times as the "ops" attribute of a log
+func (s *opStats) group() slog.Attr {
+	if s == nil {
+		return slog.Group("ops")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.ops))
+	for k := range s.ops {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	attrs := []any{}
+	for _, k := range names {
+		attrs = append(attrs, k, s.ops[k])
+	}
+	return slog.Group("ops", attrs...)
+}
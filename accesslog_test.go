@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowDS reads slowly, timing the read like Datastore does
+type slowDS struct {
+	*memDS
+	delay time.Duration
+}
+
+func (s *slowDS) Read(ctx context.Context, name string, out io.Writer) error {
+	defer trackOp(ctx, "read")()
+	time.Sleep(s.delay)
+	return s.memDS.Read(ctx, name, out)
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := &bytes.Buffer{}
+	defer func(orig *slog.Logger) { slog.SetDefault(orig) }(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+
+	mem := newMemDS()
+	mem.put("fast", `{"v":1}`)
+	mem.put("slow", `{"v":1}`)
+	h := &APIHandler{ds: mem, accessLog: &AccessLog{Sample: 0, Slow: 50 * time.Millisecond}}
+	get := func(path string) int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Code
+	}
+	responses := func() []string {
+		res := []string{}
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "msg=response") {
+				res = append(res, line)
+			}
+		}
+		logs.Reset()
+		return res
+	}
+
+	if code := get("/fast"); code != http.StatusOK {
+		t.Fatalf("read failed: %d", code)
+	}
+	if strings.Contains(logs.String(), "msg=access") {
+		t.Errorf("access logged before the outcome is known: %s", logs.String())
+	}
+	if lines := responses(); len(lines) != 0 {
+		t.Errorf("sampled out request logged: %v", lines)
+	}
+
+	if code := get("/missing"); code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if lines := responses(); len(lines) != 1 || !strings.Contains(lines[0], "status=\"Not Found\"") {
+		t.Errorf("error not logged: %v", lines)
+	}
+
+	h.ds = &slowDS{memDS: mem, delay: 60 * time.Millisecond}
+	if code := get("/slow"); code != http.StatusOK {
+		t.Fatalf("read failed: %d", code)
+	}
+	lines := responses()
+	if len(lines) != 1 || !strings.Contains(lines[0], "level=WARN") || !strings.Contains(lines[0], "slow=true") || !strings.Contains(lines[0], "ops.read=") {
+		t.Errorf("slow request not logged with its operations: %v", lines)
+	}
+
+	h.accessLog = nil
+	h.ds = mem
+	get("/fast")
+	if lines := responses(); len(lines) != 1 || strings.Contains(lines[0], "slow") {
+		t.Errorf("expected the request logged without sampling: %v", lines)
+	}
+
+	// credentials are not logged
+	req := httptest.NewRequest(http.MethodGet, "/fast", nil)
+	req.SetBasicAuth("alice", "hunter2")
+	req.Header.Set("Proxy-Authorization", "Bearer hunter2")
+	req.Header.Set("Cookie", "session=hunter2")
+	req.Header.Set("User-Agent", "terraform")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if out := logs.String(); !strings.Contains(out, "msg=access") || !strings.Contains(out, "terraform") || strings.Contains(out, "hunter2") || strings.Contains(out, "YWxpY2U6aHVudGVyMg") {
+		t.Errorf("credentials logged: %s", out)
+	}
+	if req.Header.Get("Authorization") == "" {
+		t.Errorf("headers of the request changed")
+	}
+}
+
+func TestTrackOp(t *testing.T) {
+	// no collector: nothing to record
+	trackOp(t.Context(), "read")()
+	ctx, ops := withOpStats(t.Context())
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(ctx, "a", strings.NewReader("{}"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := ds.Read(ctx, "a", io.Discard); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if _, ok := ops.ops["write"]; !ok {
+		t.Errorf("write not recorded: %v", ops.ops)
+	}
+	if _, ok := ops.ops["read"]; !ok {
+		t.Errorf("read not recorded: %v", ops.ops)
+	}
+	if _, ok := ops.ops["walk"]; ok {
+		t.Errorf("unexpected walk: %v", ops.ops)
+	}
+}
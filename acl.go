@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ACL permissions
+const (
+	aclRead  = 'r'
+	aclWrite = 'w'
+	aclLock  = 'l'
+)
+
+// ACLRule grants permissions on files matching the pattern to the users ("*": anyone)
+type ACLRule struct {
+	Users   []string
+	Pattern string
+	Perms   string
+}
+
+// Match checks whether the rule applies to the user and the file
+func (rule ACLRule) Match(user string, name string) bool {
+	if !slices.Contains(rule.Users, "*") && !slices.Contains(rule.Users, user) {
+		return false
+	}
+	return aclMatch(rule.Pattern, name)
+}
+
+// aclMatch matches a file name with a glob; a pattern ending with /* also matches deeper files
+func aclMatch(pattern string, name string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+	name = strings.TrimPrefix(name, "/")
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		segs := strings.Split(name, "/")
+		n := strings.Count(prefix, "/") + 1
+		if len(segs) <= n {
+			return false
+		}
+		ok, _ := path.Match(prefix, strings.Join(segs[:n], "/"))
+		return ok
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// ACL wraps a handler and refuses requests the user has no permission for
+//
+// the rules are read from a file of "users pattern perms" lines, e.g. "alice,bob platform/* rwl";
+// the first matching rule decides and requests matching no rule are refused.
+type ACL struct {
+	handler http.Handler
+	file    string
+	mu      sync.RWMutex
+	rules   []ACLRule
+	// lockMethods tell lock and unlock requests which need the lock permission
+	lockMethods LockMethods
+	// aliases are resolved before checking, so that the rules of the file apply whatever name it is accessed by
+	aliases Aliases
+}
+
+// NewACL creates an ACL from the rule file
+func NewACL(handler http.Handler, file string) (*ACL, error) {
+	res := &ACL{handler: handler, file: file}
+	if err := res.Load(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Load (re)reads the rules
+func (a *ACL) Load() error {
+	content, err := os.ReadFile(a.file)
+	if err != nil {
+		slog.Error("cannot read acl file", "file", a.file, "error", err)
+		return err
+	}
+	rules := []ACLRule{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.Trim(fields[2], "rwl-") != "" {
+			slog.Error("invalid acl line", "file", a.file, "line", line)
+			return ErrInvalidPath
+		}
+		rules = append(rules, ACLRule{Users: strings.Split(fields[0], ","), Pattern: fields[1], Perms: fields[2]})
+	}
+	slog.Info("acl loaded", "file", a.file, "rules", len(rules))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+	return nil
+}
+
+// ReloadOnSignal reloads the rules when SIGHUP is received
+func (a *ACL) ReloadOnSignal() {
+	reloadOnSignal(a.file, a.Load)
+}
+
+// Allowed checks the permission of the user on the file an alias resolves to
+func (a *ACL) Allowed(user string, name string, perm byte) bool {
+	name = a.aliases.Resolve(name)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		if rule.Match(user, name) {
+			return strings.IndexByte(rule.Perms, perm) != -1
+		}
+	}
+	return false
+}
+
+// aclRequest returns the files the request accesses and the permission it needs
+//
+// listings, events and static resources are not restricted; running the maintenance
+// needs write permission on all files.
+func aclRequest(r *http.Request, lockMethods LockMethods) ([]string, byte) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/api/"); ok {
+		// the same name as the handler sees; invalid names are rejected by it
+		rest, err := normalizeName(rest, false)
+		if err != nil {
+			return nil, 0
+		}
+		if rest == "_lock-batch" || rest == "_unlock-batch" {
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			req := batchRequest{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				// rejected by the handler
+				return nil, 0
+			}
+			for i, name := range req.Names {
+				if req.Names[i], err = normalizeName(name, false); err != nil {
+					return nil, 0
+				}
+			}
+			return req.Names, aclLock
+		}
+		if rest == "" || strings.HasPrefix(rest, "_") || strings.HasPrefix(rest, "+") {
+			return nil, 0
+		}
+		switch {
+		case lockMethods.op(r) != "":
+			return []string{rest}, aclLock
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			return []string{rest}, aclRead
+		case r.Method == http.MethodPost && r.URL.Query().Get("diff") == "true":
+			// compares without writing
+			return []string{rest}, aclRead
+		default:
+			return []string{rest}, aclWrite
+		}
+	}
+	if r.URL.Path == "/html/admin" && r.Method == http.MethodPost {
+		// maintenance prunes any file
+		return []string{"*"}, aclWrite
+	}
+	for _, prefix := range []string{"/html/view/", "/html/diff/"} {
+		if rest, ok := strings.CutPrefix(r.URL.Path, prefix); ok {
+			if rest, err := normalizeName(rest, false); err == nil {
+				return []string{rest}, aclRead
+			}
+			return nil, 0
+		}
+	}
+	return nil, 0
+}
+
+// ServeHTTP checks the permission of the authenticated user before passing the request
+func (a *ACL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	names, perm := aclRequest(r, a.lockMethods)
+	user := RequestUser(r)
+	for _, name := range names {
+		if !a.Allowed(user, name, perm) {
+			slog.Warn("access denied", "user", user, "name", name, "perm", string(perm), "remote", r.RemoteAddr, "method", r.Method)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	a.handler.ServeHTTP(w, r)
+}
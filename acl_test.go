@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestACLMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*", "any/thing", true},
+		{"platform/*", "platform/app", true},
+		{"platform/*", "/platform/net/vpc", true},
+		{"platform/*", "platform", false},
+		{"platform/*", "platformx/app", false},
+		{"team-*/*", "team-a/app", true},
+		{"app", "app", true},
+		{"app", "app/sub", false},
+		{"*.tfstate", "prod.tfstate", true},
+	}
+	for _, test := range tests {
+		if got := aclMatch(test.pattern, test.name); got != test.expected {
+			t.Errorf("%s %s: expected %v, got %v", test.pattern, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	aclfile := filepath.Join(t.TempDir(), "acl")
+	content := "# platform team owns platform/\nalice,bob platform/* rwl\ncarol secret/* -\n* * r\n"
+	if err := os.WriteFile(aclfile, []byte(content), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	var gotBody string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+	})
+	acl, err := NewACL(inner, aclfile)
+	if err != nil {
+		t.Fatalf("NewACL failed: %v", err)
+	}
+	batch := `{"names":["platform/a","other"],"lockinfo":{"ID":"x"}}`
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"alice", http.MethodPost, "/api/platform/app", "{}", http.StatusOK},
+		{"bob", "LOCK", "/api/platform/app", "{}", http.StatusOK},
+		{"carol", http.MethodPost, "/api/platform/app", "{}", http.StatusForbidden},
+		{"carol", http.MethodGet, "/api/platform/app", "", http.StatusOK},
+		{"carol", http.MethodHead, "/api/platform/app", "", http.StatusOK},
+		{"carol", http.MethodPost, "/api/platform/app?diff=true", "{}", http.StatusOK},
+		{"carol", http.MethodPost, "/api/secret/key?diff=true", "{}", http.StatusForbidden},
+		{"carol", "LOCK", "/api/platform/app", "{}", http.StatusForbidden},
+		{"carol", http.MethodGet, "/api/secret/key", "", http.StatusForbidden},
+		{"carol", http.MethodGet, "/html/view/secret/key", "", http.StatusForbidden},
+		{"dave", http.MethodGet, "/api/secret/key", "", http.StatusOK},
+		{"dave", http.MethodDelete, "/api/app", "", http.StatusForbidden},
+		{"alice", http.MethodPost, "/api/_lock-batch", batch, http.StatusForbidden},
+		{"alice", http.MethodPost, "/api/_lock-batch", `{"names":["platform/a"],"lockinfo":{"ID":"x"}}`, http.StatusOK},
+		{"alice", http.MethodPost, "/api/_lock-batch/", batch, http.StatusForbidden},
+		{"carol", http.MethodGet, "/api/secret//key/", "", http.StatusForbidden},
+		{"carol", http.MethodGet, "/api/+events", "", http.StatusOK},
+		{"carol", http.MethodGet, "/html/", "", http.StatusOK},
+		{"carol", http.MethodGet, "/html/admin", "", http.StatusOK},
+		{"alice", http.MethodPost, "/html/admin", "csrf=x", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.user+" "+test.method+" "+test.path, func(t *testing.T) {
+			gotBody = ""
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			req = req.WithContext(context.WithValue(req.Context(), userKey{}, test.user))
+			rr := httptest.NewRecorder()
+			acl.ServeHTTP(rr, req)
+			if rr.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, rr.Code)
+			}
+			if rr.Code == http.StatusOK && gotBody != test.body {
+				t.Errorf("body not passed: %q", gotBody)
+			}
+		})
+	}
+
+	// an alias does not bypass the rules of its target
+	acl.aliases = Aliases{"old": "secret/key", "legacy": "secret"}
+	for _, path := range []string{"/api/old", "/api/legacy/key", "/html/view/old", "/html/diff/legacy/key"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, "carol"))
+		rr := httptest.NewRecorder()
+		acl.ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: alias bypassed the acl: %d", path, rr.Code)
+		}
+	}
+	if !acl.Allowed("dave", "old", aclRead) || acl.Allowed("carol", "legacy/key", aclRead) {
+		t.Errorf("alias not checked as its target")
+	}
+	acl.aliases = nil
+
+	if err := os.WriteFile(aclfile, []byte("alice * x\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := acl.Load(); err == nil {
+		t.Errorf("expected error for invalid permission")
+	}
+	if !acl.Allowed("alice", "platform/app", aclWrite) {
+		t.Errorf("old rules should be kept after a failed reload")
+	}
+}
+
+func TestACL_History(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{"team-a/app", "team-b/secret"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader(`{"password": "hunter2"}`), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := ds.Lock(name, `{"ID":"x"}`); err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+	}
+	acl := &ACL{rules: []ACLRule{{Users: []string{"*"}, Pattern: "team-a/*", Perms: "rwl"}}}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api/", &APIHandler{ds: &ds, basepath: "/api/", acl: acl}))
+	mux.Handle("/html/", http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/", acl: acl}))
+	acl.handler = mux
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, "alice"))
+		rr := httptest.NewRecorder()
+		acl.ServeHTTP(rr, req)
+		return rr
+	}
+	// a version which is a path does not reach another file
+	for _, path := range []string{
+		"/api/team-a/app?history=../../team-b/secret/current",
+		"/api/team-a/app?history=..%2F..%2Fteam-b%2Fsecret%2Fcurrent",
+		"/api/team-a/app?history=lock",
+		"/html/view/team-a/app?history=../../team-b/secret/current",
+		"/html/diff/team-a/app?history=../../team-b/secret/current",
+	} {
+		if rr := get(path); rr.Code != http.StatusBadRequest || strings.Contains(rr.Body.String(), "hunter2") {
+			t.Errorf("%s: %d %s", path, rr.Code, rr.Body.String())
+		}
+	}
+	// the listing of locks at the root shows only the readable ones
+	rr := get("/api/?locks=true")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("locks: %d", rr.Code)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, "team-a/app") || strings.Contains(body, "team-b") {
+		t.Errorf("unexpected locks: %s", body)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Aliases maps names to the names of the files they resolve to
+//
+// an alias also applies to the files under it: with old=new, old/app resolves to new/app.
+type Aliases map[string]string
+
+// parseAlias parses old=new into normalized names
+func parseAlias(s string) (string, string, error) {
+	from, to, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", fmt.Errorf("%s: expected old=new", s)
+	}
+	from, err1 := normalizeName(strings.TrimSpace(from), false)
+	to, err2 := normalizeName(strings.TrimSpace(to), false)
+	if err1 != nil || err2 != nil || from == "" || to == "" {
+		return "", "", fmt.Errorf("%s: %w", s, ErrInvalidPath)
+	}
+	if from == to {
+		return "", "", fmt.Errorf("%s: alias of itself", s)
+	}
+	return from, to, nil
+}
+
+// NewAliases parses the aliases given as old=new, and those of the file (one per line, # for comments) if not empty
+func NewAliases(args []string, file string) (Aliases, error) {
+	lines := append([]string{}, args...)
+	if file != "" {
+		fp, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		sc := bufio.NewScanner(fp)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	res := Aliases{}
+	for _, line := range lines {
+		from, to, err := parseAlias(line)
+		if err != nil {
+			return nil, err
+		}
+		if prev, ok := res[from]; ok && prev != to {
+			return nil, fmt.Errorf("%s: defined as %s and %s", from, prev, to)
+		}
+		res[from] = to
+	}
+	// one level only, so that aliases cannot loop
+	for from, to := range res {
+		if _, ok := res.match(to); ok {
+			return nil, fmt.Errorf("%s=%s: target is an alias", from, to)
+		}
+	}
+	return res, nil
+}
+
+// match returns the longest alias which is the name or a parent directory of it
+func (a Aliases) match(name string) (string, bool) {
+	for from := name; from != "." && from != ""; {
+		if _, ok := a[from]; ok {
+			return from, true
+		}
+		i := strings.LastIndex(from, "/")
+		if i < 0 {
+			break
+		}
+		from = from[:i]
+	}
+	return "", false
+}
+
+// Resolve returns the name of the file a name refers to, the name itself if it is not under an alias
+func (a Aliases) Resolve(name string) string {
+	trimmed := strings.TrimPrefix(name, "/")
+	from, ok := a.match(trimmed)
+	if !ok {
+		return name
+	}
+	res := a[from] + strings.TrimPrefix(trimmed, from)
+	slog.Debug("alias", "name", name, "resolved", res)
+	if strings.HasPrefix(name, "/") {
+		return "/" + res
+	}
+	return res
+}
+
+// Names returns the aliases sorted
+func (a Aliases) Names() []string {
+	return slices.Sorted(maps.Keys(a))
+}
+
+// AliasEntry is an alias shown in listings
+type AliasEntry struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+// Entries returns the aliases under the prefix, sorted by name
+func (a Aliases) Entries(prefix string) []AliasEntry {
+	res := []AliasEntry{}
+	for _, from := range a.Names() {
+		if strings.HasPrefix("/"+from, "/"+strings.TrimPrefix(prefix, "/")) {
+			res = append(res, AliasEntry{Name: "/" + from, Target: "/" + a[from]})
+		}
+	}
+	return res
+}
+
+// shadowed warns of aliases which hide files stored under their own name
+func (a Aliases) shadowed(d *Datastore) {
+	for _, from := range a.Names() {
+		if d.CurrentVersion(from) != "" {
+			slog.Warn("alias hides a stored file", "name", from, "target", a[from])
+		}
+	}
+}
+
+// openAliases returns the aliases configured by the global options
+func openAliases() (Aliases, error) {
+	return NewAliases(option.Alias, option.AliasFile)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewAliases(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(file, []byte("# moved to the new layout\nenv/prod = prod\n\n"), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	a, err := NewAliases([]string{"/old/state/=new/state"}, file)
+	if err != nil {
+		t.Fatalf("NewAliases failed: %v", err)
+	}
+	if !reflect.DeepEqual(a, Aliases{"old/state": "new/state", "env/prod": "prod"}) {
+		t.Errorf("unexpected aliases: %v", a)
+	}
+
+	for _, args := range [][]string{
+		{"old"},
+		{"old="},
+		{"../x=y"},
+		{"same=same"},
+		{"a=b", "a=c"},
+		{"a=b", "b=c"},
+		{"a=b/c", "b=d"},
+	} {
+		if _, err := NewAliases(args, ""); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+	if _, err := NewAliases(nil, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestAliases_Resolve(t *testing.T) {
+	a := Aliases{"old": "new", "env/prod": "prod/main"}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"old", "new"},
+		{"/old", "/new"},
+		{"old/app", "new/app"},
+		{"older", "older"},
+		{"env/prod/net", "prod/main/net"},
+		{"env/dev", "env/dev"},
+		{"other", "other"},
+	}
+	for _, test := range tests {
+		if got := a.Resolve(test.name); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, got)
+		}
+	}
+	if got := Aliases(nil).Resolve("old"); got != "old" {
+		t.Errorf("nil aliases resolved to %s", got)
+	}
+	entries := a.Entries("/env")
+	if !reflect.DeepEqual(entries, []AliasEntry{{Name: "/env/prod", Target: "/prod/main"}}) {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+}
+
+func TestAPI_Alias(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	h := &APIHandler{ds: &ds, aliases: Aliases{"old": "new"}}
+	for _, name := range []string{"old", "old/app"} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/"+name, strings.NewReader(`{"name":"`+name+`"}`)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("POST %s: status %d", name, rr.Code)
+		}
+	}
+	for name, expected := range map[string]string{"new": `{"name":"old"}`, "new/app": `{"name":"old/app"}`} {
+		if got, err := readString(t, ds, name); err != nil || got != expected {
+			t.Errorf("%s: expected %s, got %q %v", name, expected, got, err)
+		}
+	}
+	if hist := ds.History(t.Context(), "old"); len(hist) != 0 {
+		t.Errorf("alias stored as a file: %+v", hist)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/old/app", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"name":"old/app"}` {
+		t.Errorf("GET through the alias: %d %q", rr.Code, rr.Body.String())
+	}
+
+	html := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/", aliases: h.aliases})
+	rr = httptest.NewRecorder()
+	html.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/", nil))
+	if !strings.Contains(rr.Body.String(), "/old &rarr; <a href=\"view/new\">/new</a>") {
+		t.Errorf("alias not listed: %s", rr.Body.String())
+	}
+}
+
+func TestLsTree_ExecuteAlias(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir, origAlias := option.Datadir, option.Alias
+	option.Datadir = tmp
+	option.Alias = []string{"old=new"}
+	defer func() { option.Datadir, option.Alias = origDatadir, origAlias }()
+
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "new", strings.NewReader("{}"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	out, err := captureStdout(func() error { return (&LsTree{}).Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("LsTree.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "/old -> /new (alias)") {
+		t.Errorf("alias not listed: %q", out)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type userKey struct{}
+
+// RequestUser returns the authenticated username of the request
+func RequestUser(r *http.Request) string {
+	if user, ok := r.Context().Value(userKey{}).(string); ok {
+		return user
+	}
+	return ""
+}
+
+// BasicAuth wraps a handler with basic authentication against a user list
+type BasicAuth struct {
+	handler http.Handler
+	single  string
+	file    string
+	mu      sync.RWMutex
+	users   map[string]string
+}
+
+// NewBasicAuth creates a BasicAuth from "username:password" and/or an htpasswd file
+func NewBasicAuth(handler http.Handler, single string, file string) (*BasicAuth, error) {
+	res := &BasicAuth{
+		handler: handler,
+		single:  single,
+		file:    file,
+	}
+	if err := res.Load(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Load (re)reads the credentials
+func (a *BasicAuth) Load() error {
+	users := make(map[string]string)
+	if a.file != "" {
+		content, err := os.ReadFile(a.file)
+		if err != nil {
+			slog.Error("cannot read auth file", "file", a.file, "error", err)
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok {
+				slog.Warn("invalid auth file line", "file", a.file, "user", user)
+				continue
+			}
+			if hashScheme(hash) == "" {
+				// crypt, md5-crypt, sha-crypt or plain: never compared as a plain password
+				slog.Warn("unsupported password hash, user ignored", "file", a.file, "user", user)
+				continue
+			}
+			users[user] = hash
+		}
+	}
+	if a.single != "" {
+		user, pass, ok := strings.Cut(a.single, ":")
+		if !ok {
+			slog.Error("invalid user option, expected username:password")
+			return ErrInvalidPath
+		}
+		users[user] = pass
+	}
+	slog.Info("credentials loaded", "file", a.file, "users", len(users))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+	return nil
+}
+
+// ReloadOnSignal reloads the credentials when SIGHUP is received
+func (a *BasicAuth) ReloadOnSignal() {
+	reloadOnSignal(a.file, a.Load)
+}
+
+// reloadOnSignal calls load when SIGHUP is received
+func reloadOnSignal(file string, load func() error) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			slog.Info("reloading", "file", file)
+			if err := load(); err != nil {
+				slog.Error("reload failed, keeping old settings", "file", file, "error", err)
+			}
+		}
+	}()
+}
+
+// Check verifies the username and password
+func (a *BasicAuth) Check(user string, password string) bool {
+	a.mu.RLock()
+	hash, ok := a.users[user]
+	a.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return checkPassword(hash, password)
+}
+
+// ServeHTTP authenticates the request and passes the username to the wrapped handler
+func (a *BasicAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || !a.Check(user, pass) {
+		slog.Warn("authentication failed", "user", user, "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		w.Header().Set("Www-Authenticate", `Basic realm="statesaver"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	a.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+}
+
+// hashScheme returns the supported htpasswd hash scheme of the hash (bcrypt, apr1 or sha1), empty for others
+func hashScheme(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return "bcrypt"
+	case strings.HasPrefix(hash, "$apr1$"):
+		return "apr1"
+	case strings.HasPrefix(hash, "{SHA}"):
+		return "sha1"
+	}
+	return ""
+}
+
+// checkPassword compares the password with a htpasswd-style hash (bcrypt, apr1 or sha1), or the plain password
+// of the user option
+//
+// other crypt hashes ($1$, $5$, $6$, ...) never match, so that the hash does not work as the password.
+func checkPassword(hash string, password string) bool {
+	switch hashScheme(hash) {
+	case "bcrypt":
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case "apr1":
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case "sha1":
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+	}
+	if rest, ok := strings.CutPrefix(hash, "$"); ok && strings.Contains(rest, "$") {
+		slog.Warn("unsupported password hash")
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+}
+
+// apr1 computes the Apache MD5 crypt hash of the password
+func apr1(password string, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return out.String()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestApr1(t *testing.T) {
+	// openssl passwd -apr1 -salt 8sFt66rZ secret
+	expected := "$apr1$8sFt66rZ$eup.HOtZcQ/VrnApBM3rR/"
+	if got := apr1("secret", "8sFt66rZ"); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	bhash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt failed: %v", err)
+	}
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		expected bool
+	}{
+		{"bcrypt", string(bhash), "secret", true},
+		{"bcrypt wrong", string(bhash), "wrong", false},
+		{"apr1", "$apr1$8sFt66rZ$eup.HOtZcQ/VrnApBM3rR/", "secret", true},
+		{"apr1 wrong", "$apr1$8sFt66rZ$eup.HOtZcQ/VrnApBM3rR/", "wrong", false},
+		{"sha1", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"plain", "secret", "secret", true},
+		{"plain wrong", "secret", "secret2", false},
+		// unsupported schemes never match, not even the hash itself
+		{"md5-crypt", "$1$saltsalt$qjXMvbEw8oaL.CzflDugX/", "$1$saltsalt$qjXMvbEw8oaL.CzflDugX/", false},
+		{"sha512-crypt", "$6$salt$IxDD3jeSOb5eB1CX5LBsqZFVkJdido3OUILO5Ifz5iwMuTS4XMS130MTSuDDl3aCI6WouIL9AjRbLCelDCy.g.", "$6$salt$IxDD3jeSOb5eB1CX5LBsqZFVkJdido3OUILO5Ifz5iwMuTS4XMS130MTSuDDl3aCI6WouIL9AjRbLCelDCy.g.", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkPassword(test.hash, test.password); got != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	bhash, _ := bcrypt.GenerateFromPassword([]byte("alicepw"), bcrypt.MinCost)
+	authfile := filepath.Join(t.TempDir(), "htpasswd")
+	// carol (sha-crypt) and dave (crypt) have hashes which are not supported
+	content := "# comment\nalice:" + string(bhash) + "\nbob:$apr1$8sFt66rZ$eup.HOtZcQ/VrnApBM3rR/\n" +
+		"carol:$5$salt$Gcm6FsVtF/Qa77ZKD.iwsJlCVPY0XSMgLJL0Hnww/c1\ndave:rqXexS6ZhobKA\n"
+	if err := os.WriteFile(authfile, []byte(content), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	var gotUser string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser = RequestUser(r)
+	})
+	auth, err := NewBasicAuth(inner, "admin:adminpw", authfile)
+	if err != nil {
+		t.Fatalf("NewBasicAuth failed: %v", err)
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		status   int
+	}{
+		{"alice", "alicepw", http.StatusOK},
+		{"bob", "secret", http.StatusOK},
+		{"admin", "adminpw", http.StatusOK},
+		{"alice", "secret", http.StatusUnauthorized},
+		{"carol", "secret", http.StatusUnauthorized},
+		{"carol", "$5$salt$Gcm6FsVtF/Qa77ZKD.iwsJlCVPY0XSMgLJL0Hnww/c1", http.StatusUnauthorized},
+		{"dave", "rqXexS6ZhobKA", http.StatusUnauthorized},
+		{"eve", "secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+			gotUser = ""
+			req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.password)
+			}
+			rr := httptest.NewRecorder()
+			auth.ServeHTTP(rr, req)
+			if rr.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, rr.Code)
+			}
+			if test.status == http.StatusOK && gotUser != test.user {
+				t.Errorf("expected user %q, got %q", test.user, gotUser)
+			}
+			if test.status == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("missing WWW-Authenticate header")
+			}
+		})
+	}
+
+	// reload with bob removed
+	if err := os.WriteFile(authfile, []byte("alice:"+string(bhash)+"\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := auth.Load(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if auth.Check("bob", "secret") {
+		t.Errorf("bob should be removed after reload")
+	}
+	if !auth.Check("alice", "alicepw") {
+		t.Errorf("alice should remain after reload")
+	}
+}
+
+func TestBasicAuth_MissingFile(t *testing.T) {
+	if _, err := NewBasicAuth(nil, "", filepath.Join(t.TempDir(), "nonexistent")); err == nil {
+		t.Errorf("expected error for missing auth file")
+	}
+}
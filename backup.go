@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// backupLink points to the version which current pointed to before the last change
+const backupLink = "backup"
+
+// backupTarget returns the version which the backup link points to, or empty if none
+func (d *Datastore) backupTarget(name string) string {
+	linkto, err := d.blobs().GetBackup(name)
+	if err != nil {
+		return ""
+	}
+	return linkto
+}
+
+// updateBackup points the backup link to the previous version if backups are enabled
+//
+// the change itself is already done, so a failure is only logged.
+func (d *Datastore) updateBackup(name string, previous string) {
+	if !d.Backup || previous == "" {
+		return
+	}
+	if err := d.blobs().SetBackup(name, previous); err != nil {
+		slog.Error("backup", "name", name, "previous", previous, "error", err)
+	}
+}
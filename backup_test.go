@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readBackup(t *testing.T, ds *Datastore, name string) string {
+	t.Helper()
+	rd, err := ds.ReadHistory(name, backupLink)
+	if err != nil {
+		t.Fatalf("read backup failed: %v", err)
+	}
+	defer rd.Close()
+	b, _ := io.ReadAll(rd)
+	return string(b)
+}
+
+func TestBackup(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ds.Backup = true
+	for _, body := range []string{"1", "2", "3"} {
+		if err := ds.Write(t.Context(), "state", strings.NewReader(body), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := readBackup(t, &ds, "state"); got != "2" {
+		t.Errorf("expected previous version as backup, got %q", got)
+	}
+	if err := ds.Prune(t.Context(), "state", 1, false); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	if hist := ds.History(t.Context(), "state"); len(hist) != 2 {
+		t.Errorf("expected current and backup to remain: %v", hist)
+	}
+	if got := readBackup(t, &ds, "state"); got != "2" {
+		t.Errorf("backup was pruned: %q", got)
+	}
+	backup := ds.backupTarget("state")
+	current := ds.currentTarget("state")
+	if err := ds.Rollback("state", backup); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if got := ds.backupTarget("state"); got != current {
+		t.Errorf("expected backup %s after rollback, got %s", current, got)
+	}
+	if err := ds.Delete("state"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if got := ds.backupTarget("state"); got != backup {
+		t.Errorf("expected backup %s after delete, got %s", backup, got)
+	}
+}
+
+func TestBackup_Disabled(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, body := range []string{"1", "2"} {
+		if err := ds.Write(t.Context(), "state", strings.NewReader(body), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if _, err := ds.ReadHistory("state", backupLink); err != ErrNotFound {
+		t.Errorf("expected no backup, got %v", err)
+	}
+}
+
+func TestAPIGet_Backup(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ds.Backup = true
+	for _, body := range []string{`{"v":1}`, `{"v":2}`} {
+		if err := ds.Write(t.Context(), "state", strings.NewReader(body), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h := &APIHandler{ds: &ds}
+	for _, encoding := range []string{"", "gzip"} {
+		req := httptest.NewRequest(http.MethodGet, "/state?backup=1", nil)
+		req.URL.Path = "state"
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != `{"v":1}` {
+			t.Errorf("%q: unexpected backup response %d %q", encoding, rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get("Cache-Control") != "no-cache" {
+			t.Errorf("%q: backup must not be cached: %v", encoding, rr.Header())
+		}
+	}
+}
+
+func TestAPIGet_At(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	base := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	writeAt(t, &ds, "state", base, base.Add(24*time.Hour))
+	h := &APIHandler{ds: &ds}
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"at=2024-06-01T12:30:00Z", http.StatusOK, `{"v":1}`},
+		{"at=2024-06-02T21:00:00%2B09:00", http.StatusOK, `{"v":2}`},
+		{"at=2024-06-03", http.StatusOK, `{"v":2}`},
+		{"at=2024-06-01", http.StatusNotFound, ""},
+		{"at=yesterday", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/state?"+test.query, nil)
+		req.URL.Path = "state"
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != test.status || (test.body != "" && rr.Body.String() != test.body) {
+			t.Errorf("%s: unexpected response %d %q", test.query, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// BlobStore persists the versions, the current pointer and the lock of files, and lists the files
+//
+// Datastore keeps the rules (journal, protection, holds, compression, retention) and stores
+// through it; the sidecars of those rules stay in RootDir. Names are file names as given to Datastore,
+// versions are the names of versions.
+type BlobStore interface {
+	// PutVersion stores a new version as given
+	PutVersion(name string, version string, input io.Reader) error
+	// GetVersion opens a version as stored, or fails with ErrNotFound
+	GetVersion(name string, version string) (io.ReadCloser, error)
+	// StatVersion returns the entry of a version, or fails with ErrNotFound
+	StatVersion(name string, version string) (FileEntry, error)
+	// ListVersions lists the versions of a file in no particular order
+	ListVersions(name string) ([]FileEntry, error)
+	// RemoveVersion removes a version
+	RemoveVersion(name string, version string) error
+	// SetCurrent points current to a version
+	SetCurrent(name string, version string) error
+	// GetCurrent returns the version current points to, or fails with ErrNotFound
+	GetCurrent(name string) (string, error)
+	// RemoveCurrent removes current, which deletes the file but keeps its versions, or fails with ErrNotFound
+	RemoveCurrent(name string) error
+	// SetBackup points the backup link to a version
+	SetBackup(name string, version string) error
+	// GetBackup returns the version the backup link points to, or fails with ErrNotFound
+	GetBackup(name string) (string, error)
+	// CreateLock stores the lock info, or fails with ErrLocked if the file is already locked
+	CreateLock(name string, info []byte) error
+	// ReadLock returns the lock info and when it was taken, or fails with ErrUnlocked
+	ReadLock(name string) ([]byte, time.Time, error)
+	// RemoveLock removes the lock
+	RemoveLock(name string) error
+	// ListLocks lists the locked files under the prefix, named with a leading slash, also those without current
+	ListLocks(ctx context.Context, prefix string) ([]string, error)
+	// Walk calls fn with the entry of each file under the prefix which has current, named with a leading slash,
+	// the size and time of its current version and whether it is locked; a file comes before the files under it.
+	// fn returns filepath.SkipDir to skip those, or another error to stop the walk with it. onError is called
+	// with the files which cannot be read, and the walk continues unless it returns an error.
+	Walk(ctx context.Context, prefix string, fn func(e FileEntry) error, onError func(name string, err error) error) error
+}
+
+// blobs returns the BlobStore of the datastore, the data directory unless another one is set
+func (d *Datastore) blobs() BlobStore {
+	if d.Blobs != nil {
+		return d.Blobs
+	}
+	return &fsBlobStore{d: d}
+}
+
+// fsBlobStore stores versions as files in the directory of the file, current as a symlink and the lock as a file
+type fsBlobStore struct {
+	d *Datastore
+}
+
+func (s *fsBlobStore) PutVersion(name string, version string, input io.Reader) error {
+	path, err := s.d.File(name, version)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	return s.d.writeFile(path, input)
+}
+
+func (s *fsBlobStore) GetVersion(name string, version string) (io.ReadCloser, error) {
+	path, err := s.d.File(name, version)
+	if err != nil {
+		return nil, ErrInvalidPath
+	}
+	fp, err := s.d.RootDir.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+func (s *fsBlobStore) StatVersion(name string, version string) (FileEntry, error) {
+	path, err := s.d.File(name, version)
+	if err != nil {
+		return FileEntry{}, ErrInvalidPath
+	}
+	fi, err := s.d.RootDir.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileEntry{}, ErrNotFound
+	} else if err != nil {
+		return FileEntry{}, err
+	}
+	return FileEntry{Name: fi.Name(), Timestamp: fi.ModTime().UTC(), Size: fi.Size()}, nil
+}
+
+func (s *fsBlobStore) ListVersions(name string) ([]FileEntry, error) {
+	dirn, err := s.d.File(name)
+	if err != nil {
+		return nil, ErrInvalidPath
+	}
+	files, err := afero.ReadDir(s.d.RootDir, dirn)
+	if err != nil {
+		return nil, err
+	}
+	res := []FileEntry{}
+	for _, ent := range files {
+		// dotfiles are sidecars of the versions
+		if ent.IsDir() || reservedNames[ent.Name()] || strings.HasPrefix(ent.Name(), ".") || !ent.Mode().IsRegular() {
+			continue
+		}
+		fi, err := s.d.RootDir.Stat(filepath.Join(dirn, ent.Name()))
+		if err != nil {
+			slog.Error("info", "path", dirn, "name", ent.Name(), "error", err)
+			continue
+		}
+		res = append(res, FileEntry{Name: fi.Name(), Timestamp: fi.ModTime().UTC(), Size: fi.Size()})
+	}
+	return res, nil
+}
+
+func (s *fsBlobStore) RemoveVersion(name string, version string) error {
+	path, err := s.d.File(name, version)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	return s.d.RootDir.Remove(path)
+}
+
+func (s *fsBlobStore) SetCurrent(name string, version string) error {
+	linkto, err := s.d.File(name, "current")
+	if err != nil {
+		slog.Error("invalid filename?", "name", name, "error", err)
+		return ErrInvalidPath
+	}
+	slog.Debug("check exists", "linkto", linkto)
+	if _, _, err := s.d.RootDir.LstatIfPossible(linkto); err == nil {
+		slog.Debug("removing old", "linkto", linkto)
+		if err := s.d.RootDir.Remove(linkto); err != nil {
+			slog.Error("remove current", "name", linkto, "erroo", err)
+			return err
+		}
+	}
+	if err := s.d.step("set_current", "unlink"); err != nil {
+		return err
+	}
+	slog.Debug("creating symlink", "newname", version, "linkto", linkto)
+	realto, err := s.d.RootDir.RealPath(linkto)
+	if err != nil {
+		slog.Error("realto", "error", err, "linkto", linkto)
+		return err
+	}
+	if err = os.Symlink(version, realto); err != nil {
+		slog.Error("symlink", "error", err, "newname", version, "realto", realto)
+		return err
+	}
+	return nil
+}
+
+func (s *fsBlobStore) GetCurrent(name string) (string, error) {
+	cur, err := s.d.File(name, "current")
+	if err != nil {
+		return "", ErrInvalidPath
+	}
+	linkto, err := s.d.RootDir.ReadlinkIfPossible(cur)
+	if err != nil {
+		slog.Debug("readlink", "error", err, "name", name)
+		return "", ErrNotFound
+	}
+	return linkto, nil
+}
+
+func (s *fsBlobStore) RemoveCurrent(name string) error {
+	cur, err := s.d.File(name, "current")
+	if err != nil {
+		return ErrInvalidPath
+	}
+	if err := s.d.RootDir.Remove(cur); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *fsBlobStore) SetBackup(name string, version string) error {
+	path, err := s.d.File(name, backupLink)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	realpath, err := s.d.RootDir.RealPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(realpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(version, realpath)
+}
+
+func (s *fsBlobStore) GetBackup(name string) (string, error) {
+	path, err := s.d.File(name, backupLink)
+	if err != nil {
+		return "", ErrInvalidPath
+	}
+	linkto, err := s.d.RootDir.ReadlinkIfPossible(path)
+	if err != nil {
+		return "", ErrNotFound
+	}
+	return linkto, nil
+}
+
+func (s *fsBlobStore) CreateLock(name string, info []byte) error {
+	path, err := s.d.File(name, "lock")
+	if err != nil {
+		return ErrInvalidPath
+	}
+	if err := s.d.RootDir.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		slog.Error("mkdir failed", "path", path, "error", err)
+		return err
+	}
+	// O_EXCL: another client may have taken the lock since it was checked
+	fp, err := s.d.RootDir.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if os.IsExist(err) {
+		return ErrLocked
+	} else if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = fp.Write(info)
+	return err
+}
+
+func (s *fsBlobStore) ReadLock(name string) ([]byte, time.Time, error) {
+	path, err := s.d.File(name, "lock")
+	if err != nil {
+		return nil, time.Time{}, ErrInvalidPath
+	}
+	fi, err := s.d.RootDir.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, ErrUnlocked
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	content, err := afero.ReadFile(s.d.RootDir, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, ErrUnlocked
+	}
+	return content, fi.ModTime().UTC(), err
+}
+
+func (s *fsBlobStore) RemoveLock(name string) error {
+	path, err := s.d.File(name, "lock")
+	if err != nil {
+		return ErrInvalidPath
+	}
+	return s.d.RootDir.Remove(path)
+}
+
+func (s *fsBlobStore) Walk(ctx context.Context, prefix string, fn func(e FileEntry) error, onError func(name string, err error) error) error {
+	d := s.d
+	basedir := d.walkBase(prefix)
+	slog.Debug("walk", "root", d.RootName, "prefix", prefix, "base", basedir)
+	return afero.Walk(d.RootDir, basedir, func(path string, info fs.FileInfo, err error) error {
+		slog.Debug("walk-cb", "path", path, "info", info, "error", err)
+		if ctx.Err() != nil {
+			slog.Warn("client gone", "prefix", prefix, "path", path, "error", ctx.Err())
+			return ctx.Err()
+		}
+		if d.skipDir(path, info) {
+			return filepath.SkipDir
+		}
+		cur := filepath.Join(path, "current")
+		lpath, ok := d.layoutPath(cur)
+		if err != nil {
+			lpath, ok = d.layoutPath(path)
+		}
+		if !ok || !strings.HasPrefix(lpath, prefix) {
+			slog.Debug("skip", "path", path, "prefix", prefix)
+			return nil
+		}
+		if err != nil {
+			slog.Error("walkdir", "error", err, "path", path)
+			return onError(lpath, err)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if ci, _, err := d.RootDir.LstatIfPossible(cur); err != nil || ci.Mode().Type()&os.ModeSymlink != os.ModeSymlink {
+			return nil
+		}
+		slog.Debug("current", "path", cur)
+		fi, err := d.RootDir.Stat(cur)
+		if err != nil {
+			slog.Warn("current not found", "path", cur)
+			return onError(filepath.Dir(lpath), err)
+		}
+		lockfn := filepath.Join(path, "lock")
+		locked := false
+		slog.Debug("check lock", "path", cur, "lockfile", lockfn)
+		_, err = d.RootDir.Stat(lockfn)
+		if err == nil {
+			slog.Warn("lock exists", "path", cur, "lockfile", lockfn)
+			locked = true
+		}
+		// SkipDir skips the files under this one
+		return fn(FileEntry{
+			Name:      filepath.Dir(lpath),
+			Locked:    locked,
+			Timestamp: fi.ModTime().UTC(),
+			Size:      fi.Size(),
+		})
+	})
+}
+
+func (s *fsBlobStore) ListLocks(ctx context.Context, prefix string) ([]string, error) {
+	d := s.d
+	res := []string{}
+	err := afero.Walk(d.RootDir, d.walkBase(prefix), func(path string, info fs.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			slog.Error("walkdir", "error", err, "path", path)
+			return nil
+		}
+		if d.skipDir(path, info) {
+			return filepath.SkipDir
+		}
+		lpath, ok := d.layoutPath(path)
+		if ok && strings.HasPrefix(lpath, prefix) && !info.IsDir() && info.Name() == "lock" {
+			res = append(res, filepath.Dir(lpath))
+		}
+		return nil
+	})
+	return res, err
+}
+
+// memBlob is a file of MemBlobStore
+type memBlob struct {
+	versions map[string]FileEntry
+	data     map[string][]byte
+	current  string
+	backup   string
+	lock     []byte
+	locked   time.Time
+}
+
+// MemBlobStore keeps files in memory, for tests and as a reference implementation of BlobStore
+type MemBlobStore struct {
+	mu    sync.Mutex
+	files map[string]*memBlob
+}
+
+// NewMemBlobStore creates an empty MemBlobStore
+func NewMemBlobStore() *MemBlobStore {
+	return &MemBlobStore{files: map[string]*memBlob{}}
+}
+
+// NewMemDatastore creates a Datastore which keeps everything in memory
+//
+// versions, current and locks are kept in a MemBlobStore and the sidecars and journals in a memory filesystem.
+func NewMemDatastore() Datastore {
+	bpfs := afero.NewBasePathFs(afero.NewMemMapFs(), "/")
+	return Datastore{
+		RootDir:  bpfs.(*afero.BasePathFs),
+		RootName: "/",
+		Skip:     DefaultSkip,
+		Blobs:    NewMemBlobStore(),
+		refs:     newVersionRefs(),
+	}
+}
+
+// file returns the file of the name, creating it if create is set
+func (s *MemBlobStore) file(name string, create bool) *memBlob {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	f, ok := s.files[name]
+	if !ok && create {
+		f = &memBlob{versions: map[string]FileEntry{}, data: map[string][]byte{}}
+		s.files[name] = f
+	}
+	return f
+}
+
+func (s *MemBlobStore) PutVersion(name string, version string, input io.Reader) error {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, true)
+	f.versions[version] = FileEntry{Name: version, Timestamp: time.Now(), Size: int64(len(data))}
+	f.data[version] = data
+	return nil
+}
+
+func (s *MemBlobStore) GetVersion(name string, version string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, false)
+	if f == nil || f.data[version] == nil {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(f.data[version])), nil
+}
+
+func (s *MemBlobStore) StatVersion(name string, version string) (FileEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, false)
+	if f == nil {
+		return FileEntry{}, ErrNotFound
+	}
+	e, ok := f.versions[version]
+	if !ok {
+		return FileEntry{}, ErrNotFound
+	}
+	return e, nil
+}
+
+func (s *MemBlobStore) ListVersions(name string) ([]FileEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []FileEntry{}
+	if f := s.file(name, false); f != nil {
+		for _, e := range f.versions {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+func (s *MemBlobStore) RemoveVersion(name string, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, false)
+	if f == nil || f.data[version] == nil {
+		return ErrNotFound
+	}
+	delete(f.versions, version)
+	delete(f.data, version)
+	return nil
+}
+
+func (s *MemBlobStore) SetCurrent(name string, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// like a symlink, current may point to a missing version
+	s.file(name, true).current = version
+	return nil
+}
+
+func (s *MemBlobStore) GetCurrent(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, false)
+	if f == nil || f.current == "" {
+		return "", ErrNotFound
+	}
+	return f.current, nil
+}
+
+func (s *MemBlobStore) RemoveCurrent(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, false)
+	if f == nil || f.current == "" {
+		return ErrNotFound
+	}
+	f.current = ""
+	return nil
+}
+
+func (s *MemBlobStore) SetBackup(name string, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file(name, true).backup = version
+	return nil
+}
+
+func (s *MemBlobStore) GetBackup(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, false)
+	if f == nil || f.backup == "" {
+		return "", ErrNotFound
+	}
+	return f.backup, nil
+}
+
+func (s *MemBlobStore) CreateLock(name string, info []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, true)
+	if f.lock != nil {
+		return ErrLocked
+	}
+	f.lock = append([]byte{}, info...)
+	f.locked = time.Now()
+	return nil
+}
+
+func (s *MemBlobStore) ReadLock(name string) ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, false)
+	if f == nil || f.lock == nil {
+		return nil, time.Time{}, ErrUnlocked
+	}
+	return append([]byte{}, f.lock...), f.locked, nil
+}
+
+func (s *MemBlobStore) RemoveLock(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.file(name, false)
+	if f == nil || f.lock == nil {
+		return ErrUnlocked
+	}
+	f.lock = nil
+	return nil
+}
+
+func (s *MemBlobStore) ListLocks(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []string{}
+	for name, f := range s.files {
+		if f.lock != nil && strings.HasPrefix("/"+name+"/lock", prefix) {
+			res = append(res, "/"+name)
+		}
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+func (s *MemBlobStore) Walk(ctx context.Context, prefix string, fn func(e FileEntry) error, onError func(name string, err error) error) error {
+	type walkEntry struct {
+		FileEntry
+		// dangling is current pointing to a missing version
+		dangling bool
+	}
+	s.mu.Lock()
+	entries := []walkEntry{}
+	for name, f := range s.files {
+		if f.current == "" || !strings.HasPrefix("/"+name+"/current", prefix) {
+			continue
+		}
+		v, ok := f.versions[f.current]
+		entries = append(entries, walkEntry{
+			FileEntry: FileEntry{Name: "/" + name, Locked: f.lock != nil, Timestamp: v.Timestamp.UTC(), Size: v.Size},
+			dangling:  !ok,
+		})
+	}
+	s.mu.Unlock()
+	// by path segments, so that the files under a file follow it as in a directory walk
+	slices.SortFunc(entries, func(a, b walkEntry) int {
+		return slices.Compare(strings.Split(a.Name, "/"), strings.Split(b.Name, "/"))
+	})
+	skip := ""
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if skip != "" && strings.HasPrefix(e.Name, skip) {
+			continue
+		}
+		if e.dangling {
+			if err := onError(e.Name, ErrNotFound); err != nil {
+				return err
+			}
+			continue
+		}
+		switch err := fn(e.FileEntry); err {
+		case nil:
+		case filepath.SkipDir:
+			skip = e.Name + "/"
+		default:
+			return err
+		}
+	}
+	return nil
+}
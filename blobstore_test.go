@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBlobStore checks the behavior Datastore relies on of a BlobStore
+func testBlobStore(t *testing.T, bs BlobStore) {
+	t.Helper()
+	if _, err := bs.GetCurrent("a/b"); err != ErrNotFound {
+		t.Errorf("GetCurrent of a missing file: %v", err)
+	}
+	if _, err := bs.GetVersion("a/b", "v1"); err != ErrNotFound {
+		t.Errorf("GetVersion of a missing version: %v", err)
+	}
+	for _, v := range []string{"v1", "v2"} {
+		if err := bs.PutVersion("a/b", v, strings.NewReader("data-"+v)); err != nil {
+			t.Fatalf("PutVersion(%s) failed: %v", v, err)
+		}
+	}
+	if err := bs.SetCurrent("a/b", "v2"); err != nil {
+		t.Fatalf("SetCurrent failed: %v", err)
+	}
+	if cur, err := bs.GetCurrent("a/b"); err != nil || cur != "v2" {
+		t.Errorf("GetCurrent: %q %v", cur, err)
+	}
+	rd, err := bs.GetVersion("a/b", "v1")
+	if err != nil {
+		t.Fatalf("GetVersion failed: %v", err)
+	}
+	data, _ := io.ReadAll(rd)
+	rd.Close()
+	if string(data) != "data-v1" {
+		t.Errorf("GetVersion: %q", data)
+	}
+	if e, err := bs.StatVersion("a/b", "v2"); err != nil || e.Name != "v2" || e.Size != 7 {
+		t.Errorf("StatVersion: %+v %v", e, err)
+	}
+	if ents, err := bs.ListVersions("a/b"); err != nil || len(ents) != 2 {
+		t.Errorf("ListVersions: %+v %v", ents, err)
+	}
+	if err := bs.RemoveVersion("a/b", "v1"); err != nil {
+		t.Errorf("RemoveVersion failed: %v", err)
+	}
+	if _, err := bs.StatVersion("a/b", "v1"); err != ErrNotFound {
+		t.Errorf("StatVersion of a removed version: %v", err)
+	}
+
+	if _, err := bs.GetBackup("a/b"); err != ErrNotFound {
+		t.Errorf("GetBackup without a backup: %v", err)
+	}
+	for _, version := range []string{"v1", "v2"} {
+		if err := bs.SetBackup("a/b", version); err != nil {
+			t.Fatalf("SetBackup failed: %v", err)
+		}
+		if got, err := bs.GetBackup("a/b"); err != nil || got != version {
+			t.Errorf("GetBackup: %q %v", got, err)
+		}
+	}
+
+	if _, _, err := bs.ReadLock("a/b"); err != ErrUnlocked {
+		t.Errorf("ReadLock of an unlocked file: %v", err)
+	}
+	if err := bs.CreateLock("a/b", []byte(`{"ID":"1"}`)); err != nil {
+		t.Fatalf("CreateLock failed: %v", err)
+	}
+	if err := bs.CreateLock("a/b", []byte(`{"ID":"2"}`)); err != ErrLocked {
+		t.Errorf("second CreateLock: %v", err)
+	}
+	if info, at, err := bs.ReadLock("a/b"); err != nil || !bytes.Equal(info, []byte(`{"ID":"1"}`)) || at.IsZero() {
+		t.Errorf("ReadLock: %q %v %v", info, at, err)
+	}
+	if err := bs.RemoveLock("a/b"); err != nil {
+		t.Errorf("RemoveLock failed: %v", err)
+	}
+	if _, _, err := bs.ReadLock("a/b"); err != ErrUnlocked {
+		t.Errorf("ReadLock after RemoveLock: %v", err)
+	}
+
+	if err := bs.RemoveCurrent("a/b"); err != nil {
+		t.Errorf("RemoveCurrent failed: %v", err)
+	}
+	if _, err := bs.GetCurrent("a/b"); err != ErrNotFound {
+		t.Errorf("GetCurrent after RemoveCurrent: %v", err)
+	}
+	if _, err := bs.StatVersion("a/b", "v2"); err != nil {
+		t.Errorf("RemoveCurrent removed the version: %v", err)
+	}
+
+	for _, name := range []string{"x-z", "x/y", "x"} {
+		if err := bs.PutVersion(name, "v1", strings.NewReader("data-v1")); err != nil {
+			t.Fatalf("PutVersion(%s) failed: %v", name, err)
+		}
+		if err := bs.SetCurrent(name, "v1"); err != nil {
+			t.Fatalf("SetCurrent(%s) failed: %v", name, err)
+		}
+	}
+	if err := bs.CreateLock("x/y", []byte(`{"ID":"1"}`)); err != nil {
+		t.Fatalf("CreateLock failed: %v", err)
+	}
+	walk := func(prefix string, skip string) ([]string, []string) {
+		names, failed := []string{}, []string{}
+		err := bs.Walk(t.Context(), prefix, func(e FileEntry) error {
+			names = append(names, fmt.Sprintf("%s %d %v", e.Name, e.Size, e.Locked))
+			if e.Timestamp.IsZero() {
+				t.Errorf("Walk: no time of %s", e.Name)
+			}
+			if e.Name == skip {
+				return filepath.SkipDir
+			}
+			return nil
+		}, func(name string, err error) error {
+			failed = append(failed, name)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Walk failed: %v", err)
+		}
+		return names, failed
+	}
+	if names, _ := walk("/", ""); strings.Join(names, ",") != "/x 7 false,/x/y 7 true,/x-z 7 false" {
+		t.Errorf("Walk: %v", names)
+	}
+	if names, _ := walk("/x/y", ""); strings.Join(names, ",") != "/x/y 7 true" {
+		t.Errorf("Walk under /x/y: %v", names)
+	}
+	if names, _ := walk("/", "/x"); strings.Join(names, ",") != "/x 7 false,/x-z 7 false" {
+		t.Errorf("Walk skipping /x: %v", names)
+	}
+	if err := bs.SetCurrent("x-z", "missing"); err != nil {
+		t.Fatalf("SetCurrent failed: %v", err)
+	}
+	if names, failed := walk("/", ""); len(names) != 2 || strings.Join(failed, ",") != "/x-z" {
+		t.Errorf("Walk with a dangling current: %v %v", names, failed)
+	}
+
+	// locked before the first write, without current
+	if err := bs.CreateLock("new/file", []byte(`{"ID":"2"}`)); err != nil {
+		t.Fatalf("CreateLock failed: %v", err)
+	}
+	if locks, err := bs.ListLocks(t.Context(), "/"); err != nil || strings.Join(locks, ",") != "/new/file,/x/y" {
+		t.Errorf("ListLocks: %v %v", locks, err)
+	}
+	if locks, err := bs.ListLocks(t.Context(), "/x/"); err != nil || strings.Join(locks, ",") != "/x/y" {
+		t.Errorf("ListLocks under /x/: %v %v", locks, err)
+	}
+}
+
+func TestBlobStore(t *testing.T) {
+	t.Run("fs", func(t *testing.T) {
+		ds := NewDatastore(t.TempDir())
+		testBlobStore(t, ds.blobs())
+	})
+	t.Run("mem", func(t *testing.T) {
+		testBlobStore(t, NewMemBlobStore())
+	})
+}
+
+func TestMemDatastore(t *testing.T) {
+	ds := NewMemDatastore()
+	ds.Compress = true
+	ds.Backup = true
+	for _, content := range []string{`{"serial":1}`, `{"serial":2}`, `{"serial":3}`} {
+		if err := ds.Write(t.Context(), "prod/app", strings.NewReader(content), nil, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := ds.Read(t.Context(), "prod/app", buf); err != nil || buf.String() != `{"serial":3}` {
+		t.Errorf("Read: %q %v", buf.String(), err)
+	}
+	if rd, err := ds.ReadHistory("prod/app", backupLink); err != nil {
+		t.Errorf("ReadHistory of the backup failed: %v", err)
+	} else {
+		if content, _ := io.ReadAll(rd); string(content) != `{"serial":2}` {
+			t.Errorf("backup: %q", content)
+		}
+		rd.Close()
+	}
+	hist := ds.History(t.Context(), "prod/app")
+	if len(hist) != 3 || !hist[0].Locked {
+		t.Fatalf("History: %+v", hist)
+	}
+
+	if err := ds.Lock("prod/app", `{"ID":"x"}`); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := ds.Lock("prod/app", `{"ID":"y"}`); err != ErrLocked {
+		t.Errorf("Lock by another ID: %v", err)
+	}
+	if err := ds.Write(t.Context(), "prod/app", strings.NewReader("{}"), nil, "y"); err != ErrLocked {
+		t.Errorf("Write without the lock: %v", err)
+	}
+	if locks, err := ds.Locks("/"); err != nil || len(locks) != 1 || locks[0].Path != "/prod/app" {
+		t.Errorf("Locks: %+v %v", locks, err)
+	}
+	if err := ds.Unlock("prod/app", `{"ID":"x"}`); err != nil {
+		t.Errorf("Unlock failed: %v", err)
+	}
+	if err := ds.Write(t.Context(), "dev/app", strings.NewReader(`{"serial":1}`), nil, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	names := []string{}
+	if err := ds.Walk(t.Context(), "/", func(e FileEntry) error {
+		names = append(names, e.Name)
+		return nil
+	}); err != nil || strings.Join(names, ",") != "/dev/app,/prod/app" {
+		t.Errorf("Walk: %v %v", names, err)
+	}
+	if states, size, err := ds.Stats(); err != nil || states != 2 || size == 0 {
+		t.Errorf("Stats: %d %d %v", states, size, err)
+	}
+
+	if err := ds.Rollback("prod/app", hist[2].Name); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	buf.Reset()
+	if err := ds.Read(t.Context(), "prod/app", buf); err != nil || buf.String() != `{"serial":1}` {
+		t.Errorf("Read after rollback: %q %v", buf.String(), err)
+	}
+	res, err := ds.PruneDetail(t.Context(), "prod/app", 1, false)
+	if err != nil || res.After != 2 {
+		// the current version is kept
+		t.Errorf("Prune: %+v %v", res, err)
+	}
+	if err := ds.Delete("prod/app"); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if err := ds.Read(t.Context(), "prod/app", buf); err != ErrNotFound {
+		t.Errorf("Read after delete: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// browser is an interactive, line based browser of the files, their history and versions
+type browser struct {
+	ds            *Datastore
+	in            *bufio.Scanner
+	out           io.Writer
+	prefix        string
+	allowRollback bool
+}
+
+// prompt prints the prompt and returns the fields of the next line, or false at the end of input
+func (b *browser) prompt(p string) ([]string, bool) {
+	fmt.Fprint(b.out, p+"> ")
+	if !b.in.Scan() {
+		fmt.Fprintln(b.out)
+		return nil, false
+	}
+	return strings.Fields(b.in.Text()), true
+}
+
+// pick returns the entry of the 1-based index given as a string
+func pick[T any](list []T, s string) (T, bool) {
+	var zero T
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 1 || i > len(list) {
+		return zero, false
+	}
+	return list[i-1], true
+}
+
+// run lists the files and opens the chosen ones until quit or the end of input
+func (b *browser) run(ctx context.Context) error {
+	filter := ""
+	for {
+		files := []FileEntry{}
+		err := b.ds.Walk(ctx, b.prefix, func(e FileEntry) error {
+			if strings.Contains(e.Name, filter) {
+				files = append(files, e)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, e := range files {
+			locked := ""
+			if e.Locked {
+				locked = " [locked]"
+			}
+			fmt.Fprintf(b.out, "%3d %s %s %s%s\n", i+1, e.Name, humanizeBytes(e.Size), showTime(e.Timestamp), locked)
+		}
+		if len(files) == 0 {
+			fmt.Fprintln(b.out, "no files")
+		}
+		fmt.Fprintln(b.out, "<n>: open, /<text>: filter, r: reload, q: quit")
+		args, ok := b.prompt("browse")
+		if !ok {
+			return nil
+		}
+		switch {
+		case len(args) == 0 || args[0] == "r":
+		case args[0] == "q":
+			return nil
+		case strings.HasPrefix(args[0], "/"):
+			filter = strings.TrimPrefix(args[0], "/")
+		default:
+			e, ok := pick(files, args[0])
+			if !ok {
+				fmt.Fprintln(b.out, "no such file:", args[0])
+				continue
+			}
+			if quit, err := b.file(ctx, e.Name); err != nil || quit {
+				return err
+			}
+		}
+	}
+}
+
+// file shows the history of a file and its versions, and returns true to quit
+func (b *browser) file(ctx context.Context, name string) (bool, error) {
+	for {
+		hist := b.ds.History(ctx, name)
+		fmt.Fprintln(b.out, name)
+		for i, e := range hist {
+			current := ""
+			if e.Locked {
+				current = " (current)"
+			}
+			fmt.Fprintf(b.out, "%3d %s %8s %s%s\n", i+1, showTime(e.Timestamp), humanizeBytes(e.Size), e.Name, current)
+		}
+		help := "v <n>: view, d <n> [<m>]: diff with current or m, "
+		if b.allowRollback {
+			help += "rollback <n>, "
+		}
+		fmt.Fprintln(b.out, help+"b: back, q: quit")
+		args, ok := b.prompt(name)
+		if !ok {
+			return true, nil
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "q":
+			return true, nil
+		case "b":
+			return false, nil
+		case "v":
+			if len(args) != 2 {
+				fmt.Fprintln(b.out, "usage: v <n>")
+			} else if e, ok := pick(hist, args[1]); !ok {
+				fmt.Fprintln(b.out, "no such version:", args[1])
+			} else if err := b.view(name, e.Name); err != nil {
+				fmt.Fprintln(b.out, "cannot read:", err)
+			}
+		case "d":
+			if len(args) < 2 || len(args) > 3 {
+				fmt.Fprintln(b.out, "usage: d <n> [<m>]")
+				continue
+			}
+			a, ok := pick(hist, args[1])
+			if !ok {
+				fmt.Fprintln(b.out, "no such version:", args[1])
+				continue
+			}
+			other := "current"
+			if len(args) == 3 {
+				e, ok := pick(hist, args[2])
+				if !ok {
+					fmt.Fprintln(b.out, "no such version:", args[2])
+					continue
+				}
+				other = e.Name
+			}
+			if err := b.diff(name, a.Name, other); err != nil {
+				fmt.Fprintln(b.out, "cannot diff:", err)
+			}
+		case "rollback":
+			if !b.allowRollback {
+				fmt.Fprintln(b.out, "read only, start with --allow-rollback")
+			} else if len(args) != 2 {
+				fmt.Fprintln(b.out, "usage: rollback <n>")
+			} else if e, ok := pick(hist, args[1]); !ok {
+				fmt.Fprintln(b.out, "no such version:", args[1])
+			} else if err := b.rollback(name, e.Name); err != nil {
+				fmt.Fprintln(b.out, "rollback failed:", err)
+			}
+		default:
+			fmt.Fprintln(b.out, "unknown command:", args[0])
+		}
+	}
+}
+
+// view prints the contents of a version
+func (b *browser) view(name string, version string) error {
+	rd, err := b.ds.ReadHistory(name, version)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	_, err = io.Copy(b.out, rd)
+	fmt.Fprintln(b.out)
+	return err
+}
+
+// diff prints the differences from version a to version b
+func (b *browser) diff(name string, a string, other string) error {
+	objs := []map[string]interface{}{}
+	for _, version := range []string{a, other} {
+		rd, err := b.ds.ReadHistory(name, version)
+		if err != nil {
+			return err
+		}
+		obj := map[string]interface{}{}
+		err = json.NewDecoder(rd).Decode(&obj)
+		rd.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", version, ErrNotJSON)
+		}
+		objs = append(objs, obj)
+	}
+	res, err := asciiDiff(objs[0], objs[1])
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(b.out, res)
+	return err
+}
+
+// rollback rolls back to the version after the name of the file is typed to confirm,
+// and only if current did not change while browsing
+func (b *browser) rollback(name string, version string) error {
+	current := b.ds.CurrentVersion(name)
+	fmt.Fprintf(b.out, "rollback %s from %s to %s, type the file name to confirm\n", name, current, version)
+	args, ok := b.prompt("confirm")
+	if !ok || len(args) != 1 || strings.TrimPrefix(args[0], "/") != strings.TrimPrefix(name, "/") {
+		fmt.Fprintln(b.out, "cancelled")
+		return nil
+	}
+	if err := b.ds.RollbackIf(name, version, current); err != nil {
+		return err
+	}
+	fmt.Fprintln(b.out, "rolled back to", version)
+	return nil
+}
+
+// Browse explores files, their history and versions interactively
+type Browse struct {
+	AllowRollback bool `long:"allow-rollback" description:"enable the rollback command, confirmed by typing the file name"`
+}
+
+func (cmd *Browse) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	ctx, stop := commandContext()
+	defer stop()
+	prefix := "/"
+	if len(args) != 0 {
+		prefix = args[0]
+	}
+	b := &browser{ds: &root, in: bufio.NewScanner(os.Stdin), out: os.Stdout, prefix: prefix, allowRollback: cmd.AllowRollback}
+	return b.run(ctx)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runBrowser(t *testing.T, ds *Datastore, allowRollback bool, input string) string {
+	t.Helper()
+	out := &bytes.Buffer{}
+	b := &browser{ds: ds, in: bufio.NewScanner(strings.NewReader(input)), out: out, prefix: "/", allowRollback: allowRollback}
+	if err := b.run(t.Context()); err != nil {
+		t.Fatalf("browse failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestBrowser(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for i, data := range []string{`{"serial":1}`, `{"serial":2}`} {
+		if err := ds.Write(t.Context(), "prod/app", strings.NewReader(data), []byte{}, ""); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	writeAt(t, &ds, "dev/app", time.Now())
+
+	out := runBrowser(t, &ds, false, "/prod\n1\nv 2\nd 2\nrollback 2\nq\n")
+	if strings.Count(out, "/dev/app") != 1 {
+		t.Errorf("filter not applied: %s", out)
+	}
+	for _, expected := range []string{`{"serial":1}`, `-  "serial": 1`, `+  "serial": 2`, "read only"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("%q not found: %s", expected, out)
+		}
+	}
+	if got, _ := readString(t, ds, "prod/app"); got != `{"serial":2}` {
+		t.Errorf("read only browser changed current: %s", got)
+	}
+
+	// the rollback is cancelled unless confirmed with the file name
+	out = runBrowser(t, &ds, true, "/prod\n1\nrollback 2\nno\nrollback 2\nprod/app\nb\nq\n")
+	if !strings.Contains(out, "cancelled") || !strings.Contains(out, "rolled back to") {
+		t.Errorf("unexpected output: %s", out)
+	}
+	if got, _ := readString(t, ds, "prod/app"); got != `{"serial":1}` {
+		t.Errorf("not rolled back: %s", got)
+	}
+
+	// end of input quits
+	out = runBrowser(t, &ds, false, "9\n")
+	if !strings.Contains(out, "no such file: 9") {
+		t.Errorf("unexpected output: %s", out)
+	}
+}
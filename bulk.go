@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// defaultBulkWorkers is the number of paths of a bulk request handled in parallel unless the server sets another
+const defaultBulkWorkers = 4
+
+// maxBulkPaths is the largest number of paths of a bulk request
+const maxBulkPaths = 1000
+
+// bulkRequest is the body of +bulk requests
+type bulkRequest struct {
+	Op      string      `json:"op"`
+	Paths   []string    `json:"paths"`
+	Options bulkOptions `json:"options"`
+}
+
+// bulkOptions are the options of the operation of a bulk request
+type bulkOptions struct {
+	// Keep is the number of versions kept by prune
+	Keep *int `json:"keep,omitempty"`
+}
+
+// BulkResult is the result of the operation on one path of a bulk request
+type BulkResult struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"`
+	// Content is the contents read if they are JSON, Data if not
+	Content json.RawMessage `json:"content,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+}
+
+// bulkPerm is the permission each operation needs on the paths
+var bulkPerm = map[string]byte{"read": aclRead, "delete": aclWrite, "prune": aclWrite}
+
+// APIBulk handles POST +bulk: the operation runs on each path with bounded parallelism, and the result
+// of each path is returned, one JSON object per line for read and a JSON array otherwise
+//
+// the permissions of the ACL are checked for each path; refused paths get 403 while the others go on.
+func (h *APIHandler) APIBulk(w io.Writer, r *http.Request) (string, error) {
+	req := bulkRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("invalid bulk request", "error", err)
+		return "", ErrInvalidPath
+	}
+	perm, ok := bulkPerm[req.Op]
+	if !ok || len(req.Paths) == 0 || (req.Op == "prune" && (req.Options.Keep == nil || *req.Options.Keep < 0)) {
+		slog.Error("bulk request requires op read, delete or prune, paths, and keep for prune", "op", req.Op, "paths", len(req.Paths))
+		return "", ErrInvalidPath
+	}
+	if len(req.Paths) > maxBulkPaths {
+		slog.Error("too many paths in bulk request", "paths", len(req.Paths), "max", maxBulkPaths)
+		return "", ErrTooLarge
+	}
+	workers := h.bulkWorkers
+	if workers < 1 {
+		workers = defaultBulkWorkers
+	}
+	user := RequestUser(r)
+	res := make([]BulkResult, len(req.Paths))
+	var wg sync.WaitGroup
+	queue := make(chan int)
+	for range min(workers, len(req.Paths)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				res[i] = h.bulkOne(r, req, req.Paths[i], perm, user)
+			}
+		}()
+	}
+	for i := range req.Paths {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	if req.Op != "read" {
+		return "application/json", json.NewEncoder(w).Encode(res)
+	}
+	enc := json.NewEncoder(w)
+	for _, v := range res {
+		if err := enc.Encode(v); err != nil {
+			return "", err
+		}
+	}
+	return "application/x-ndjson", nil
+}
+
+// bulkOne runs the operation of a bulk request on one path
+func (h *APIHandler) bulkOne(r *http.Request, req bulkRequest, path string, perm byte, user string) BulkResult {
+	res := BulkResult{Path: path}
+	name, err := normalizeName(path, h.strictPaths)
+	if err == nil && name == "" {
+		err = ErrInvalidPath
+	}
+	if err == nil && h.acl != nil && !h.acl.Allowed(user, name, perm) {
+		slog.Warn("access denied", "user", user, "name", name, "perm", string(perm), "op", req.Op)
+		err = ErrForbidden
+	}
+	if err == nil {
+		name = h.aliases.Resolve(name)
+		switch req.Op {
+		case "read":
+			buf := &bytes.Buffer{}
+			if err = h.ds.Read(r.Context(), name, buf); err == nil {
+				res.Bytes = buf.Len()
+				if json.Valid(buf.Bytes()) {
+					res.Content = buf.Bytes()
+				} else {
+					res.Data = buf.Bytes()
+				}
+			}
+		case "delete":
+			err = h.ds.Delete(name)
+		case "prune":
+			err = h.ds.Prune(r.Context(), name, *req.Options.Keep, false)
+		}
+	}
+	res.Status = http.StatusOK
+	if err != nil {
+		res.Status = h.errorStatus(err)
+		res.Error = err.Error()
+		return res
+	}
+	if req.Op != "read" {
+		h.events.Publish(Event{Name: name, Type: req.Op, User: user})
+	}
+	return res
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func bulk(t *testing.T, h http.Handler, user string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/+bulk", strings.NewReader(body))
+	if user != "" {
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAPIBulk(t *testing.T) {
+	ds := newMemDS()
+	for _, name := range []string{"pr/1", "pr/2", "pr/3", "keep"} {
+		ds.put(name, `{"v":1}`)
+	}
+	ds.file("pr/3", false).protected = true
+	h := &APIHandler{ds: ds, events: NewEventBroker()}
+
+	rr := bulk(t, h, "", `{"op":"delete","paths":["pr/1","pr/2","pr/3","pr/missing","a/../b"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("bulk failed: %d %s", rr.Code, rr.Body.String())
+	}
+	res := []BulkResult{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("invalid response %s: %v", rr.Body.String(), err)
+	}
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusForbidden, http.StatusNotFound, http.StatusBadRequest}
+	if len(res) != len(expected) {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	for i, status := range expected {
+		if res[i].Status != status || (status != http.StatusOK) != (res[i].Error != "") {
+			t.Errorf("%s: expected %d, got %+v", res[i].Path, status, res[i])
+		}
+	}
+	if ds.file("pr/1", false) != nil || ds.file("pr/3", false) == nil || ds.file("keep", false) == nil {
+		t.Errorf("unexpected files left: %v", ds.files)
+	}
+	if evs := h.events.Recent(0); len(evs) != 2 || evs[0].Type != "delete" {
+		t.Errorf("unexpected events %+v", evs)
+	}
+
+	rr = bulk(t, h, "", `{"op":"read","paths":["keep","pr/1"]}`)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" || len(lines) != 2 {
+		t.Fatalf("unexpected read response: %d %v %s", rr.Code, rr.Header(), rr.Body.String())
+	}
+	read := BulkResult{}
+	if err := json.Unmarshal([]byte(lines[0]), &read); err != nil || read.Status != http.StatusOK || string(read.Content) != `{"v":1}` || read.Bytes != 7 {
+		t.Errorf("unexpected read %s %v", lines[0], err)
+	}
+	read = BulkResult{}
+	if err := json.Unmarshal([]byte(lines[1]), &read); err != nil || read.Status != http.StatusNotFound || read.Content != nil {
+		t.Errorf("unexpected read %s %v", lines[1], err)
+	}
+
+	for _, body := range []string{`{"op":"rename","paths":["keep"]}`, `{"op":"delete","paths":[]}`, `{"op":"prune","paths":["keep"]}`, `not json`} {
+		if rr := bulk(t, h, "", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+	rr = bulk(t, h, "", `{"op":"prune","paths":["keep"],"options":{"keep":1}}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"status":200`) || len(ds.called("Prune")) != 1 {
+		t.Errorf("prune failed: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAPIBulk_ACL(t *testing.T) {
+	ds := newMemDS()
+	ds.put("team-a/app", `{"v":1}`)
+	ds.put("team-b/app", `{"v":1}`)
+	aclfile := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(aclfile, []byte("alice team-a/* rwl\nalice * r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := &APIHandler{ds: ds}
+	acl, err := NewACL(http.StripPrefix("/api", h), aclfile)
+	if err != nil {
+		t.Fatalf("NewACL failed: %v", err)
+	}
+	h.acl = acl
+	req := httptest.NewRequest(http.MethodPost, "/api/+bulk", strings.NewReader(`{"op":"delete","paths":["team-a/app","team-b/app"]}`))
+	req = req.WithContext(context.WithValue(req.Context(), userKey{}, "alice"))
+	rr := httptest.NewRecorder()
+	acl.ServeHTTP(rr, req)
+	res := []BulkResult{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil || len(res) != 2 {
+		t.Fatalf("unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+	if res[0].Status != http.StatusOK || res[1].Status != http.StatusForbidden {
+		t.Errorf("expected the path without permission refused: %+v", res)
+	}
+	if ds.file("team-b/app", false) == nil {
+		t.Errorf("file deleted without permission")
+	}
+	if rr := bulk(t, h, "alice", `{"op":"read","paths":["team-b/app"]}`); !strings.Contains(rr.Body.String(), `"status":200`) {
+		t.Errorf("read refused: %s", rr.Body.String())
+	}
+}
+
+// busyDS counts the deletes running at the same time
+type busyDS struct {
+	*memDS
+	running atomic.Int32
+	mu      sync.Mutex
+	peak    int32
+}
+
+func (b *busyDS) Delete(name string) error {
+	n := b.running.Add(1)
+	defer b.running.Add(-1)
+	b.mu.Lock()
+	b.peak = max(b.peak, n)
+	b.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	return b.memDS.Delete(name)
+}
+
+func TestAPIBulk_Parallelism(t *testing.T) {
+	ds := &busyDS{memDS: newMemDS()}
+	paths := []string{}
+	for i := range 20 {
+		name := "pr/" + string(rune('a'+i))
+		ds.put(name, "{}")
+		paths = append(paths, name)
+	}
+	h := &APIHandler{ds: ds, bulkWorkers: 3}
+	body, _ := json.Marshal(bulkRequest{Op: "delete", Paths: paths})
+	if rr := bulk(t, h, "", string(body)); rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "error") {
+		t.Fatalf("bulk failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if ds.peak > 3 || ds.peak < 2 {
+		t.Errorf("expected up to 3 deletes at a time, got %d", ds.peak)
+	}
+	if len(ds.files) != 0 {
+		t.Errorf("files left: %v", ds.files)
+	}
+}
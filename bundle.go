@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// bundleManifest is the name of the manifest entry, the first one of a bundle
+const bundleManifest = "manifest.json"
+
+// BundleVersion describes a version in a bundle
+type BundleVersion struct {
+	Name      string    `json:"name"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+	// MD5 is the digest of the version as stored (compressed versions are not decompressed)
+	MD5 string `json:"md5"`
+}
+
+// BundleManifest describes the contents of a bundle
+type BundleManifest struct {
+	Name     string          `json:"name"`
+	Exported time.Time       `json:"exported"`
+	Current  string          `json:"current"`
+	Versions []BundleVersion `json:"versions"` // oldest first
+	Sidecars []string        `json:"sidecars"`
+	Locked   bool            `json:"locked"`
+}
+
+// fileMD5 returns the hex md5 of a file in the datastore
+func (d *Datastore) fileMD5(path string) (string, error) {
+	fp, err := d.RootDir.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addBundleFile copies a file of the datastore into the bundle, keeping the mtime which orders versions
+func (d *Datastore) addBundleFile(tw *tar.Writer, src string, dst string) error {
+	fi, err := d.RootDir.Stat(src)
+	if err != nil {
+		return err
+	}
+	fp, err := d.RootDir.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: dst, Mode: 0o644, Size: fi.Size(), ModTime: fi.ModTime(), Format: tar.FormatPAX}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fp)
+	return err
+}
+
+// ExportBundle writes all versions, sidecars and lock of a file as a tar.gz bundle
+func (d *Datastore) ExportBundle(name string, w io.Writer) (BundleManifest, error) {
+	res := BundleManifest{Name: name, Exported: time.Now(), Current: d.currentTarget(name), Versions: []BundleVersion{}, Sidecars: []string{}}
+	dir, err := d.File(name)
+	if err != nil {
+		return res, ErrInvalidPath
+	}
+	hist := d.History(context.Background(), name)
+	if len(hist) == 0 {
+		return res, ErrNotFound
+	}
+	slices.Reverse(hist)
+	for _, e := range hist {
+		sum, err := d.fileMD5(filepath.Join(dir, e.Name))
+		if err != nil {
+			slog.Error("read version", "name", name, "version", e.Name, "error", err)
+			return res, err
+		}
+		res.Versions = append(res.Versions, BundleVersion{Name: e.Name, Timestamp: e.Timestamp, Size: e.Size, MD5: sum})
+	}
+	files, err := afero.ReadDir(d.RootDir, dir)
+	if err != nil {
+		return res, err
+	}
+	for _, ent := range files {
+		if strings.HasPrefix(ent.Name(), ".") && ent.Mode().IsRegular() {
+			res.Sidecars = append(res.Sidecars, ent.Name())
+		}
+		if ent.Name() == "lock" {
+			res.Locked = true
+		}
+	}
+	manifest, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return res, err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: bundleManifest, Mode: 0o644, Size: int64(len(manifest)), ModTime: res.Exported, Format: tar.FormatPAX}); err != nil {
+		return res, err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return res, err
+	}
+	for _, v := range res.Versions {
+		if err := d.addBundleFile(tw, filepath.Join(dir, v.Name), path.Join("versions", v.Name)); err != nil {
+			return res, err
+		}
+	}
+	for _, v := range res.Sidecars {
+		if err := d.addBundleFile(tw, filepath.Join(dir, v), path.Join("sidecars", v)); err != nil {
+			return res, err
+		}
+	}
+	if res.Locked {
+		if err := d.addBundleFile(tw, filepath.Join(dir, "lock"), "lock"); err != nil {
+			return res, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return res, err
+	}
+	return res, gz.Close()
+}
+
+// bundleEntryName checks that a name from a manifest is a plain file name
+func bundleEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." && name == path.Base(name) && !strings.Contains(name, "\\") && !reservedNames[name]
+}
+
+// ImportBundle restores a bundle as the file name (the exported name if empty), which must not exist
+func (d *Datastore) ImportBundle(name string, r io.Reader) (BundleManifest, error) {
+	res := BundleManifest{}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return res, err
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != bundleManifest {
+		slog.Error("manifest not found", "error", err)
+		return res, ErrInvalidState
+	}
+	if err := json.NewDecoder(tr).Decode(&res); err != nil {
+		slog.Error("invalid manifest", "error", err)
+		return res, ErrInvalidState
+	}
+	if name == "" {
+		name = res.Name
+	}
+	dir, err := d.File(name)
+	if err != nil {
+		return res, ErrInvalidPath
+	}
+	if _, _, err := d.RootDir.LstatIfPossible(filepath.Join(dir, "current")); err == nil {
+		slog.Error("already exists", "name", name)
+		return res, ErrExists
+	}
+	if err := d.RootDir.MkdirAll(dir, 0o755); err != nil {
+		return res, err
+	}
+	sums := map[string]string{}
+	for _, v := range res.Versions {
+		if !bundleEntryName(v.Name) || strings.HasPrefix(v.Name, ".") {
+			slog.Error("invalid version name", "version", v.Name)
+			return res, ErrInvalidPath
+		}
+		sums[path.Join("versions", v.Name)] = v.MD5
+	}
+	expected := map[string]bool{}
+	for _, v := range res.Sidecars {
+		if !bundleEntryName(v) || !strings.HasPrefix(v, ".") {
+			slog.Error("invalid sidecar name", "sidecar", v)
+			return res, ErrInvalidPath
+		}
+		expected[path.Join("sidecars", v)] = true
+	}
+	if res.Locked {
+		expected["lock"] = true
+	}
+	written := []string{}
+	cleanup := func() {
+		for _, v := range written {
+			if err := d.RootDir.Remove(v); err != nil {
+				slog.Error("cannot remove", "path", v, "error", err)
+			}
+		}
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return res, err
+		}
+		base := path.Base(hdr.Name)
+		sum, isVersion := sums[hdr.Name]
+		if !isVersion && !expected[hdr.Name] {
+			slog.Error("unexpected entry", "entry", hdr.Name)
+			cleanup()
+			return res, ErrInvalidPath
+		}
+		dst := filepath.Join(dir, base)
+		h := md5.New()
+		if err := d.writeFile(dst, io.TeeReader(tr, h)); err != nil {
+			cleanup()
+			return res, err
+		}
+		written = append(written, dst)
+		if isVersion && hex.EncodeToString(h.Sum(nil)) != sum {
+			slog.Error("digest mismatch", "entry", hdr.Name)
+			cleanup()
+			return res, ErrInvalidHash
+		}
+		if err := d.RootDir.Chtimes(dst, hdr.ModTime, hdr.ModTime); err != nil {
+			slog.Warn("cannot set time", "path", dst, "error", err)
+		}
+		delete(sums, hdr.Name)
+	}
+	if len(sums) != 0 || !d.versionExists(name, res.Current) {
+		slog.Error("incomplete bundle", "missing", len(sums), "current", res.Current)
+		cleanup()
+		return res, ErrInvalidState
+	}
+	if err := d.set_current(name, res.Current); err != nil {
+		cleanup()
+		return res, err
+	}
+	res.Name = name
+	return res, d.syncDir(dir)
+}
+
+// ExportState writes the full history of a file to a bundle
+type ExportState struct {
+	Output string `short:"o" long:"output" required:"true" description:"bundle file (.tgz)"`
+}
+
+func (cmd *ExportState) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	if len(args) != 1 {
+		return fmt.Errorf("specify a file to export")
+	}
+	fp, err := os.Create(cmd.Output)
+	if err != nil {
+		return err
+	}
+	res, err := root.ExportBundle(args[0], fp)
+	if err != nil {
+		fp.Close()
+		os.Remove(cmd.Output)
+		slog.Error("export failed", "name", args[0], "error", err)
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d versions of %s into %s\n", len(res.Versions), args[0], cmd.Output)
+	return nil
+}
+
+// ImportStateBundle restores a bundle made by export-state
+type ImportStateBundle struct {
+	Name string `long:"name" description:"file name (default: the exported name)"`
+}
+
+func (cmd *ImportStateBundle) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	if len(args) != 1 {
+		return fmt.Errorf("specify a bundle to import")
+	}
+	fp, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	res, err := root.ImportBundle(cmd.Name, fp)
+	if err != nil {
+		slog.Error("import failed", "bundle", args[0], "error", err)
+		return err
+	}
+	fmt.Printf("imported %d versions into %s\n", len(res.Versions), res.Name)
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rewriteBundle copies a bundle, changing the contents of entries with edit
+func rewriteBundle(t *testing.T, data []byte, edit func(name string, content []byte) []byte) []byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("not gzip: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		content, _ := io.ReadAll(tr)
+		content = edit(hdr.Name, content)
+		hdr.Size = int64(len(content))
+		tw.WriteHeader(hdr)
+		tw.Write(content)
+	}
+	tw.Close()
+	gzw.Close()
+	return buf.Bytes()
+}
+
+func TestBundle_RoundTrip(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for i, content := range []string{"v1", "v2", "v3"} {
+		ds.Compress = i == 1
+		if err := ds.Write(t.Context(), "prod/app", strings.NewReader(content), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hist := ds.History(t.Context(), "prod/app")
+	if err := ds.Rollback("prod/app", hist[1].Name); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if err := ds.Lock("prod/app", `{"ID":"lock1"}`); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := ds.Protect("prod/app"); err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	hist = ds.History(t.Context(), "prod/app")
+	buf := &bytes.Buffer{}
+	manifest, err := ds.ExportBundle("prod/app", buf)
+	if err != nil {
+		t.Fatalf("ExportBundle failed: %v", err)
+	}
+	if len(manifest.Versions) != 3 || manifest.Versions[0].Name != hist[2].Name || !manifest.Locked || manifest.Current != hist[1].Name {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+	if len(manifest.Sidecars) != 2 {
+		t.Errorf("expected hash sidecar and protect marker: %+v", manifest.Sidecars)
+	}
+	bundle := buf.Bytes()
+
+	for _, name := range []string{"", "restored/app"} {
+		t.Run("import "+name, func(t *testing.T) {
+			dst := NewDatastore(t.TempDir())
+			res, err := dst.ImportBundle(name, bytes.NewReader(bundle))
+			if err != nil {
+				t.Fatalf("ImportBundle failed: %v", err)
+			}
+			restored := res.Name
+			if name == "" && restored != "prod/app" || name != "" && restored != name {
+				t.Errorf("unexpected name: %s", restored)
+			}
+			got := dst.History(t.Context(), restored)
+			if len(got) != len(hist) {
+				t.Fatalf("expected %d versions, got %d", len(hist), len(got))
+			}
+			for i := range hist {
+				if got[i].Name != hist[i].Name || got[i].Size != hist[i].Size || !got[i].Timestamp.Equal(hist[i].Timestamp) || got[i].Locked != hist[i].Locked {
+					t.Errorf("version %d differs: %+v != %+v", i, got[i], hist[i])
+				}
+			}
+			for _, v := range manifest.Versions {
+				path, _ := dst.File(restored, v.Name)
+				if sum, _ := dst.fileMD5(path); sum != v.MD5 {
+					t.Errorf("digest of %s differs", v.Name)
+				}
+			}
+			if content, _ := readString(t, dst, restored); content != "v2" {
+				t.Errorf("unexpected current: %q", content)
+			}
+			if _, err := dst.LockRead(restored); err != nil {
+				t.Errorf("lock not restored: %v", err)
+			}
+			if !dst.Protected(restored) {
+				t.Errorf("protect marker not restored")
+			}
+			if _, err := dst.ImportBundle(name, bytes.NewReader(bundle)); err != ErrExists {
+				t.Errorf("expected ErrExists, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBundle_Invalid(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(t.Context(), "app", strings.NewReader("v1"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := ds.ExportBundle("app", buf); err != nil {
+		t.Fatalf("ExportBundle failed: %v", err)
+	}
+	tests := []struct {
+		name     string
+		edit     func(name string, content []byte) []byte
+		expected error
+	}{
+		{"tampered version", func(name string, content []byte) []byte {
+			if strings.HasPrefix(name, "versions/") {
+				return []byte("v2")
+			}
+			return content
+		}, ErrInvalidHash},
+		{"path in manifest", func(name string, content []byte) []byte {
+			if name == bundleManifest {
+				return bytes.ReplaceAll(content, []byte(`"name": "`), []byte(`"name": "../`))
+			}
+			return content
+		}, ErrInvalidPath},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst := NewDatastore(t.TempDir())
+			bundle := rewriteBundle(t, buf.Bytes(), test.edit)
+			if _, err := dst.ImportBundle("restored", bytes.NewReader(bundle)); err != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, err)
+			}
+			if hist := dst.History(t.Context(), "restored"); len(hist) != 0 {
+				t.Errorf("partial import left behind: %+v", hist)
+			}
+		})
+	}
+	if _, err := ds.ExportBundle("missing", &bytes.Buffer{}); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
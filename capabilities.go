@@ -0,0 +1,111 @@
+package main
+
+import (
+	"cmp"
+	"runtime/debug"
+	"slices"
+)
+
+// Capabilities describes what a server supports, served at /api/+capabilities
+type Capabilities struct {
+	Version  string            `json:"version"`
+	Features []string          `json:"features"`
+	Auth     []string          `json:"auth"`
+	Limits   CapabilityLimits  `json:"limits"`
+	Options  map[string]string `json:"options,omitempty"`
+}
+
+// CapabilityLimits are the limits of a server, zero for no limit
+type CapabilityLimits struct {
+	MaxNameLength  int     `json:"max_name_length"`
+	MaxNamePart    int     `json:"max_name_part_length"`
+	MaxNameDepth   int     `json:"max_name_depth"`
+	MaxSize        int64   `json:"max_size"`
+	MinFreeBytes   int64   `json:"min_free_bytes"`
+	MaxWatchers    int     `json:"max_watchers"`
+	RecentEvents   int     `json:"recent_events"`
+	RequestTimeout float64 `json:"request_timeout_seconds"`
+	MaxWait        float64 `json:"max_wait_seconds"`
+}
+
+// Has reports whether the feature is enabled
+func (c *Capabilities) Has(feature string) bool {
+	return slices.Contains(c.Features, feature)
+}
+
+// baseFeatures are the features every server has
+var baseFeatures = []string{"read", "write", "delete", "lock", "versions", "history", "at", "select", "rollback", "rollback-if-match", "prune", "lock-batch", "no-retain", "events", "watch", "content-type", "resumable-upload", "notes", "long-poll", "bulk"}
+
+// serverVersion returns the module version of the binary, "(devel)" if built from a checkout
+func serverVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// capabilities assembles the capabilities from the effective configuration of the server
+func (cmd *WebServer) capabilities(d *Datastore) *Capabilities {
+	res := &Capabilities{
+		Version:  serverVersion(),
+		Features: append([]string{}, baseFeatures...),
+		Auth:     []string{},
+		Limits: CapabilityLimits{
+			MaxNameLength:  maxNameLength,
+			MaxNamePart:    maxComponentLength,
+			MaxNameDepth:   maxNameDepth,
+			MaxSize:        d.MaxSize,
+			MinFreeBytes:   d.MinFreeBytes,
+			MaxWatchers:    cmd.MaxWatchers,
+			RecentEvents:   cmd.RecentEvents,
+			RequestTimeout: cmd.RequestTimeout.Seconds(),
+			MaxWait:        cmp.Or(cmd.MaxWait, defaultMaxWait).Seconds(),
+		},
+		Options: map[string]string{},
+	}
+	toggles := []struct {
+		feature string
+		enabled bool
+	}{
+		{"backup", d.Backup},
+		{"compress", d.Compress},
+		{"require-lock", d.RequireLock},
+		{"normalize-json", d.NormalizeJSON},
+		{"normalize-newline", d.NormalizeNewline},
+		{"no-autocreate", d.NoAutocreate},
+		{"reject-binary", cmd.RejectBinary},
+		{"strict-paths", cmd.StrictPaths},
+		{"missing-state-as-empty", cmd.MissingAsEmpty},
+		{"write-receipt", cmd.WriteReceipt},
+		{"replica-fallback", cmd.ReplicaFallback && option.ReplicaDir != ""},
+		{"acl", cmd.ACLFile != ""},
+		{"webhook", len(cmd.Webhook) != 0},
+		{"upstream", cmd.Upstream != ""},
+		{"maintenance", cmd.GCInterval != 0},
+	}
+	for _, t := range toggles {
+		if t.enabled {
+			res.Features = append(res.Features, t.feature)
+		}
+	}
+	if d.Compress {
+		res.Options["compress_algo"] = "gzip"
+		if d.CompressAlgo != "" {
+			res.Options["compress_algo"] = d.CompressAlgo
+		}
+	}
+	if m := cmd.lockMethods(); m.Lock != "LOCK" || m.Unlock != "UNLOCK" {
+		res.Options["lock_method"] = m.Lock
+		res.Options["unlock_method"] = m.Unlock
+	}
+	if cmd.Auth != "" || cmd.AuthFile != "" {
+		res.Auth = append(res.Auth, "basic")
+	}
+	if cmd.SigningKey != "" {
+		res.Auth = append(res.Auth, "signed-url")
+	}
+	if len(res.Auth) == 0 {
+		res.Auth = append(res.Auth, "none")
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebServer_Capabilities(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	cmd := &WebServer{MaxWatchers: 100, RecentEvents: 100}
+	caps := cmd.capabilities(&ds)
+	if !caps.Has("rollback") || caps.Has("require-lock") || caps.Has("compress") || !slices.Equal(caps.Auth, []string{"none"}) {
+		t.Errorf("unexpected default capabilities: %+v", caps)
+	}
+	if caps.Limits.MaxNameLength != maxNameLength || caps.Limits.MaxWatchers != 100 || caps.Limits.RequestTimeout != 0 {
+		t.Errorf("unexpected limits: %+v", caps.Limits)
+	}
+
+	ds.RequireLock = true
+	ds.Compress = true
+	ds.CompressAlgo = "zstd"
+	cmd = &WebServer{RejectBinary: true, StrictPaths: true, AuthFile: "htpasswd", SigningKey: "key", RequestTimeout: 30 * time.Second}
+	caps = cmd.capabilities(&ds)
+	for _, f := range []string{"require-lock", "compress", "reject-binary", "strict-paths"} {
+		if !caps.Has(f) {
+			t.Errorf("%s missing: %v", f, caps.Features)
+		}
+	}
+	if caps.Has("normalize-json") || caps.Has("replica-fallback") {
+		t.Errorf("disabled features listed: %v", caps.Features)
+	}
+	if caps.Options["compress_algo"] != "zstd" || !slices.Equal(caps.Auth, []string{"basic", "signed-url"}) || caps.Limits.RequestTimeout != 30 {
+		t.Errorf("unexpected capabilities: %+v", caps)
+	}
+}
+
+func TestAPIGet_Capabilities(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	h := &APIHandler{ds: &ds}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/+capabilities", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without capabilities, got %d", rr.Code)
+	}
+
+	h.capabilities = (&WebServer{NormalizeJSON: true}).capabilities(&ds)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/+capabilities", nil))
+	caps := Capabilities{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &caps); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("invalid response %d: %s", rr.Code, rr.Body.String())
+	}
+	if caps.Version == "" || !caps.Has("write") {
+		t.Errorf("unexpected capabilities: %+v", caps)
+	}
+}
+
+func TestDoctor_Capabilities(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	caps := (&WebServer{}).capabilities(&ds)
+	caps.Features = slices.DeleteFunc(caps.Features, func(f string) bool { return f == "rollback" || f == "prune" })
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api/", &APIHandler{ds: &ds, basepath: "/api/", capabilities: caps}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	out, err := captureStdout(func() error { return (&Doctor{URL: srv.URL, Name: "probe"}).Execute(nil) })
+	if err != nil {
+		t.Fatalf("Doctor.Execute() failed: %v\n%s", err, out)
+	}
+	for _, step := range []string{"rollback", "prune"} {
+		if !strings.Contains(out, "SKIP "+step+" ") {
+			t.Errorf("step %s not skipped: %s", step, out)
+		}
+	}
+	if !strings.Contains(out, "PASS delete ") {
+		t.Errorf("delete not passed: %s", out)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+)
+
+// gzipSuffix marks versions stored compressed with gzip
+const gzipSuffix = ".gz"
+
+// zstdSuffix marks versions stored compressed with zstd
+const zstdSuffix = ".zst"
+
+// compressSuffix returns the suffix of versions compressed with the algorithm
+func compressSuffix(algo string) string {
+	if algo == "zstd" {
+		return zstdSuffix
+	}
+	return gzipSuffix
+}
+
+// checkCompression validates the compression algorithm and level
+func checkCompression(algo string, level int) error {
+	switch algo {
+	case "", "gzip":
+		if level != 0 && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+			return fmt.Errorf("gzip level %d is not in 1-9", level)
+		}
+	case "zstd":
+		if level < 0 || level > 22 {
+			return fmt.Errorf("zstd level %d is not in 1-22", level)
+		}
+	default:
+		return fmt.Errorf("unknown compression algorithm %q", algo)
+	}
+	return nil
+}
+
+// versionEncoding returns the content encoding of a stored version
+//
+// the suffix tells the algorithm, so versions compressed with different algorithms are read alike.
+func versionEncoding(version string) string {
+	switch {
+	case strings.HasSuffix(version, gzipSuffix):
+		return "gzip"
+	case strings.HasSuffix(version, zstdSuffix):
+		return "zstd"
+	}
+	return ""
+}
+
+// hashSidecar is the name of the file holding the md5 of the uncompressed contents of a version
+func hashSidecar(version string) string {
+	return "." + version + ".md5"
+}
+
+// gzipReadCloser closes both the gzip reader and the underlying file
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// zstdReadCloser closes both the zstd decoder and the underlying file
+type zstdReadCloser struct {
+	*zstd.Decoder
+	file io.Closer
+}
+
+func (r *zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.file.Close()
+}
+
+// openVersion opens a version of a file, decompressing it if it is stored compressed
+func (d *Datastore) openVersion(name string, version string) (io.ReadCloser, error) {
+	return d.openTracked(name, version, func() (io.ReadCloser, error) { return d.decodeVersion(name, version) })
+}
+
+// decodeVersion opens a version of a file like openVersion, without counting the reader
+func (d *Datastore) decodeVersion(name string, version string) (io.ReadCloser, error) {
+	if _, err := d.File(name, version); err != nil {
+		slog.Error("invalid filename?", "name", name, "error", err)
+		return nil, ErrInvalidPath
+	}
+	fp, err := d.blobs().GetVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+	switch versionEncoding(version) {
+	case "gzip":
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			slog.Error("broken gzip", "name", name, "version", version, "error", err)
+			fp.Close()
+			return nil, err
+		}
+		return &gzipReadCloser{Reader: gz, file: fp}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(fp, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			slog.Error("broken zstd", "name", name, "version", version, "error", err)
+			fp.Close()
+			return nil, err
+		}
+		return &zstdReadCloser{Decoder: zr, file: fp}, nil
+	}
+	return fp, nil
+}
+
+// compressWriter returns a writer compressing into w with the algorithm at the level (default if 0)
+func compressWriter(w io.Writer, algo string, level int) (io.WriteCloser, error) {
+	if algo == "zstd" {
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// compressPipe returns the input compressed; closing it stops the compression
+func compressPipe(input io.Reader, algo string, level int) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		cw, err := compressWriter(pw, algo, level)
+		if err == nil {
+			if _, err = io.Copy(cw, input); err == nil {
+				err = cw.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// writeHash records the md5 of the uncompressed contents of a version
+func (d *Datastore) writeHash(name string, version string, sum []byte) error {
+	path, err := d.File(name, hashSidecar(version))
+	if err != nil {
+		return ErrInvalidPath
+	}
+	return afero.WriteFile(d.RootDir, path, []byte(hex.EncodeToString(sum)), 0o644)
+}
+
+// readHash returns the recorded md5 of the uncompressed contents of a version, or nil
+func (d *Datastore) readHash(name string, version string) []byte {
+	path, err := d.File(name, hashSidecar(version))
+	if err != nil {
+		return nil
+	}
+	content, err := afero.ReadFile(d.RootDir, path)
+	if err != nil {
+		return nil
+	}
+	sum, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(sum) != 16 {
+		return nil
+	}
+	return sum
+}
+
+// RawVersion is a version as stored, without decompression
+type RawVersion struct {
+	io.ReadCloser
+	// Encoding is the content encoding ("gzip"), or empty if stored as is
+	Encoding string
+	// MD5 is the md5 of the uncompressed contents, if known
+	MD5 []byte
+}
+
+// ReadRaw opens a version (current if history is empty) as stored
+func (d *Datastore) ReadRaw(name string, history string) (RawVersion, error) {
+	res := RawVersion{}
+	d.recoverIfNeeded(name)
+	switch history {
+	case "":
+		history = d.currentTarget(name)
+	case backupLink:
+		history = d.backupTarget(name)
+	}
+	if history == "" {
+		return res, ErrNotFound
+	}
+	if err := checkVersion(history); err != nil {
+		return res, err
+	}
+	if _, err := d.File(name, history); err != nil {
+		slog.Error("invalid filename?", "name", name, "error", err)
+		return res, ErrInvalidPath
+	}
+	fp, err := d.openTracked(name, history, func() (io.ReadCloser, error) { return d.blobs().GetVersion(name, history) })
+	if err != nil {
+		slog.Error("open file", "error", err, "name", name, "history", history)
+		return res, err
+	}
+	res.ReadCloser = fp
+	res.Encoding = versionEncoding(history)
+	res.MD5 = d.readHash(name, history)
+	return res, nil
+}
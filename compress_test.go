@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompress(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "a", strings.NewReader("plain"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	ds.Compress = true
+	content := strings.Repeat(`{"key": "value"}`, 100)
+	sum := md5.Sum([]byte(content))
+	if err := ds.Write(t.Context(), "a", strings.NewReader(content), sum[:], ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	hist := ds.History(t.Context(), "a")
+	if len(hist) != 2 || !strings.HasSuffix(hist[0].Name, gzipSuffix) {
+		t.Fatalf("expected compressed version, got %+v", hist)
+	}
+	if hist[0].Size >= int64(len(content)) {
+		t.Errorf("expected compressed size, got %d", hist[0].Size)
+	}
+	// mixed history: both versions read back as written
+	if got, _ := readString(t, ds, "a"); got != content {
+		t.Errorf("unexpected current: %q", got)
+	}
+	rd, err := ds.ReadHistory("a", hist[1].Name)
+	if err != nil {
+		t.Fatalf("ReadHistory failed: %v", err)
+	}
+	if b, _ := io.ReadAll(rd); string(b) != "plain" {
+		t.Errorf("unexpected old version: %q", b)
+	}
+	rd.Close()
+
+	raw, err := ds.ReadRaw("a", "")
+	if err != nil {
+		t.Fatalf("ReadRaw failed: %v", err)
+	}
+	if raw.Encoding != "gzip" || !bytes.Equal(raw.MD5, sum[:]) {
+		t.Errorf("unexpected raw version: %q %x", raw.Encoding, raw.MD5)
+	}
+	gz, err := gzip.NewReader(raw)
+	if err != nil {
+		t.Fatalf("raw version is not gzip: %v", err)
+	}
+	if b, _ := io.ReadAll(gz); string(b) != content {
+		t.Errorf("unexpected raw contents")
+	}
+	// an open version is removed when closed
+	raw.Close()
+
+	if err := ds.Rollback("a", hist[1].Name); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if err := ds.Prune(t.Context(), "a", 0, false); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "a", hashSidecar(hist[0].Name))); !os.IsNotExist(err) {
+		t.Errorf("hash sidecar not removed with its version: %v", err)
+	}
+}
+
+func TestAPIGet_Gzip(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ds.Compress = true
+	content := strings.Repeat(`{"key": "value"}`, 100)
+	sum := md5.Sum([]byte(content))
+	if err := ds.Write(t.Context(), "a", strings.NewReader(content), sum[:], ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	h := &APIHandler{ds: &ds}
+	tests := []struct {
+		name     string
+		accept   string
+		encoding string
+	}{
+		{"gzip", "gzip, deflate", "gzip"},
+		{"gzip refused", "gzip;q=0, identity", ""},
+		{"no accept-encoding", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/a", nil)
+			if test.accept != "" {
+				req.Header.Set("Accept-Encoding", test.accept)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", rr.Code)
+			}
+			if got := rr.Header().Get("Content-Encoding"); got != test.encoding {
+				t.Errorf("expected encoding %q, got %q", test.encoding, got)
+			}
+			// Content-Md5 is always of the decoded contents
+			if got := rr.Header().Get("Content-Md5"); got != base64.StdEncoding.EncodeToString(sum[:]) {
+				t.Errorf("unexpected Content-Md5: %s", got)
+			}
+			body := rr.Body.Bytes()
+			if test.encoding == "gzip" {
+				gz, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("body is not gzip: %v", err)
+				}
+				body, _ = io.ReadAll(gz)
+			}
+			if string(body) != content {
+				t.Errorf("unexpected body: %q", body)
+			}
+		})
+	}
+}
+
+func TestAPIGet_GzipUncompressedStore(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(t.Context(), "a", strings.NewReader("plain"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	h := &APIHandler{ds: &ds}
+	req := httptest.NewRequest(http.MethodGet, "/a", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != "plain" {
+		t.Errorf("expected plain response, got %d %q %q", rr.Code, rr.Header().Get("Content-Encoding"), rr.Body.String())
+	}
+}
+
+func TestCompress_Algo(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	contents := []string{"plain", strings.Repeat(`{"gzip": 1}`, 100), strings.Repeat(`{"zstd": 2}`, 100)}
+	for i, algo := range []string{"", "gzip", "zstd"} {
+		ds.Compress = algo != ""
+		ds.CompressAlgo = algo
+		ds.CompressLevel = 3
+		sum := md5.Sum([]byte(contents[i]))
+		if err := ds.Write(t.Context(), "a", strings.NewReader(contents[i]), sum[:], ""); err != nil {
+			t.Fatalf("Write(%s) failed: %v", algo, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hist := ds.History(t.Context(), "a")
+	if len(hist) != 3 || !strings.HasSuffix(hist[0].Name, zstdSuffix) || !strings.HasSuffix(hist[1].Name, gzipSuffix) {
+		t.Fatalf("unexpected versions: %+v", hist)
+	}
+	// mixed history: each version is read with its own algorithm
+	for i, e := range hist {
+		rd, err := ds.ReadHistory("a", e.Name)
+		if err != nil {
+			t.Fatalf("ReadHistory(%s) failed: %v", e.Name, err)
+		}
+		b, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil || string(b) != contents[2-i] {
+			t.Errorf("unexpected contents of %s: %q %v", e.Name, b, err)
+		}
+	}
+	raw, err := ds.ReadRaw("a", "")
+	if err != nil {
+		t.Fatalf("ReadRaw failed: %v", err)
+	}
+	raw.Close()
+	if raw.Encoding != "zstd" {
+		t.Errorf("unexpected encoding: %q", raw.Encoding)
+	}
+
+	// zstd is not passed to clients accepting gzip
+	req := httptest.NewRequest(http.MethodGet, "/a", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	(&APIHandler{ds: &ds}).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != contents[2] {
+		t.Errorf("unexpected response: %d %q", rr.Code, rr.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestCompress_CLI(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	// written by a server storing compressed versions, read by commands without --compress
+	ds := NewDatastore(tmp)
+	h := &APIHandler{ds: &ds}
+	contents := []string{`{"serial":1,"outputs":{"ip":{"value":"10.0.0.1"}}}`, `{"serial":2,"outputs":{"ip":{"value":"10.0.0.2"}}}`}
+	for i, algo := range []string{"gzip", "zstd"} {
+		ds.Compress = true
+		ds.CompressAlgo = algo
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/app", strings.NewReader(contents[i])))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("POST with %s failed: %d", algo, rr.Code)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hist := ds.History(t.Context(), "app")
+	if len(hist) != 2 || versionEncoding(hist[0].Name) != "zstd" || versionEncoding(hist[1].Name) != "gzip" {
+		t.Fatalf("unexpected versions: %+v", hist)
+	}
+
+	if out, err := captureStdout(func() error { return (&Cat{}).Execute([]string{"app"}) }); err != nil || out != contents[1] {
+		t.Errorf("cat: %q %v", out, err)
+	}
+	if out, err := captureStdout(func() error { return (&Cat{Select: ".outputs.ip.value"}).Execute([]string{"app"}) }); err != nil || strings.TrimSpace(out) != `"10.0.0.2"` {
+		t.Errorf("cat --select: %q %v", out, err)
+	}
+	if out, err := captureStdout(func() error { return (&HistoryCat{File: "app"}).Execute([]string{hist[1].Name}) }); err != nil || out != contents[0] {
+		t.Errorf("hcat: %q %v", out, err)
+	}
+	if out, err := captureStdout(func() error { return (&History{}).Execute([]string{"app"}) }); err != nil || !strings.Contains(out, hist[1].Name) {
+		t.Errorf("history: %q %v", out, err)
+	}
+	if err := (&HistoryRollback{File: "app", History: hist[1].Name}).Execute(nil); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/app", nil))
+	if rr.Body.String() != contents[0] {
+		t.Errorf("server does not serve the version rolled back to: %q", rr.Body.String())
+	}
+}
+
+func TestCheckCompression(t *testing.T) {
+	tests := []struct {
+		algo  string
+		level int
+		valid bool
+	}{
+		{"gzip", 0, true},
+		{"gzip", 9, true},
+		{"gzip", 10, false},
+		{"zstd", 0, true},
+		{"zstd", 19, true},
+		{"zstd", 23, false},
+		{"lz4", 0, false},
+	}
+	for _, test := range tests {
+		if err := checkCompression(test.algo, test.level); (err == nil) != test.valid {
+			t.Errorf("checkCompression(%s, %d): %v", test.algo, test.level, err)
+		}
+	}
+}
+
+// sampleState makes a terraform state with n resources
+func sampleState(n int) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"version":4,"terraform_version":"1.9.0","serial":42,"lineage":"3f2a","outputs":{},"resources":[`)
+	for i := 0; i < n; i++ {
+		if i != 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(buf, `{"mode":"managed","type":"aws_instance","name":"web%d","provider":"provider[\"registry.terraform.io/hashicorp/aws\"]","instances":[{"schema_version":1,"attributes":{"id":"i-%08x","ami":"ami-0c55b159cbfafe1f0","instance_type":"t3.micro","private_ip":"10.0.%d.%d","tags":{"Name":"web-%d","env":"prod"}}}]}`, i, i*7919, i/256, i%256, i)
+	}
+	buf.WriteString(`]}`)
+	return buf.Bytes()
+}
+
+func BenchmarkCompress(b *testing.B) {
+	state := sampleState(2000)
+	for _, bench := range []struct {
+		algo  string
+		level int
+	}{
+		{"gzip", 1}, {"gzip", 0}, {"gzip", 9},
+		{"zstd", 1}, {"zstd", 0}, {"zstd", 19},
+	} {
+		b.Run(fmt.Sprintf("%s-%d", bench.algo, bench.level), func(b *testing.B) {
+			b.SetBytes(int64(len(state)))
+			size := 0
+			for b.Loop() {
+				buf := &bytes.Buffer{}
+				cw, err := compressWriter(buf, bench.algo, bench.level)
+				if err != nil {
+					b.Fatal(err)
+				}
+				cw.Write(state)
+				cw.Close()
+				size = buf.Len()
+			}
+			b.ReportMetric(float64(size)/float64(len(state)), "ratio")
+		})
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	state := sampleState(2000)
+	for _, algo := range []string{"gzip", "zstd"} {
+		b.Run(algo, func(b *testing.B) {
+			ds := NewMemDatastore()
+			ds.Compress = true
+			ds.CompressAlgo = algo
+			if err := ds.Write(b.Context(), "a", bytes.NewReader(state), nil, ""); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(state)))
+			for b.Loop() {
+				if err := ds.Read(b.Context(), "a", io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -10,9 +13,13 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/spf13/afero"
@@ -20,14 +27,27 @@ import (
 
 // DsIf is the interface for datastore operations
 type DsIf interface {
-	Read(name string, out io.Writer) error
+	Read(ctx context.Context, name string, out io.Writer) error
 	Delete(name string) error
-	Write(name string, input io.Reader, hash []byte, lockid string) error
+	Write(ctx context.Context, name string, input io.Reader, hash []byte, lockid string) error
+	Replace(ctx context.Context, name string, input io.Reader, hash []byte, lockid string) error
 	Lock(name string, lockinfo string) error
 	Unlock(name string, lockinfo string) error
-	Walk(prefix string, fn func(e FileEntry) error) error
-	History(path string) []FileEntry
+	Walk(ctx context.Context, prefix string, fn func(e FileEntry) error) error
+	WalkSkipped(ctx context.Context, prefix string, fn func(e FileEntry) error) ([]WalkFailure, error)
+	History(ctx context.Context, path string) []FileEntry
 	ReadHistory(name string, history string) (io.ReadCloser, error)
+	Locks(prefix string) ([]LockEntry, error)
+	Rollback(name string, history string) error
+	RollbackIf(name string, history string, current string) error
+	CurrentVersion(name string) string
+	Prune(ctx context.Context, name string, keep int, dry bool) error
+	Protected(name string) bool
+	Held(name string) bool
+	LockRead(name string) (string, error)
+	ReadRaw(name string, history string) (RawVersion, error)
+	ContentType(name string) string
+	SetContentType(name string, ctype string) error
 }
 
 // Datastore implements DsIf using the afero.BasePathFs
@@ -35,6 +55,58 @@ type Datastore struct {
 	DsIf
 	RootDir  *afero.BasePathFs
 	RootName string
+	Skip     []string
+	Fsync    bool
+	// Compress stores new versions compressed with CompressAlgo (gzip if empty) at CompressLevel (default if 0)
+	Compress      bool
+	CompressAlgo  string
+	CompressLevel int
+	// StrictLock disables idempotent re-lock and unlock by the same lock ID
+	StrictLock bool
+	// Backup keeps a backup link to the previous version on each change
+	Backup bool
+	// RequireLock refuses writes to a locked file without the lock ID
+	RequireLock bool
+	// Shard stores files under directories derived from the hash of their name
+	Shard bool
+	// NoAutocreate refuses new files in namespaces which were not created with Mkns
+	NoAutocreate bool
+	// MaxSize limits the size of versions of files without a max-size tag, 0 for no limit
+	MaxSize int64
+	// MinFreeBytes refuses writes while the data directory has less free space, 0 for no check
+	MinFreeBytes int64
+	// NormalizeJSON stores JSON in a canonical form and skips writes equal to the current version
+	NormalizeJSON bool
+	// NormalizeNewline ends JSON with exactly one newline and skips writes equal to the current version
+	NormalizeNewline bool
+	// FailBusy returns ErrBusy instead of waiting when another write, rollback or delete of the file is in progress, also for lock, protect and hold
+	FailBusy bool
+	// UploadExpire is the age of the abandoned uploads which Maintain removes, defaultUploadExpire if 0
+	UploadExpire time.Duration
+	// StrictWalk fails walks on entries which cannot be read instead of skipping them
+	StrictWalk bool
+	// legacyNames skips the name rules to reach files created before them
+	legacyNames bool
+	// Blobs stores the versions, current and locks, in the data directory if nil
+	Blobs BlobStore
+	// refs counts the readers of versions, so that prune removes a version after they close it
+	refs      *versionRefs
+	failpoint func(op string, step string) error
+	walkHook  func(path string)
+	// diskFree returns the free space of the data directory, from the filesystem if nil
+	diskFree func(path string) (uint64, error)
+}
+
+// DefaultSkip is the default list of directory name patterns which Walk does not descend into
+var DefaultSkip = []string{".*", "lost+found"}
+
+// reservedNames are files in a state directory which are not versions
+var reservedNames = map[string]bool{
+	"current":     true,
+	"lock":        true,
+	"journal":     true,
+	"journal.tmp": true,
+	backupLink:    true,
 }
 
 // NewDatastore creates a new Datastore rooted at the given directory
@@ -43,7 +115,33 @@ func NewDatastore(root string) Datastore {
 	return Datastore{
 		RootDir:  bpfs.(*afero.BasePathFs),
 		RootName: root,
+		Skip:     DefaultSkip,
+		refs:     newVersionRefs(),
+	}
+}
+
+// skipDir checks whether the walk should not descend into the directory
+func (d *Datastore) skipDir(path string, info fs.FileInfo) bool {
+	if d.walkHook != nil {
+		d.walkHook(path)
+	}
+	if info == nil || !info.IsDir() || path == "/" || path == "." {
+		return false
+	}
+	lpath, _ := d.layoutPath(path)
+	for _, pattern := range d.Skip {
+		// patterns with a slash match the path from the root, others match the name
+		target := info.Name()
+		if strings.Contains(pattern, "/") {
+			target = "/" + strings.TrimPrefix(filepath.ToSlash(lpath), "/")
+			pattern = "/" + strings.TrimPrefix(pattern, "/")
+		}
+		if matched, _ := filepath.Match(pattern, target); matched {
+			slog.Debug("skip directory", "path", path, "pattern", pattern)
+			return true
+		}
 	}
+	return false
 }
 
 // ParseJSON parses a JSON string into a map
@@ -56,10 +154,58 @@ func (d *Datastore) ParseJSON(data string) map[string]interface{} {
 	return res
 }
 
+// FormatJSON reformats JSON data, keeping numbers as they are
+//
+// without sortKeys the order of the keys is preserved.
+func FormatJSON(data []byte, indent bool, sortKeys bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if !sortKeys {
+		var err error
+		if indent {
+			err = json.Indent(buf, data, "", "  ")
+		} else {
+			err = json.Compact(buf, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	}
+	var parsed interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(parsed); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // File constructs a file path within the datastore
 func (d *Datastore) File(name ...string) (string, error) {
 	slog.Debug("find file", "name", name)
+	if len(name) != 0 && !d.legacyNames {
+		if err := checkName(name[0]); err != nil {
+			return "", err
+		}
+	}
+	for _, part := range name[min(len(name), 1):] {
+		if err := checkPart(part); err != nil {
+			return "", err
+		}
+	}
 	path := filepath.Join(name...)
+	if d.Shard && len(name) != 0 {
+		path = filepath.Join(shardDir(name[0]), path)
+	}
 	ret, err := d.RootDir.RealPath(path)
 	if err != nil {
 		return ret, err
@@ -73,140 +219,448 @@ func (d *Datastore) Tempstr(name string) string {
 	return strconv.FormatInt(time.Now().UnixNano(), 32)
 }
 
-// set_current sets the 'current' symlink to point to the target file
+// set_current points 'current' to the target version
 func (d *Datastore) set_current(name string, target string) error {
-	if linkto, err := d.File(name, "current"); err != nil {
-		slog.Error("invalid filename?", "name", name, "error", err)
-		return ErrInvalidPath
-	} else {
-		slog.Debug("check exists", "linkto", linkto)
-		if _, err := d.RootDir.Stat(linkto); err == nil {
-			slog.Debug("removing old", "linkto", linkto)
-			if err := d.RootDir.Remove(linkto); err != nil {
-				slog.Error("remove current", "name", linkto, "erroo", err)
-				return err
-			}
-		}
-		slog.Debug("creating symlink", "newname", target, "linkto", linkto)
-		// d.RootDir.SymlinkIfPossible(newname, linkto)
-		if realto, err := d.RootDir.RealPath(linkto); err != nil {
-			slog.Error("realto", "error", err, "linkto", linkto)
-			return err
-		} else {
-			if err = os.Symlink(target, realto); err != nil {
-				slog.Error("symlink", "error", err, "newname", target, "realto", realto)
-				return err
-			}
-		}
-	}
-	return nil
+	return d.blobs().SetCurrent(name, target)
 }
 
 // Write writes data to a file in the datastore
-func (d *Datastore) Write(name string, input io.Reader, hash []byte, lockid string) error {
-	slog.Debug("write", "name", name, "hash", fmt.Sprintf("%x", hash), "lockid", lockid)
-	newname, err := d.File(name, d.Tempstr(name))
-	if err != nil {
+func (d *Datastore) Write(ctx context.Context, name string, input io.Reader, hash []byte, lockid string) error {
+	return d.write(ctx, name, input, hash, lockid, true)
+}
+
+// Replace writes data like Write, but replaces the current version instead of adding to the history
+func (d *Datastore) Replace(ctx context.Context, name string, input io.Reader, hash []byte, lockid string) error {
+	return d.write(ctx, name, input, hash, lockid, false)
+}
+
+func (d *Datastore) write(ctx context.Context, name string, input io.Reader, hash []byte, lockid string, retain bool) error {
+	defer trackOp(ctx, "write")()
+	slog.Debug("write", "name", name, "hash", fmt.Sprintf("%x", hash), "lockid", lockid, "retain", retain)
+	version := d.Tempstr(name)
+	if d.Compress {
+		version += compressSuffix(d.CompressAlgo)
+	}
+	if _, err := d.File(name, version); err != nil {
 		slog.Error("invalid filename?", "name", name, "error", err)
 		return ErrInvalidPath
 	}
-	if lockid != "" {
+	// the checks and the swap of current are done under the guard, which protect, hold and lock also take
+	release, err := d.guard(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := d.checkProtected(name); err != nil {
+		return err
+	}
+	if err := d.checkNamespace(name); err != nil {
+		return err
+	}
+	if err := d.checkPathConflict(name); err != nil {
+		return err
+	}
+	if err := d.checkSpace(); err != nil {
+		return err
+	}
+	if lockid != "" || d.RequireLock {
 		if d.LockCheck(name, lockid) != nil {
+			slog.Warn("write without the lock", "name", name, "lockid", lockid)
 			return ErrLocked
 		}
 	}
-	parent := filepath.Dir(newname)
-	if err := d.RootDir.MkdirAll(parent, 0o755); err != nil {
-		slog.Error("mkdir", "name", name, "error", err)
+	d.recoverGuarded(name)
+	input = d.limitInput(name, input)
+	if d.NormalizeJSON || d.NormalizeNewline {
+		data, err := d.normalizeInput(ctx, name, input, hash)
+		if err != nil || data == nil {
+			return err
+		}
+		input, hash = bytes.NewReader(data), nil
+	}
+	ent := journalEntry{
+		Op:       journalWrite,
+		Version:  version,
+		Previous: d.currentTarget(name),
+		Stage:    stageData,
+	}
+	if err := d.journalBegin(name, ent); err != nil {
+		return noSpace(err)
+	}
+	if err := d.step(journalWrite, "journal"); err != nil {
 		return err
 	}
-	var input2 io.Reader
+	var input2 io.Reader = ctxReader{ctx, input}
 	hashfp := md5.New()
-	if len(hash) != 0 {
-		input2 = io.TeeReader(input, hashfp)
-	} else {
-		input2 = input
+	if len(hash) != 0 || d.Compress {
+		input2 = io.TeeReader(input2, hashfp)
+	}
+	head := &headBuffer{max: stateHeadSize}
+	input2 = io.TeeReader(input2, head)
+	if d.Compress {
+		cr := compressPipe(input2, d.CompressAlgo, d.CompressLevel)
+		defer cr.Close()
+		input2 = cr
 	}
-	if err := afero.WriteReader(d.RootDir, newname, input2); err != nil {
-		slog.Error("write", "error", err, "name", newname)
+	if err := d.blobs().PutVersion(name, version, input2); err != nil {
+		slog.Error("write", "error", err, "name", name, "version", version)
+		if err := d.blobs().RemoveVersion(name, version); err != nil {
+			slog.Error("cannot unlink partial file", "name", name, "version", version, "error", err)
+		}
+		d.journalEnd(name)
+		return noSpace(err)
+	}
+	if err := d.step(journalWrite, "data"); err != nil {
+		return err
 	}
 	if len(hash) != 0 {
 		hashb := hashfp.Sum(nil)
 		if len(hash) != 0 && !reflect.DeepEqual(hash, hashb) {
 			slog.Error("hash mismatch", "name", name)
-			if err := d.RootDir.Remove(newname); err != nil {
-				slog.Error("cannot unlink invalid file", "name", newname, "error", err)
+			if err := d.blobs().RemoveVersion(name, version); err != nil {
+				slog.Error("cannot unlink invalid file", "name", name, "version", version, "error", err)
 			}
+			d.journalEnd(name)
 			return ErrInvalidHash
 		}
 	}
-	return d.set_current(name, filepath.Base(newname))
+	if d.Compress {
+		// serving the compressed version as is needs the hash of the contents
+		if err := d.writeHash(name, version, hashfp.Sum(nil)); err != nil {
+			slog.Error("write hash", "name", name, "error", err)
+		}
+	}
+	if err := d.writeStateHeader(name, version, head.Bytes()); err != nil {
+		slog.Error("write state header", "name", name, "error", err)
+	}
+	ent.Stage = stagePointer
+	if err := d.journalAppend(name, ent); err != nil {
+		return d.abortFull(name, ent, err)
+	}
+	if err := d.step(journalWrite, "pointer"); err != nil {
+		return err
+	}
+	if err := d.set_current(name, version); err != nil {
+		return d.abortFull(name, ent, err)
+	}
+	if retain {
+		d.updateBackup(name, ent.Previous)
+	}
+	if dir, err := d.File(name); err == nil {
+		if err := d.syncDir(dir); err != nil {
+			return err
+		}
+	}
+	if err := d.step(journalWrite, "link"); err != nil {
+		return err
+	}
+	if err := d.journalEnd(name); err != nil {
+		return err
+	}
+	if !retain {
+		d.removeVersion(name, ent.Previous)
+	}
+	return nil
+}
+
+// abortFull rolls back a write which failed on a full disk after its version was stored: the version and its
+// sidecars are removed and current points to the previous version again
+//
+// other errors are returned as they are, leaving the write to the recovery like a crash.
+func (d *Datastore) abortFull(name string, ent journalEntry, err error) error {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	slog.Warn("rolling back the write on a full disk", "name", name, "version", ent.Version, "previous", ent.Previous)
+	if err := d.unlinkVersion(name, ent.Version); err != nil {
+		slog.Error("cannot remove the version of the failed write", "name", name, "version", ent.Version, "error", err)
+	}
+	if err := d.restoreCurrent(name, ent.Previous); err != nil {
+		slog.Error("cannot restore current, recovered on the next access", "name", name, "previous", ent.Previous, "error", err)
+	} else {
+		d.journalEnd(name)
+	}
+	return noSpace(err)
+}
+
+// removeVersion removes a replaced version and its sidecar unless the backup link points to it
+// or the file is under a retention hold
+func (d *Datastore) removeVersion(name string, version string) {
+	if version == "" || version == d.backupTarget(name) || d.Held(name) {
+		return
+	}
+	slog.Debug("removing replaced version", "name", name, "history", version)
+	if err := d.unlinkVersion(name, version); err != nil {
+		slog.Warn("cannot remove replaced version", "name", name, "history", version, "error", err)
+	}
+}
+
+// writeFile writes the version file, flushing it and its directory to disk if Fsync is set
+func (d *Datastore) writeFile(path string, input io.Reader) error {
+	if err := d.RootDir.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	fp, err := d.RootDir.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fp, input); err != nil {
+		fp.Close()
+		return err
+	}
+	if d.Fsync {
+		if err := fp.Sync(); err != nil {
+			slog.Error("fsync", "name", path, "error", err)
+			fp.Close()
+			return err
+		}
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return d.syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory entries to disk if Fsync is set
+func (d *Datastore) syncDir(path string) error {
+	if !d.Fsync {
+		return nil
+	}
+	dir, err := d.RootDir.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		if runtime.GOOS == "windows" {
+			// directories cannot be flushed on windows
+			return nil
+		}
+		slog.Error("fsync directory", "name", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// ctxReader stops reading once the context is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
 }
 
 // Read reads data from a file in the datastore
-func (d *Datastore) Read(name string, out io.Writer) error {
+//
+// an error while copying is returned, so that the part already written to out is not taken as the contents.
+func (d *Datastore) Read(ctx context.Context, name string, out io.Writer) error {
+	defer trackOp(ctx, "read")()
 	slog.Debug("read", "name", name)
-	path, err := d.File(name, "current")
-	if err != nil {
+	d.recoverIfNeeded(name)
+	if _, err := d.File(name, "current"); err != nil {
 		slog.Error("invalid filename?", "name", name, "error", err)
 		return ErrInvalidPath
 	}
-	if fp, err := d.RootDir.Open(path); err != nil {
-		slog.Error("open file", "error", err, "name", name)
+	version := d.currentTarget(name)
+	if version == "" {
+		slog.Error("no current", "name", name)
 		return ErrNotFound
+	}
+	if fp, err := d.openVersion(name, version); err != nil {
+		slog.Error("open file", "error", err, "name", name)
+		return err
 	} else {
 		defer fp.Close()
-		written, err := io.Copy(out, fp)
+		written, err := io.Copy(out, ctxReader{ctx, fp})
+		if ctx.Err() != nil {
+			slog.Warn("client gone", "written", written, "name", name, "error", ctx.Err())
+			return ctx.Err()
+		}
 		if err != nil {
-			slog.Error("partial read", "written", written, "name", name)
+			partialReads.Add(1)
+			slog.Error("partial read", "name", name, "version", version, "written", written, "expected", d.versionSize(name, version), "error", err, "partial-reads", partialReads.Load())
+			return err
 		}
 	}
 	return nil
 }
 
+// partialReads counts the reads which failed after a part of the contents was copied, since start
+var partialReads atomic.Int64
+
 // Delete removes a file from the datastore
+//
+// deleting a file which does not exist succeeds.
 func (d *Datastore) Delete(name string) error {
 	slog.Debug("delete", "name", name)
-	path, err := d.File(name, "current")
-	if err != nil {
+	if _, err := d.File(name, "current"); err != nil {
 		slog.Error("invalid filename?", "name", name, "error", err)
 		return ErrInvalidPath
 	}
-	if err = d.RootDir.Remove(path); err != nil {
+	release, err := d.guard(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := d.checkProtected(name); err != nil {
+		return err
+	}
+	if err := d.checkHeld(name); err != nil {
+		return err
+	}
+	d.recoverGuarded(name)
+	previous := d.currentTarget(name)
+	if previous == "" {
+		// terraform retries DELETE, deleting a file which is already gone succeeds
+		slog.Info("already deleted", "name", name)
+		return nil
+	}
+	if err := d.journalBegin(name, journalEntry{Op: journalDelete, Previous: previous}); err != nil {
+		return err
+	}
+	if err := d.step(journalDelete, "journal"); err != nil {
+		return err
+	}
+	if err := d.blobs().RemoveCurrent(name); err == ErrNotFound {
+		slog.Info("already deleted", "name", name)
+		return d.journalEnd(name)
+	} else if err != nil {
 		slog.Error("unlink error", "name", name, "error", err)
+		d.journalEnd(name)
 		return err
 	}
-	return nil
+	d.updateBackup(name, previous)
+	if err := d.step(journalDelete, "unlink"); err != nil {
+		return err
+	}
+	return d.journalEnd(name)
+}
+
+// lockID extracts the ID from the lock info
+func lockID(lockinfo string) string {
+	info := struct{ ID string }{}
+	if err := json.Unmarshal([]byte(lockinfo), &info); err != nil {
+		return ""
+	}
+	return info.ID
+}
+
+// relock reports whether the existing lock is held by the same ID, so that a retried lock succeeds
+func (d *Datastore) relock(name string, lockinfo string) bool {
+	if d.StrictLock {
+		return false
+	}
+	id := lockID(lockinfo)
+	if id == "" {
+		return false
+	}
+	holder, err := d.LockRead(name)
+	if err != nil {
+		return false
+	}
+	return lockID(holder) == id
 }
 
 // Lock locks a file in the datastore
+//
+// locking again with the ID which already holds the lock succeeds unless StrictLock is set.
 func (d *Datastore) Lock(name string, lockinfo string) error {
 	slog.Debug("lock", "name", name, "lockinfo", lockinfo)
-	path, err := d.File(name, "lock")
-	if err != nil {
+	if _, err := d.File(name, "lock"); err != nil {
 		slog.Error("invalid filename?", "name", name, "error", err)
 		return err
 	}
-	if fi, err := d.RootDir.Stat(path); err == nil {
-		slog.Warn("lock exists", "name", name, "error", err, "fi", fi)
+	// not in the middle of a write which checked the lock
+	release, err := d.guard(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if _, _, err := d.blobs().ReadLock(name); err == nil {
+		if d.relock(name, lockinfo) {
+			slog.Info("already locked by the same id", "name", name)
+			return nil
+		}
+		slog.Warn("lock exists", "name", name)
 		return ErrLocked
 	}
-	if err := d.RootDir.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		slog.Error("mkdir failed", "path", path, "error", err)
+	if err := d.checkNamespace(name); err != nil {
+		return err
+	}
+	// another client may have taken the lock since it was read
+	if err := d.blobs().CreateLock(name, []byte(lockinfo)); err == ErrLocked {
+		if d.relock(name, lockinfo) {
+			slog.Info("already locked by the same id", "name", name)
+			return nil
+		}
+		slog.Warn("lock exists", "name", name)
+		return ErrLocked
+	} else if err != nil {
+		slog.Error("create lock", "name", name, "error", err)
 		return err
 	}
-	return afero.WriteFile(d.RootDir, path, []byte(lockinfo), 0o644)
+	return nil
+}
+
+// LockBatch locks all the files or none of them
+//
+// the files are locked once each in sorted order; on conflict the locks the batch has taken are released,
+// those the same ID already held before are kept.
+// the name which could not be locked is returned with the error.
+func LockBatch(ds DsIf, names []string, lockinfo string) (string, error) {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	sorted = slices.Compact(sorted)
+	acquired := []string{}
+	for _, name := range sorted {
+		held := false
+		if holder, err := ds.LockRead(name); err == nil && lockID(lockinfo) != "" {
+			held = lockID(holder) == lockID(lockinfo)
+		}
+		if err := ds.Lock(name, lockinfo); err != nil {
+			slog.Warn("batch lock failed, releasing", "name", name, "error", err, "acquired", acquired)
+			for _, name := range acquired {
+				if err := ds.Unlock(name, lockinfo); err != nil {
+					slog.Error("cannot release lock", "name", name, "error", err)
+				}
+			}
+			return name, err
+		}
+		if !held {
+			acquired = append(acquired, name)
+		}
+	}
+	return "", nil
+}
+
+// UnlockBatch unlocks all the files, returning the first name which could not be unlocked
+func UnlockBatch(ds DsIf, names []string, lockinfo string) (string, error) {
+	failed := ""
+	var res error
+	for _, name := range names {
+		if err := ds.Unlock(name, lockinfo); err != nil {
+			slog.Warn("batch unlock failed", "name", name, "error", err)
+			if res == nil {
+				failed, res = name, err
+			}
+		}
+	}
+	return failed, res
 }
 
 // LockRead reads the lock information for a file
 func (d *Datastore) LockRead(name string) (string, error) {
 	slog.Debug("lock-read", "name", name)
-	path, err := d.File(name, "lock")
-	if err != nil {
+	if _, err := d.File(name, "lock"); err != nil {
 		slog.Error("invalid filename?", "name", name, "error", err)
 		return "", err
 	}
-	content, err := afero.ReadFile(d.RootDir, path)
+	content, _, err := d.blobs().ReadLock(name)
 	if err != nil {
 		slog.Info("cannot read lock", "name", name)
 		return "", ErrUnlocked
@@ -228,122 +682,249 @@ func (d *Datastore) LockCheck(name string, lockid string) error {
 }
 
 // Unlock unlocks a file in the datastore
+//
+// unlocking a file which is not locked succeeds if lock info with an ID is given, unless StrictLock is set.
 func (d *Datastore) Unlock(name string, lockinfo string) error {
 	slog.Debug("unlock", "name", name, "lockinfo", lockinfo)
-	path, err := d.File(name, "lock")
-	if err != nil {
+	if _, err := d.File(name, "lock"); err != nil {
 		slog.Error("invalid filename?", "name", name, "error", err)
 		return err
 	}
 	match_data := d.ParseJSON(lockinfo)
 	if match_data != nil {
-		content, err := afero.ReadFile(d.RootDir, path)
+		content, _, err := d.blobs().ReadLock(name)
 		if err != nil {
+			if !d.StrictLock && err == ErrUnlocked && lockID(lockinfo) != "" {
+				slog.Info("already unlocked", "name", name)
+				return nil
+			}
 			slog.Error("cannot read lock", "name", name)
 			return ErrUnlocked
 		}
-		prev_data := d.ParseJSON(string(content))
-		if match_data["ID"].(string) != prev_data["ID"].(string) {
+		if lockID(lockinfo) != lockID(string(content)) {
 			return ErrLocked
 		}
 	}
-	if err = d.RootDir.Remove(path); err != nil {
+	if err := d.blobs().RemoveLock(name); err != nil {
 		slog.Error("cannot remove link", "name", name)
 		return err
 	}
 	return nil
 }
 
+// LockEntry represents a lock held on a file in the datastore
+type LockEntry struct {
+	Path      string        `json:"path"`
+	LockInfo  interface{}   `json:"lockinfo"`
+	Timestamp time.Time     `json:"timestamp"`
+	Age       time.Duration `json:"age"`
+}
+
+// MarshalJSON encodes the lock age in seconds, with the time in the display zone
+func (l LockEntry) MarshalJSON() ([]byte, error) {
+	type alias LockEntry
+	return json.Marshal(struct {
+		alias
+		Age   float64 `json:"age"`
+		Local string  `json:"timestamp_local"`
+	}{alias(l), l.Age.Seconds(), localTime(l.Timestamp)})
+}
+
+// Locks lists the locks held on files under the prefix
+func (d *Datastore) Locks(prefix string) ([]LockEntry, error) {
+	slog.Debug("locks", "prefix", prefix)
+	res := []LockEntry{}
+	now := time.Now()
+	// also the files locked before their first write, which have no current to walk
+	names, err := d.blobs().ListLocks(context.Background(), prefix)
+	for _, name := range names {
+		content, locked, err := d.blobs().ReadLock(name)
+		if err != nil {
+			slog.Warn("lock disappeared", "name", name, "error", err)
+			continue
+		}
+		var info interface{} = string(content)
+		if parsed := d.ParseJSON(string(content)); parsed != nil {
+			info = parsed
+		}
+		res = append(res, LockEntry{
+			Path:      name,
+			LockInfo:  info,
+			Timestamp: locked,
+			Age:       now.Sub(locked),
+		})
+	}
+	return res, err
+}
+
+// StaleLocks filters locks held at least for the given duration
+func StaleLocks(locks []LockEntry, stale time.Duration) []LockEntry {
+	res := []LockEntry{}
+	for _, l := range locks {
+		if l.Age >= stale {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
 // FileEntry represents a file entry in the datastore
 type FileEntry struct {
 	Name      string
 	Locked    bool
 	Timestamp time.Time
 	Size      int64
+	// Terraform is the header of the version if it is a terraform state, left nil by Walk
+	Terraform *TerraformState `json:",omitempty"`
 }
 
 // Walk walks through all files in the datastore and applies the given function
-func (d *Datastore) Walk(prefix string, fn func(e FileEntry) error) error {
-	basedir := filepath.Dir(prefix)
-	slog.Debug("walk", "root", d.RootName, "prefix", prefix, "base", basedir)
-	return afero.Walk(d.RootDir, basedir, func(path string, info fs.FileInfo, err error) error {
-		slog.Debug("walk-cb", "path", path, "info", info, "error", err)
-		if !strings.HasPrefix(path, prefix) {
-			slog.Debug("skip", "path", path, "prefix", prefix)
-			return nil
+//
+// the function returns filepath.SkipDir to skip the files under the file, filepath.SkipAll to stop
+// the walk, or another error to abort the walk with it.
+//
+// directories which cannot be read and files whose current cannot be read are skipped with a warning,
+// or abort the walk with StrictWalk.
+func (d *Datastore) Walk(ctx context.Context, prefix string, fn func(e FileEntry) error) error {
+	_, err := d.WalkSkipped(ctx, prefix, fn)
+	return err
+}
+
+// WalkSkipped walks like Walk and returns the entries which were skipped because they cannot be read
+func (d *Datastore) WalkSkipped(ctx context.Context, prefix string, fn func(e FileEntry) error) ([]WalkFailure, error) {
+	defer trackOp(ctx, "walk")()
+	stopped := false
+	skipped := []WalkFailure{}
+	err := d.walk(ctx, prefix, func(e FileEntry) error {
+		err := fn(e)
+		if err == filepath.SkipAll {
+			stopped = true
 		}
-		if err != nil {
-			slog.Error("walkdir", "error", err, "path", path)
+		return err
+	}, func(name string, err error) error {
+		if d.StrictWalk {
 			return err
 		}
-		if info.Name() == "current" && (info.Mode().Type()&os.ModeSymlink == os.ModeSymlink) {
-			slog.Debug("current", "path", path, "info", info)
-			fi, err := d.RootDir.Stat(path)
-			if err != nil {
-				slog.Warn("current not found", "path", path, "info", info)
-				return err
-			}
-			lockfn := filepath.Join(path, "..", "lock")
-			locked := false
-			slog.Debug("check lock", "path", path, "lockfile", lockfn)
-			_, err = d.RootDir.Stat(lockfn)
-			if err == nil {
-				slog.Warn("lock exists", "path", path, "lockfile", lockfn)
-				locked = true
-			}
-			if fn(FileEntry{
-				Name:      filepath.Dir(path),
-				Locked:    locked,
-				Timestamp: fi.ModTime(),
-				Size:      fi.Size(),
-			}) != nil {
-				return filepath.SkipDir
+		slog.Warn("skipping unreadable entry", "name", name, "error", err)
+		skipped = append(skipped, WalkFailure{Name: name, Error: err.Error(), err: err})
+		return nil
+	})
+	if stopped && err == filepath.SkipAll {
+		return skipped, nil
+	}
+	return skipped, err
+}
+
+// WalkFailure is an error of the function of WalkAll for a file
+type WalkFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+	err   error
+}
+
+// WalkResult summarizes a walk which continued on errors
+type WalkResult struct {
+	Visited int           `json:"visited"`
+	Skipped int           `json:"skipped"`
+	Failed  []WalkFailure `json:"failed"`
+}
+
+// Err returns the errors of the failed files joined, or nil
+func (r WalkResult) Err() error {
+	errs := []error{}
+	for _, f := range r.Failed {
+		errs = append(errs, fmt.Errorf("%s: %w", f.Name, f.err))
+	}
+	return errors.Join(errs...)
+}
+
+// WalkAll walks like Walk, but records the errors of the function and continues with the next file
+//
+// only a cancelled context aborts the walk.
+func (d *Datastore) WalkAll(ctx context.Context, prefix string, fn func(e FileEntry) error) (WalkResult, error) {
+	res := WalkResult{Failed: []WalkFailure{}}
+	err := d.Walk(ctx, prefix, func(e FileEntry) error {
+		res.Visited++
+		err := fn(e)
+		switch err {
+		case nil:
+		case filepath.SkipDir, filepath.SkipAll:
+			res.Skipped++
+			return err
+		default:
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			slog.Warn("walk continues after error", "name", e.Name, "error", err)
+			res.Failed = append(res.Failed, WalkFailure{Name: e.Name, Error: err.Error(), err: err})
 		}
 		return nil
 	})
+	return res, err
+}
+
+// walk calls the function for the file of a directory before descending into it
+//
+// onError is called with the entries which cannot be read, and the walk continues unless it returns an error.
+func (d *Datastore) walk(ctx context.Context, prefix string, fn func(e FileEntry) error, onError func(name string, err error) error) error {
+	return d.blobs().Walk(ctx, prefix, fn, onError)
+}
+
+// DetailEntry is a FileEntry extended with a summary of the history
+type DetailEntry struct {
+	FileEntry
+	Versions   int
+	MaxSize    int64
+	MaxVersion string
+}
+
+// WalkDetail walks like Walk, scanning the history of each file to find its largest version
+func (d *Datastore) WalkDetail(ctx context.Context, prefix string, fn func(e DetailEntry) error) error {
+	return d.Walk(ctx, prefix, func(e FileEntry) error {
+		return fn(d.Detail(ctx, e))
+	})
+}
+
+// Detail scans the history of the file to find its largest version
+func (d *Datastore) Detail(ctx context.Context, e FileEntry) DetailEntry {
+	res := DetailEntry{FileEntry: e}
+	for _, h := range d.History(ctx, e.Name) {
+		res.Versions++
+		if h.Size > res.MaxSize || res.MaxVersion == "" {
+			res.MaxSize = h.Size
+			res.MaxVersion = h.Name
+		}
+	}
+	return res
 }
 
 // History retrieves the history of a file in the datastore
-func (d *Datastore) History(path string) []FileEntry {
+func (d *Datastore) History(ctx context.Context, path string) []FileEntry {
+	defer trackOp(ctx, "history")()
 	slog.Debug("find history", "path", path)
+	d.recoverIfNeeded(path)
 	res := []FileEntry{}
-	cur, err := d.File(path, "current")
-	if err != nil {
+	if _, err := d.File(path, "current"); err != nil {
 		slog.Error("current", "error", err, "path", path)
 		return res
 	}
-	slog.Debug("current", "cur", cur, "path", path)
-	linkto, err := d.RootDir.ReadlinkIfPossible(cur)
+	linkto, err := d.blobs().GetCurrent(path)
 	if err != nil {
 		slog.Error("readlink", "error", err, "path", path)
 		return res
 	}
-	dirn, err := d.File(path)
+	ents, err := d.blobs().ListVersions(path)
 	if err != nil {
 		slog.Error("history", "error", err, "path", path)
-	} else {
-		files, err := afero.ReadDir(d.RootDir, dirn)
-		if err != nil {
-			slog.Error("readdir", "error", err, "dirn", dirn)
-		} else {
-			for _, ent := range files {
-				if ent.IsDir() || ent.Name() == "lock" || !ent.Mode().IsRegular() {
-					continue
-				}
-				fi, err := d.RootDir.Stat(filepath.Join(dirn, ent.Name()))
-				if err != nil {
-					slog.Error("info", "path", dirn, "name", ent.Name)
-				} else {
-					res = append(res, FileEntry{
-						Name:      fi.Name(),
-						Locked:    linkto == fi.Name(),
-						Timestamp: fi.ModTime(),
-						Size:      fi.Size(),
-					})
-				}
-			}
-		}
+		return res
+	}
+	if ctx.Err() != nil {
+		return res
+	}
+	for _, e := range ents {
+		e.Locked = linkto == e.Name
+		e.Terraform = d.StateHeader(path, e.Name)
+		res = append(res, e)
 	}
 	sort.Slice(res, func(i, j int) bool {
 		return res[i].Timestamp.After(res[j].Timestamp)
@@ -351,57 +932,236 @@ func (d *Datastore) History(path string) []FileEntry {
 	return res
 }
 
+// VersionAt returns the version which was current at the time, the newest one written at or before it
+func VersionAt(ctx context.Context, ds DsIf, name string, at time.Time) (FileEntry, error) {
+	for _, e := range ds.History(ctx, name) {
+		if !e.Timestamp.After(at) {
+			return e, nil
+		}
+	}
+	slog.Error("no version at the time", "name", name, "at", at)
+	return FileEntry{}, ErrNotFound
+}
+
+// parseTime parses a time in RFC 3339 or a date in UTC
+func parseTime(s string) (time.Time, error) {
+	if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return ts, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// StateInfo represents summary information of a file in the datastore
+type StateInfo struct {
+	Name      string        `json:"name"`
+	Current   string        `json:"current"`
+	Newest    string        `json:"newest"`
+	Versions  int           `json:"versions"`
+	Locked    bool          `json:"locked"`
+	IsNewest  bool          `json:"is_newest"`
+	Behind    int           `json:"behind"`
+	BehindBy  time.Duration `json:"behind_by"`
+	Dangling  bool          `json:"dangling"`
+	Protected bool          `json:"protected"`
+	Held      bool          `json:"held"`
+	Hold      *HoldInfo     `json:"hold,omitempty"`
+	MaxSize   int64         `json:"max_size,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+	Size      int64         `json:"size"`
+}
+
+// Info returns summary information of a file, checking that current points to the newest version
+func (d *Datastore) Info(name string) (StateInfo, error) {
+	slog.Debug("info", "name", name)
+	res := StateInfo{Name: name, Protected: d.Protected(name), MaxSize: d.MaxSizeOf(name)}
+	if hold, ok := d.HoldRead(name); ok {
+		res.Held = true
+		res.Hold = &hold
+	}
+	if _, err := d.File(name, "current"); err != nil {
+		slog.Error("invalid filename?", "name", name, "error", err)
+		return res, ErrInvalidPath
+	}
+	linkto, err := d.blobs().GetCurrent(name)
+	if err != nil {
+		return res, ErrNotFound
+	}
+	res.Current = linkto
+	if _, err := d.LockRead(name); err == nil {
+		res.Locked = true
+	}
+	hist := d.History(context.Background(), name)
+	res.Versions = len(hist)
+	res.Dangling = true
+	if len(hist) != 0 {
+		res.Newest = hist[0].Name
+	}
+	for i, e := range hist {
+		if e.Locked {
+			res.Dangling = false
+			res.IsNewest = i == 0
+			res.Behind = i
+			res.BehindBy = hist[0].Timestamp.Sub(e.Timestamp)
+			res.Timestamp = e.Timestamp
+			res.Size = e.Size
+			break
+		}
+	}
+	if res.Dangling {
+		slog.Warn("current points to missing version", "name", name, "current", linkto)
+	} else if !res.IsNewest {
+		slog.Info("current is not the newest", "name", name, "current", linkto, "newest", res.Newest, "behind", res.Behind)
+	}
+	return res, nil
+}
+
 // ReadHistory reads a specific version of a file from the datastore
 func (d *Datastore) ReadHistory(name string, history string) (io.ReadCloser, error) {
 	slog.Debug("reading history", "name", name, "history", history)
-	path, err := d.File(name, history)
-	if err != nil {
+	if _, err := d.File(name, history); err != nil {
 		slog.Error("invalid filename?", "name", name, "error", err)
 		return nil, ErrInvalidPath
 	}
-	return d.RootDir.Open(path)
+	switch history {
+	case "current":
+		if history = d.currentTarget(name); history == "" {
+			return nil, ErrNotFound
+		}
+	case backupLink:
+		if history = d.backupTarget(name); history == "" {
+			return nil, ErrNotFound
+		}
+	}
+	if err := checkVersion(history); err != nil {
+		return nil, err
+	}
+	return d.openVersion(name, history)
+}
+
+// CurrentVersion returns the version current points to, or empty if there is none
+func (d *Datastore) CurrentVersion(name string) string {
+	if _, err := d.File(name); err != nil {
+		return ""
+	}
+	return d.currentTarget(name)
 }
 
 // Rollback rolls back a file to a specific history version
 func (d *Datastore) Rollback(name string, history string) error {
-	slog.Debug("rollback to history", "name", name, "history", history)
-	path, err := d.File(name, history)
-	if err != nil {
+	return d.RollbackIf(name, history, "")
+}
+
+// RollbackIf rolls back like Rollback if current is empty or the current version,
+// and returns ErrPrecondition if another version became current since
+func (d *Datastore) RollbackIf(name string, history string, current string) error {
+	slog.Debug("rollback to history", "name", name, "history", history, "expected", current)
+	if err := checkVersion(history); err != nil {
+		return err
+	}
+	if _, err := d.File(name, history); err != nil {
 		slog.Error("invalid filename?", "name", name, "error", err)
 		return ErrInvalidPath
 	}
-	if _, err := d.RootDir.Stat(path); err != nil {
-		slog.Error("target not found", "name", name, "error", err)
+	release, err := d.guard(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// only a version in the history, not another file of the state which happens to exist
+	versions, err := d.blobs().ListVersions(name)
+	if err != nil || !slices.ContainsFunc(versions, func(e FileEntry) bool { return e.Name == history }) {
+		slog.Error("target not found", "name", name, "history", history, "error", err)
+		return ErrNotFound
+	}
+	// pruned, removed when its readers close it
+	if key, _ := d.File(name, history); d.refs.pendingRemoval(key) {
+		slog.Error("target is being removed", "name", name, "history", history)
 		return ErrNotFound
 	}
-	return d.set_current(name, history)
+	if err := d.checkProtected(name); err != nil {
+		return err
+	}
+	d.recoverGuarded(name)
+	previous := d.currentTarget(name)
+	if current != "" && current != previous {
+		slog.Warn("current version changed", "name", name, "expected", current, "current", previous)
+		return ErrPrecondition
+	}
+	if err := d.journalBegin(name, journalEntry{Op: journalRollback, Version: history, Previous: previous}); err != nil {
+		return err
+	}
+	if err := d.step(journalRollback, "journal"); err != nil {
+		return err
+	}
+	if err := d.set_current(name, history); err != nil {
+		return err
+	}
+	if previous != history {
+		d.updateBackup(name, previous)
+	}
+	if err := d.step(journalRollback, "link"); err != nil {
+		return err
+	}
+	return d.journalEnd(name)
+}
+
+// PruneResult summarizes the versions a prune removed, or would remove in a dry run
+type PruneResult struct {
+	Name      string `json:"name"`
+	Before    int    `json:"before"`
+	After     int    `json:"after"`
+	Reclaimed int64  `json:"reclaimed"`
 }
 
 // Prune removes old history versions of a file in the datastore
-func (d *Datastore) Prune(name string, keep int, dry bool) error {
-	ent := d.History(name)
+func (d *Datastore) Prune(ctx context.Context, name string, keep int, dry bool) error {
+	_, err := d.PruneDetail(ctx, name, keep, dry)
+	return err
+}
+
+// PruneDetail prunes like Prune and reports the number of versions and bytes removed
+func (d *Datastore) PruneDetail(ctx context.Context, name string, keep int, dry bool) (PruneResult, error) {
+	res := PruneResult{Name: name}
+	if err := d.checkProtected(name); err != nil {
+		return res, err
+	}
+	if err := d.checkHeld(name); err != nil {
+		return res, err
+	}
+	ent := d.History(ctx, name)
 	slog.Debug("prune", "length", len(ent), "names", ent)
+	if ctx.Err() != nil {
+		// the history may be incomplete
+		return res, ctx.Err()
+	}
+	res.Before = len(ent)
+	res.After = len(ent)
 	if len(ent) <= keep {
 		slog.Debug("nothing to do", "entries", len(ent), "keep", keep)
-		return nil
+		return res, nil
 	}
+	backup := d.backupTarget(name)
 	for _, i := range ent[keep:] {
+		if ctx.Err() != nil {
+			slog.Warn("prune aborted", "name", name, "error", ctx.Err())
+			return res, ctx.Err()
+		}
 		if i.Locked {
 			slog.Debug("skip current", "name", i.Name)
 			continue
 		}
-		path, err := d.File(name, i.Name)
-		if err != nil {
-			slog.Error("invalid history name", "name", name, "history", i.Name, "error", err)
-			return err
+		if i.Name == backup {
+			slog.Debug("skip backup", "name", i.Name)
+			continue
 		}
-		slog.Info("removing", "name", name, "history", i.Name, "dry", dry, "path", path)
+		slog.Info("removing", "name", name, "history", i.Name, "dry", dry)
 		if !dry {
-			if err := d.RootDir.Remove(path); err != nil {
-				slog.Error("cannot remove", "name", name, "history", i.Name, "path", path, "error", err)
-				return err
+			if err := d.unlinkVersion(name, i.Name); err != nil {
+				return res, err
 			}
 		}
+		res.After--
+		res.Reclaimed += i.Size
 	}
-	return nil
+	return res, nil
 }
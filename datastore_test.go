@@ -2,13 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/spf13/afero"
 )
 
 func TestNewDatastore(t *testing.T) {
@@ -157,7 +168,7 @@ func TestWrite(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			reader := strings.NewReader(test.content)
-			err := ds.Write(test.filename, reader, test.hash, "")
+			err := ds.Write(t.Context(), test.filename, reader, test.hash, "")
 			if test.expectErr {
 				if err == nil {
 					t.Errorf("expected error, got nil")
@@ -182,13 +193,13 @@ func TestWriteAndRead(t *testing.T) {
 	content := "test content for read/write"
 
 	reader := strings.NewReader(content)
-	err := ds.Write(filename, reader, []byte{}, "")
+	err := ds.Write(t.Context(), filename, reader, []byte{}, "")
 	if err != nil {
 		t.Fatalf("write failed: %v", err)
 	}
 
 	var buf bytes.Buffer
-	err = ds.Read(filename, &buf)
+	err = ds.Read(t.Context(), filename, &buf)
 	if err != nil {
 		t.Fatalf("read failed: %v", err)
 	}
@@ -206,7 +217,7 @@ func TestDelete(t *testing.T) {
 	content := "test content"
 
 	reader := strings.NewReader(content)
-	err := ds.Write(filename, reader, []byte{}, "")
+	err := ds.Write(t.Context(), filename, reader, []byte{}, "")
 	if err != nil {
 		t.Fatalf("write failed: %v", err)
 	}
@@ -217,12 +228,38 @@ func TestDelete(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err = ds.Read(filename, &buf)
+	err = ds.Read(t.Context(), filename, &buf)
 	if err == nil {
 		t.Errorf("expected error after delete, got nil")
 	}
 }
 
+func TestDelete_Missing(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	// a retried delete, and a delete of a file which never existed
+	if err := ds.Write(t.Context(), "a", strings.NewReader("{}"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	for _, name := range []string{"a", "a", "never/existed"} {
+		if err := ds.Delete(name); err != nil {
+			t.Errorf("delete of %s failed: %v", name, err)
+		}
+	}
+	if journals, err := ds.PendingJournals("/"); err != nil || len(journals) != 0 {
+		t.Errorf("journal left behind: %v %v", journals, err)
+	}
+	if err := ds.blobs().RemoveCurrent("a"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound removing a missing current, got %v", err)
+	}
+
+	h := &APIHandler{ds: &ds}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/nonexistent", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200 deleting a nonexistent state, got %d", rr.Code)
+	}
+}
+
 func TestLockUnlock(t *testing.T) {
 	tmp := t.TempDir()
 	ds := NewDatastore(tmp)
@@ -235,7 +272,7 @@ func TestLockUnlock(t *testing.T) {
 		t.Fatalf("lock failed: %v", err)
 	}
 
-	err = ds.Lock(filename, lockinfo)
+	err = ds.Lock(filename, `{"ID":"other"}`)
 	if err != ErrLocked {
 		t.Errorf("expected ErrLocked, got %v", err)
 	}
@@ -259,6 +296,47 @@ func TestLockUnlock(t *testing.T) {
 	}
 }
 
+func TestLock_Idempotent(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		ds := NewDatastore(t.TempDir())
+		ds.StrictLock = strict
+		lockinfo := `{"ID":"lock123","Operation":"OperationTypeApply"}`
+		if err := ds.Lock("myfile", lockinfo); err != nil {
+			t.Fatalf("lock failed: %v", err)
+		}
+		// a retried lock carries the same ID
+		err := ds.Lock("myfile", `{"ID":"lock123","Operation":"OperationTypeApply"}`)
+		if strict && err != ErrLocked {
+			t.Errorf("strict: expected ErrLocked for re-lock, got %v", err)
+		}
+		if !strict && err != nil {
+			t.Errorf("expected re-lock with same ID to succeed, got %v", err)
+		}
+		if err := ds.Lock("myfile", `{"ID":"other"}`); err != ErrLocked {
+			t.Errorf("expected ErrLocked for other ID, got %v", err)
+		}
+		if err := ds.Lock("myfile", "not json"); err != ErrLocked {
+			t.Errorf("expected ErrLocked for lock without ID, got %v", err)
+		}
+		if content, _ := ds.LockRead("myfile"); content != lockinfo {
+			t.Errorf("lock info changed: %q", content)
+		}
+		if err := ds.Unlock("myfile", `{"ID":"other"}`); err != ErrLocked {
+			t.Errorf("expected ErrLocked for unlock with other ID, got %v", err)
+		}
+		if err := ds.Unlock("myfile", lockinfo); err != nil {
+			t.Fatalf("unlock failed: %v", err)
+		}
+		err = ds.Unlock("myfile", lockinfo)
+		if strict && err != ErrUnlocked {
+			t.Errorf("strict: expected ErrUnlocked for double unlock, got %v", err)
+		}
+		if !strict && err != nil {
+			t.Errorf("expected double unlock to succeed, got %v", err)
+		}
+	}
+}
+
 func TestLockCheck(t *testing.T) {
 	tmp := t.TempDir()
 	ds := NewDatastore(tmp)
@@ -296,13 +374,13 @@ func TestHistory(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		content := "version " + string(rune(48+i))
 		reader := strings.NewReader(content)
-		err := ds.Write(filename, reader, []byte{}, "")
+		err := ds.Write(t.Context(), filename, reader, []byte{}, "")
 		if err != nil {
 			t.Fatalf("write failed: %v", err)
 		}
 	}
 
-	hist := ds.History(filename)
+	hist := ds.History(t.Context(), filename)
 	if len(hist) < 1 {
 		t.Errorf("expected at least 1 history entry, got %d", len(hist))
 	}
@@ -321,19 +399,19 @@ func TestRollback(t *testing.T) {
 	filename := "myfile"
 
 	reader1 := strings.NewReader("version1")
-	err := ds.Write(filename, reader1, []byte{}, "")
+	err := ds.Write(t.Context(), filename, reader1, []byte{}, "")
 	if err != nil {
 		t.Fatalf("first write failed: %v", err)
 	}
 
-	hist := ds.History(filename)
+	hist := ds.History(t.Context(), filename)
 	if len(hist) == 0 {
 		t.Fatalf("no history found")
 	}
 	firstVersion := hist[0].Name
 
 	reader2 := strings.NewReader("version2")
-	err = ds.Write(filename, reader2, []byte{}, "")
+	err = ds.Write(t.Context(), filename, reader2, []byte{}, "")
 	if err != nil {
 		t.Fatalf("second write failed: %v", err)
 	}
@@ -344,7 +422,7 @@ func TestRollback(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err = ds.Read(filename, &buf)
+	err = ds.Read(t.Context(), filename, &buf)
 	if err != nil {
 		t.Fatalf("read failed: %v", err)
 	}
@@ -353,6 +431,46 @@ func TestRollback(t *testing.T) {
 	}
 }
 
+func TestRollbackIf(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	versions := writeAt(t, &ds, "a", time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour), time.Now())
+	observed := ds.CurrentVersion("a")
+	if observed != versions[2] {
+		t.Fatalf("expected current %s, got %s", versions[2], observed)
+	}
+	// another operator rolls back first
+	if err := ds.RollbackIf("a", versions[1], observed); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if err := ds.RollbackIf("a", versions[0], observed); err != ErrPrecondition {
+		t.Errorf("expected ErrPrecondition, got %v", err)
+	}
+	if got := ds.CurrentVersion("a"); got != versions[1] {
+		t.Errorf("stale rollback changed current to %s", got)
+	}
+	if err := ds.RollbackIf("a", versions[0], versions[1]); err != nil {
+		t.Errorf("rollback failed: %v", err)
+	}
+	if got := ds.CurrentVersion("missing"); got != "" {
+		t.Errorf("current of a missing file: %q", got)
+	}
+	// files of the state which are not versions are no targets
+	if err := ds.Lock("a", `{"ID":"x"}`); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	for _, target := range []string{"current", "lock", "backup", "journal", ".meta", "../a/" + versions[1], "missing"} {
+		if err := ds.RollbackIf("a", target, ""); err == nil {
+			t.Errorf("rollback to %s succeeded", target)
+		}
+	}
+	if got := ds.CurrentVersion("a"); got != versions[0] {
+		t.Errorf("current changed to %s", got)
+	}
+	if err := ds.Read(t.Context(), "a", io.Discard); err != nil {
+		t.Errorf("read failed: %v", err)
+	}
+}
+
 func TestPrune(t *testing.T) {
 	tmp := t.TempDir()
 	ds := NewDatastore(tmp)
@@ -362,23 +480,23 @@ func TestPrune(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		content := "version" + string(rune(48+i))
 		reader := strings.NewReader(content)
-		err := ds.Write(filename, reader, []byte{}, "")
+		err := ds.Write(t.Context(), filename, reader, []byte{}, "")
 		if err != nil {
 			t.Fatalf("write failed: %v", err)
 		}
 	}
 
-	hist := ds.History(filename)
+	hist := ds.History(t.Context(), filename)
 	if len(hist) < 5 {
 		t.Errorf("expected at least 5 versions, got %d", len(hist))
 	}
 
-	err := ds.Prune(filename, 2, false)
+	err := ds.Prune(t.Context(), filename, 2, false)
 	if err != nil {
 		t.Fatalf("prune failed: %v", err)
 	}
 
-	hist = ds.History(filename)
+	hist = ds.History(t.Context(), filename)
 	if len(hist) > 3 { // current + keep
 		t.Errorf("expected 2 or fewer versions after prune, got %d", len(hist))
 		t.Logf("history: %+v", hist)
@@ -394,21 +512,21 @@ func TestPruneDry(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		content := "version" + string(rune(48+i))
 		reader := strings.NewReader(content)
-		err := ds.Write(filename, reader, []byte{}, "")
+		err := ds.Write(t.Context(), filename, reader, []byte{}, "")
 		if err != nil {
 			t.Fatalf("write failed: %v", err)
 		}
 	}
 
-	hist := ds.History(filename)
+	hist := ds.History(t.Context(), filename)
 	originalCount := len(hist)
 
-	err := ds.Prune(filename, 1, true)
+	err := ds.Prune(t.Context(), filename, 1, true)
 	if err != nil {
 		t.Fatalf("prune failed: %v", err)
 	}
 
-	hist = ds.History(filename)
+	hist = ds.History(t.Context(), filename)
 	if len(hist) != originalCount {
 		t.Errorf("expected %d versions after dry-run, got %d", originalCount, len(hist))
 	}
@@ -420,7 +538,7 @@ func TestReadNonExistent(t *testing.T) {
 
 	filename := "nonexistent"
 	var buf bytes.Buffer
-	err := ds.Read(filename, &buf)
+	err := ds.Read(t.Context(), filename, &buf)
 	if err != ErrNotFound {
 		t.Errorf("expected ErrNotFound, got %v", err)
 	}
@@ -434,12 +552,12 @@ func TestReadHistory(t *testing.T) {
 	content := "historical content"
 
 	reader := strings.NewReader(content)
-	err := ds.Write(filename, reader, []byte{}, "")
+	err := ds.Write(t.Context(), filename, reader, []byte{}, "")
 	if err != nil {
 		t.Fatalf("write failed: %v", err)
 	}
 
-	hist := ds.History(filename)
+	hist := ds.History(t.Context(), filename)
 	if len(hist) == 0 {
 		t.Fatalf("no history found")
 	}
@@ -461,6 +579,51 @@ func TestReadHistory(t *testing.T) {
 	}
 }
 
+// writeAt writes versions of the file with the given modification times
+func writeAt(t *testing.T, ds *Datastore, name string, times ...time.Time) []string {
+	t.Helper()
+	res := []string{}
+	for i, ts := range times {
+		if err := ds.Write(t.Context(), name, strings.NewReader(fmt.Sprintf(`{"v":%d}`, i+1)), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		version := ds.currentTarget(name)
+		path, _ := ds.File(name, version)
+		if err := ds.RootDir.Chtimes(path, ts, ts); err != nil {
+			t.Fatalf("chtimes failed: %v", err)
+		}
+		res = append(res, version)
+		time.Sleep(time.Millisecond)
+	}
+	return res
+}
+
+func TestVersionAt(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	base := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	versions := writeAt(t, &ds, "state", base, base.Add(time.Hour), base.Add(2*time.Hour))
+	tests := []struct {
+		at      time.Time
+		version string
+		err     error
+	}{
+		{base.Add(-time.Second), "", ErrNotFound},
+		{base, versions[0], nil},
+		{base.Add(90 * time.Minute), versions[1], nil},
+		{base.Add(time.Hour), versions[1], nil},
+		{base.Add(48 * time.Hour), versions[2], nil},
+	}
+	for _, test := range tests {
+		ent, err := VersionAt(t.Context(), &ds, "state", test.at)
+		if err != test.err || ent.Name != test.version {
+			t.Errorf("%v: expected %q %v, got %q %v", test.at, test.version, test.err, ent.Name, err)
+		}
+	}
+	if _, err := VersionAt(t.Context(), &ds, "missing", base); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing file, got %v", err)
+	}
+}
+
 func TestWriteWithLock(t *testing.T) {
 	tmp := t.TempDir()
 	ds := NewDatastore(tmp)
@@ -476,13 +639,13 @@ func TestWriteWithLock(t *testing.T) {
 	}
 
 	reader := strings.NewReader("content")
-	err = ds.Write(filename, reader, []byte{}, "wrong-id")
+	err = ds.Write(t.Context(), filename, reader, []byte{}, "wrong-id")
 	if err != ErrLocked {
 		t.Errorf("expected ErrLocked, got %v", err)
 	}
 
 	reader = strings.NewReader("content")
-	err = ds.Write(filename, reader, []byte{}, lockID)
+	err = ds.Write(t.Context(), filename, reader, []byte{}, lockID)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -522,7 +685,7 @@ func TestWalk(t *testing.T) {
 	}
 
 	var entries []FileEntry
-	if err := ds.Walk("/", func(e FileEntry) error {
+	if err := ds.Walk(t.Context(), "/", func(e FileEntry) error {
 		entries = append(entries, e)
 		return nil
 	}); err != nil {
@@ -567,3 +730,720 @@ func TestWalk(t *testing.T) {
 		t.Errorf("expected entry2 size > 0")
 	}
 }
+
+func TestLocks(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+
+	ages := map[string]time.Duration{
+		"fresh":  time.Hour,
+		"border": 2*time.Hour + time.Minute,
+		"old":    48 * time.Hour,
+	}
+	for name, age := range ages {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if err := ds.Lock(name, `{"ID":"`+name+`"}`); err != nil {
+			t.Fatalf("lock failed: %v", err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(tmp, name, "lock"), mtime, mtime); err != nil {
+			t.Fatalf("chtimes failed: %v", err)
+		}
+	}
+	if err := ds.Write(t.Context(), "unlocked", strings.NewReader("{}"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	// locked before the first write
+	if err := ds.Lock("new", `{"ID":"new"}`); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	locks, err := ds.Locks("/")
+	if err != nil {
+		t.Fatalf("locks failed: %v", err)
+	}
+	if len(locks) != 4 {
+		t.Fatalf("expected 4 locks, got %d: %+v", len(locks), locks)
+	}
+	for _, l := range locks {
+		info, ok := l.LockInfo.(map[string]interface{})
+		if !ok || "/"+info["ID"].(string) != l.Path {
+			t.Errorf("unexpected lockinfo for %s: %+v", l.Path, l.LockInfo)
+		}
+	}
+
+	tests := []struct {
+		stale    time.Duration
+		expected []string
+	}{
+		{0, []string{"/border", "/fresh", "/new", "/old"}},
+		{2 * time.Hour, []string{"/border", "/old"}},
+		{2*time.Hour + 2*time.Minute, []string{"/old"}},
+		{72 * time.Hour, []string{}},
+	}
+	for _, test := range tests {
+		names := []string{}
+		for _, l := range StaleLocks(locks, test.stale) {
+			names = append(names, l.Path)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("stale %s: expected %v, got %v", test.stale, test.expected, names)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+
+	if _, err := ds.Info("missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := ds.Write(t.Context(), "myfile", strings.NewReader("version"+string(rune(48+i))), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	info, err := ds.Info("myfile")
+	if err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	if !info.IsNewest || info.Behind != 0 || info.Versions != 3 || info.Dangling {
+		t.Errorf("expected current to be newest: %+v", info)
+	}
+
+	hist := ds.History(t.Context(), "myfile")
+	if err := ds.Rollback("myfile", hist[2].Name); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	info, err = ds.Info("myfile")
+	if err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	if info.IsNewest || info.Behind != 2 || info.Current != hist[2].Name || info.Newest != hist[0].Name {
+		t.Errorf("expected current to be 2 behind: %+v", info)
+	}
+	if info.BehindBy != hist[0].Timestamp.Sub(hist[2].Timestamp) {
+		t.Errorf("unexpected behind duration: %s", info.BehindBy)
+	}
+
+	if err := os.Remove(filepath.Join(tmp, "myfile", hist[2].Name)); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	info, err = ds.Info("myfile")
+	if err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	if !info.Dangling {
+		t.Errorf("expected dangling current: %+v", info)
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	input := `{"b": 12345678901234567890, "a": [1.50, {"z": 1, "y": "<&>"}]}`
+	tests := []struct {
+		name     string
+		indent   bool
+		sortKeys bool
+		expected string
+	}{
+		{"compact", false, false, `{"b":12345678901234567890,"a":[1.50,{"z":1,"y":"<&>"}]}` + "\n"},
+		{"sorted", false, true, `{"a":[1.50,{"y":"<&>","z":1}],"b":12345678901234567890}` + "\n"},
+		{"indent", true, false, "{\n  \"b\": 12345678901234567890,\n  \"a\": [\n    1.50,\n    {\n      \"z\": 1,\n      \"y\": \"<&>\"\n    }\n  ]\n}\n"},
+		{"indent sorted", true, true, "{\n  \"a\": [\n    1.50,\n    {\n      \"y\": \"<&>\",\n      \"z\": 1\n    }\n  ],\n  \"b\": 12345678901234567890\n}\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := FormatJSON([]byte(input), test.indent, test.sortKeys)
+			if err != nil {
+				t.Fatalf("format failed: %v", err)
+			}
+			if string(out) != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, string(out))
+			}
+		})
+	}
+	if _, err := FormatJSON([]byte("{invalid"), false, false); err == nil {
+		t.Errorf("expected error for invalid json")
+	}
+	if _, err := FormatJSON([]byte("{invalid"), true, true); err == nil {
+		t.Errorf("expected error for invalid json")
+	}
+}
+
+func TestWalk_CallbackErrors(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{"a", "a/b", "c", "d"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	errBad := errors.New("bad state")
+	walk := func(results map[string]error) ([]string, error) {
+		names := []string{}
+		err := ds.Walk(t.Context(), "/", func(e FileEntry) error {
+			names = append(names, e.Name)
+			return results[e.Name]
+		})
+		return names, err
+	}
+
+	names, err := walk(map[string]error{"/a": filepath.SkipDir})
+	if err != nil || !reflect.DeepEqual(names, []string{"/a", "/c", "/d"}) {
+		t.Errorf("SkipDir: %v %v", names, err)
+	}
+	names, err = walk(map[string]error{"/c": filepath.SkipAll})
+	if err != nil || !reflect.DeepEqual(names, []string{"/a", "/a/b", "/c"}) {
+		t.Errorf("SkipAll: %v %v", names, err)
+	}
+	names, err = walk(map[string]error{"/a/b": errBad})
+	if err != errBad || !reflect.DeepEqual(names, []string{"/a", "/a/b"}) {
+		t.Errorf("error mid-walk: %v %v", names, err)
+	}
+
+	names = []string{}
+	res, err := ds.WalkAll(t.Context(), "/", func(e FileEntry) error {
+		names = append(names, e.Name)
+		switch e.Name {
+		case "/a/b", "/c":
+			return errBad
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkAll failed: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"/a", "/a/b", "/c", "/d"}) || res.Visited != 4 {
+		t.Errorf("walk stopped at an error: %v %+v", names, res)
+	}
+	if len(res.Failed) != 2 || res.Failed[0].Name != "/a/b" || res.Failed[1].Name != "/c" || res.Failed[0].Error != "bad state" {
+		t.Errorf("unexpected failures: %+v", res.Failed)
+	}
+	if err := res.Err(); !errors.Is(err, errBad) || !strings.Contains(err.Error(), "/c: bad state") {
+		t.Errorf("unexpected joined error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	res, err = ds.WalkAll(ctx, "/", func(e FileEntry) error {
+		cancel()
+		return errBad
+	})
+	if !errors.Is(err, context.Canceled) || res.Visited != 1 {
+		t.Errorf("cancelled walk continued: %+v %v", res, err)
+	}
+}
+
+func TestWalk_Skip(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"visible", ".trash/deleted", ".git/objects", "lost+found/x", "sub/.index/y"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	// sidecar files are not versions
+	if err := os.WriteFile(filepath.Join(tmp, "visible", ".sums"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write sidecar failed: %v", err)
+	}
+
+	visited := []string{}
+	ds.walkHook = func(path string) { visited = append(visited, path) }
+	names := []string{}
+	if err := ds.Walk(t.Context(), "/", func(e FileEntry) error {
+		names = append(names, e.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"/visible"}) {
+		t.Errorf("unexpected entries: %v", names)
+	}
+	for _, path := range visited {
+		for _, skipped := range []string{"/.trash/", "/.git/", "/lost+found/", "/sub/.index/"} {
+			if strings.HasPrefix(path, skipped) {
+				t.Errorf("descended into %s", path)
+			}
+		}
+	}
+	if hist := ds.History(t.Context(), "visible"); len(hist) != 1 {
+		t.Errorf("sidecar listed as version: %+v", hist)
+	}
+
+	ds.Skip = nil
+	names = []string{}
+	ds.Walk(t.Context(), "/", func(e FileEntry) error {
+		names = append(names, e.Name)
+		return nil
+	})
+	if len(names) != 5 {
+		t.Errorf("expected all entries without skip list, got %v", names)
+	}
+}
+
+func TestLockBatch(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	lockinfo := `{"ID":"batch"}`
+
+	if failed, err := LockBatch(&ds, []string{"c", "a", "b"}, lockinfo); err != nil {
+		t.Fatalf("batch lock failed at %s: %v", failed, err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if content, err := ds.LockRead(name); err != nil || content != lockinfo {
+			t.Errorf("%s not locked: %q %v", name, content, err)
+		}
+	}
+	if failed, err := UnlockBatch(&ds, []string{"a", "b", "c"}, lockinfo); err != nil {
+		t.Fatalf("batch unlock failed at %s: %v", failed, err)
+	}
+
+	// conflict: nothing stays locked
+	if err := ds.Lock("b", `{"ID":"other"}`); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	failed, err := LockBatch(&ds, []string{"a", "b", "c"}, lockinfo)
+	if err != ErrLocked || failed != "b" {
+		t.Fatalf("expected conflict at b, got %q %v", failed, err)
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, err := ds.LockRead(name); err != ErrUnlocked {
+			t.Errorf("%s should not be locked: %v", name, err)
+		}
+	}
+	if content, _ := ds.LockRead("b"); content != `{"ID":"other"}` {
+		t.Errorf("existing lock must be kept: %q", content)
+	}
+
+	failed, err = UnlockBatch(&ds, []string{"b"}, lockinfo)
+	if err != ErrLocked || failed != "b" {
+		t.Errorf("expected unlock conflict at b, got %q %v", failed, err)
+	}
+
+	// a lock the ID held before the batch is kept on conflict
+	if err := ds.Lock("a", lockinfo); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if failed, err := LockBatch(&ds, []string{"a", "b"}, lockinfo); err != ErrLocked || failed != "b" {
+		t.Fatalf("expected conflict at b, got %q %v", failed, err)
+	}
+	if content, err := ds.LockRead("a"); err != nil || content != lockinfo {
+		t.Errorf("lock held before the batch released: %q %v", content, err)
+	}
+	if err := ds.Unlock("a", lockinfo); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+
+	// a name given twice is locked once, also with StrictLock
+	ds.StrictLock = true
+	if failed, err := LockBatch(&ds, []string{"a", "a"}, lockinfo); err != nil {
+		t.Fatalf("batch lock failed at %s: %v", failed, err)
+	}
+	if content, err := ds.LockRead("a"); err != nil || content != lockinfo {
+		t.Errorf("a not locked: %q %v", content, err)
+	}
+}
+
+// syncFs records the files which were synced
+type syncFs struct {
+	afero.OsFs
+	synced *[]string
+}
+
+type syncFile struct {
+	afero.File
+	synced *[]string
+}
+
+func (f syncFile) Sync() error {
+	*f.synced = append(*f.synced, f.Name())
+	return f.File.Sync()
+}
+
+func (s syncFs) Open(name string) (afero.File, error) {
+	f, err := s.OsFs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return syncFile{File: f, synced: s.synced}, nil
+}
+
+func (s syncFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := s.OsFs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return syncFile{File: f, synced: s.synced}, nil
+}
+
+func TestWrite_Fsync(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		tmp := t.TempDir()
+		synced := []string{}
+		ds := NewDatastore(tmp)
+		ds.RootDir = afero.NewBasePathFs(syncFs{synced: &synced}, tmp).(*afero.BasePathFs)
+		ds.Fsync = fsync
+		if err := ds.Write(t.Context(), "a/b", strings.NewReader("data"), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if !fsync {
+			if len(synced) != 0 {
+				t.Errorf("unexpected fsync: %v", synced)
+			}
+			continue
+		}
+		hist := ds.History(t.Context(), "a/b")
+		if len(hist) != 1 {
+			t.Fatalf("expected 1 version, got %d", len(hist))
+		}
+		version := filepath.Join(tmp, "a", "b", hist[0].Name)
+		dir := filepath.Join(tmp, "a", "b")
+		journal := filepath.Join(dir, "journal")
+		// journal, version file and directory must be synced before the pointer stage is recorded
+		expected := []string{journal, version, dir, journal}
+		if len(synced) < 4 || !reflect.DeepEqual(synced[:4], expected) {
+			t.Errorf("expected sync of %v, got %v", expected, synced)
+		}
+		buf := &bytes.Buffer{}
+		if err := ds.Read(t.Context(), "a/b", buf); err != nil || buf.String() != "data" {
+			t.Errorf("read back failed: %q %v", buf.String(), err)
+		}
+	}
+}
+
+func TestProtect(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Protect("a"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing file, got %v", err)
+	}
+	for _, s := range []string{"v1", "v2"} {
+		if err := ds.Write(t.Context(), "a", strings.NewReader(s), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hist := ds.History(t.Context(), "a")
+	if err := ds.Protect("a"); err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	if !ds.Protected("a") {
+		t.Errorf("expected protected")
+	}
+	blocked := map[string]func() error{
+		"write":    func() error { return ds.Write(t.Context(), "a", strings.NewReader("v3"), []byte{}, "") },
+		"delete":   func() error { return ds.Delete("a") },
+		"rollback": func() error { return ds.Rollback("a", hist[1].Name) },
+		"prune":    func() error { return ds.Prune(t.Context(), "a", 0, false) },
+	}
+	for name, fn := range blocked {
+		if err := fn(); err != ErrProtected {
+			t.Errorf("%s: expected ErrProtected, got %v", name, err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := ds.Read(t.Context(), "a", buf); err != nil || buf.String() != "v2" {
+		t.Errorf("read should be allowed: %q %v", buf.String(), err)
+	}
+	if got := ds.History(t.Context(), "a"); len(got) != 2 {
+		t.Errorf("history should be kept, got %d versions", len(got))
+	}
+	if info, err := ds.Info("a"); err != nil || !info.Protected {
+		t.Errorf("expected protected in info: %+v %v", info, err)
+	}
+
+	if err := ds.Unprotect("a"); err != nil {
+		t.Fatalf("Unprotect failed: %v", err)
+	}
+	if err := ds.Unprotect("a"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for double unprotect, got %v", err)
+	}
+	if err := ds.Rollback("a", hist[1].Name); err != nil {
+		t.Errorf("rollback after unprotect failed: %v", err)
+	}
+	if err := ds.Prune(t.Context(), "a", 1, false); err != nil {
+		t.Errorf("prune after unprotect failed: %v", err)
+	}
+	if err := ds.Write(t.Context(), "a", strings.NewReader("v3"), []byte{}, ""); err != nil {
+		t.Errorf("write after unprotect failed: %v", err)
+	}
+	if err := ds.Delete("a"); err != nil {
+		t.Errorf("delete after unprotect failed: %v", err)
+	}
+}
+
+func TestWalkDetail(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, s := range []string{"small", strings.Repeat("x", 1000), "mid-size"} {
+		if err := ds.Write(t.Context(), "a", strings.NewReader(s), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ds.Write(t.Context(), "b", strings.NewReader("only"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	res := map[string]DetailEntry{}
+	if err := ds.WalkDetail(t.Context(), "/", func(e DetailEntry) error {
+		res[e.Name] = e
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkDetail failed: %v", err)
+	}
+	a := res["/a"]
+	if a.Size != 8 || a.Versions != 3 || a.MaxSize != 1000 {
+		t.Errorf("unexpected entry for a: %+v", a)
+	}
+	if hist := ds.History(t.Context(), "a"); a.MaxVersion != hist[1].Name {
+		t.Errorf("expected largest version %s, got %s", hist[1].Name, a.MaxVersion)
+	}
+	if b := res["/b"]; b.Versions != 1 || b.MaxSize != 4 {
+		t.Errorf("unexpected entry for b: %+v", b)
+	}
+}
+
+func TestWalk_Exclude(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"app/prod", "app/archive/old", "snapshot/app", "other/snapshot/x"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	tests := []struct {
+		skip     []string
+		expected []string
+	}{
+		{[]string{"snapshot"}, []string{"/app/archive/old", "/app/prod"}},
+		{[]string{"/snapshot"}, []string{"/app/archive/old", "/app/prod", "/other/snapshot/x"}},
+		{[]string{"app/arch*"}, []string{"/app/prod", "/other/snapshot/x", "/snapshot/app"}},
+	}
+	for _, test := range tests {
+		ds.Skip = test.skip
+		names := []string{}
+		ds.Walk(t.Context(), "/", func(e FileEntry) error {
+			names = append(names, e.Name)
+			return nil
+		})
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("skip %v: expected %v, got %v", test.skip, test.expected, names)
+		}
+	}
+}
+
+func TestWalk_Unreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"a", "secret/b", "c"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	dir := filepath.Join(tmp, "secret")
+	if err := os.Chmod(dir, 0); err != nil {
+		t.Fatalf("chmod failed: %v", err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0o755) })
+
+	names := []string{}
+	skipped, err := ds.WalkSkipped(t.Context(), "/", func(e FileEntry) error {
+		names = append(names, e.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"/a", "/c"}) {
+		t.Errorf("unexpected entries: %v", names)
+	}
+	if len(skipped) != 1 || skipped[0].Name != "/secret" {
+		t.Errorf("expected /secret to be skipped, got %+v", skipped)
+	}
+
+	ds.StrictWalk = true
+	if err := ds.Walk(t.Context(), "/", func(e FileEntry) error { return nil }); !os.IsPermission(err) {
+		t.Errorf("expected permission error with StrictWalk, got %v", err)
+	}
+}
+
+func TestWalk_DanglingCurrent(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"a", "broken", "c"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	cur := filepath.Join(tmp, "broken", "current")
+	target, err := os.Readlink(cur)
+	if err != nil {
+		t.Fatalf("readlink failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tmp, "broken", target)); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	names := []string{}
+	skipped, err := ds.WalkSkipped(t.Context(), "/", func(e FileEntry) error {
+		names = append(names, e.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"/a", "/c"}) {
+		t.Errorf("unexpected entries: %v", names)
+	}
+	if len(skipped) != 1 || skipped[0].Name != "/broken" || skipped[0].Error == "" {
+		t.Errorf("expected /broken to be skipped, got %+v", skipped)
+	}
+
+	ds.StrictWalk = true
+	if err := ds.Walk(t.Context(), "/", func(e FileEntry) error { return nil }); err == nil {
+		t.Error("expected an error with StrictWalk")
+	}
+}
+
+func TestDatastore_Cancel(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{"a", "b", "b", "b"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	called := 0
+	if err := ds.Walk(ctx, "/", func(e FileEntry) error {
+		called++
+		return nil
+	}); !errors.Is(err, context.Canceled) || called != 0 {
+		t.Errorf("walk not stopped: %v, %d called", err, called)
+	}
+	if err := ds.Read(ctx, "a", &bytes.Buffer{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("read not stopped: %v", err)
+	}
+	if err := ds.Prune(ctx, "b", 1, false); !errors.Is(err, context.Canceled) {
+		t.Errorf("prune not stopped: %v", err)
+	}
+	if err := ds.Write(ctx, "c", strings.NewReader("{}"), []byte{}, ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("write not stopped: %v", err)
+	}
+	if hist := ds.History(t.Context(), "b"); len(hist) != 3 {
+		t.Errorf("prune removed versions: %v", hist)
+	}
+	if hist := ds.History(t.Context(), "c"); len(hist) != 0 {
+		t.Errorf("cancelled write left versions: %v", hist)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ds.Backup = true
+	write := func(body string, retain bool) {
+		t.Helper()
+		var err error
+		if retain {
+			err = ds.Write(t.Context(), "state", strings.NewReader(body), []byte{}, "")
+		} else {
+			err = ds.Replace(t.Context(), "state", strings.NewReader(body), []byte{}, "")
+		}
+		if err != nil {
+			t.Fatalf("write %s failed: %v", body, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	write("1", true)
+	write("2", true)
+	backup := ds.backupTarget("state")
+	for _, body := range []string{"3", "4", "5"} {
+		write(body, false)
+		if hist := ds.History(t.Context(), "state"); len(hist) != 2 {
+			t.Fatalf("history grew on replace: %v", hist)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := ds.Read(t.Context(), "state", buf); err != nil || buf.String() != "5" {
+		t.Errorf("unexpected contents %q %v", buf.String(), err)
+	}
+	if ds.backupTarget("state") != backup || !ds.versionExists("state", backup) {
+		t.Errorf("backup changed by replace")
+	}
+	write("6", true)
+	if hist := ds.History(t.Context(), "state"); len(hist) != 3 {
+		t.Errorf("expected a new version after a normal write: %v", hist)
+	}
+	if err := ds.Lock("state", `{"ID":"x"}`); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := ds.Replace(t.Context(), "state", strings.NewReader("7"), []byte{}, "y"); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	if err := ds.Replace(t.Context(), "state", strings.NewReader("7"), []byte{1, 2, 3}, "x"); err != ErrInvalidHash {
+		t.Errorf("expected ErrInvalidHash, got %v", err)
+	}
+	if hist := ds.History(t.Context(), "state"); len(hist) != 3 {
+		t.Errorf("failed replace changed history: %v", hist)
+	}
+}
+
+// failWriter fails after n bytes
+type failWriter struct {
+	n int
+}
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errors.New("disk full")
+	}
+	w.n -= len(b)
+	return len(b), nil
+}
+
+func TestRead_Partial(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	content := strings.Repeat(`{"key": "value"}`, 1000)
+	if err := ds.Write(t.Context(), "a", strings.NewReader(content), []byte{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	before := partialReads.Load()
+	if err := ds.Read(t.Context(), "a", &failWriter{n: 100}); err == nil {
+		t.Errorf("partial read succeeded")
+	}
+	if partialReads.Load() != before+1 {
+		t.Errorf("partial read not counted")
+	}
+
+	// a compressed version cut short fails midway through decompression
+	ds.Compress = true
+	if err := ds.Write(t.Context(), "gz", strings.NewReader(content), []byte{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := ds.File("gz", ds.currentTarget("gz"))
+	st, err := ds.RootDir.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(ds.RootName, path), st.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	logs := &bytes.Buffer{}
+	defer func(orig *slog.Logger) { slog.SetDefault(orig) }(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, nil)))
+	rr := httptest.NewRecorder()
+	(&APIHandler{ds: &ds}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/gz", nil))
+	if rr.Code != http.StatusInternalServerError || rr.Body.Len() != 0 {
+		t.Errorf("truncated contents served: %d %d bytes", rr.Code, rr.Body.Len())
+	}
+	if !strings.Contains(logs.String(), `"msg":"partial read"`) || !strings.Contains(logs.String(), `"msg":"response","status":"Internal Server Error"`) || strings.Contains(logs.String(), `"status":"OK"`) {
+		t.Errorf("unexpected access log: %s", logs.String())
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// slashEscape decodes escaped slashes only, other escapes may be part of a name
+var slashEscape = strings.NewReplacer("%2F", "/", "%2f", "/")
+
+// canonicalName returns the name a file was meant to have when its directory name
+// is an escaped path, e.g. prod%2Fapp written through a proxy which re-encodes slashes,
+// or empty if the name is already canonical
+func canonicalName(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	unescaped := slashEscape.Replace(name)
+	if unescaped == name {
+		return ""
+	}
+	res, err := normalizeName(unescaped, false)
+	if err != nil || res == "" || res == name {
+		return ""
+	}
+	return "/" + res
+}
+
+// DedupePaths finds files under the prefix which duplicate another name only by escaped slashes
+//
+// with fix, the versions of each duplicate are moved into the file of the canonical name,
+// current points to the newer of both currents, and the duplicate is removed.
+func (d *Datastore) DedupePaths(prefix string, fix bool) ([]VerifyResult, error) {
+	dups := []string{}
+	err := d.Walk(context.Background(), prefix, func(e FileEntry) error {
+		if canonicalName(e.Name) != "" {
+			dups = append(dups, e.Name)
+		}
+		return nil
+	})
+	res := []VerifyResult{}
+	for _, name := range dups {
+		canonical := canonicalName(name)
+		result := VerifyResult{Name: name, Problem: "duplicate of " + canonical}
+		if fix {
+			if err := d.mergeState(name, canonical); err != nil {
+				slog.Error("cannot merge", "name", name, "into", canonical, "error", err)
+				result.Problem += " (" + err.Error() + ")"
+			} else {
+				result.Fixed = true
+			}
+		}
+		res = append(res, result)
+	}
+	return res, err
+}
+
+// mergeState moves the versions of the file into another and removes it
+func (d *Datastore) mergeState(name string, into string) error {
+	for _, n := range []string{name, into} {
+		if _, err := d.LockRead(n); err == nil {
+			return ErrLocked
+		}
+		if d.Protected(n) {
+			return ErrProtected
+		}
+		if d.Held(n) {
+			return ErrHeld
+		}
+	}
+	src, err := d.File(name)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	dst, err := d.File(into)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	if _, err := d.RootDir.Stat(dst); err != nil {
+		// nothing to merge with
+		if err := d.RootDir.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		return d.RootDir.Rename(src, dst)
+	}
+	ents, err := afero.ReadDir(d.RootDir, src)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if ent.IsDir() {
+			return fmt.Errorf("%s has nested files: %w", name, ErrExists)
+		}
+		if reservedNames[ent.Name()] || !ent.Mode().IsRegular() {
+			continue
+		}
+		if _, err := d.RootDir.Stat(filepath.Join(dst, ent.Name())); err == nil {
+			slog.Error("version exists in both", "name", name, "into", into, "version", ent.Name())
+			return ErrExists
+		}
+	}
+	for _, ent := range ents {
+		if reservedNames[ent.Name()] || !ent.Mode().IsRegular() {
+			continue
+		}
+		slog.Info("moving", "name", name, "into", into, "version", ent.Name())
+		if err := d.RootDir.Rename(filepath.Join(src, ent.Name()), filepath.Join(dst, ent.Name())); err != nil {
+			return err
+		}
+	}
+	srcCurrent := d.currentTarget(name)
+	dstCurrent := d.currentTarget(into)
+	if dstCurrent == "" || d.versionTime(into, srcCurrent).After(d.versionTime(into, dstCurrent)) {
+		if err := d.set_current(into, srcCurrent); err != nil {
+			return err
+		}
+	}
+	for _, ent := range ents {
+		if reservedNames[ent.Name()] {
+			d.RootDir.Remove(filepath.Join(src, ent.Name()))
+		}
+	}
+	return d.RootDir.Remove(src)
+}
+
+// versionTime returns the modification time of the version, or zero if it does not exist
+func (d *Datastore) versionTime(name string, version string) time.Time {
+	path, err := d.File(name, version)
+	if err != nil || version == "" {
+		return time.Time{}
+	}
+	fi, err := d.RootDir.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"/prod/app", ""},
+		{"/prod%2Fapp", "/prod/app"},
+		{"prod%2fapp", "/prod/app"},
+		{"/prod%2F%2Fapp%2F", "/prod/app"},
+		{"/a%20b", ""},
+		{"/%2F", ""},
+		{"/a%2F..%2Fb", ""},
+	}
+	for _, test := range tests {
+		if got := canonicalName(test.name); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestDedupePaths(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	write := func(name string, body string) {
+		if err := ds.Write(t.Context(), name, strings.NewReader(body), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	write("prod/app", "1")
+	write("prod/app", "2")
+	write("prod%2Fapp", "3")
+	write("prod%2Fapp", "4")
+	write("dev%2Fapp", "5")
+	write("stage%2Fapp", "6")
+	if err := ds.Lock("stage%2Fapp", `{"ID":"x"}`); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	res, err := ds.DedupePaths("/", false)
+	if err != nil || len(res) != 3 {
+		t.Fatalf("unexpected result: %+v %v", res, err)
+	}
+	for _, r := range res {
+		if r.Fixed {
+			t.Errorf("fixed without fix: %+v", r)
+		}
+	}
+	if hist := ds.History(t.Context(), "prod/app"); len(hist) != 2 {
+		t.Errorf("changed without fix: %v", hist)
+	}
+
+	res, err = ds.DedupePaths("/", true)
+	if err != nil {
+		t.Fatalf("dedupe failed: %v", err)
+	}
+	fixed := map[string]bool{}
+	for _, r := range res {
+		fixed[r.Name] = r.Fixed
+	}
+	if !fixed["/prod%2Fapp"] || !fixed["/dev%2Fapp"] || fixed["/stage%2Fapp"] {
+		t.Errorf("unexpected fix result: %+v", res)
+	}
+	if hist := ds.History(t.Context(), "prod/app"); len(hist) != 4 {
+		t.Errorf("expected merged history, got %v", hist)
+	}
+	for name, expected := range map[string]string{"prod/app": "4", "dev/app": "5", "stage%2Fapp": "6"} {
+		buf := &bytes.Buffer{}
+		if err := ds.Read(t.Context(), name, buf); err != nil || buf.String() != expected {
+			t.Errorf("%s: expected %q, got %q %v", name, expected, buf.String(), err)
+		}
+	}
+	if err := ds.Read(t.Context(), "prod%2Fapp", &bytes.Buffer{}); err == nil {
+		t.Errorf("duplicate still exists")
+	}
+	if res, _ := ds.DedupePaths("/prod", false); len(res) != 0 {
+		t.Errorf("canonical names reported: %+v", res)
+	}
+}
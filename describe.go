@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+)
+
+// descriptionTag is the markdown description of a file, shown on its view page and by ls --long
+const descriptionTag = "description"
+
+// maxDescriptionLength limits the length of descriptions; longer texts belong in the notes
+const maxDescriptionLength = 1024
+
+// Describer is implemented by the datastores which keep descriptions of files
+type Describer interface {
+	Description(name string) string
+}
+
+// Description returns the description of the file, empty if it has none
+func (d *Datastore) Description(name string) string {
+	tags, _ := d.MetaRead(name)
+	return tags[descriptionTag]
+}
+
+// SetDescription sets the description of the file, removing it if blank
+func (d *Datastore) SetDescription(name string, desc string) error {
+	desc = strings.TrimSpace(desc)
+	if len(desc) > maxDescriptionLength {
+		slog.Error("description too long", "name", name, "length", len(desc), "max", maxDescriptionLength)
+		return ErrTooLarge
+	}
+	return d.MetaSet(name, map[string]string{descriptionTag: desc})
+}
+
+// oneLine returns the description on a single line for listings
+func oneLine(desc string) string {
+	return strings.Join(strings.Fields(desc), " ")
+}
+
+// viewDescription returns the rendered description of the file for its view page, empty if it has none
+func (h *HTMLHandler) viewDescription(name string) template.HTML {
+	desc, ok := h.ds.(Describer)
+	if !ok {
+		return ""
+	}
+	if content := desc.Description(name); content != "" {
+		return renderMarkdown(content)
+	}
+	return ""
+}
+
+// DescribeCmd shows or sets the description of a file
+type DescribeCmd struct {
+	File string `short:"f" long:"file" required:"true" description:"file name"`
+}
+
+func (cmd *DescribeCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	if len(args) != 0 {
+		return root.SetDescription(cmd.File, strings.Join(args, " "))
+	}
+	if root.CurrentVersion(cmd.File) == "" {
+		return fmt.Errorf("%s: %w", cmd.File, ErrNotFound)
+	}
+	if desc := root.Description(cmd.File); desc != "" {
+		fmt.Println(desc)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDescribe_CLI(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	writeAt(t, &ds, "net/vpc", time.Now())
+	writeAt(t, &ds, "other", time.Now())
+	if err := (&DescribeCmd{File: "missing"}).Execute([]string{"x"}); err != ErrNotFound {
+		t.Errorf("description of a missing file: %v", err)
+	}
+	if err := (&DescribeCmd{File: "net/vpc"}).Execute([]string{"prod", "VPC", "network\nstate"}); err != nil {
+		t.Fatalf("describe failed: %v", err)
+	}
+	out, err := captureStdout(func() error { return (&DescribeCmd{File: "net/vpc"}).Execute(nil) })
+	if err != nil || out != "prod VPC network\nstate\n" {
+		t.Errorf("unexpected description %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&LsTree{Long: true}).Execute(nil) })
+	if err != nil || !strings.Contains(out, "/net/vpc  # prod VPC network state\n") || strings.Contains(out, "/other  #") {
+		t.Errorf("unexpected ls --long %q %v", out, err)
+	}
+	if err := ds.SetDescription("other", strings.Repeat("x", maxDescriptionLength+1)); err != ErrTooLarge {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+	// the other tags are kept, and the meta sidecar goes with the last one
+	if err := ds.MetaSet("net/vpc", map[string]string{maxSizeTag: "1MB"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&DescribeCmd{File: "net/vpc"}).Execute([]string{""}); err != nil {
+		t.Fatalf("clear failed: %v", err)
+	}
+	if tags, _ := ds.MetaRead("net/vpc"); len(tags) != 1 || ds.Description("net/vpc") != "" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+	if err := ds.MetaSet("net/vpc", map[string]string{maxSizeTag: ""}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "net", "vpc", metaFile)); !os.IsNotExist(err) {
+		t.Errorf("meta not removed: %v", err)
+	}
+}
+
+func TestDescribe_View(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	writeAt(t, &ds, "prod", time.Now())
+	if err := ds.SetDescription("prod", "*prod* VPC <img src=x onerror=alert(1)>"); err != nil {
+		t.Fatalf("describe failed: %v", err)
+	}
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/"})
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/view/prod", nil))
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, `<div class="description text-muted mb-2"><p><em>prod</em> VPC &lt;img`) {
+		t.Errorf("description not shown: %d %s", rr.Code, body)
+	}
+	if strings.Contains(body, "<img") {
+		t.Errorf("html not escaped: %s", body)
+	}
+}
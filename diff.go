@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/yudai/gojsondiff"
+)
+
+// maxDiffSize limits the size of the contents compared by POST ?diff=true
+const maxDiffSize = 64 << 20
+
+// DiffResult is the result of comparing contents with a version of a file
+type DiffResult struct {
+	Identical bool `json:"identical"`
+	// Diff shows the changes from the version to the contents, empty if identical
+	Diff string `json:"diff,omitempty"`
+}
+
+// diffContents compares the stored contents with the candidate: JSON objects with the same JSON-aware diff as
+// the diff page, anything else byte by byte
+func diffContents(stored []byte, candidate []byte) (DiffResult, error) {
+	a, b := map[string]interface{}{}, map[string]interface{}{}
+	if json.Unmarshal(stored, &a) != nil || json.Unmarshal(candidate, &b) != nil {
+		if bytes.Equal(stored, candidate) {
+			return DiffResult{Identical: true}, nil
+		}
+		return DiffResult{Diff: fmt.Sprintf("contents differ: %d bytes stored, %d bytes given\n", len(stored), len(candidate))}, nil
+	}
+	if !gojsondiff.New().CompareObjects(a, b).Modified() {
+		return DiffResult{Identical: true}, nil
+	}
+	res, err := asciiDiff(a, b)
+	return DiffResult{Diff: res}, err
+}
+
+// readVersion reads a version of the file, current if empty
+func readVersion(ds DsIf, name string, version string) ([]byte, error) {
+	if version == "" {
+		version = "current"
+	}
+	rd, err := ds.ReadHistory(name, version)
+	if err != nil {
+		slog.Error("cannot read", "name", name, "version", version, "error", err)
+		return nil, ErrNotFound
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+// APIDiff handles POST ?diff=true: the body is compared with the current version, or the one given by
+// ?history=, ?at= or ?backup=1, without writing it
+func (h *APIHandler) APIDiff(path string, w io.Writer, r *http.Request) error {
+	hist, err := h.requestedHistory(path, r)
+	if err != nil {
+		return err
+	}
+	stored, err := readVersion(h.ds, path, hist)
+	if err != nil {
+		return err
+	}
+	candidate, err := io.ReadAll(io.LimitReader(r.Body, maxDiffSize+1))
+	if err != nil {
+		return err
+	}
+	if len(candidate) > maxDiffSize {
+		return ErrTooLarge
+	}
+	res, err := diffContents(stored, candidate)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(res)
+}
+
+// DiffCmd compares a local file, or another version, with a version of a file
+type DiffCmd struct {
+	Local string `long:"local" description:"local file compared with the file given as name[@version], - for stdin"`
+}
+
+func (cmd *DiffCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	var stored, candidate []byte
+	var err error
+	switch {
+	case cmd.Local != "" && len(args) == 1:
+		name, version := args[0], ""
+		if idx := strings.LastIndex(name, "@"); idx != -1 {
+			name, version = name[:idx], name[idx+1:]
+		}
+		if stored, err = readVersion(&root, name, version); err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		if cmd.Local == "-" {
+			candidate, err = io.ReadAll(os.Stdin)
+		} else {
+			candidate, err = os.ReadFile(cmd.Local)
+		}
+	case cmd.Local == "" && (len(args) == 2 || len(args) == 3):
+		// name a [b]: from version a to b, current if omitted
+		other := ""
+		if len(args) == 3 {
+			other = args[2]
+		}
+		if stored, err = readVersion(&root, args[0], args[1]); err != nil {
+			return fmt.Errorf("%s@%s: %w", args[0], args[1], err)
+		}
+		candidate, err = readVersion(&root, args[0], other)
+	default:
+		return fmt.Errorf("expected --local file name[@version], or name version [version]")
+	}
+	if err != nil {
+		return err
+	}
+	res, err := diffContents(stored, candidate)
+	if err != nil {
+		return err
+	}
+	if res.Identical {
+		return nil
+	}
+	fmt.Print(res.Diff)
+	return ErrDifferent
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffContents(t *testing.T) {
+	tests := []struct {
+		stored    string
+		candidate string
+		identical bool
+		diff      string
+	}{
+		{`{"a":1,"b":[1,2]}`, "{\n  \"b\": [1, 2],\n  \"a\": 1\n}\n", true, ""},
+		{`{"a":1,"b":2}`, `{"a":1,"b":3}`, false, "-  \"b\": 2\n+  \"b\": 3"},
+		{"plain text", "plain text", true, ""},
+		{"plain text", "other text", false, "contents differ: 10 bytes stored, 10 bytes given"},
+		{`{"a":1}`, "not json", false, "contents differ"},
+	}
+	for _, test := range tests {
+		res, err := diffContents([]byte(test.stored), []byte(test.candidate))
+		if err != nil || res.Identical != test.identical || !strings.Contains(res.Diff, test.diff) || test.identical != (res.Diff == "") {
+			t.Errorf("%q %q: unexpected %+v %v", test.stored, test.candidate, res, err)
+		}
+	}
+}
+
+func TestDiffCmd(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	versions := writeAt(t, &ds, "prod/app", time.Now().Add(-time.Hour), time.Now())
+	local := filepath.Join(t.TempDir(), "app.tfstate")
+	if err := os.WriteFile(local, []byte(`{"v": 2}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(func() error { return (&DiffCmd{Local: local}).Execute([]string{"prod/app"}) })
+	if err != nil || out != "" {
+		t.Errorf("expected identical: %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&DiffCmd{Local: local}).Execute([]string{"prod/app@" + versions[0]}) })
+	if err != ErrDifferent || !strings.Contains(out, "-  \"v\": 1\n+  \"v\": 2") {
+		t.Errorf("expected the diff from the version: %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&DiffCmd{}).Execute([]string{"prod/app", versions[0], versions[1]}) })
+	if err != ErrDifferent || !strings.Contains(out, "+  \"v\": 2") {
+		t.Errorf("expected the diff of the versions: %q %v", out, err)
+	}
+	if err := os.WriteFile(local, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = captureStdout(func() error { return (&DiffCmd{Local: local}).Execute([]string{"prod/app"}) })
+	if err != ErrDifferent || !strings.Contains(out, "contents differ") {
+		t.Errorf("expected non-json to differ: %q %v", out, err)
+	}
+	for _, args := range [][]string{{"missing"}, {"prod/app@nope"}, {}} {
+		if err := (&DiffCmd{Local: local}).Execute(args); err == nil || err == ErrDifferent {
+			t.Errorf("%v: expected an error, got %v", args, err)
+		}
+	}
+
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+	os.Args = []string{"program", "-d", tmp, "diff", "--local", local, "prod/app"}
+	if code := realMain(); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+}
+
+func TestAPIDiff(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	versions := writeAt(t, &ds, "prod", time.Now().Add(-time.Hour), time.Now())
+	h := &APIHandler{ds: &ds, events: NewEventBroker()}
+	diff := func(path string, body string) (int, DiffResult) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		res := DiffResult{}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Fatalf("invalid response %s: %v", rr.Body.String(), err)
+			}
+		}
+		return rr.Code, res
+	}
+	if code, res := diff("/prod?diff=true", "{\"v\":2}\n"); code != http.StatusOK || !res.Identical || res.Diff != "" {
+		t.Errorf("expected identical: %d %+v", code, res)
+	}
+	if code, res := diff("/prod?diff=true", `{"v":3}`); code != http.StatusOK || res.Identical || !strings.Contains(res.Diff, "+  \"v\": 3") {
+		t.Errorf("expected a diff: %d %+v", code, res)
+	}
+	if code, res := diff("/prod?diff=true&history="+versions[0], `{"v":1}`); code != http.StatusOK || !res.Identical {
+		t.Errorf("expected identical to the version: %d %+v", code, res)
+	}
+	if code, res := diff("/prod?diff=true", "not json"); code != http.StatusOK || res.Identical || !strings.Contains(res.Diff, "contents differ") {
+		t.Errorf("expected non-json to differ: %d %+v", code, res)
+	}
+	if code, _ := diff("/missing?diff=true", "{}"); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	// nothing written
+	if hist := ds.History(t.Context(), "prod"); len(hist) != 2 || ds.CurrentVersion("prod") != versions[1] {
+		t.Errorf("diff changed the file: %+v", hist)
+	}
+	if evs := h.events.Recent(0); len(evs) != 0 {
+		t.Errorf("unexpected events %+v", evs)
+	}
+}
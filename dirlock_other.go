@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// flockDir is not supported on this platform, so operations are only excluded within the process
+func flockDir(path string, wait bool) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// diskFree is not supported on this platform, so --min-free-bytes does not refuse writes
+func diskFree(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// doctorTarget is the set of operations exercised by the doctor command
+type doctorTarget interface {
+	Write(name string, data []byte) error
+	Read(name string) ([]byte, error)
+	Lock(name string, lockinfo string) error
+	Unlock(name string, lockinfo string) error
+	History(name string) ([]FileEntry, error)
+	Rollback(name string, history string) error
+	Prune(name string, keep int) error
+	Delete(name string) error
+	Cleanup(name string)
+	// Capabilities returns what the target supports, or nil if it does not tell
+	Capabilities() (*Capabilities, error)
+}
+
+// dsTarget runs the doctor directly against the data directory
+type dsTarget struct {
+	ds Datastore
+}
+
+func (t *dsTarget) Write(name string, data []byte) error {
+	sum := md5.Sum(data)
+	return t.ds.Write(context.Background(), name, bytes.NewReader(data), sum[:], "")
+}
+
+func (t *dsTarget) Read(name string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := t.ds.Read(context.Background(), name, buf)
+	return buf.Bytes(), err
+}
+
+func (t *dsTarget) Lock(name string, lockinfo string) error {
+	return t.ds.Lock(name, lockinfo)
+}
+
+func (t *dsTarget) Unlock(name string, lockinfo string) error {
+	return t.ds.Unlock(name, lockinfo)
+}
+
+func (t *dsTarget) History(name string) ([]FileEntry, error) {
+	return t.ds.History(context.Background(), name), nil
+}
+
+func (t *dsTarget) Rollback(name string, history string) error {
+	return t.ds.Rollback(name, history)
+}
+
+func (t *dsTarget) Prune(name string, keep int) error {
+	return t.ds.Prune(context.Background(), name, keep, false)
+}
+
+func (t *dsTarget) Delete(name string) error {
+	return t.ds.Delete(name)
+}
+
+func (t *dsTarget) Capabilities() (*Capabilities, error) {
+	return nil, nil
+}
+
+func (t *dsTarget) Cleanup(name string) {
+	if path, err := t.ds.File(name); err == nil {
+		if err := t.ds.RootDir.RemoveAll(path); err != nil {
+			slog.Warn("cleanup failed", "name", name, "error", err)
+		}
+	}
+}
+
+// httpTarget runs the doctor against a running server
+type httpTarget struct {
+	base   string
+	user   string
+	client *http.Client
+}
+
+func (t *httpTarget) do(method string, name string, query url.Values, body []byte, hdr http.Header) ([]byte, error) {
+	u := t.base + "/api/" + strings.TrimPrefix(name, "/")
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	if user, pass, ok := strings.Cut(t.user, ":"); ok {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return res, nil
+	case http.StatusNotFound:
+		return res, ErrNotFound
+	case http.StatusConflict, http.StatusLocked:
+		return res, ErrLocked
+	}
+	return res, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+}
+
+func (t *httpTarget) Write(name string, data []byte) error {
+	sum := md5.Sum(data)
+	hdr := http.Header{}
+	hdr.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	_, err := t.do(http.MethodPost, name, nil, data, hdr)
+	return err
+}
+
+func (t *httpTarget) Read(name string) ([]byte, error) {
+	return t.do(http.MethodGet, name, nil, nil, nil)
+}
+
+func (t *httpTarget) Lock(name string, lockinfo string) error {
+	_, err := t.do("LOCK", name, nil, []byte(lockinfo), nil)
+	return err
+}
+
+func (t *httpTarget) Unlock(name string, lockinfo string) error {
+	_, err := t.do("UNLOCK", name, nil, []byte(lockinfo), nil)
+	return err
+}
+
+func (t *httpTarget) History(name string) ([]FileEntry, error) {
+	body, err := t.do(http.MethodGet, name, url.Values{"versions": {"true"}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := []FileEntry{}
+	err = json.Unmarshal(body, &res)
+	return res, err
+}
+
+func (t *httpTarget) Rollback(name string, history string) error {
+	_, err := t.do(http.MethodPost, name, url.Values{"rollback": {history}}, nil, nil)
+	return err
+}
+
+func (t *httpTarget) Prune(name string, keep int) error {
+	_, err := t.do(http.MethodPost, name, url.Values{"prune": {strconv.Itoa(keep)}}, nil, nil)
+	return err
+}
+
+func (t *httpTarget) Delete(name string) error {
+	_, err := t.do(http.MethodDelete, name, nil, nil, nil)
+	return err
+}
+
+func (t *httpTarget) Capabilities() (*Capabilities, error) {
+	body, err := t.do(http.MethodGet, "+capabilities", nil, nil, nil)
+	if err == ErrNotFound {
+		// older server, assume everything is supported
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := &Capabilities{}
+	err = json.Unmarshal(body, res)
+	return res, err
+}
+
+func (t *httpTarget) Cleanup(name string) {
+	// only what the API allows: drop old versions and the current pointer; the API cannot remove the version
+	// current pointed to and the directory, which are left on the server
+	t.Prune(name, 0)
+	t.Delete(name)
+	slog.Warn("the last version of the probe is left on the server, remove its directory from the data directory", "name", name)
+}
+
+// Doctor exercises the datastore end to end and reports the result of each step
+type Doctor struct {
+	URL  string `long:"url" description:"server url (default: use data directory)"`
+	User string `short:"u" long:"user" description:"basic auth username:password"`
+	Name string `long:"name" description:"probe state name"`
+}
+
+// doctorStep is a single check of the doctor command, skipped if the target lacks the feature
+type doctorStep struct {
+	name    string
+	feature string
+	fn      func() error
+}
+
+func (cmd *Doctor) target() doctorTarget {
+	if cmd.URL != "" {
+		return &httpTarget{
+			base:   strings.TrimSuffix(strings.TrimSuffix(cmd.URL, "/"), "/api"),
+			user:   cmd.User,
+			client: &http.Client{Timeout: 30 * time.Second},
+		}
+	}
+	return &dsTarget{ds: openDatastore()}
+}
+
+func (cmd *Doctor) Execute(args []string) error {
+	init_log()
+	name := cmd.Name
+	if name == "" {
+		name = "doctor-probe-" + strconv.FormatInt(time.Now().UnixNano(), 32)
+	}
+	tgt := cmd.target()
+	caps, err := tgt.Capabilities()
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "FAIL %-14s %s\n", "capabilities", err)
+		return ErrCheckFailed
+	}
+	if caps != nil {
+		slog.Info("server", "version", caps.Version, "features", caps.Features)
+	}
+	v1 := []byte(`{"version":4,"serial":1,"lineage":"statesaver-doctor"}`)
+	v2 := []byte(`{"version":4,"serial":2,"lineage":"statesaver-doctor"}`)
+	lockinfo := `{"ID":"` + name + `","Operation":"doctor","Who":"statesaver"}`
+	locked := false
+	var history []FileEntry
+	readCompare := func(expected []byte) error {
+		got, err := tgt.Read(name)
+		if err != nil {
+			return err
+		}
+		if md5.Sum(got) != md5.Sum(expected) {
+			return fmt.Errorf("digest mismatch: %q", string(got))
+		}
+		return nil
+	}
+	steps := []doctorStep{
+		{"write", "", func() error { return tgt.Write(name, v1) }},
+		{"read", "", func() error { return readCompare(v1) }},
+		{"lock", "lock", func() error {
+			err := tgt.Lock(name, lockinfo)
+			locked = err == nil
+			return err
+		}},
+		{"lock-conflict", "lock", func() error {
+			other := `{"ID":"` + name + `-other","Operation":"doctor","Who":"statesaver"}`
+			switch err := tgt.Lock(name, other); err {
+			case ErrLocked:
+				return nil
+			case nil:
+				tgt.Unlock(name, other)
+				return fmt.Errorf("locked twice with different IDs")
+			default:
+				return err
+			}
+		}},
+		{"unlock", "lock", func() error {
+			err := tgt.Unlock(name, lockinfo)
+			locked = locked && err != nil
+			return err
+		}},
+		{"write-version", "", func() error { return tgt.Write(name, v2) }},
+		{"history", "versions", func() error {
+			var err error
+			if history, err = tgt.History(name); err != nil {
+				return err
+			}
+			if len(history) < 2 {
+				return fmt.Errorf("expected 2 versions, got %d", len(history))
+			}
+			if !history[0].Locked {
+				return fmt.Errorf("current is not the newest version")
+			}
+			return nil
+		}},
+		{"rollback", "rollback", func() error {
+			if len(history) == 0 {
+				return fmt.Errorf("no history to roll back to")
+			}
+			if err := tgt.Rollback(name, history[len(history)-1].Name); err != nil {
+				return err
+			}
+			return readCompare(v1)
+		}},
+		{"prune", "prune", func() error {
+			if err := tgt.Prune(name, 0); err != nil {
+				return err
+			}
+			hist, err := tgt.History(name)
+			if err != nil {
+				return err
+			}
+			if len(hist) != 1 {
+				return fmt.Errorf("expected 1 version after prune, got %d", len(hist))
+			}
+			return nil
+		}},
+		{"delete", "delete", func() error {
+			if err := tgt.Delete(name); err != nil {
+				return err
+			}
+			if _, err := tgt.Read(name); err != ErrNotFound {
+				return fmt.Errorf("still readable after delete: %v", err)
+			}
+			return nil
+		}},
+	}
+	failed := 0
+	for _, s := range steps {
+		if caps != nil && s.feature != "" && !caps.Has(s.feature) {
+			fmt.Fprintf(os.Stdout, "SKIP %-14s %10s not supported\n", s.name, "")
+			continue
+		}
+		st := time.Now()
+		err := s.fn()
+		elapsed := time.Since(st)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stdout, "FAIL %-14s %10s %s\n", s.name, elapsed.Round(time.Microsecond), err)
+			break
+		}
+		fmt.Fprintf(os.Stdout, "PASS %-14s %10s\n", s.name, elapsed.Round(time.Microsecond))
+	}
+	if locked {
+		tgt.Unlock(name, lockinfo)
+	}
+	tgt.Cleanup(name)
+	if failed != 0 {
+		return ErrCheckFailed
+	}
+	return nil
+}
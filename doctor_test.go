@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDoctor_HTTP(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api/", &APIHandler{ds: &ds, basepath: "/api/"}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cmd := &Doctor{URL: srv.URL, Name: "probe"}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("Doctor.Execute() failed: %v\n%s", err, out)
+	}
+	for _, step := range []string{"write", "read", "lock", "lock-conflict", "unlock", "write-version", "history", "rollback", "prune", "delete"} {
+		if !strings.Contains(out, "PASS "+step+" ") {
+			t.Errorf("step %s not passed: %s", step, out)
+		}
+	}
+	if hist := ds.History(t.Context(), "probe"); len(hist) != 0 {
+		t.Errorf("probe not cleaned up: %+v", hist)
+	}
+	// the API cannot remove the last version
+	if vers, err := ds.blobs().ListVersions("probe"); err != nil || len(vers) != 1 {
+		t.Errorf("expected the last version left: %+v %v", vers, err)
+	}
+}
+
+func TestDoctor_Local(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	cmd := &Doctor{Name: "probe"}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("Doctor.Execute() failed: %v\n%s", err, out)
+	}
+	if strings.Contains(out, "FAIL") || !strings.Contains(out, "PASS lock-conflict ") {
+		t.Errorf("unexpected failure: %s", out)
+	}
+	files, _ := os.ReadDir(tmp)
+	if len(files) != 0 {
+		t.Errorf("probe not cleaned up: %+v", files)
+	}
+}
+
+func TestDoctor_Failure(t *testing.T) {
+	ds := &mockDS{writeErr: ErrInvalidHash}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api/", &APIHandler{ds: ds, basepath: "/api/"}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cmd := &Doctor{URL: srv.URL + "/api/"}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != ErrCheckFailed {
+		t.Errorf("expected ErrCheckFailed, got %v", err)
+	}
+	if !strings.Contains(out, "FAIL write") {
+		t.Errorf("expected write failure: %s", out)
+	}
+}
@@ -2,32 +2,118 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"mime"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/confluentinc/go-editor"
+	"github.com/spf13/afero"
 )
 
 // LsTree lists the files in the datastore
 type LsTree struct {
+	Preview bool `long:"preview" description:"show a short extract of the contents"`
+	MaxSize bool `long:"max-size" description:"scan history and show the number of versions and the largest version"`
+	JSON    bool `short:"j" long:"json" description:"output as json, with the entries which could not be read"`
+	Long    bool `short:"l" long:"long" description:"show the terraform serial and version, and the description of the files"`
 }
 
-func (cmd *LsTree) do1(root Datastore, prefix string) error {
-	err := root.Walk(prefix, func(e FileEntry) error {
-		locked := ""
-		if e.Locked {
-			locked = " (locked)"
+// lsEntry is a file listed by ls --json
+type lsEntry struct {
+	DetailEntry
+	Held        bool   `json:"held,omitempty"`
+	Preview     string `json:"preview,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// MarshalJSON adds the time in the display zone
+func (e lsEntry) MarshalJSON() ([]byte, error) {
+	type alias lsEntry
+	return json.Marshal(struct {
+		alias
+		TimestampLocal string
+	}{alias(e), localTime(e.Timestamp)})
+}
+
+// lsResult is the output of ls --json
+type lsResult struct {
+	Files   []lsEntry     `json:"files"`
+	Errors  []WalkFailure `json:"errors"`
+	Aliases []AliasEntry  `json:"aliases"`
+}
+
+func (cmd *LsTree) entry(root Datastore, e DetailEntry) lsEntry {
+	res := lsEntry{DetailEntry: e, Held: root.Held(e.Name)}
+	if cmd.Long {
+		res.Description = root.Description(e.Name)
+	}
+	if cmd.Long || cmd.JSON {
+		res.Terraform = root.StateHeader(e.Name, "")
+	}
+	if cmd.Preview {
+		if p, err := PreviewFile(&root, e.Name); err == nil {
+			res.Preview = p.String()
+		}
+	}
+	return res
+}
+
+func (cmd *LsTree) print(e lsEntry) {
+	locked := ""
+	if e.Locked {
+		locked = " (locked)"
+	}
+	if e.Held {
+		locked += " (hold)"
+	}
+	line := fmt.Sprintf("%s %6d %s%s", showTime(e.Timestamp), e.Size, e.Name, locked)
+	if cmd.MaxSize {
+		line += fmt.Sprintf("  versions=%d max=%d (%s)", e.Versions, e.MaxSize, e.MaxVersion)
+	}
+	if cmd.Preview {
+		line += "  " + e.Preview
+	}
+	if e.Terraform != nil {
+		line += "  " + e.Terraform.String()
+	}
+	if e.Description != "" {
+		line += "  # " + oneLine(e.Description)
+	}
+	fmt.Println(line)
+}
+
+func (cmd *LsTree) do1(ctx context.Context, root Datastore, prefix string, res *lsResult) error {
+	skipped, err := root.WalkSkipped(ctx, prefix, func(e FileEntry) error {
+		detail := DetailEntry{FileEntry: e}
+		if cmd.MaxSize {
+			detail = root.Detail(ctx, e)
+		}
+		ent := cmd.entry(root, detail)
+		if cmd.JSON {
+			res.Files = append(res.Files, ent)
+		} else {
+			cmd.print(ent)
 		}
-		fmt.Printf("%s %6d %s%s\n", e.Timestamp.Format(time.RFC3339), e.Size, e.Name, locked)
 		return nil
 	})
+	res.Errors = append(res.Errors, skipped...)
+	if !cmd.JSON {
+		for _, v := range skipped {
+			fmt.Fprintf(os.Stderr, "skipped %s: %s\n", v.Name, v.Error)
+		}
+	}
 	if err != nil {
 		slog.Error("walk error", "error", err, "root", root.RootDir)
 	}
@@ -36,43 +122,96 @@ func (cmd *LsTree) do1(root Datastore, prefix string) error {
 
 func (cmd *LsTree) Execute(args []string) error {
 	init_log()
-	root := NewDatastore(option.Datadir)
+	root := openDatastore()
+	ctx, stop := commandContext()
+	defer stop()
 	if len(args) == 0 {
 		args = append(args, "/")
 	}
+	aliases, err := openAliases()
+	if err != nil {
+		return err
+	}
+	res := lsResult{Files: []lsEntry{}, Errors: []WalkFailure{}, Aliases: []AliasEntry{}}
 	for _, v := range args {
-		if err := cmd.do1(root, v); err != nil {
+		if err := cmd.do1(ctx, root, v, &res); err != nil {
 			return err
 		}
+		res.Aliases = append(res.Aliases, aliases.Entries(v)...)
+	}
+	if !cmd.JSON {
+		for _, a := range res.Aliases {
+			fmt.Printf("%s -> %s (alias)\n", a.Name, a.Target)
+		}
+	}
+	if cmd.JSON {
+		return json.NewEncoder(os.Stdout).Encode(res)
 	}
 	return nil
 }
 
 // Cat outputs the contents of files in the datastore
 type Cat struct {
-	JSON bool `short:"j" long:"json" description:"read as json, output compat json"`
+	JSON     bool          `short:"j" long:"json" description:"read as json, output compat json"`
+	Indent   bool          `long:"indent" description:"pretty-print json with two-space indentation"`
+	SortKeys bool          `long:"sort-keys" description:"sort keys of json objects"`
+	Select   string        `long:"select" description:"output only the value at a path like .outputs.vpc_id.value"`
+	Timeout  time.Duration `long:"timeout" description:"give up reading after this duration, e.g. 30s (exit code 3)"`
 }
 
 func (cmd *Cat) Execute(args []string) error {
 	init_log()
-	root := NewDatastore(option.Datadir)
+	root := openDatastore()
+	replica := openReplica()
+	sigctx, stop := commandContext()
+	defer stop()
+	ctx, cancel := withTimeout(sigctx, cmd.Timeout)
+	defer cancel()
+	asJSON := cmd.JSON || cmd.Indent || cmd.SortKeys
 	for _, v := range args {
-		if !cmd.JSON {
-			if err := root.Read(v, os.Stdout); err != nil {
+		if ctype := root.ContentType(v); (asJSON || cmd.Select != "") && !isJSONType(ctype) {
+			slog.Error("not json", "name", v, "content-type", ctype)
+			return fmt.Errorf("%s is %s: %w", v, ctype, ErrNotJSON)
+		}
+		if cmd.Select != "" {
+			buf := bytes.Buffer{}
+			if err := readWithReplica(ctx, &root, replica, v, &buf); err != nil {
+				slog.Error("read error", "error", err, "name", v)
+				return err
+			}
+			if err := writeSelected(buf.Bytes(), cmd.Select, v); err != nil {
+				return err
+			}
+		} else if !asJSON {
+			p := newProgress(v, root.versionSize(v, ""))
+			err := readWithReplica(ctx, &root, replica, v, p.writer(os.Stdout))
+			p.finish()
+			if err != nil {
 				slog.Error("read error", "error", err, "name", v)
 				return err
 			}
 		} else {
 			buf := bytes.Buffer{}
-			if err := root.Read(v, &buf); err != nil {
+			if err := readWithReplica(ctx, &root, replica, v, &buf); err != nil {
 				slog.Error("read error", "error", err, "name", v)
 				return err
 			}
-			enc := json.NewEncoder(os.Stdout)
-			if err := enc.Encode(root.ParseJSON(buf.String())); err != nil {
+			if !cmd.Indent && !cmd.SortKeys {
+				// the compat output of --json as before: keys sorted and HTML escaped
+				if err := json.NewEncoder(os.Stdout).Encode(root.ParseJSON(buf.String())); err != nil {
+					slog.Error("encode error", "error", err, "name", v)
+					return err
+				}
+				continue
+			}
+			out, err := FormatJSON(buf.Bytes(), cmd.Indent, cmd.SortKeys)
+			if err != nil {
 				slog.Error("encode error", "error", err, "name", v)
 				return err
 			}
+			if _, err := os.Stdout.Write(out); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -80,10 +219,16 @@ func (cmd *Cat) Execute(args []string) error {
 
 // Put stores files into the datastore
 type Put struct {
-	Prefix string `short:"p" long:"prefix" description:"output prefix"`
-	Lock   string `long:"lock" description:"lock string"`
-	Hash   bool   `long:"hash" description:"using hash"`
-	NoJson bool   `long:"no-json" description:"do not validate JSON"`
+	Prefix           string        `short:"p" long:"prefix" description:"output prefix"`
+	Lock             string        `long:"lock" description:"lock string"`
+	Hash             bool          `long:"hash" description:"using hash"`
+	NoJson           bool          `long:"no-json" description:"do not validate JSON"`
+	NoHistory        bool          `long:"no-history" description:"replace the current version instead of adding to the history"`
+	Normalize        bool          `long:"normalize-json" description:"store JSON with sorted keys and fixed indentation, skipping files equal to the current version"`
+	NormalizeNewline bool          `long:"normalize-newline" description:"end JSON with exactly one newline, skipping files equal to the current version"`
+	Timeout          time.Duration `long:"timeout" description:"give up writing after this duration, e.g. 30s (exit code 3); no partial version is left"`
+	// ContentType is recorded for the files; JSON is only validated for JSON files
+	ContentType string `long:"content-type" description:"media type of the files, e.g. application/octet-stream (default: as recorded, or application/json)"`
 }
 
 // LockStruct represents a lock structure
@@ -93,7 +238,13 @@ type LockStruct struct {
 
 func (cmd *Put) Execute(args []string) error {
 	init_log()
-	root := NewDatastore(option.Datadir)
+	root := openDatastore()
+	root.NormalizeJSON = cmd.Normalize
+	root.NormalizeNewline = cmd.NormalizeNewline
+	sigctx, stop := commandContext()
+	defer stop()
+	ctx, cancel := withTimeout(sigctx, cmd.Timeout)
+	defer cancel()
 	for _, v := range args {
 		fp, err := os.Open(v)
 		if err != nil {
@@ -101,7 +252,16 @@ func (cmd *Put) Execute(args []string) error {
 			continue
 		}
 		defer fp.Close()
-		if !cmd.NoJson {
+		ctype := cmd.ContentType
+		if ctype == "" {
+			ctype = root.ContentType(cmd.Prefix + v)
+		}
+		mediatype, _, err := mime.ParseMediaType(ctype)
+		if err != nil {
+			slog.Error("invalid content type", "content-type", ctype, "error", err)
+			return err
+		}
+		if !cmd.NoJson && isJSONType(mediatype) {
 			buf := &bytes.Buffer{}
 			if _, err := io.Copy(buf, fp); err != nil {
 				slog.Error("read file", "name", v, "error", err)
@@ -114,9 +274,26 @@ func (cmd *Put) Execute(args []string) error {
 			// Reset file pointer
 			fp.Seek(0, io.SeekStart)
 		}
-		err = root.Write(cmd.Prefix+v, fp, []byte{}, cmd.Lock)
-		if err != nil {
+		var total int64
+		if st, err := fp.Stat(); err == nil {
+			total = st.Size()
+		}
+		p := newProgress(v, total)
+		if cmd.NoHistory {
+			err = root.Replace(ctx, cmd.Prefix+v, p.reader(fp), []byte{}, cmd.Lock)
+		} else {
+			err = root.Write(ctx, cmd.Prefix+v, p.reader(fp), []byte{}, cmd.Lock)
+		}
+		p.finish()
+		if interrupted(err) {
+			slog.Error("put interrupted", "error", err, "name", cmd.Prefix+v)
+			return err
+		} else if err != nil {
 			slog.Error("put failed", "error", err, "name", cmd.Prefix+v)
+		} else if cmd.ContentType != "" {
+			if err := root.SetContentType(cmd.Prefix+v, mediatype); err != nil {
+				slog.Error("content type not recorded", "error", err, "name", cmd.Prefix+v)
+			}
 		}
 	}
 	return nil
@@ -124,89 +301,664 @@ func (cmd *Put) Execute(args []string) error {
 
 // History lists the history of files in the datastore
 type History struct {
+	All   bool          `short:"a" long:"all" description:"list the versions of all files under the prefixes (default /), newest first"`
+	Since time.Duration `long:"since" description:"only versions written within the duration, e.g. 168h"`
+	JSON  bool          `short:"j" long:"json" description:"output as json"`
 }
 
 func (cmd *History) Execute(args []string) error {
 	init_log()
-	root := NewDatastore(option.Datadir)
+	root := openDatastore()
+	ctx, stop := commandContext()
+	defer stop()
+	since := time.Time{}
+	if cmd.Since != 0 {
+		since = time.Now().Add(-cmd.Since)
+	}
+	if cmd.All {
+		if len(args) == 0 {
+			args = append(args, "/")
+		}
+		return cmd.printAll(ctx, root, args, since)
+	}
+	res := []HistoryEntry{}
 	for _, v := range args {
-		fmt.Println(v)
-		for _, e := range root.History(v) {
+		if !cmd.JSON {
+			fmt.Println(v)
+		}
+		for _, e := range root.History(ctx, v) {
+			if e.Timestamp.Before(since) {
+				break
+			}
+			if cmd.JSON {
+				res = append(res, HistoryEntry{State: v, Version: e.Name, Timestamp: e.Timestamp, Size: e.Size, Current: e.Locked, Terraform: e.Terraform})
+				continue
+			}
 			current := ""
 			if e.Locked {
 				current = " (current)"
 			}
-			fmt.Printf("%s %6d %s%s\n", e.Timestamp.Format(time.RFC3339), e.Size, e.Name, current)
+			if e.Terraform != nil {
+				current += "  " + e.Terraform.String()
+			}
+			fmt.Printf("%s %6d %s%s\n", showTime(e.Timestamp), e.Size, e.Name, current)
 		}
 	}
+	if cmd.JSON {
+		return json.NewEncoder(os.Stdout).Encode(res)
+	}
 	return nil
 }
 
+// printAll prints the versions of all files as they are merged, so the list is not held in memory
+func (cmd *History) printAll(ctx context.Context, root Datastore, prefixes []string, since time.Time) error {
+	enc := json.NewEncoder(os.Stdout)
+	sep := "["
+	err := root.WalkHistory(ctx, prefixes, since, func(e HistoryEntry) error {
+		if cmd.JSON {
+			fmt.Print(sep)
+			sep = ","
+			return enc.Encode(e)
+		}
+		current := ""
+		if e.Current {
+			current = " (current)"
+		}
+		if e.Terraform != nil {
+			current += "  " + e.Terraform.String()
+		}
+		_, err := fmt.Printf("%s %8d %s %s%s\n", showTime(e.Timestamp), e.Size, e.State, e.Version, current)
+		return err
+	})
+	if cmd.JSON {
+		if sep == "[" {
+			fmt.Print(sep)
+		}
+		fmt.Println("]")
+	}
+	return err
+}
+
+// Tree prints the files of a state directory as stored on disk
+type Tree struct {
+	File string `short:"f" long:"file" description:"file name"`
+	All  bool   `short:"a" long:"all" description:"dump the whole datastore"`
+}
+
+func (cmd *Tree) print(root Datastore, dir string, indent string) error {
+	files, err := afero.ReadDir(root.RootDir, dir)
+	if err != nil {
+		slog.Error("readdir", "error", err, "dir", dir)
+		return err
+	}
+	for i, ent := range files {
+		branch, next := "├── ", "│   "
+		if i == len(files)-1 {
+			branch, next = "└── ", "    "
+		}
+		path := filepath.Join(dir, ent.Name())
+		switch {
+		case ent.Mode().Type()&fs.ModeSymlink != 0:
+			target, err := root.RootDir.ReadlinkIfPossible(path)
+			if err != nil {
+				target = "?"
+			}
+			dangling := ""
+			if _, err := root.RootDir.Stat(path); err != nil {
+				dangling = " (dangling)"
+			}
+			fmt.Printf("%s%s%s -> %s%s\n", indent, branch, ent.Name(), target, dangling)
+		case ent.IsDir():
+			fmt.Printf("%s%s%s/\n", indent, branch, ent.Name())
+			if cmd.All && !root.skipDir(path, ent) {
+				if err := cmd.print(root, path, indent+next); err != nil {
+					return err
+				}
+			}
+		default:
+			fmt.Printf("%s%s%s %d %s\n", indent, branch, ent.Name(), ent.Size(), showTime(ent.ModTime()))
+		}
+	}
+	return nil
+}
+
+func (cmd *Tree) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	name := cmd.File
+	if cmd.All {
+		name = "/"
+	} else if name == "" {
+		return fmt.Errorf("file name (-f) or --all is required")
+	}
+	dir, err := root.File(name)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	if _, err := root.RootDir.Stat(dir); err != nil {
+		slog.Error("stat", "name", name, "error", err)
+		return ErrNotFound
+	}
+	fmt.Println(name)
+	return cmd.print(root, dir, "")
+}
+
 // Prune removes old history entries from the datastore
 type Prune struct {
 	Keep int  `short:"k" long:"keep" description:"keep generations" default:"5"`
 	Dry  bool `short:"n" long:"dry-run" description:"do not remove"`
 	All  bool `short:"a" long:"all" description:"walk and prune"`
+	JSON bool `short:"j" long:"json" description:"output the report as json"`
+}
+
+// PruneReport lists the files a prune removed versions of, with totals
+type PruneReport struct {
+	Dry       bool          `json:"dry"`
+	States    []PruneResult `json:"states"`
+	Versions  int           `json:"versions"`
+	Reclaimed int64         `json:"reclaimed"`
+	Failed    []WalkFailure `json:"failed,omitempty"`
+}
+
+// Add records the result of a file if anything was removed
+func (r *PruneReport) Add(res PruneResult) {
+	if res.Before == res.After {
+		return
+	}
+	r.States = append(r.States, res)
+	r.Versions += res.Before - res.After
+	r.Reclaimed += res.Reclaimed
+}
+
+// Print writes the report as text
+func (r *PruneReport) Print(w io.Writer) {
+	for _, res := range r.States {
+		fmt.Fprintf(w, "%s: %d -> %d versions, %s\n", res.Name, res.Before, res.After, humanizeBytes(res.Reclaimed))
+	}
+	dry := ""
+	if r.Dry {
+		dry = " (dry run)"
+	}
+	for _, f := range r.Failed {
+		fmt.Fprintf(w, "%s: failed: %s\n", f.Name, f.Error)
+	}
+	fmt.Fprintf(w, "total: %d files, %d versions, %s reclaimed%s\n", len(r.States), r.Versions, humanizeBytes(r.Reclaimed), dry)
 }
 
 func (cmd *Prune) Execute(args []string) error {
 	init_log()
-	root := NewDatastore(option.Datadir)
+	root := openDatastore()
+	// Ctrl-C stops a long prune between removals
+	ctx, stop := commandContext()
+	defer stop()
 	if len(args) == 0 {
 		args = append(args, "/")
 	}
+	report := PruneReport{Dry: cmd.Dry, States: []PruneResult{}}
+	err := cmd.prune(ctx, root, args, &report)
+	// the report of an interrupted prune shows what was already removed
+	if cmd.JSON {
+		if err1 := json.NewEncoder(os.Stdout).Encode(report); err1 != nil {
+			return err1
+		}
+	} else {
+		report.Print(os.Stdout)
+	}
+	return err
+}
+
+func (cmd *Prune) prune(ctx context.Context, root Datastore, args []string, report *PruneReport) error {
 	if cmd.All {
+		errs := []error{}
 		for _, v := range args {
-			if err := root.Walk(v, func(e FileEntry) error {
+			// a file which cannot be pruned does not stop the others
+			res, err := root.WalkAll(ctx, v, func(e FileEntry) error {
 				slog.Info("try prune", "name", e.Name, "keep", cmd.Keep, "dry", cmd.Dry)
-				return root.Prune(e.Name, cmd.Keep, cmd.Dry)
-			}); err != nil {
+				res, err := root.PruneDetail(ctx, e.Name, cmd.Keep, cmd.Dry)
+				report.Add(res)
+				return err
+			})
+			if err != nil {
 				return err
 			}
+			for _, f := range res.Failed {
+				report.Failed = append(report.Failed, f)
+				slog.Error("prune failed", "name", f.Name, "error", f.Error)
+			}
+			errs = append(errs, res.Err())
 		}
-	} else {
-		for _, v := range args {
-			fmt.Println(v)
-			if err := root.Prune(v, cmd.Keep, cmd.Dry); err != nil {
-				slog.Error("prune failed", "name", v, "error", err)
+		return errors.Join(errs...)
+	}
+	for _, v := range args {
+		res, err := root.PruneDetail(ctx, v, cmd.Keep, cmd.Dry)
+		report.Add(res)
+		if err != nil {
+			slog.Error("prune failed", "name", v, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// LockList lists the locked files in the datastore
+type LockList struct {
+	Stale time.Duration `long:"stale" description:"show locks held longer than this"`
+	JSON  bool          `short:"j" long:"json" description:"output as json"`
+}
+
+func (cmd *LockList) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	if len(args) == 0 {
+		args = append(args, "/")
+	}
+	res := []LockEntry{}
+	for _, v := range args {
+		locks, err := root.Locks(v)
+		if err != nil {
+			slog.Error("walk error", "error", err, "prefix", v)
+			return err
+		}
+		res = append(res, StaleLocks(locks, cmd.Stale)...)
+	}
+	if cmd.JSON {
+		return json.NewEncoder(os.Stdout).Encode(res)
+	}
+	for _, l := range res {
+		who := ""
+		if info, ok := l.LockInfo.(map[string]interface{}); ok {
+			who = fmt.Sprintf(" %v %v", info["ID"], info["Who"])
+			if srv, ok := info[lockServerKey].(map[string]interface{}); ok {
+				who += fmt.Sprintf(" (from %v", srv["remote_addr"])
+				if user, ok := srv["user"]; ok {
+					who += fmt.Sprintf(" as %v", user)
+				}
+				who += ")"
+			}
+		}
+		fmt.Printf("%s %10s %s%s\n", showTime(l.Timestamp), l.Age.Truncate(time.Second), l.Path, who)
+	}
+	return nil
+}
+
+// Info shows summary information of files in the datastore
+type Info struct {
+	JSON bool `short:"j" long:"json" description:"output as json"`
+}
+
+func (cmd *Info) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	for _, v := range args {
+		info, err := root.Info(v)
+		if err != nil {
+			slog.Error("info failed", "name", v, "error", err)
+			return err
+		}
+		if cmd.JSON {
+			if err := json.NewEncoder(os.Stdout).Encode(info); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Println(v)
+		fmt.Printf("  current:   %s\n", info.Current)
+		fmt.Printf("  newest:    %s\n", info.Newest)
+		fmt.Printf("  versions:  %d\n", info.Versions)
+		fmt.Printf("  locked:    %t\n", info.Locked)
+		fmt.Printf("  protected: %t\n", info.Protected)
+		if info.Hold != nil {
+			fmt.Printf("  hold:      since %s %s\n", showTime(info.Hold.Since), info.Hold.Reason)
+		} else {
+			fmt.Printf("  hold:      false\n")
+		}
+		if info.MaxSize != 0 {
+			fmt.Printf("  max size:  %s\n", humanizeBytes(info.MaxSize))
+		}
+		switch {
+		case info.Dangling:
+			fmt.Printf("  status:    current points to missing version\n")
+		case info.IsNewest:
+			fmt.Printf("  status:    current is newest\n")
+		default:
+			fmt.Printf("  status:    current is %d version(s) behind newest (%s)\n", info.Behind, info.BehindBy)
+		}
+	}
+	return nil
+}
+
+// ProtectCmd makes files immutable
+type ProtectCmd struct {
+}
+
+func (cmd *ProtectCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	for _, v := range args {
+		if err := root.Protect(v); err != nil {
+			slog.Error("protect failed", "name", v, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// UnprotectCmd makes immutable files writable again
+type UnprotectCmd struct {
+}
+
+func (cmd *UnprotectCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	for _, v := range args {
+		if err := root.Unprotect(v); err != nil {
+			slog.Error("unprotect failed", "name", v, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay writes a directory of exported versions into a file, oldest first
+type Replay struct {
+	File         string `short:"f" long:"file" required:"true" description:"target state name"`
+	From         string `long:"from" required:"true" description:"directory of version files"`
+	ByName       bool   `long:"by-name" description:"order by file name instead of modification time"`
+	PreserveTime bool   `long:"preserve-time" description:"set the timestamp of each version to that of its source file"`
+	NoJson       bool   `long:"no-json" description:"do not validate JSON"`
+	Dry          bool   `short:"n" long:"dry-run" description:"validate only"`
+}
+
+// replaySource is a version file to be replayed
+type replaySource struct {
+	path    string
+	modtime time.Time
+	data    []byte
+}
+
+func (cmd *Replay) sources(root Datastore) ([]replaySource, error) {
+	ents, err := os.ReadDir(cmd.From)
+	if err != nil {
+		slog.Error("read dir", "from", cmd.From, "error", err)
+		return nil, err
+	}
+	res := []replaySource{}
+	for _, ent := range ents {
+		if ent.IsDir() || strings.HasPrefix(ent.Name(), ".") {
+			continue
+		}
+		fi, err := ent.Info()
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(cmd.From, ent.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("read file", "name", path, "error", err)
+			return nil, err
+		}
+		if !cmd.NoJson && root.ParseJSON(string(data)) == nil {
+			slog.Error("invalid json", "name", path)
+			return nil, fmt.Errorf("%s: invalid json", path)
+		}
+		res = append(res, replaySource{path: path, modtime: fi.ModTime(), data: data})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if !cmd.ByName && !res[i].modtime.Equal(res[j].modtime) {
+			return res[i].modtime.Before(res[j].modtime)
+		}
+		return res[i].path < res[j].path
+	})
+	return res, nil
+}
+
+func (cmd *Replay) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	ctx, stop := commandContext()
+	defer stop()
+	// validate everything before writing anything
+	srcs, err := cmd.sources(root)
+	if err != nil {
+		return err
+	}
+	imported := 0
+	for _, src := range srcs {
+		slog.Info("replay", "name", cmd.File, "source", src.path, "modtime", src.modtime, "dry", cmd.Dry)
+		if cmd.Dry {
+			continue
+		}
+		sum := md5.Sum(src.data)
+		if err := root.Write(ctx, cmd.File, bytes.NewReader(src.data), sum[:], ""); err != nil {
+			slog.Error("write failed", "name", cmd.File, "source", src.path, "error", err)
+			fmt.Printf("imported %d of %d versions into %s\n", imported, len(srcs), cmd.File)
+			return err
+		}
+		if cmd.PreserveTime {
+			path, err := root.File(cmd.File, root.currentTarget(cmd.File))
+			if err == nil {
+				err = root.RootDir.Chtimes(path, src.modtime, src.modtime)
+			}
+			if err != nil {
+				slog.Error("cannot set timestamp", "name", cmd.File, "source", src.path, "error", err)
+				return err
+			}
+		}
+		imported++
+	}
+	if cmd.Dry {
+		fmt.Printf("%d versions to import into %s\n", len(srcs), cmd.File)
+		return nil
+	}
+	fmt.Printf("imported %d versions into %s\n", imported, cmd.File)
+	return nil
+}
+
+// ImportState imports terraform state files as new versions
+type ImportState struct {
+	Name              string `long:"name" description:"target state name"`
+	FromWorkspacesDir string `long:"from-workspaces-dir" description:"import each workspace in terraform.tfstate.d"`
+	NamePrefix        string `long:"name-prefix" description:"prefix of the state names of workspaces"`
+	NewLineage        bool   `long:"new-lineage" description:"rewrite the lineage to avoid collisions"`
+}
+
+func (cmd *ImportState) import1(ctx context.Context, root Datastore, src string, name string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		slog.Error("read file", "name", src, "error", err)
+		return err
+	}
+	state, err := ParseTerraformState(data)
+	if err != nil {
+		slog.Error("not a terraform state", "name", src, "error", err)
+		return err
+	}
+	if cmd.NewLineage {
+		state.Lineage = NewLineage()
+		if data, err = SetLineage(data, state.Lineage); err != nil {
+			return err
+		}
+	}
+	sum := md5.Sum(data)
+	if err := root.Write(ctx, name, bytes.NewReader(data), sum[:], ""); err != nil {
+		slog.Error("write failed", "name", name, "error", err)
+		return err
+	}
+	fmt.Printf("%s -> %s: serial=%d lineage=%s\n", src, name, state.Serial, state.Lineage)
+	return nil
+}
+
+func (cmd *ImportState) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	ctx, stop := commandContext()
+	defer stop()
+	if cmd.FromWorkspacesDir != "" {
+		ents, err := os.ReadDir(cmd.FromWorkspacesDir)
+		if err != nil {
+			slog.Error("read dir", "name", cmd.FromWorkspacesDir, "error", err)
+			return err
+		}
+		imported := 0
+		for _, ent := range ents {
+			src := filepath.Join(cmd.FromWorkspacesDir, ent.Name(), "terraform.tfstate")
+			if !ent.IsDir() {
+				continue
+			}
+			if _, err := os.Stat(src); err != nil {
+				slog.Warn("no state in workspace", "workspace", ent.Name())
+				continue
+			}
+			if err := cmd.import1(ctx, root, src, cmd.NamePrefix+ent.Name()); err != nil {
+				return err
+			}
+			imported++
+		}
+		if imported == 0 {
+			slog.Error("no workspace found", "name", cmd.FromWorkspacesDir)
+			return ErrNotFound
+		}
+		return nil
+	}
+	if len(args) != 1 || cmd.Name == "" {
+		slog.Error("specify a state file and --name, or --from-workspaces-dir")
+		return ErrInvalidPath
+	}
+	return cmd.import1(ctx, root, args[0], cmd.Name)
+}
+
+// Verify checks the consistency of the datastore
+type Verify struct {
+	Fix         bool `long:"fix" description:"recover interrupted operations"`
+	JSON        bool `short:"j" long:"json" description:"output as json"`
+	DedupePaths bool `long:"dedupe-paths" description:"find files duplicated by escaped slashes in their names (merged with --fix)"`
+}
+
+func (cmd *Verify) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	if len(args) == 0 {
+		args = append(args, "/")
+	}
+	res := []VerifyResult{}
+	for _, v := range args {
+		results, err := root.Verify(v, cmd.Fix)
+		if err != nil {
+			slog.Error("verify failed", "prefix", v, "error", err)
+			return err
+		}
+		res = append(res, results...)
+		if cmd.DedupePaths {
+			results, err := root.DedupePaths(v, cmd.Fix)
+			if err != nil {
+				slog.Error("dedupe failed", "prefix", v, "error", err)
 				return err
 			}
+			res = append(res, results...)
 		}
 	}
+	if cmd.JSON {
+		if err := json.NewEncoder(os.Stdout).Encode(res); err != nil {
+			return err
+		}
+	}
+	unfixed := 0
+	for _, r := range res {
+		fixed := ""
+		if r.Fixed {
+			fixed = " (fixed)"
+		} else {
+			unfixed++
+		}
+		if !cmd.JSON {
+			fmt.Printf("%s: %s%s\n", r.Name, r.Problem, fixed)
+		}
+	}
+	if unfixed != 0 {
+		return ErrInconsistent
+	}
 	return nil
 }
 
 // HistoryCat outputs the contents of historical versions of files
 type HistoryCat struct {
-	File string `short:"f" long:"file" description:"file name"`
+	File    string        `short:"f" long:"file" description:"file name"`
+	At      string        `long:"at" description:"also cat the version which was current at the time (RFC 3339 or date)"`
+	Select  string        `long:"select" description:"output only the value at a path like .outputs.vpc_id.value"`
+	Timeout time.Duration `long:"timeout" description:"give up reading after this duration, e.g. 30s (exit code 3)"`
 }
 
 func (cmd *HistoryCat) Execute(args []string) error {
 	init_log()
-	root := NewDatastore(option.Datadir)
+	root := openDatastore()
+	replica := openReplica()
+	sigctx, stop := commandContext()
+	defer stop()
+	ctx, cancel := withTimeout(sigctx, cmd.Timeout)
+	defer cancel()
+	if cmd.At != "" {
+		at, err := parseTime(cmd.At)
+		if err != nil {
+			slog.Error("invalid time", "at", cmd.At, "error", err)
+			return err
+		}
+		ent, err := VersionAt(ctx, &root, cmd.File, at)
+		if err != nil {
+			return err
+		}
+		args = append([]string{ent.Name}, args...)
+	}
 	for _, v := range args {
-		if fp, err := root.ReadHistory(cmd.File, v); err != nil {
+		if fp, err := readHistoryWithReplica(&root, replica, cmd.File, v); err != nil {
 			slog.Error("read failed", "name", cmd.File, "history", v, "error", err)
+		} else if cmd.Select != "" {
+			data, err := io.ReadAll(fp)
+			fp.Close()
+			if err != nil {
+				slog.Error("read failed", "name", cmd.File, "history", v, "error", err)
+				return err
+			}
+			if err := writeSelected(data, cmd.Select, cmd.File); err != nil {
+				return err
+			}
 		} else {
-			if written, err := io.Copy(os.Stdout, fp); err != nil {
+			written, err := copyContext(ctx, os.Stdout, fp, newProgress(v, root.versionSize(cmd.File, v)))
+			fp.Close()
+			if interrupted(err) {
+				slog.Error("read interrupted", "name", cmd.File, "history", v, "written", written, "error", err)
+				return err
+			} else if err != nil {
+				partialReads.Add(1)
 				slog.Error("part read", "name", cmd.File, "history", v, "written", written, "error", err)
+				return err
 			}
-			fp.Close()
 		}
 	}
 	return nil
 }
 
+// writeSelected writes the value at the path of the JSON to stdout
+func writeSelected(data []byte, path string, name string) error {
+	out, err := SelectJSON(data, path)
+	if err != nil {
+		slog.Error("cannot select", "name", name, "select", path, "error", err)
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
 // HistoryRollback rolls back a file to a specified historical version
 type HistoryRollback struct {
-	File    string `short:"f" long:"file" description:"file name" required:"true"`
-	History string `short:"t" long:"history" description:"rollback to" required:"true"`
+	File      string `short:"f" long:"file" description:"file name" required:"true"`
+	History   string `short:"t" long:"history" description:"rollback to" required:"true"`
+	IfCurrent string `long:"if-current" description:"rollback only if this version is still current"`
 }
 
 func (cmd *HistoryRollback) Execute(args []string) error {
 	init_log()
-	root := NewDatastore(option.Datadir)
-	return root.Rollback(cmd.File, cmd.History)
+	root := openDatastore()
+	return root.RollbackIf(cmd.File, cmd.History, cmd.IfCurrent)
 }
 
 type chkjson struct {
@@ -233,22 +985,26 @@ type Editor interface {
 
 func (cmd *EditFile) Execute(args []string) error {
 	init_log()
-	root := NewDatastore(option.Datadir)
+	root := openDatastore()
 	buf := &bytes.Buffer{}
-	if err := root.Read(args[0], buf); err != nil {
+	if err := root.Read(context.Background(), args[0], buf); err != nil {
 		slog.Error("read failed", "name", args[0], "error", err)
 		return err
 	}
 	slog.Info("launch editor", "name", args[0])
 	schema := &chkjson{ds: root}
+	isJSON := isJSONType(root.ContentType(args[0]))
 	var edit Editor
-	if !cmd.NoJson {
+	if !cmd.NoJson && isJSON {
 		edit = editor.NewValidatingEditor(schema)
 	} else {
 		edit = editor.NewEditor()
 	}
 	old := buf.Bytes()
-	olddata := root.ParseJSON(string(old))
+	var olddata map[string]interface{}
+	if isJSON {
+		olddata = root.ParseJSON(string(old))
+	}
 	if olddata != nil {
 		if b, err := json.MarshalIndent(olddata, "", "  "); err == nil {
 			old = b
@@ -267,11 +1023,10 @@ func (cmd *EditFile) Execute(args []string) error {
 		slog.Info("no changes made", "name", args[0])
 		return ErrNotChanged
 	}
-	newdata := root.ParseJSON(string(edited))
-	if olddata != nil && newdata != nil && reflect.DeepEqual(olddata, newdata) {
+	if olddata != nil && reflect.DeepEqual(olddata, root.ParseJSON(string(edited))) {
 		slog.Info("no changes in data", "name", args[0])
 		return ErrNotChanged
 	}
 	slog.Info("change", "name", args[0], "before", string(old), "after", string(edited))
-	return root.Write(args[0], bytes.NewReader(edited), []byte{}, "")
+	return root.Write(context.Background(), args[0], bytes.NewReader(edited), []byte{}, "")
 }
@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // captureStdout captures stdout during function execution
@@ -34,7 +39,7 @@ func TestLsTree_Execute(t *testing.T) {
 	// Setup test data
 	ds := NewDatastore(tmp)
 	reader := strings.NewReader("test content")
-	if err := ds.Write("file1", reader, []byte{}, ""); err != nil {
+	if err := ds.Write(t.Context(), "file1", reader, []byte{}, ""); err != nil {
 		t.Fatalf("Write failed: %v", err)
 	}
 
@@ -49,6 +54,130 @@ func TestLsTree_Execute(t *testing.T) {
 	}
 }
 
+func TestLsTree_ExecutePreview(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	tfstate := `{"version": 4, "terraform_version": "1.5.7", "serial": 3, "resources": [{"name": "a"}]}`
+	if err := ds.Write(t.Context(), "tf", strings.NewReader(tfstate), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := ds.Write(t.Context(), "bin", strings.NewReader("\x00\x01"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	cmd := &LsTree{Preview: true}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("LsTree.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "terraform 1.5.7, serial 3, 1 resources") {
+		t.Errorf("expected terraform preview in output, got: %q", out)
+	}
+	if !strings.Contains(out, `"\x00\x01"`) {
+		t.Errorf("expected escaped preview in output, got: %q", out)
+	}
+}
+
+func TestLsTree_ExecuteMaxSize(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	for _, s := range []string{strings.Repeat("x", 100), "y"} {
+		if err := ds.Write(t.Context(), "file1", strings.NewReader(s), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cmd := &LsTree{MaxSize: true}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("LsTree.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "versions=2 max=100") {
+		t.Errorf("expected max size in output, got: %q", out)
+	}
+}
+
+func TestLsTree_ExecuteJSON(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"file1", "broken"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	target, err := os.Readlink(filepath.Join(tmp, "broken", "current"))
+	if err != nil {
+		t.Fatalf("readlink failed: %v", err)
+	}
+	os.Remove(filepath.Join(tmp, "broken", target))
+
+	cmd := &LsTree{JSON: true}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("LsTree.Execute() failed: %v", err)
+	}
+	res := lsResult{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("invalid json %q: %v", out, err)
+	}
+	if len(res.Files) != 1 || res.Files[0].Name != "/file1" {
+		t.Errorf("unexpected files: %+v", res.Files)
+	}
+	if len(res.Errors) != 1 || res.Errors[0].Name != "/broken" {
+		t.Errorf("unexpected errors: %+v", res.Errors)
+	}
+}
+
+func TestLsTree_ExecuteExclude(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir, origExclude := option.Datadir, option.Exclude
+	option.Datadir = tmp
+	option.Exclude = []string{".snapshot", "tmp*"}
+	defer func() { option.Datadir, option.Exclude = origDatadir, origExclude }()
+
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"keep", "tmp1/x", "a/.snapshot/hourly"} {
+		for _, s := range []string{"v1", "v2"} {
+			if err := ds.Write(t.Context(), name, strings.NewReader(s), []byte{}, ""); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+
+	cmd := &LsTree{}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("LsTree.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "/keep") || strings.Contains(out, "tmp1") || strings.Contains(out, "snapshot") {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	prune := &Prune{Keep: 0, All: true}
+	if _, err := captureStdout(func() error { return prune.Execute([]string{}) }); err != nil {
+		t.Fatalf("Prune.Execute() failed: %v", err)
+	}
+	if hist := ds.History(t.Context(), "keep"); len(hist) != 1 {
+		t.Errorf("expected keep to be pruned, got %d versions", len(hist))
+	}
+	if hist := ds.History(t.Context(), "tmp1/x"); len(hist) != 2 {
+		t.Errorf("expected excluded file to be untouched, got %d versions", len(hist))
+	}
+}
+
 func TestCat_Execute(t *testing.T) {
 	tmp := t.TempDir()
 	origDatadir := option.Datadir
@@ -59,7 +188,7 @@ func TestCat_Execute(t *testing.T) {
 	ds := NewDatastore(tmp)
 	content := "hello world"
 	reader := strings.NewReader(content)
-	if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+	if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 		t.Fatalf("Write failed: %v", err)
 	}
 
@@ -82,9 +211,9 @@ func TestCat_ExecuteJSON(t *testing.T) {
 
 	// Setup test data with JSON content
 	ds := NewDatastore(tmp)
-	content := `{"key":"value"}`
+	content := `{"key":"value", "html":"<b>"}`
 	reader := strings.NewReader(content)
-	if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+	if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 		t.Fatalf("Write failed: %v", err)
 	}
 
@@ -94,8 +223,9 @@ func TestCat_ExecuteJSON(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Cat.Execute(JSON) failed: %v", err)
 	}
-	if !strings.Contains(out, "key") || !strings.Contains(out, "value") {
-		t.Errorf("expected JSON output with key/value, got: %q", out)
+	// keys sorted and HTML escaped, as --json always did
+	if expected := "{\"html\":\"\\u003cb\\u003e\",\"key\":\"value\"}\n"; out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
 	}
 }
 
@@ -136,7 +266,7 @@ func TestPut_ExecuteNoJson(t *testing.T) {
 	// Verify the file was written
 	ds := NewDatastore(tmp)
 	var buf bytes.Buffer
-	if err := ds.Read("prefix_"+tmpFile, &buf); err != nil {
+	if err := ds.Read(t.Context(), "prefix_"+tmpFile, &buf); err != nil {
 		t.Errorf("Read after Put failed: %v", err)
 	}
 	if buf.String() != "test data" {
@@ -165,7 +295,7 @@ func TestPut_Execute(t *testing.T) {
 	// Verify the file was written
 	ds := NewDatastore(tmp)
 	var buf bytes.Buffer
-	if err := ds.Read("prefix_"+tmpFile, &buf); err != nil {
+	if err := ds.Read(t.Context(), "prefix_"+tmpFile, &buf); err != nil {
 		t.Errorf("Read after Put failed: %v", err)
 	}
 	if buf.String() != `{"hello":"world"}` {
@@ -191,6 +321,27 @@ func TestPut_ExecuteWithPrefix(t *testing.T) {
 	}
 }
 
+func TestPut_ExecuteNoHistory(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	if err := os.WriteFile(filepath.Join(tmp, "in.json"), []byte(`{"v":1}`), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	ds := NewDatastore(tmp)
+	for _, noHistory := range []bool{false, true, true} {
+		cmd := &Put{Prefix: "p", NoHistory: noHistory}
+		if err := cmd.Execute([]string{filepath.Join(tmp, "in.json")}); err != nil {
+			t.Fatalf("Put.Execute() failed: %v", err)
+		}
+	}
+	if hist := ds.History(t.Context(), "p"+filepath.Join(tmp, "in.json")); len(hist) != 1 {
+		t.Errorf("expected 1 version, got %v", hist)
+	}
+}
+
 func TestHistory_Execute(t *testing.T) {
 	tmp := t.TempDir()
 	origDatadir := option.Datadir
@@ -201,7 +352,7 @@ func TestHistory_Execute(t *testing.T) {
 	ds := NewDatastore(tmp)
 	for i := 0; i < 3; i++ {
 		reader := strings.NewReader("version " + string(rune(48+i)))
-		if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+		if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 			t.Fatalf("Write failed: %v", err)
 		}
 	}
@@ -217,6 +368,47 @@ func TestHistory_Execute(t *testing.T) {
 	}
 }
 
+func TestTree_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "dir/test", strings.NewReader("v1"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := ds.Lock("dir/test", `{"ID":"lock1"}`); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	current := ds.History(t.Context(), "dir/test")[0].Name
+
+	cmd := &Tree{File: "dir/test"}
+	out, err := captureStdout(func() error { return cmd.Execute(nil) })
+	if err != nil {
+		t.Fatalf("Tree.Execute() failed: %v", err)
+	}
+	for _, expected := range []string{"dir/test\n", "├── " + current + " 2 ", "current -> " + current + "\n", "└── lock "} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in output, got: %q", expected, out)
+		}
+	}
+
+	cmd = &Tree{All: true}
+	out, err = captureStdout(func() error { return cmd.Execute(nil) })
+	if err != nil {
+		t.Fatalf("Tree.Execute() --all failed: %v", err)
+	}
+	if !strings.Contains(out, "└── dir/\n    └── test/\n") || !strings.Contains(out, "        ├── current -> ") {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	cmd = &Tree{File: "missing"}
+	if _, err := captureStdout(func() error { return cmd.Execute(nil) }); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
 func TestPrune_Execute(t *testing.T) {
 	tmp := t.TempDir()
 	origDatadir := option.Datadir
@@ -227,7 +419,7 @@ func TestPrune_Execute(t *testing.T) {
 	ds := NewDatastore(tmp)
 	for i := 0; i < 5; i++ {
 		reader := strings.NewReader("version " + string(rune(48+i)))
-		if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+		if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 			t.Fatalf("Write failed: %v", err)
 		}
 	}
@@ -239,7 +431,7 @@ func TestPrune_Execute(t *testing.T) {
 	}
 
 	// Verify pruning
-	hist := ds.History("test")
+	hist := ds.History(t.Context(), "test")
 	if len(hist) > 3 { // current + keep
 		t.Errorf("expected <= 3 versions after prune, got %d", len(hist))
 		t.Logf("history: %+v", hist)
@@ -256,12 +448,12 @@ func TestPrune_DryRun(t *testing.T) {
 	ds := NewDatastore(tmp)
 	for i := 0; i < 3; i++ {
 		reader := strings.NewReader("version " + string(rune(48+i)))
-		if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+		if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 			t.Fatalf("Write failed: %v", err)
 		}
 	}
 
-	hist := ds.History("test")
+	hist := ds.History(t.Context(), "test")
 	originalCount := len(hist)
 
 	cmd := &Prune{Keep: 1, Dry: true, All: false}
@@ -271,7 +463,7 @@ func TestPrune_DryRun(t *testing.T) {
 	}
 
 	// Verify nothing was deleted
-	hist = ds.History("test")
+	hist = ds.History(t.Context(), "test")
 	if len(hist) != originalCount {
 		t.Errorf("expected %d versions after dry-run, got %d", originalCount, len(hist))
 	}
@@ -287,12 +479,12 @@ func TestHistoryCat_Execute(t *testing.T) {
 	ds := NewDatastore(tmp)
 	content := "historical content"
 	reader := strings.NewReader(content)
-	if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+	if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 		t.Fatalf("Write failed: %v", err)
 	}
 
 	// Get the history name
-	hist := ds.History("test")
+	hist := ds.History(t.Context(), "test")
 	if len(hist) == 0 {
 		t.Fatalf("no history found")
 	}
@@ -308,6 +500,30 @@ func TestHistoryCat_Execute(t *testing.T) {
 	}
 }
 
+func TestHistoryCat_ExecuteAt(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	base := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	writeAt(t, &ds, "test", base, base.Add(time.Hour))
+
+	out, err := captureStdout(func() error {
+		return (&HistoryCat{File: "test", At: "2024-06-01T12:59:59Z"}).Execute(nil)
+	})
+	if err != nil || out != `{"v":1}` {
+		t.Errorf("unexpected output: %q %v", out, err)
+	}
+	if err := (&HistoryCat{File: "test", At: "2024-05-31"}).Execute(nil); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound before the first version, got %v", err)
+	}
+	if err := (&HistoryCat{File: "test", At: "noon"}).Execute(nil); err == nil {
+		t.Errorf("expected error for invalid time")
+	}
+}
+
 func TestHistoryRollback_Execute(t *testing.T) {
 	tmp := t.TempDir()
 	origDatadir := option.Datadir
@@ -319,11 +535,11 @@ func TestHistoryRollback_Execute(t *testing.T) {
 
 	// Write version 1
 	reader := strings.NewReader("version1")
-	if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+	if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 		t.Fatalf("Write version1 failed: %v", err)
 	}
 
-	hist := ds.History("test")
+	hist := ds.History(t.Context(), "test")
 	if len(hist) == 0 {
 		t.Fatalf("no history found")
 	}
@@ -331,7 +547,7 @@ func TestHistoryRollback_Execute(t *testing.T) {
 
 	// Write version 2
 	reader = strings.NewReader("version2")
-	if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+	if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 		t.Fatalf("Write version2 failed: %v", err)
 	}
 
@@ -344,7 +560,7 @@ func TestHistoryRollback_Execute(t *testing.T) {
 
 	// Verify rollback
 	var buf bytes.Buffer
-	if err := ds.Read("test", &buf); err != nil {
+	if err := ds.Read(t.Context(), "test", &buf); err != nil {
 		t.Errorf("Read after rollback failed: %v", err)
 	}
 	if buf.String() != "version1" {
@@ -362,7 +578,7 @@ func TestCat_ExecuteJSON_InvalidJSON(t *testing.T) {
 	ds := NewDatastore(tmp)
 	content := `not valid json`
 	reader := strings.NewReader(content)
-	if err := ds.Write("test", reader, []byte{}, ""); err != nil {
+	if err := ds.Write(t.Context(), "test", reader, []byte{}, ""); err != nil {
 		t.Fatalf("Write failed: %v", err)
 	}
 
@@ -384,7 +600,7 @@ func TestPrune_All(t *testing.T) {
 		fname := "file" + string(rune(49+i))
 		for j := 0; j < 3; j++ {
 			reader := strings.NewReader("v" + string(rune(49+j)))
-			if err := ds.Write(fname, reader, []byte{}, ""); err != nil {
+			if err := ds.Write(t.Context(), fname, reader, []byte{}, ""); err != nil {
 				t.Fatalf("Write failed: %v", err)
 			}
 		}
@@ -395,4 +611,429 @@ func TestPrune_All(t *testing.T) {
 	if err != nil {
 		t.Errorf("Prune.Execute(all) failed: %v", err)
 	}
+
+	// a file which cannot be pruned does not stop the others
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"file1", "file2"} {
+			if err := ds.Write(t.Context(), name, strings.NewReader("w"+string(rune(49+i))), []byte{}, ""); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+	if err := ds.Hold("file1", "audit"); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if !errors.Is(err, ErrHeld) {
+		t.Errorf("expected the held file to fail, got %v", err)
+	}
+	if !strings.Contains(out, "/file1: failed: under retention hold") || !strings.Contains(out, "/file2: 3 -> 1 versions") {
+		t.Errorf("unexpected output: %q", out)
+	}
+	if hist := ds.History(t.Context(), "file2"); len(hist) != 1 {
+		t.Errorf("file2 not pruned after the failure: %d versions", len(hist))
+	}
+}
+
+func TestPrune_Report(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"a", "b/c"} {
+		for i := 0; i < 4; i++ {
+			if err := ds.Write(t.Context(), name, strings.NewReader("1234"), []byte{}, ""); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+	if err := ds.Write(t.Context(), "single", strings.NewReader("1234"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	out, err := captureStdout(func() error {
+		return (&Prune{Keep: 1, Dry: true, All: true, JSON: true}).Execute([]string{})
+	})
+	if err != nil {
+		t.Fatalf("Prune.Execute(dry) failed: %v", err)
+	}
+	report := PruneReport{}
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("invalid json %q: %v", out, err)
+	}
+	expected := PruneReport{Dry: true, States: []PruneResult{
+		{Name: "/a", Before: 4, After: 1, Reclaimed: 12},
+		{Name: "/b/c", Before: 4, After: 1, Reclaimed: 12},
+	}, Versions: 6, Reclaimed: 24}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("unexpected dry run report: %+v", report)
+	}
+	if hist := ds.History(t.Context(), "a"); len(hist) != 4 {
+		t.Errorf("dry run removed versions: %d left", len(hist))
+	}
+
+	out, err = captureStdout(func() error {
+		return (&Prune{Keep: 2}).Execute([]string{"a", "single"})
+	})
+	if err != nil {
+		t.Fatalf("Prune.Execute() failed: %v", err)
+	}
+	if out != "a: 4 -> 2 versions, 8 B\ntotal: 1 files, 2 versions, 8 B reclaimed\n" {
+		t.Errorf("unexpected report: %q", out)
+	}
+	if hist := ds.History(t.Context(), "a"); len(hist) != 2 {
+		t.Errorf("expected 2 versions left, got %d", len(hist))
+	}
+}
+
+func TestLockList_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"a", "b"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := ds.Lock("a", `{"ID":"xyz","Who":"someone","_server":{"remote_addr":"192.0.2.1:1234","user":"alice"}}`); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	cmd := &LockList{}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("LockList.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "/a xyz someone (from 192.0.2.1:1234 as alice)") || strings.Contains(out, "/b") {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	cmd = &LockList{JSON: true, Stale: time.Hour}
+	out, err = captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("LockList.Execute(json) failed: %v", err)
+	}
+	if strings.TrimSpace(out) != "[]" {
+		t.Errorf("expected no stale locks, got %q", out)
+	}
+}
+
+func TestInfo_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	for i := 0; i < 2; i++ {
+		if err := ds.Write(t.Context(), "test", strings.NewReader("v"+string(rune(49+i))), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	hist := ds.History(t.Context(), "test")
+	if err := ds.Rollback("test", hist[1].Name); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	cmd := &Info{}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{"test"}) })
+	if err != nil {
+		t.Fatalf("Info.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "1 version(s) behind newest") {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
+
+func TestVerify_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "test", strings.NewReader("v1"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	ds.failpoint = crashAt(journalWrite, "data")
+	if err := ds.Write(t.Context(), "test", strings.NewReader("v2"), []byte{}, ""); err != errCrash {
+		t.Fatalf("expected crash, got %v", err)
+	}
+
+	cmd := &Verify{}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != ErrInconsistent {
+		t.Errorf("expected ErrInconsistent, got %v", err)
+	}
+	if !strings.Contains(out, "/test: interrupted write") {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	cmd = &Verify{Fix: true}
+	out, err = captureStdout(func() error { return cmd.Execute([]string{}) })
+	if err != nil {
+		t.Errorf("Verify.Execute(fix) failed: %v", err)
+	}
+	if !strings.Contains(out, "(fixed)") {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
+
+func TestCat_ExecuteIndent(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "test", strings.NewReader(`{"serial":18446744073709551615,"a":1}`), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	cmd := &Cat{Indent: true, SortKeys: true}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{"test"}) })
+	if err != nil {
+		t.Fatalf("Cat.Execute(indent) failed: %v", err)
+	}
+	expected := "{\n  \"a\": 1,\n  \"serial\": 18446744073709551615\n}\n"
+	if out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestReplay_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	src := t.TempDir()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// names are in reverse order of the timestamps
+	for i, name := range []string{"c.json", "b.json", "a.json"} {
+		path := filepath.Join(src, name)
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(`{"serial": %d}`, i+1)), 0o644); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		ts := base.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, ts, ts); err != nil {
+			t.Fatalf("chtimes failed: %v", err)
+		}
+	}
+
+	cmd := &Replay{File: "migrated", From: src, PreserveTime: true}
+	out, err := captureStdout(func() error { return cmd.Execute(nil) })
+	if err != nil {
+		t.Fatalf("Replay.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "imported 3 versions into migrated") {
+		t.Errorf("unexpected output: %q", out)
+	}
+	ds := NewDatastore(tmp)
+	hist := ds.History(t.Context(), "migrated")
+	if len(hist) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(hist))
+	}
+	for i, h := range hist {
+		expected := base.Add(time.Duration(2-i) * time.Hour)
+		if !h.Timestamp.Equal(expected) {
+			t.Errorf("version %d: expected %s, got %s", i, expected, h.Timestamp)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := ds.Read(t.Context(), "migrated", buf); err != nil || buf.String() != `{"serial": 3}` {
+		t.Errorf("expected newest as current, got %q %v", buf.String(), err)
+	}
+}
+
+func TestReplay_Invalid(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "1.json"), []byte(`{"serial": 1}`), 0o644)
+	os.WriteFile(filepath.Join(src, "2.json"), []byte(`not json`), 0o644)
+
+	cmd := &Replay{File: "migrated", From: src, ByName: true}
+	if _, err := captureStdout(func() error { return cmd.Execute(nil) }); err == nil {
+		t.Fatalf("expected error for invalid json")
+	}
+	ds := NewDatastore(tmp)
+	if hist := ds.History(t.Context(), "migrated"); len(hist) != 0 {
+		t.Errorf("nothing should be written, got %d versions", len(hist))
+	}
+}
+
+func TestImportState_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	src := t.TempDir()
+	statefile := filepath.Join(src, "terraform.tfstate")
+	if err := os.WriteFile(statefile, []byte(testTFState), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	invalid := filepath.Join(src, "invalid.json")
+	os.WriteFile(invalid, []byte(`{"hello": "world"}`), 0o644)
+
+	cmd := &ImportState{Name: "prod/app"}
+	out, err := captureStdout(func() error { return cmd.Execute([]string{statefile}) })
+	if err != nil {
+		t.Fatalf("ImportState.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "prod/app: serial=12345678901234567 lineage=27074632-8326-ecfb-b44c-84addb04459f") {
+		t.Errorf("unexpected output: %q", out)
+	}
+	if _, err := captureStdout(func() error { return cmd.Execute([]string{invalid}) }); err != ErrInvalidState {
+		t.Errorf("expected ErrInvalidState, got %v", err)
+	}
+
+	cmd = &ImportState{Name: "prod/app", NewLineage: true}
+	out, err = captureStdout(func() error { return cmd.Execute([]string{statefile}) })
+	if err != nil {
+		t.Fatalf("ImportState.Execute() failed: %v", err)
+	}
+	if strings.Contains(out, "27074632-8326-ecfb-b44c-84addb04459f") {
+		t.Errorf("lineage not rewritten: %q", out)
+	}
+	ds := NewDatastore(tmp)
+	if hist := ds.History(t.Context(), "prod/app"); len(hist) != 2 {
+		t.Errorf("expected 2 versions, got %d", len(hist))
+	}
+}
+
+func TestImportState_Workspaces(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	wsdir := filepath.Join(t.TempDir(), "terraform.tfstate.d")
+	for _, ws := range []string{"dev", "stg", "empty"} {
+		if err := os.MkdirAll(filepath.Join(wsdir, ws), 0o755); err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+		if ws == "empty" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(wsdir, ws, "terraform.tfstate"), []byte(testTFState), 0o644); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	cmd := &ImportState{FromWorkspacesDir: wsdir, NamePrefix: "app/"}
+	out, err := captureStdout(func() error { return cmd.Execute(nil) })
+	if err != nil {
+		t.Fatalf("ImportState.Execute() failed: %v", err)
+	}
+	if !strings.Contains(out, "app/dev: serial=") || !strings.Contains(out, "app/stg: serial=") {
+		t.Errorf("unexpected output: %q", out)
+	}
+	ds := NewDatastore(tmp)
+	names := []string{}
+	ds.Walk(t.Context(), "/", func(e FileEntry) error {
+		names = append(names, e.Name)
+		return nil
+	})
+	if strings.Join(names, ",") != "/app/dev,/app/stg" {
+		t.Errorf("unexpected states: %v", names)
+	}
+
+	cmd = &ImportState{FromWorkspacesDir: t.TempDir()}
+	if _, err := captureStdout(func() error { return cmd.Execute(nil) }); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for empty dir, got %v", err)
+	}
+}
+
+func TestHistory_ExecuteAll(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	now := time.Now()
+	// interleaved versions of three files, 10 days old to 1 day old
+	writeAt(t, &ds, "prod/app", now.Add(-240*time.Hour), now.Add(-72*time.Hour), now.Add(-24*time.Hour))
+	writeAt(t, &ds, "prod/net", now.Add(-96*time.Hour), now.Add(-48*time.Hour))
+	writeAt(t, &ds, "dev/app", now.Add(-200*time.Hour), now.Add(-120*time.Hour))
+
+	out, err := captureStdout(func() error {
+		return (&History{All: true, Since: 168 * time.Hour, JSON: true}).Execute([]string{})
+	})
+	if err != nil {
+		t.Fatalf("History.Execute(all) failed: %v", err)
+	}
+	res := []HistoryEntry{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("invalid json %q: %v", out, err)
+	}
+	states := []string{}
+	for i, e := range res {
+		states = append(states, e.State)
+		if i != 0 && e.Timestamp.After(res[i-1].Timestamp) {
+			t.Errorf("not sorted newest first: %+v", res)
+		}
+	}
+	if !reflect.DeepEqual(states, []string{"/prod/app", "/prod/net", "/prod/app", "/prod/net", "/dev/app"}) {
+		t.Errorf("unexpected versions: %v", states)
+	}
+	if !res[0].Current || res[2].Current || res[0].Size == 0 {
+		t.Errorf("unexpected entries: %+v", res)
+	}
+
+	out, err = captureStdout(func() error {
+		return (&History{All: true}).Execute([]string{"/prod/"})
+	})
+	if err != nil {
+		t.Fatalf("History.Execute(all, prefix) failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 5 || !strings.Contains(lines[0], "/prod/app") || !strings.HasSuffix(lines[0], "(current)") || strings.Contains(out, "/dev/") {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	out, _ = captureStdout(func() error {
+		return (&History{All: true, Since: time.Hour, JSON: true}).Execute([]string{})
+	})
+	if strings.TrimSpace(out) != "[]" {
+		t.Errorf("expected no versions, got %q", out)
+	}
+}
+
+func TestCat_ExecuteSelect(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	for _, content := range []string{`{"outputs":{"vpc_id":{"value":"vpc-1"}}}`, `{"outputs":{"vpc_id":{"value":"vpc-2"}}}`} {
+		if err := ds.Write(t.Context(), "test", strings.NewReader(content), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	out, err := captureStdout(func() error { return (&Cat{Select: ".outputs.vpc_id.value"}).Execute([]string{"test"}) })
+	if err != nil || out != "\"vpc-2\"\n" {
+		t.Errorf("Cat.Execute(select): %q %v", out, err)
+	}
+	if _, err := captureStdout(func() error { return (&Cat{Select: ".outputs.subnet"}).Execute([]string{"test"}) }); !errors.Is(err, ErrUnresolved) {
+		t.Errorf("expected ErrUnresolved, got %v", err)
+	}
+	hist := ds.History(t.Context(), "test")
+	out, err = captureStdout(func() error {
+		return (&HistoryCat{File: "test", Select: ".outputs.vpc_id"}).Execute([]string{hist[1].Name})
+	})
+	if err != nil || out != `{"value":"vpc-1"}`+"\n" {
+		t.Errorf("HistoryCat.Execute(select): %q %v", out, err)
+	}
 }
@@ -8,3 +8,25 @@ var ErrInvalidHash = errors.New("hash mismatch")
 var ErrLocked = errors.New("already locked")
 var ErrUnlocked = errors.New("not locked")
 var ErrNotChanged = errors.New("not changed")
+var ErrInconsistent = errors.New("inconsistent")
+var ErrCheckFailed = errors.New("check failed")
+var ErrUnsupportedMedia = errors.New("unsupported media type")
+var ErrProtected = errors.New("protected")
+var ErrHeld = errors.New("under retention hold")
+var ErrForbidden = errors.New("forbidden")
+var ErrExpired = errors.New("expired")
+var ErrInvalidState = errors.New("not a terraform state")
+var ErrExists = errors.New("already exists")
+var ErrNotDatastore = errors.New("not a datastore")
+var ErrNoNamespace = errors.New("namespace does not exist")
+var ErrNotJSON = errors.New("not json")
+var ErrUnresolved = errors.New("path does not resolve")
+var ErrPrecondition = errors.New("current version changed")
+var ErrTooLarge = errors.New("too large")
+var ErrBusy = errors.New("another operation on the file is in progress")
+var ErrRange = errors.New("range not satisfiable")
+var ErrPathConflict = errors.New("path conflict")
+var ErrTimeout = errors.New("timed out")
+var ErrUpstream = errors.New("upstream failed")
+var ErrDifferent = errors.New("different")
+var ErrNoSpace = errors.New("no space left")
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event represents a change of a file in the datastore
+type Event struct {
+	ID      uint64    `json:"id"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Version string    `json:"version,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// DefaultRecentEvents is the default number of events kept for the activity feed
+const DefaultRecentEvents = 100
+
+// EventBroker is an in-process pub/sub of datastore changes, keeping recent events in a ring buffer
+type EventBroker struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	seq    uint64
+	recent []Event
+	size   int
+}
+
+// NewEventBroker creates an EventBroker without subscribers
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subs: make(map[chan Event]struct{}), size: DefaultRecentEvents}
+}
+
+// SetRecentSize changes the number of events kept for the activity feed
+func (b *EventBroker) SetRecentSize(size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size = max(size, 0)
+	if len(b.recent) > b.size {
+		b.recent = append([]Event{}, b.recent[len(b.recent)-b.size:]...)
+	}
+}
+
+// Recent returns the kept events newer than the id, oldest first
+func (b *EventBroker) Recent(since uint64) []Event {
+	res := []Event{}
+	if b == nil {
+		return res
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ev := range b.recent {
+		if ev.ID > since {
+			res = append(res, ev)
+		}
+	}
+	return res
+}
+
+// Subscribe registers a new subscriber
+func (b *EventBroker) Subscribe() chan Event {
+	ch, _ := b.TrySubscribe(0)
+	return ch
+}
+
+// TrySubscribe registers a new subscriber unless there are already limit subscribers (0: no limit)
+func (b *EventBroker) TrySubscribe(limit int) (chan Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit > 0 && len(b.subs) >= limit {
+		return nil, false
+	}
+	ch := make(chan Event, 16)
+	b.subs[ch] = struct{}{}
+	slog.Debug("subscribe", "subscribers", len(b.subs))
+	return ch, true
+}
+
+// Unsubscribe removes the subscriber
+func (b *EventBroker) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	slog.Debug("unsubscribe", "subscribers", len(b.subs))
+}
+
+// Subscribers returns the number of subscribers
+func (b *EventBroker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Publish sends the event to all subscribers, dropping it for subscribers which are too slow
+func (b *EventBroker) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	ev.ID = b.seq
+	if b.size > 0 {
+		if len(b.recent) >= b.size {
+			b.recent = b.recent[len(b.recent)-b.size+1:]
+		}
+		b.recent = append(b.recent, ev)
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			slog.Warn("subscriber too slow, event dropped", "name", ev.Name, "type", ev.Type)
+		}
+	}
+}
+
+// DefaultHeartbeat is the default interval of comments keeping an event stream open
+const DefaultHeartbeat = 30 * time.Second
+
+// readableEvents returns the events of the files the user of the request may read, all of them without an ACL
+func readableEvents(acl *ACL, r *http.Request, evs []Event) []Event {
+	if acl == nil {
+		return evs
+	}
+	user := RequestUser(r)
+	res := make([]Event, 0, len(evs))
+	for _, ev := range evs {
+		if acl.Allowed(user, ev.Name, aclRead) {
+			res = append(res, ev)
+		}
+	}
+	return res
+}
+
+// EventHandler streams datastore changes as server-sent events
+type EventHandler struct {
+	broker    *EventBroker
+	heartbeat time.Duration
+	// maxWatchers limits the number of open streams (0: no limit)
+	maxWatchers int
+	// acl hides the events of files the user cannot read
+	acl *ACL
+}
+
+// ServeHTTP streams events until the client disconnects
+//
+// ?prefix= streams only the events of files under the prefix; events of files the user cannot read are left out.
+func (h *EventHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slog.Info("access", "method", r.Method, "path", r.URL.Path, "user", RequestUser(r))
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("streaming not supported")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	heartbeat := h.heartbeat
+	if heartbeat <= 0 {
+		heartbeat = DefaultHeartbeat
+	}
+	prefix := strings.TrimPrefix(r.URL.Query().Get("prefix"), "/")
+	ch, ok := h.broker.TrySubscribe(h.maxWatchers)
+	if !ok {
+		slog.Warn("too many watchers", "max", h.maxWatchers, "user", RequestUser(r))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer h.broker.Unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.Info("event stream closed", "path", r.URL.Path, "user", RequestUser(r))
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev := <-ch:
+			if !strings.HasPrefix(ev.Name, prefix) || (h.acl != nil && !h.acl.Allowed(RequestUser(r), ev.Name, aclRead)) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.Error("encode event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := NewEventBroker()
+	ch1 := b.Subscribe()
+	ch2 := b.Subscribe()
+	if b.Subscribers() != 2 {
+		t.Fatalf("expected 2 subscribers, got %d", b.Subscribers())
+	}
+	b.Publish(Event{Name: "a", Type: "write"})
+	for _, ch := range []chan Event{ch1, ch2} {
+		ev := <-ch
+		if ev.Name != "a" || ev.Type != "write" || ev.Time.IsZero() {
+			t.Errorf("unexpected event: %+v", ev)
+		}
+	}
+	b.Unsubscribe(ch1)
+	b.Unsubscribe(ch1)
+	if b.Subscribers() != 1 {
+		t.Errorf("expected 1 subscriber, got %d", b.Subscribers())
+	}
+	// slow subscribers must not block publishers
+	for i := 0; i < 100; i++ {
+		b.Publish(Event{Name: "b", Type: "lock"})
+	}
+	var nilBroker *EventBroker
+	nilBroker.Publish(Event{Name: "c"})
+}
+
+func TestEventHandler_Stream(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	broker := NewEventBroker()
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api/", &APIHandler{ds: &ds, basepath: "/api/", events: broker}))
+	mux.Handle("/api/_events", &EventHandler{broker: broker, heartbeat: 10 * time.Millisecond})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/_events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content-type: %q", ct)
+	}
+
+	for _, r := range []struct{ method, body string }{
+		{http.MethodPost, `{"serial":1}`},
+		{"LOCK", `{"ID":"1"}`},
+		{"UNLOCK", `{"ID":"1"}`},
+		{http.MethodDelete, ""},
+	} {
+		req, _ := http.NewRequest(r.method, srv.URL+"/api/state1", strings.NewReader(r.body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("%s failed: %v %+v", r.method, err, res)
+		}
+		res.Body.Close()
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	events := []Event{}
+	heartbeat := false
+	for len(events) < 4 && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ": heartbeat") {
+			heartbeat = true
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			ev := Event{}
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatalf("invalid event: %q", data)
+			}
+			events = append(events, ev)
+		}
+	}
+	types := []string{}
+	for _, ev := range events {
+		types = append(types, ev.Type)
+		if ev.Name != "state1" {
+			t.Errorf("unexpected name: %+v", ev)
+		}
+	}
+	if strings.Join(types, ",") != "write,lock,unlock,delete" {
+		t.Errorf("unexpected events: %v", types)
+	}
+	if events[0].Version == "" {
+		t.Errorf("write event without version: %+v", events[0])
+	}
+	for !heartbeat && scanner.Scan() {
+		heartbeat = strings.HasPrefix(scanner.Text(), ": heartbeat")
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for broker.Subscribers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if broker.Subscribers() != 0 {
+		t.Errorf("subscriber not cleaned up after disconnect")
+	}
+}
+
+func TestEventBroker_Recent(t *testing.T) {
+	b := NewEventBroker()
+	b.SetRecentSize(3)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		b.Publish(Event{Name: name, Type: "write"})
+	}
+	names := func(evs []Event) string {
+		res := []string{}
+		for _, ev := range evs {
+			res = append(res, ev.Name)
+		}
+		return strings.Join(res, ",")
+	}
+	recent := b.Recent(0)
+	if got := names(recent); got != "c,d,e" {
+		t.Errorf("expected oldest to be evicted, got %s", got)
+	}
+	if recent[0].ID != 3 || recent[2].ID != 5 {
+		t.Errorf("unexpected ids: %+v", recent)
+	}
+	if got := names(b.Recent(4)); got != "e" {
+		t.Errorf("expected events after 4, got %s", got)
+	}
+	if got := names(b.Recent(5)); got != "" {
+		t.Errorf("expected no events after 5, got %s", got)
+	}
+	b.SetRecentSize(1)
+	if got := names(b.Recent(0)); got != "e" {
+		t.Errorf("expected shrink to keep newest, got %s", got)
+	}
+	b.SetRecentSize(0)
+	b.Publish(Event{Name: "f"})
+	if got := names(b.Recent(0)); got != "" {
+		t.Errorf("expected no events kept, got %s", got)
+	}
+}
+
+func TestAPIActivity(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	broker := NewEventBroker()
+	h := http.StripPrefix("/api/", &APIHandler{ds: &ds, basepath: "/api/", events: broker})
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+	do(http.MethodPost, "/api/a", `{"serial": 1}`)
+	do("LOCK", "/api/a", `{"ID":"1"}`)
+	do(http.MethodPost, "/api/a?ID=1", `{"serial": 2}`)
+	do("UNLOCK", "/api/a", `{"ID":"1"}`)
+	do(http.MethodPost, "/api/a?prune=0", "")
+	do(http.MethodDelete, "/api/a", "")
+
+	rr := do(http.MethodGet, "/api/+events", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	evs := []Event{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &evs); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	types := []string{}
+	for _, ev := range evs {
+		types = append(types, ev.Type)
+	}
+	if got := strings.Join(types, ","); got != "write,lock,write,unlock,prune,delete" {
+		t.Errorf("unexpected feed order: %s", got)
+	}
+	if evs[0].Version == "" || evs[0].Name != "a" {
+		t.Errorf("unexpected first event: %+v", evs[0])
+	}
+
+	rr = do(http.MethodGet, "/api/+events?since=4", "")
+	evs = []Event{}
+	json.Unmarshal(rr.Body.Bytes(), &evs)
+	if len(evs) != 2 || evs[0].Type != "prune" || evs[1].Type != "delete" {
+		t.Errorf("unexpected events since 4: %+v", evs)
+	}
+	if rr := do(http.MethodGet, "/api/+events?since=x", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid since, got %d", rr.Code)
+	}
+}
+
+func TestHTMLIndex_Activity(t *testing.T) {
+	broker := NewEventBroker()
+	broker.Publish(Event{Name: "a", Type: "write", Version: "v1", User: "alice"})
+	broker.Publish(Event{Name: "b", Type: "lock"})
+	h := &HTMLHandler{ds: &mockDS{}, basepath: "/html/", events: broker}
+	rr := httptest.NewRecorder()
+	http.StripPrefix("/html/", h).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "recent activity") || !strings.Contains(body, "by alice") {
+		t.Errorf("activity panel not rendered: %s", body)
+	}
+	if strings.Index(body, ">b<") > strings.Index(body, ">a<") {
+		t.Errorf("expected newest first: %s", body)
+	}
+}
+
+func TestEventHandler_Watch(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	broker := NewEventBroker()
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api/", &APIHandler{ds: &ds, basepath: "/api/", events: broker}))
+	mux.Handle("/api/+watch", &EventHandler{broker: broker, maxWatchers: 1})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/+watch?prefix=prod/", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("watch failed: %v %+v", err, resp)
+	}
+	defer resp.Body.Close()
+
+	res, err := http.Get(srv.URL + "/api/+watch")
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 over max watchers: %v %+v", err, res)
+	}
+	if err == nil {
+		res.Body.Close()
+	}
+
+	for _, name := range []string{"dev/app", "production", "prod/app"} {
+		res, err := http.Post(srv.URL+"/api/"+name, "application/json", strings.NewReader("{}"))
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("write %s failed: %v %+v", name, err, res)
+		}
+		res.Body.Close()
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			ev := Event{}
+			json.Unmarshal([]byte(data), &ev)
+			if ev.Name != "prod/app" || ev.Type != "write" {
+				t.Errorf("event outside of the prefix: %+v", ev)
+			}
+			break
+		}
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for broker.Subscribers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if broker.Subscribers() != 0 {
+		t.Errorf("watcher not cleaned up after disconnect")
+	}
+}
+
+func TestEvents_ACL(t *testing.T) {
+	broker := NewEventBroker()
+	acl := &ACL{rules: []ACLRule{
+		{Users: []string{"*"}, Pattern: "secret/*", Perms: "-"},
+		{Users: []string{"*"}, Pattern: "*", Perms: "r"},
+	}}
+	asCarol := func(r *http.Request) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), userKey{}, "carol"))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/+watch", &EventHandler{broker: broker, acl: acl})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { mux.ServeHTTP(w, asCarol(r)) }))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/+watch", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("watch failed: %v %+v", err, resp)
+	}
+	defer resp.Body.Close()
+	for broker.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	broker.Publish(Event{Name: "secret/key", Type: "write", User: "alice"})
+	broker.Publish(Event{Name: "open", Type: "write", User: "alice"})
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			if !strings.Contains(data, `"name":"open"`) {
+				t.Errorf("event of an unreadable file streamed: %s", data)
+			}
+			break
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	http.StripPrefix("/api/", &APIHandler{ds: &mockDS{}, events: broker, acl: acl}).ServeHTTP(rr, asCarol(httptest.NewRequest(http.MethodGet, "/api/+events", nil)))
+	if body := rr.Body.String(); strings.Contains(body, "secret") || !strings.Contains(body, `"name":"open"`) {
+		t.Errorf("unexpected feed: %s", body)
+	}
+	rr = httptest.NewRecorder()
+	http.StripPrefix("/html/", &HTMLHandler{ds: &mockDS{}, basepath: "/html/", events: broker, acl: acl}).ServeHTTP(rr, asCarol(httptest.NewRequest(http.MethodGet, "/html/", nil)))
+	if body := rr.Body.String(); strings.Contains(body, "secret") || !strings.Contains(body, "open") {
+		t.Errorf("unexpected activity: %s", body)
+	}
+}
@@ -7,8 +7,10 @@ require (
 	github.com/confluentinc/go-editor v0.11.0
 	github.com/dustin/go-humanize v1.0.1
 	github.com/jessevdk/go-flags v1.6.1
+	github.com/klauspost/compress v1.18.0
 	github.com/spf13/afero v1.15.0
 	github.com/yudai/gojsondiff v1.0.0
+	golang.org/x/crypto v0.46.0
 )
 
 require (
@@ -27,7 +29,6 @@ require (
 	github.com/spf13/cast v1.10.0 // indirect
 	github.com/yudai/golcs v0.0.0-20170316035057-ecda9a501e82 // indirect
 	github.com/yudai/pp v2.0.1+incompatible // indirect
-	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/sys v0.39.0 // indirect
 	golang.org/x/text v0.32.0 // indirect
 )
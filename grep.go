@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// stateRefs is the part of a terraform state which grep matches, the attributes are not decoded
+type stateRefs struct {
+	Resources []struct {
+		Module string `json:"module"`
+		Mode   string `json:"mode"`
+		Type   string `json:"type"`
+		Name   string `json:"name"`
+	} `json:"resources"`
+	Outputs map[string]json.RawMessage `json:"outputs"`
+}
+
+// GrepMatch lists what matched in a version of a file
+type GrepMatch struct {
+	State     string   `json:"state"`
+	Version   string   `json:"version,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+	Outputs   []string `json:"outputs,omitempty"`
+}
+
+// Count returns the number of matches
+func (m GrepMatch) Count() int {
+	return len(m.Resources) + len(m.Outputs)
+}
+
+// matchAddress reports whether the glob matches the resource address, with or without its module path
+func matchAddress(pattern string, addr string, local string) bool {
+	for _, s := range []string{addr, local} {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// grepState finds the resources and outputs matching the globs in a terraform state
+func grepState(data []byte, resources []string, outputs []string) (GrepMatch, error) {
+	res := GrepMatch{}
+	refs := stateRefs{}
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return res, ErrInvalidState
+	}
+	for _, r := range refs.Resources {
+		local := r.Type + "." + r.Name
+		if r.Mode == "data" {
+			local = "data." + local
+		}
+		addr := local
+		if r.Module != "" {
+			addr = r.Module + "." + local
+		}
+		for _, pattern := range resources {
+			if matchAddress(pattern, addr, local) {
+				res.Resources = append(res.Resources, addr)
+				break
+			}
+		}
+	}
+	for key := range refs.Outputs {
+		for _, pattern := range outputs {
+			if ok, _ := path.Match(pattern, key); ok {
+				res.Outputs = append(res.Outputs, key)
+				break
+			}
+		}
+	}
+	sort.Strings(res.Outputs)
+	return res, nil
+}
+
+// Grep finds the files whose current version (or any version with Deep) has matching resources or outputs
+func (d *Datastore) Grep(ctx context.Context, prefix string, resources []string, outputs []string, deep bool, fn func(m GrepMatch) error) error {
+	match := func(name string, version string, rd io.ReadCloser) error {
+		defer rd.Close()
+		data, err := io.ReadAll(ctxReader{ctx, rd})
+		if err != nil {
+			return err
+		}
+		m, err := grepState(data, resources, outputs)
+		if err != nil {
+			slog.Debug("not a terraform state", "name", name, "version", version)
+			return nil
+		}
+		if m.Count() == 0 {
+			return nil
+		}
+		m.State, m.Version = name, version
+		return fn(m)
+	}
+	return d.Walk(ctx, prefix, func(e FileEntry) error {
+		if !deep {
+			rd, err := d.ReadHistory(e.Name, "current")
+			if err != nil {
+				slog.Warn("cannot read", "name", e.Name, "error", err)
+				return nil
+			}
+			return match(e.Name, "", rd)
+		}
+		for _, v := range d.History(ctx, e.Name) {
+			rd, err := d.ReadHistory(e.Name, v.Name)
+			if err != nil {
+				slog.Warn("cannot read", "name", e.Name, "history", v.Name, "error", err)
+				continue
+			}
+			if err := match(e.Name, v.Name, rd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GrepCmd lists the files referencing resources or outputs
+type GrepCmd struct {
+	Resource []string `short:"r" long:"resource" description:"resource address glob, e.g. aws_instance.web or module.vpc.*"`
+	Output   []string `short:"o" long:"output" description:"output name glob"`
+	Deep     bool     `long:"deep" description:"search all versions, not only the current one"`
+	JSON     bool     `short:"j" long:"json" description:"output as json"`
+}
+
+func (cmd *GrepCmd) Execute(args []string) error {
+	init_log()
+	if len(cmd.Resource) == 0 && len(cmd.Output) == 0 {
+		return errors.New("--resource or --output is required")
+	}
+	root := openDatastore()
+	ctx, stop := commandContext()
+	defer stop()
+	if len(args) == 0 {
+		args = append(args, "/")
+	}
+	res := []GrepMatch{}
+	for _, v := range args {
+		err := root.Grep(ctx, v, cmd.Resource, cmd.Output, cmd.Deep, func(m GrepMatch) error {
+			if cmd.JSON {
+				res = append(res, m)
+				return nil
+			}
+			name := m.State
+			if m.Version != "" {
+				name += " " + m.Version
+			}
+			matched := append(append([]string{}, m.Resources...), prefixAll("output.", m.Outputs)...)
+			_, err := fmt.Printf("%s %d %s\n", name, m.Count(), strings.Join(matched, ","))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cmd.JSON {
+		return json.NewEncoder(os.Stdout).Encode(res)
+	}
+	return nil
+}
+
+// prefixAll returns the strings with the prefix
+func prefixAll(prefix string, ss []string) []string {
+	res := make([]string, 0, len(ss))
+	for _, s := range ss {
+		res = append(res, prefix+s)
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const grepTestState = `{"version":4,"serial":1,"lineage":"x","outputs":{"vpc_id":{"value":"vpc-1"},"subnet_ids":{"value":[]}},"resources":[
+{"mode":"managed","type":"aws_instance","name":"web","instances":[{"attributes":{"id":"i-1"}}]},
+{"module":"module.app","mode":"managed","type":"aws_instance","name":"web","instances":[]},
+{"mode":"data","type":"aws_ami","name":"ubuntu","instances":[]}]}`
+
+func TestGrepState(t *testing.T) {
+	tests := []struct {
+		resources []string
+		outputs   []string
+		expected  GrepMatch
+	}{
+		{[]string{"aws_instance.web"}, nil, GrepMatch{Resources: []string{"aws_instance.web", "module.app.aws_instance.web"}}},
+		{[]string{"module.app.*"}, nil, GrepMatch{Resources: []string{"module.app.aws_instance.web"}}},
+		{[]string{"data.aws_ami.*"}, []string{"*_id*"}, GrepMatch{Resources: []string{"data.aws_ami.ubuntu"}, Outputs: []string{"subnet_ids", "vpc_id"}}},
+		{[]string{"aws_ami.ubuntu"}, []string{"vpc"}, GrepMatch{}},
+	}
+	for _, test := range tests {
+		res, err := grepState([]byte(grepTestState), test.resources, test.outputs)
+		if err != nil {
+			t.Fatalf("grepState failed: %v", err)
+		}
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("grepState(%v, %v) = %+v, expected %+v", test.resources, test.outputs, res, test.expected)
+		}
+	}
+	if _, err := grepState([]byte("not json"), nil, nil); err != ErrInvalidState {
+		t.Errorf("expected ErrInvalidState, got %v", err)
+	}
+}
+
+func TestGrepCmd_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	for name, contents := range map[string][]string{
+		"prod/app": {grepTestState, `{"version":4,"serial":2,"lineage":"x","resources":[]}`},
+		"prod/net": {`{"version":4,"serial":1,"lineage":"y","outputs":{"vpc_id":{"value":"vpc-1"}},"resources":[]}`},
+		"notes":    {"plain text"},
+	} {
+		for _, c := range contents {
+			if err := ds.Write(t.Context(), name, strings.NewReader(c), []byte{}, ""); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+
+	out, err := captureStdout(func() error { return (&GrepCmd{Output: []string{"vpc_id"}}).Execute([]string{}) })
+	if err != nil {
+		t.Fatalf("GrepCmd.Execute() failed: %v", err)
+	}
+	if strings.TrimSpace(out) != "/prod/net 1 output.vpc_id" {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	out, err = captureStdout(func() error {
+		return (&GrepCmd{Resource: []string{"aws_instance.web"}, Output: []string{"vpc_id"}, Deep: true, JSON: true}).Execute([]string{"/prod/"})
+	})
+	if err != nil {
+		t.Fatalf("GrepCmd.Execute(deep) failed: %v", err)
+	}
+	res := []GrepMatch{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("invalid json %q: %v", out, err)
+	}
+	if len(res) != 2 || res[0].State != "/prod/app" || res[0].Version == "" || res[0].Count() != 3 || res[1].State != "/prod/net" {
+		t.Errorf("unexpected matches: %+v", res)
+	}
+
+	if err := (&GrepCmd{}).Execute([]string{}); err == nil {
+		t.Error("expected an error without --resource and --output")
+	}
+}
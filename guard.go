@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// nameGuard serializes the operations which change current of a file
+type nameGuard struct {
+	mu   sync.Mutex
+	refs int
+	// dir is the lock of the directory of the file which other processes see, taken by the operation holding mu
+	// when it begins its journal
+	dir *os.File
+}
+
+// guards are the guards of the files with operations in progress, by root and name
+var guards = struct {
+	sync.Mutex
+	m map[string]*nameGuard
+}{m: map[string]*nameGuard{}}
+
+// guardKey identifies the file across copies of the Datastore
+func (d *Datastore) guardKey(name string) string {
+	return d.RootName + "\x00" + filepath.Clean("/"+name)
+}
+
+// acquireGuard returns the guard of the file, registered until releaseGuard
+func acquireGuard(key string) *nameGuard {
+	guards.Lock()
+	defer guards.Unlock()
+	g, ok := guards.m[key]
+	if !ok {
+		g = &nameGuard{}
+		guards.m[key] = g
+	}
+	g.refs++
+	return g
+}
+
+// unlock releases the guard taken by guard, waitGuard or tryGuard, with the lock of the directory
+func (g *nameGuard) unlock(key string) {
+	if g.dir != nil {
+		g.dir.Close()
+		g.dir = nil
+	}
+	g.mu.Unlock()
+	releaseGuard(key, g)
+}
+
+func releaseGuard(key string, g *nameGuard) {
+	guards.Lock()
+	defer guards.Unlock()
+	g.refs--
+	if g.refs == 0 {
+		delete(guards.m, key)
+	}
+}
+
+// guard waits for the other writes, rollbacks and deletes of the file to finish,
+// or returns ErrBusy with FailBusy, and returns the function to release the file
+func (d *Datastore) guard(name string) (func(), error) {
+	key := d.guardKey(name)
+	g := acquireGuard(key)
+	if d.FailBusy {
+		if !g.mu.TryLock() {
+			releaseGuard(key, g)
+			return nil, ErrBusy
+		}
+	} else {
+		g.mu.Lock()
+	}
+	return func() { g.unlock(key) }, nil
+}
+
+// waitGuard waits for the guard of the file also with FailBusy, for work in the background which nobody waits for
+func (d *Datastore) waitGuard(name string) func() {
+	key := d.guardKey(name)
+	g := acquireGuard(key)
+	g.mu.Lock()
+	return func() { g.unlock(key) }
+}
+
+// tryGuard returns the function to release the file, or false if an operation on it is in progress
+func (d *Datastore) tryGuard(name string) (func(), bool) {
+	key := d.guardKey(name)
+	g := acquireGuard(key)
+	if !g.mu.TryLock() {
+		releaseGuard(key, g)
+		return nil, false
+	}
+	return func() { g.unlock(key) }, true
+}
+
+// lockDir takes the lock of the directory of the file, which excludes the operations of other processes
+// on the same data directory; without wait it returns ErrBusy if another operation holds it
+//
+// it returns nil without a lock if the file has no directory yet, or the store or the platform has no locks.
+func (d *Datastore) lockDir(name string, wait bool) (*os.File, error) {
+	if d.Blobs != nil {
+		return nil, nil
+	}
+	dirn, err := d.File(name)
+	if err != nil {
+		return nil, ErrInvalidPath
+	}
+	path, err := d.RootDir.RealPath(dirn)
+	if err != nil {
+		return nil, ErrInvalidPath
+	}
+	fp, err := flockDir(path, wait)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errors.ErrUnsupported) {
+		return nil, nil
+	}
+	return fp, err
+}
+
+// holdDir takes the lock of the directory for the operation holding the guard of the file until it releases
+// the guard, so that other processes do not recover its journal while it is in progress
+func (d *Datastore) holdDir(name string) error {
+	guards.Lock()
+	g := guards.m[d.guardKey(name)]
+	guards.Unlock()
+	if g == nil || g.dir != nil {
+		return nil
+	}
+	fp, err := d.lockDir(name, !d.FailBusy)
+	if err != nil {
+		slog.Error("cannot lock the directory", "name", name, "error", err)
+		return err
+	}
+	g.dir = fp
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGuard_WriteAndRollback(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	vers := writeAt(t, &ds, "state", time.Now(), time.Now())
+	for i := 0; i < 20; i++ {
+		var wg sync.WaitGroup
+		var werr, rerr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			werr = ds.Write(t.Context(), "state", strings.NewReader("new"), []byte{}, "")
+		}()
+		go func() {
+			defer wg.Done()
+			rerr = ds.Rollback("state", vers[0])
+		}()
+		wg.Wait()
+		if werr != nil || rerr != nil {
+			t.Fatalf("write: %v, rollback: %v", werr, rerr)
+		}
+		// whichever ran last decides current, and the journal is gone
+		current := ds.CurrentVersion("state")
+		content, err := readString(t, ds, "state")
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if current == vers[0] {
+			if content != `{"v":1}` {
+				t.Errorf("current is %s but contents are %q", current, content)
+			}
+		} else if content != "new" {
+			t.Errorf("current is %s but contents are %q", current, content)
+		}
+		if ent := ds.journalRead("state"); ent != nil {
+			t.Errorf("journal left behind: %+v", ent)
+		}
+	}
+}
+
+func TestGuard_RollbackWaitsForWrite(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	vers := writeAt(t, &ds, "state", time.Now())
+	writer := ds
+	started, proceed := make(chan struct{}), make(chan struct{})
+	writer.failpoint = func(op string, step string) error {
+		if step == "data" {
+			close(started)
+			<-proceed
+		}
+		return nil
+	}
+	done := make(chan error)
+	go func() { done <- writer.Write(t.Context(), "state", strings.NewReader("new"), []byte{}, "") }()
+	<-started
+
+	// readers do not recover the journal of the write in progress
+	if _, err := readString(t, ds, "state"); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	busy := ds
+	busy.FailBusy = true
+	if err := busy.Rollback("state", vers[0]); !errors.Is(err, ErrBusy) {
+		t.Errorf("expected ErrBusy, got %v", err)
+	}
+	rolled := make(chan error)
+	go func() { rolled <- ds.Rollback("state", vers[0]) }()
+	select {
+	case err := <-rolled:
+		t.Fatalf("rollback did not wait for the write: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := <-rolled; err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if current := ds.CurrentVersion("state"); current != vers[0] {
+		t.Errorf("expected the rollback to win, current is %s", current)
+	}
+	if hist := ds.History(t.Context(), "state"); len(hist) != 2 {
+		t.Errorf("expected the written version in the history, got %+v", hist)
+	}
+}
+
+func TestGuard_ChecksOfWrite(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	writeAt(t, &ds, "state", time.Now())
+	writer := ds
+	started, proceed := make(chan struct{}), make(chan struct{})
+	writer.failpoint = func(op string, step string) error {
+		if step == "journal" {
+			close(started)
+			<-proceed
+		}
+		return nil
+	}
+	done := make(chan error)
+	go func() { done <- writer.Write(t.Context(), "state", strings.NewReader("new"), []byte{}, "") }()
+	<-started
+
+	// the write has passed its checks: protect, hold and lock wait for it
+	busy := ds
+	busy.FailBusy = true
+	for name, op := range map[string]func() error{
+		"protect": func() error { return busy.Protect("state") },
+		"hold":    func() error { return busy.Hold("state", "case 1") },
+		"lock":    func() error { return busy.Lock("state", `{"ID":"x"}`) },
+	} {
+		if err := op(); !errors.Is(err, ErrBusy) {
+			t.Errorf("%s: expected ErrBusy, got %v", name, err)
+		}
+	}
+	protected := make(chan error)
+	go func() { protected <- ds.Protect("state") }()
+	select {
+	case err := <-protected:
+		t.Fatalf("protect did not wait for the write: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := <-protected; err != nil {
+		t.Fatalf("protect failed: %v", err)
+	}
+	if err := ds.Write(t.Context(), "state", strings.NewReader("newer"), []byte{}, ""); err != ErrProtected {
+		t.Errorf("expected ErrProtected, got %v", err)
+	}
+	if content, err := readString(t, ds, "state"); err != nil || content != "new" {
+		t.Errorf("unexpected contents %q %v", content, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// HistoryEntry is a version of a file in a listing across files
+type HistoryEntry struct {
+	State     string    `json:"state"`
+	Version   string    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+	Current   bool      `json:"current"`
+	// Terraform is the header of the version if it is a terraform state
+	Terraform *TerraformState `json:"terraform,omitempty"`
+}
+
+// MarshalJSON adds the time in the display zone
+func (e HistoryEntry) MarshalJSON() ([]byte, error) {
+	type alias HistoryEntry
+	return json.Marshal(struct {
+		alias
+		Local string `json:"timestamp_local"`
+	}{alias(e), localTime(e.Timestamp)})
+}
+
+// historyHeap holds the remaining versions of each file, newest first, with the newest head on top
+type historyHeap [][]HistoryEntry
+
+func (h historyHeap) Len() int           { return len(h) }
+func (h historyHeap) Less(i, j int) bool { return h[i][0].Timestamp.After(h[j][0].Timestamp) }
+func (h historyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *historyHeap) Push(x any)        { *h = append(*h, x.([]HistoryEntry)) }
+func (h *historyHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// WalkHistory calls the function with the versions of all files under the prefixes written since the time, newest first
+//
+// the history of each file is filtered while walking, so only the versions to report are kept for the merge.
+func (d *Datastore) WalkHistory(ctx context.Context, prefixes []string, since time.Time, fn func(e HistoryEntry) error) error {
+	h := historyHeap{}
+	for _, prefix := range prefixes {
+		err := d.Walk(ctx, prefix, func(e FileEntry) error {
+			ents := []HistoryEntry{}
+			// History is sorted newest first
+			for _, v := range d.History(ctx, e.Name) {
+				if v.Timestamp.Before(since) {
+					break
+				}
+				ents = append(ents, HistoryEntry{State: e.Name, Version: v.Name, Timestamp: v.Timestamp, Size: v.Size, Current: v.Locked, Terraform: v.Terraform})
+			}
+			if len(ents) != 0 {
+				h = append(h, ents)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	heap.Init(&h)
+	for h.Len() != 0 {
+		if err := fn(h[0][0]); err != nil {
+			return err
+		}
+		if h[0] = h[0][1:]; len(h[0]) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return nil
+}
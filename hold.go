@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// holdFile is the marker of a retention hold
+const holdFile = ".hold"
+
+// HoldInfo describes a retention hold of a file
+type HoldInfo struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Held reports whether the file is under a retention hold
+func (d *Datastore) Held(name string) bool {
+	_, ok := d.HoldRead(name)
+	return ok
+}
+
+// HoldRead returns the retention hold of the file if any
+func (d *Datastore) HoldRead(name string) (HoldInfo, bool) {
+	res := HoldInfo{}
+	path, err := d.File(name, holdFile)
+	if err != nil {
+		return res, false
+	}
+	content, err := afero.ReadFile(d.RootDir, path)
+	if err != nil {
+		return res, false
+	}
+	if err := json.Unmarshal(content, &res); err != nil {
+		// the marker itself holds the file
+		slog.Warn("invalid hold", "name", name, "error", err)
+	}
+	return res, true
+}
+
+// checkHeld refuses removal of versions of a file under a retention hold
+func (d *Datastore) checkHeld(name string) error {
+	if d.Held(name) {
+		slog.Warn("file is under retention hold", "name", name)
+		return ErrHeld
+	}
+	return nil
+}
+
+// Hold puts the file under a retention hold; prune and delete are refused until it is released
+func (d *Datastore) Hold(name string, reason string) error {
+	// not in the middle of a delete which checked the hold
+	release, err := d.guard(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if d.currentTarget(name) == "" {
+		slog.Error("not found", "name", name)
+		return ErrNotFound
+	}
+	path, err := d.File(name, holdFile)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	content, err := json.Marshal(HoldInfo{Reason: reason, Since: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return d.writeFile(path, bytes.NewReader(content))
+}
+
+// Release removes the retention hold of the file
+func (d *Datastore) Release(name string) error {
+	path, err := d.File(name, holdFile)
+	if err != nil {
+		slog.Error("invalid filename?", "name", name, "error", err)
+		return ErrInvalidPath
+	}
+	if err := d.RootDir.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// HoldCmd puts files under a retention hold
+type HoldCmd struct {
+	File   []string `short:"f" long:"file" required:"true" description:"file name"`
+	Reason string   `short:"r" long:"reason" description:"reason of the hold, e.g. a case number"`
+}
+
+func (cmd *HoldCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	for _, v := range cmd.File {
+		if err := root.Hold(v, cmd.Reason); err != nil {
+			slog.Error("hold failed", "name", v, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseCmd releases retention holds
+type ReleaseCmd struct {
+	File []string `short:"f" long:"file" required:"true" description:"file name"`
+}
+
+func (cmd *ReleaseCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	for _, v := range cmd.File {
+		if err := root.Release(v); err != nil {
+			slog.Error("release failed", "name", v, "error", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHold(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Hold("a", "case-1"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing file, got %v", err)
+	}
+	for _, s := range []string{"v1", "v2", "v3"} {
+		if err := ds.Write(t.Context(), "a", strings.NewReader(s), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ds.Hold("a", "case-1"); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	if info, err := ds.Info("a"); err != nil || !info.Held || info.Hold.Reason != "case-1" || info.Hold.Since.IsZero() {
+		t.Errorf("expected hold in info: %+v %v", info, err)
+	}
+	if err := ds.Prune(t.Context(), "a", 1, true); err != ErrHeld {
+		t.Errorf("prune: expected ErrHeld, got %v", err)
+	}
+	if err := ds.Delete("a"); err != ErrHeld {
+		t.Errorf("delete: expected ErrHeld, got %v", err)
+	}
+	// writes are allowed but do not remove anything
+	if err := ds.Write(t.Context(), "a", strings.NewReader("v4"), []byte{}, ""); err != nil {
+		t.Errorf("write under hold failed: %v", err)
+	}
+	if err := ds.Replace(t.Context(), "a", strings.NewReader("v5"), []byte{}, ""); err != nil {
+		t.Errorf("replace under hold failed: %v", err)
+	}
+	if hist := ds.History(t.Context(), "a"); len(hist) != 5 {
+		t.Errorf("expected all versions to be kept, got %d", len(hist))
+	}
+
+	if err := ds.Release("a"); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if err := ds.Release("a"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for double release, got %v", err)
+	}
+	if err := ds.Prune(t.Context(), "a", 1, false); err != nil {
+		t.Errorf("prune after release failed: %v", err)
+	}
+	if err := ds.Delete("a"); err != nil {
+		t.Errorf("delete after release failed: %v", err)
+	}
+}
+
+func TestHold_Handlers(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(t.Context(), "a", strings.NewReader(`{"v":1}`), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := ds.Hold("a", ""); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	api := http.StripPrefix("/api/", &APIHandler{ds: &ds})
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodDelete, "/api/a", nil),
+		httptest.NewRequest(http.MethodPost, "/api/a?prune=0", nil),
+	} {
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403, got %d", req.Method, req.URL, rr.Code)
+		}
+	}
+	html := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/"})
+	for _, path := range []string{"/html/", "/html/view/a"} {
+		rr := httptest.NewRecorder()
+		html.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if !strings.Contains(rr.Body.String(), ">hold</span>") {
+			t.Errorf("%s: hold not shown", path)
+		}
+	}
+}
+
+func TestHoldCmd_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "a", strings.NewReader("{}"), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := (&HoldCmd{File: []string{"a"}, Reason: "audit"}).Execute(nil); err != nil {
+		t.Fatalf("hold failed: %v", err)
+	}
+	out, err := captureStdout(func() error { return (&Info{}).Execute([]string{"a"}) })
+	if err != nil || !strings.Contains(out, "audit") {
+		t.Errorf("hold not shown in info: %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&LsTree{}).Execute(nil) })
+	if err != nil || !strings.Contains(out, "/a (hold)") {
+		t.Errorf("hold not shown in ls: %q %v", out, err)
+	}
+	if err := (&ReleaseCmd{File: []string{"a"}}).Execute(nil); err != nil || ds.Held("a") {
+		t.Errorf("release failed: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// IndexResult counts the versions hashed by Index
+type IndexResult struct {
+	Hashed  int   `json:"hashed"`
+	Bytes   int64 `json:"bytes"`
+	Skipped int   `json:"skipped"`
+	Failed  int   `json:"failed"`
+}
+
+// VersionHash returns the md5 of the uncompressed contents of a version, recording it into the hash sidecar
+//
+// computed is false when the sidecar already had it, size is the number of bytes hashed.
+func (d *Datastore) VersionHash(ctx context.Context, name string, version string, p *progress) (sum []byte, size int64, computed bool, err error) {
+	if sum := d.readHash(name, version); sum != nil {
+		return sum, 0, false, nil
+	}
+	rd, err := d.ReadHistory(name, version)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer rd.Close()
+	hash := md5.New()
+	size, err = io.Copy(p.writer(hash), ctxReader{ctx, rd})
+	if ctx.Err() != nil {
+		return nil, size, false, ctx.Err()
+	} else if err != nil {
+		return nil, size, false, err
+	}
+	sum = hash.Sum(nil)
+	if err := d.writeHash(name, version, sum); err != nil {
+		return nil, size, false, err
+	}
+	return sum, size, true, nil
+}
+
+// Index records the hashes of the current versions of the files under the prefixes, or of all versions,
+// skipping those with a hash already; an interrupted run resumes where it stopped when run again
+func (d *Datastore) Index(ctx context.Context, prefixes []string, all bool, p *progress) (IndexResult, error) {
+	res := IndexResult{}
+	index := func(name string, version string) {
+		_, size, computed, err := d.VersionHash(ctx, name, version, p)
+		switch {
+		case err != nil:
+			if !interrupted(err) {
+				slog.Error("cannot hash", "name", name, "version", version, "error", err)
+				res.Failed++
+			}
+		case computed:
+			slog.Debug("hashed", "name", name, "version", version)
+			res.Hashed++
+			res.Bytes += size
+		default:
+			res.Skipped++
+		}
+	}
+	for _, prefix := range prefixes {
+		err := d.Walk(ctx, prefix, func(e FileEntry) error {
+			if !all {
+				if version := d.currentTarget(e.Name); version != "" {
+					index(e.Name, version)
+				}
+				return ctx.Err()
+			}
+			for _, v := range d.History(ctx, e.Name) {
+				index(e.Name, v.Name)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, ctx.Err()
+}
+
+// IndexCmd records the hashes of versions for the features which compare or serve them
+type IndexCmd struct {
+	All  bool `short:"a" long:"all" description:"hash all versions, not only the current ones"`
+	JSON bool `short:"j" long:"json" description:"output the counts as json"`
+}
+
+func (cmd *IndexCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	ctx, stop := commandContext()
+	defer stop()
+	if len(args) == 0 {
+		args = append(args, "/")
+	}
+	p := newProgress("hashed", 0)
+	res, err := root.Index(ctx, args, cmd.All, p)
+	p.finish()
+	if cmd.JSON {
+		if err := json.NewEncoder(os.Stdout).Encode(res); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("hashed %d versions (%s), %d already hashed, %d failed\n", res.Hashed, humanizeBytes(res.Bytes), res.Skipped, res.Failed)
+	}
+	if err != nil {
+		return err
+	}
+	if res.Failed != 0 {
+		return fmt.Errorf("%d versions could not be hashed", res.Failed)
+	}
+	return nil
+}
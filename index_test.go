@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatastore_Index(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	base := time.Now().Add(-time.Hour)
+	a := writeAt(t, &ds, "a", base, base.Add(time.Minute))
+	b := writeAt(t, &ds, "dir/b", base)
+
+	res, err := ds.Index(t.Context(), []string{"/"}, false, nil)
+	if err != nil || res.Hashed != 2 || res.Skipped != 0 || res.Bytes != 14 {
+		t.Fatalf("current versions: %+v %v", res, err)
+	}
+	if sum := md5.Sum([]byte(`{"v":2}`)); string(ds.readHash("a", a[1])) != string(sum[:]) {
+		t.Errorf("unexpected hash of %s: %x", a[1], ds.readHash("a", a[1]))
+	}
+	if ds.readHash("a", a[0]) != nil {
+		t.Errorf("old version hashed without all")
+	}
+	res, err = ds.Index(t.Context(), []string{"/"}, true, nil)
+	if err != nil || res.Hashed != 1 || res.Skipped != 2 {
+		t.Errorf("all versions: %+v %v", res, err)
+	}
+	if sum := md5.Sum([]byte(`{"v":1}`)); string(ds.readHash("dir/b", b[0])) != string(sum[:]) {
+		t.Errorf("unexpected hash of %s", b[0])
+	}
+	// the recorded hash is served with the version
+	raw, err := ds.ReadRaw("a", a[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+	if sum := md5.Sum([]byte(`{"v":1}`)); string(raw.MD5) != string(sum[:]) {
+		t.Errorf("hash not used by ReadRaw: %x", raw.MD5)
+	}
+	// pruned versions lose their hash
+	if err := ds.Prune(t.Context(), "a", 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if ds.readHash("a", a[0]) != nil {
+		t.Errorf("hash of pruned version kept")
+	}
+}
+
+func TestDatastore_IndexResume(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{"a", "b", "c"} {
+		writeAt(t, &ds, name, time.Now())
+	}
+	// a run which stopped after the first file
+	if _, _, computed, err := ds.VersionHash(t.Context(), "a", ds.currentTarget("a"), nil); err != nil || !computed {
+		t.Fatalf("hash failed: %v %v", computed, err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := ds.Index(ctx, []string{"/"}, false, nil); !interrupted(err) {
+		t.Errorf("expected interruption, got %v", err)
+	}
+	res, err := ds.Index(t.Context(), []string{"/"}, false, nil)
+	if err != nil || res.Hashed != 2 || res.Skipped != 1 {
+		t.Errorf("resumed run: %+v %v", res, err)
+	}
+}
+
+func TestIndexCmd_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+	ds := NewDatastore(tmp)
+	writeAt(t, &ds, "a", time.Now())
+
+	out, err := captureStdout(func() error { return (&IndexCmd{}).Execute(nil) })
+	if err != nil || out != "hashed 1 versions (7 B), 0 already hashed, 0 failed\n" {
+		t.Errorf("unexpected output %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&IndexCmd{JSON: true}).Execute([]string{"a"}) })
+	res := IndexResult{}
+	if err != nil || json.Unmarshal([]byte(out), &res) != nil || res != (IndexResult{Skipped: 1}) {
+		t.Errorf("unexpected output %q %v", strings.TrimSpace(out), err)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// journalEntry records an operation in progress on a file in the datastore
+type journalEntry struct {
+	Op       string `json:"op"`
+	Version  string `json:"version,omitempty"`
+	Previous string `json:"previous,omitempty"`
+	Stage    string `json:"stage,omitempty"`
+}
+
+const (
+	journalWrite    = "write"
+	journalRollback = "rollback"
+	journalDelete   = "delete"
+
+	// stageData: the version file may be partially written
+	stageData = "data"
+	// stagePointer: the version file is complete, current may not point to it yet
+	stagePointer = "pointer"
+)
+
+// errCrash is returned by failpoints to simulate an interruption
+var errCrash = errors.New("simulated crash")
+
+// step calls the failpoint hook, which tests use to stop an operation midway
+func (d *Datastore) step(op string, step string) error {
+	if d.failpoint != nil {
+		if err := d.failpoint(op, step); err != nil {
+			slog.Debug("failpoint", "op", op, "step", step, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// currentTarget returns the version the 'current' symlink points to
+func (d *Datastore) currentTarget(name string) string {
+	linkto, err := d.blobs().GetCurrent(name)
+	if err != nil {
+		return ""
+	}
+	return linkto
+}
+
+// journalBegin records the operation before performing it
+func (d *Datastore) journalBegin(name string, ent journalEntry) error {
+	path, err := d.File(name, "journal")
+	if err != nil {
+		slog.Error("invalid filename?", "name", name, "error", err)
+		return ErrInvalidPath
+	}
+	if err := d.RootDir.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		slog.Error("mkdir", "name", name, "error", err)
+		return err
+	}
+	if err := d.holdDir(name); err != nil {
+		return err
+	}
+	return d.journalAppend(name, ent)
+}
+
+// journalAppend appends a record of the operation in progress
+//
+// records are never rewritten; a record torn by a crash is ignored by journalRead.
+func (d *Datastore) journalAppend(name string, ent journalEntry) error {
+	path, err := d.File(name, "journal")
+	if err != nil {
+		return ErrInvalidPath
+	}
+	data, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	fp, err := d.RootDir.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		slog.Error("open journal", "name", name, "error", err)
+		return err
+	}
+	if _, err := fp.Write(append(data, '\n')); err != nil {
+		slog.Error("write journal", "name", name, "error", err)
+		fp.Close()
+		return err
+	}
+	if d.Fsync {
+		if err := fp.Sync(); err != nil {
+			slog.Error("fsync journal", "name", name, "error", err)
+			fp.Close()
+			return err
+		}
+	}
+	return fp.Close()
+}
+
+// journalEnd removes the journal after the operation has completed
+func (d *Datastore) journalEnd(name string) error {
+	path, err := d.File(name, "journal")
+	if err != nil {
+		return ErrInvalidPath
+	}
+	if err := d.RootDir.Remove(path); err != nil {
+		slog.Error("remove journal", "name", name, "error", err)
+		return err
+	}
+	return nil
+}
+
+// journalRead reads the last complete record of the pending journal, or nil if there is none
+func (d *Datastore) journalRead(name string) *journalEntry {
+	path, err := d.File(name, "journal")
+	if err != nil {
+		return nil
+	}
+	content, err := afero.ReadFile(d.RootDir, path)
+	if err != nil {
+		return nil
+	}
+	var res *journalEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		ent := &journalEntry{}
+		if err := json.Unmarshal([]byte(line), ent); err != nil {
+			slog.Warn("torn journal record", "name", name, "error", err)
+			continue
+		}
+		res = ent
+	}
+	if res == nil {
+		// not even the first record is complete: nothing was done yet
+		return &journalEntry{}
+	}
+	return res
+}
+
+// versionExists checks whether the version file exists
+func (d *Datastore) versionExists(name string, version string) bool {
+	if version == "" {
+		return false
+	}
+	_, err := d.blobs().StatVersion(name, version)
+	return err == nil
+}
+
+// Recover completes or rolls back an operation interrupted by a crash
+func (d *Datastore) Recover(name string) (bool, error) {
+	ent := d.journalRead(name)
+	if ent == nil {
+		return false, nil
+	}
+	// the guard excludes the operations of this process only, the operation may be in progress in another one
+	if dir, err := d.lockDir(name, false); err == ErrBusy {
+		slog.Info("operation in progress in another process", "name", name, "op", ent.Op)
+		return false, err
+	} else if dir != nil {
+		defer dir.Close()
+	}
+	slog.Warn("recovering interrupted operation", "name", name, "op", ent.Op, "version", ent.Version, "previous", ent.Previous, "stage", ent.Stage)
+	var err error
+	switch ent.Op {
+	case journalWrite:
+		if ent.Stage == stagePointer && d.versionExists(name, ent.Version) {
+			// roll forward: the data is complete
+			err = d.set_current(name, ent.Version)
+		} else {
+			// roll back: the data may be partial
+			if d.versionExists(name, ent.Version) {
+				if err := d.blobs().RemoveVersion(name, ent.Version); err != nil {
+					slog.Error("cannot remove partial version", "name", name, "version", ent.Version, "error", err)
+				}
+			}
+			err = d.restoreCurrent(name, ent.Previous)
+		}
+	case journalRollback:
+		if d.versionExists(name, ent.Version) {
+			err = d.set_current(name, ent.Version)
+		} else {
+			err = d.restoreCurrent(name, ent.Previous)
+		}
+	case journalDelete:
+		if _, err1 := d.blobs().GetCurrent(name); err1 == nil {
+			err = d.blobs().RemoveCurrent(name)
+		}
+	default:
+		slog.Warn("unknown journal entry, discarding", "name", name, "op", ent.Op)
+	}
+	if err != nil {
+		slog.Error("recovery failed", "name", name, "op", ent.Op, "error", err)
+		return false, err
+	}
+	return true, d.journalEnd(name)
+}
+
+// restoreCurrent points current back to the previous version if it is missing or dangling
+func (d *Datastore) restoreCurrent(name string, previous string) error {
+	target := d.currentTarget(name)
+	if target != "" && d.versionExists(name, target) {
+		return nil
+	}
+	if previous == "" || !d.versionExists(name, previous) {
+		if target != "" {
+			return d.blobs().RemoveCurrent(name)
+		}
+		return nil
+	}
+	return d.set_current(name, previous)
+}
+
+// recoverIfNeeded runs Recover before accessing a file, unless the journal is of an operation in progress
+func (d *Datastore) recoverIfNeeded(name string) {
+	release, ok := d.tryGuard(name)
+	if !ok {
+		slog.Debug("operation in progress", "name", name)
+		return
+	}
+	defer release()
+	d.recoverGuarded(name)
+}
+
+// recoverGuarded runs Recover for an operation which holds the guard of the file
+func (d *Datastore) recoverGuarded(name string) {
+	if _, err := d.Recover(name); err == ErrBusy {
+		slog.Debug("operation in progress", "name", name)
+	} else if err != nil {
+		slog.Error("recover", "name", name, "error", err)
+	}
+}
+
+// PendingJournals lists files under the prefix which have an interrupted operation
+func (d *Datastore) PendingJournals(prefix string) ([]string, error) {
+	res := []string{}
+	err := afero.Walk(d.RootDir, d.walkBase(prefix), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			slog.Error("walkdir", "error", err, "path", path)
+			return err
+		}
+		if d.skipDir(path, info) {
+			return filepath.SkipDir
+		}
+		lpath, ok := d.layoutPath(path)
+		if ok && strings.HasPrefix(lpath, prefix) && !info.IsDir() && info.Name() == "journal" {
+			res = append(res, filepath.Dir(lpath))
+		}
+		return nil
+	})
+	return res, err
+}
+
+// RecoverAll completes or rolls back all interrupted operations under the prefix
+func (d *Datastore) RecoverAll(prefix string) ([]VerifyResult, error) {
+	res := []VerifyResult{}
+	journals, err := d.PendingJournals(prefix)
+	if err != nil {
+		return res, err
+	}
+	for _, name := range journals {
+		ent := d.journalRead(name)
+		result := VerifyResult{Name: name, Problem: "interrupted " + ent.Op}
+		if _, err := d.Recover(name); err == nil {
+			result.Fixed = true
+		}
+		res = append(res, result)
+	}
+	return res, nil
+}
+
+// VerifyResult represents a problem found in the datastore
+type VerifyResult struct {
+	Name    string `json:"name"`
+	Problem string `json:"problem"`
+	Fixed   bool   `json:"fixed"`
+}
+
+// Verify checks files under the prefix for interrupted operations and dangling current pointers
+func (d *Datastore) Verify(prefix string, fix bool) ([]VerifyResult, error) {
+	res := []VerifyResult{}
+	journals, err := d.PendingJournals(prefix)
+	if err != nil {
+		return res, err
+	}
+	pending := map[string]bool{}
+	for _, name := range journals {
+		pending[name] = true
+		ent := d.journalRead(name)
+		result := VerifyResult{Name: name, Problem: "interrupted " + ent.Op}
+		if fix {
+			if _, err := d.Recover(name); err == nil {
+				result.Fixed = true
+			}
+		}
+		res = append(res, result)
+	}
+	err = afero.Walk(d.RootDir, d.walkBase(prefix), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			slog.Error("walkdir", "error", err, "path", path)
+			return err
+		}
+		if d.skipDir(path, info) {
+			return filepath.SkipDir
+		}
+		lpath, ok := d.layoutPath(path)
+		if !ok || !strings.HasPrefix(lpath, prefix) || info.Name() != "current" || info.Mode().Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		name := filepath.Dir(lpath)
+		if pending[name] {
+			return nil
+		}
+		if target := d.currentTarget(name); !d.versionExists(name, target) {
+			res = append(res, VerifyResult{Name: name, Problem: "dangling current -> " + target})
+		}
+		return nil
+	})
+	return res, err
+}
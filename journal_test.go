@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func crashAt(op string, step string) func(string, string) error {
+	return func(o string, s string) error {
+		if o == op && s == step {
+			return errCrash
+		}
+		return nil
+	}
+}
+
+func readString(t *testing.T, ds Datastore, name string) (string, error) {
+	t.Helper()
+	var buf bytes.Buffer
+	err := ds.Read(t.Context(), name, &buf)
+	return buf.String(), err
+}
+
+func TestJournal_WriteCrash(t *testing.T) {
+	tests := []struct {
+		op       string
+		step     string
+		expected string
+		versions int
+	}{
+		{journalWrite, "journal", "v1", 1},
+		{journalWrite, "data", "v1", 1},
+		{journalWrite, "pointer", "v2", 2},
+		{"set_current", "unlink", "v2", 2},
+		{journalWrite, "link", "v2", 2},
+	}
+	for _, test := range tests {
+		t.Run(test.op+"/"+test.step, func(t *testing.T) {
+			tmp := t.TempDir()
+			ds := NewDatastore(tmp)
+			if err := ds.Write(t.Context(), "myfile", strings.NewReader("v1"), []byte{}, ""); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			ds.failpoint = crashAt(test.op, test.step)
+			if err := ds.Write(t.Context(), "myfile", strings.NewReader("v2"), []byte{}, ""); err != errCrash {
+				t.Fatalf("expected crash, got %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(tmp, "myfile", "journal")); err != nil {
+				t.Fatalf("journal not left behind: %v", err)
+			}
+
+			reopened := NewDatastore(tmp)
+			content, err := readString(t, reopened, "myfile")
+			if err != nil {
+				t.Fatalf("read after recovery failed: %v", err)
+			}
+			if content != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, content)
+			}
+			if hist := reopened.History(t.Context(), "myfile"); len(hist) != test.versions {
+				t.Errorf("expected %d versions, got %d: %+v", test.versions, len(hist), hist)
+			}
+			if _, err := os.Stat(filepath.Join(tmp, "myfile", "journal")); !os.IsNotExist(err) {
+				t.Errorf("journal not cleared: %v", err)
+			}
+		})
+	}
+}
+
+func TestJournal_FirstWriteCrash(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	ds.failpoint = crashAt(journalWrite, "data")
+	if err := ds.Write(t.Context(), "myfile", strings.NewReader("v1"), []byte{}, ""); err != errCrash {
+		t.Fatalf("expected crash, got %v", err)
+	}
+	reopened := NewDatastore(tmp)
+	if _, err := readString(t, reopened, "myfile"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	files, _ := os.ReadDir(filepath.Join(tmp, "myfile"))
+	if len(files) != 0 {
+		t.Errorf("expected empty directory, got %+v", files)
+	}
+}
+
+func TestJournal_RollbackCrash(t *testing.T) {
+	tests := []struct {
+		op   string
+		step string
+	}{
+		{journalRollback, "journal"},
+		{"set_current", "unlink"},
+		{journalRollback, "link"},
+	}
+	for _, test := range tests {
+		t.Run(test.op+"/"+test.step, func(t *testing.T) {
+			tmp := t.TempDir()
+			ds := NewDatastore(tmp)
+			for _, v := range []string{"v1", "v2"} {
+				if err := ds.Write(t.Context(), "myfile", strings.NewReader(v), []byte{}, ""); err != nil {
+					t.Fatalf("write failed: %v", err)
+				}
+			}
+			hist := ds.History(t.Context(), "myfile")
+			ds.failpoint = crashAt(test.op, test.step)
+			if err := ds.Rollback("myfile", hist[1].Name); err != errCrash {
+				t.Fatalf("expected crash, got %v", err)
+			}
+			content, err := readString(t, NewDatastore(tmp), "myfile")
+			if err != nil {
+				t.Fatalf("read after recovery failed: %v", err)
+			}
+			if content != "v1" {
+				t.Errorf("expected rollback to be completed, got %q", content)
+			}
+		})
+	}
+}
+
+func TestJournal_DeleteCrash(t *testing.T) {
+	for _, step := range []string{"journal", "unlink"} {
+		t.Run(step, func(t *testing.T) {
+			tmp := t.TempDir()
+			ds := NewDatastore(tmp)
+			if err := ds.Write(t.Context(), "myfile", strings.NewReader("v1"), []byte{}, ""); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			ds.failpoint = crashAt(journalDelete, step)
+			if err := ds.Delete("myfile"); err != errCrash {
+				t.Fatalf("expected crash, got %v", err)
+			}
+			if _, err := readString(t, NewDatastore(tmp), "myfile"); err != ErrNotFound {
+				t.Errorf("expected delete to be completed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJournal_OtherProcess(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "myfile", strings.NewReader("v1"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	ds.failpoint = crashAt(journalWrite, "data")
+	if err := ds.Write(t.Context(), "myfile", strings.NewReader("v2"), []byte{}, ""); err != errCrash {
+		t.Fatalf("expected crash, got %v", err)
+	}
+	// another process writing holds the lock of the directory, its journal is not rolled back
+	other, err := flockDir(filepath.Join(tmp, "myfile"), true)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("no locks of directories on this platform")
+	}
+	if err != nil {
+		t.Fatalf("flockDir failed: %v", err)
+	}
+	reopened := NewDatastore(tmp)
+	if content, err := readString(t, reopened, "myfile"); err != nil || content != "v1" {
+		t.Errorf("read failed: %q %v", content, err)
+	}
+	reopened.History(t.Context(), "myfile")
+	if res, err := reopened.Verify("/", true); err != nil || len(res) != 1 || res[0].Fixed {
+		t.Errorf("recovered an operation in progress: %+v %v", res, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "myfile", "journal")); err != nil {
+		t.Errorf("journal of an operation in progress removed: %v", err)
+	}
+	// a write waits for it with the lock of the directory
+	reopened.FailBusy = true
+	if err := reopened.Write(t.Context(), "myfile", strings.NewReader("v3"), []byte{}, ""); err != ErrBusy {
+		t.Errorf("expected ErrBusy, got %v", err)
+	}
+	other.Close()
+	if content, err := readString(t, reopened, "myfile"); err != nil || content != "v1" {
+		t.Errorf("read failed: %q %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "myfile", "journal")); !os.IsNotExist(err) {
+		t.Errorf("journal not cleared: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("v1"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	ds.failpoint = crashAt(journalWrite, "pointer")
+	if err := ds.Write(t.Context(), "a", strings.NewReader("v2"), []byte{}, ""); err != errCrash {
+		t.Fatalf("expected crash, got %v", err)
+	}
+	hist := ds.History(t.Context(), "b")
+	if err := os.Remove(filepath.Join(tmp, "b", hist[0].Name)); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	reopened := NewDatastore(tmp)
+	res, err := reopened.Verify("/", false)
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 problems, got %+v", res)
+	}
+	if res[0].Name != "/a" || res[0].Problem != "interrupted write" || res[0].Fixed {
+		t.Errorf("unexpected result: %+v", res[0])
+	}
+	if res[1].Name != "/b" || !strings.HasPrefix(res[1].Problem, "dangling current") {
+		t.Errorf("unexpected result: %+v", res[1])
+	}
+
+	res, err = reopened.Verify("/", true)
+	if err != nil {
+		t.Fatalf("verify --fix failed: %v", err)
+	}
+	if !res[0].Fixed {
+		t.Errorf("expected journal to be recovered: %+v", res[0])
+	}
+	if content, _ := readString(t, reopened, "a"); content != "v2" {
+		t.Errorf("expected roll forward, got %q", content)
+	}
+}
+
+func TestJournal_AppendOnly(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "myfile", strings.NewReader("v1"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	ds.failpoint = crashAt(journalWrite, "pointer")
+	if err := ds.Write(t.Context(), "myfile", strings.NewReader("v2"), []byte{}, ""); err != errCrash {
+		t.Fatalf("expected crash, got %v", err)
+	}
+	jpath := filepath.Join(tmp, "myfile", "journal")
+	content, err := os.ReadFile(jpath)
+	if err != nil {
+		t.Fatalf("journal not left behind: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"stage":"data"`) || !strings.Contains(lines[1], `"stage":"pointer"`) {
+		t.Fatalf("expected data and pointer records, got %q", content)
+	}
+
+	// a record torn by a crash is ignored: the pointer record still wins
+	f, _ := os.OpenFile(jpath, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"op":"wri`)
+	f.Close()
+	if ent := ds.journalRead("myfile"); ent.Stage != stagePointer {
+		t.Errorf("expected pointer stage, got %+v", ent)
+	}
+
+	reopened := NewDatastore(tmp)
+	res, err := reopened.RecoverAll("/")
+	if err != nil {
+		t.Fatalf("RecoverAll failed: %v", err)
+	}
+	if len(res) != 1 || res[0].Name != "/myfile" || !res[0].Fixed {
+		t.Errorf("unexpected recovery result: %+v", res)
+	}
+	if content, _ := readString(t, reopened, "myfile"); content != "v2" {
+		t.Errorf("expected roll forward, got %q", content)
+	}
+	if _, err := os.Stat(jpath); !os.IsNotExist(err) {
+		t.Errorf("journal not cleared: %v", err)
+	}
+}
+
+func TestJournal_TornFirstRecord(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "myfile", strings.NewReader("v1"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "myfile", "journal"), []byte(`{"op":"del`), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, err := ds.RecoverAll("/"); err != nil {
+		t.Fatalf("RecoverAll failed: %v", err)
+	}
+	if content, _ := readString(t, ds, "myfile"); content != "v1" {
+		t.Errorf("expected file untouched, got %q", content)
+	}
+}
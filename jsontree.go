@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonTreePageSize is the number of array items shown at once
+const jsonTreePageSize = 50
+
+// jsonTreeOpenDepth is the number of levels expanded by default
+const jsonTreeOpenDepth = 2
+
+// jsonStep is an element of a path like .resources[3].name
+type jsonStep struct {
+	key   string
+	index int
+	isIdx bool
+}
+
+// parseJSONPath parses a path like .resources[3]["key.with.dots"]
+func parseJSONPath(path string) ([]jsonStep, error) {
+	res := []jsonStep{}
+	for rest := path; rest != ""; {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, ErrInvalidPath
+			}
+			res = append(res, jsonStep{key: rest[1 : end+1]})
+			rest = rest[end+1:]
+		case '[':
+			if strings.HasPrefix(rest, `["`) {
+				quoted, err := strconv.QuotedPrefix(rest[1:])
+				if err != nil || !strings.HasPrefix(rest[1+len(quoted):], "]") {
+					return nil, ErrInvalidPath
+				}
+				key, _ := strconv.Unquote(quoted)
+				res = append(res, jsonStep{key: key})
+				rest = rest[len(quoted)+2:]
+				continue
+			}
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, ErrInvalidPath
+			}
+			idx, err := strconv.Atoi(rest[1:end])
+			if err != nil || idx < 0 {
+				return nil, ErrInvalidPath
+			}
+			res = append(res, jsonStep{index: idx, isIdx: true})
+			rest = rest[end+1:]
+		default:
+			return nil, ErrInvalidPath
+		}
+	}
+	return res, nil
+}
+
+// jsonKeyPath appends a key to a path, quoting it if needed
+func jsonKeyPath(path string, key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]\"") {
+		return path + "[" + strconv.Quote(key) + "]"
+	}
+	return path + "." + key
+}
+
+// lookupJSONPath returns the subtree at the path
+func lookupJSONPath(data interface{}, steps []jsonStep) (interface{}, error) {
+	for _, step := range steps {
+		switch v := data.(type) {
+		case map[string]interface{}:
+			child, ok := v[step.key]
+			if step.isIdx || !ok {
+				return nil, ErrNotFound
+			}
+			data = child
+		case []interface{}:
+			if !step.isIdx || step.index >= len(v) {
+				return nil, ErrNotFound
+			}
+			data = v[step.index]
+		default:
+			return nil, ErrNotFound
+		}
+	}
+	return data, nil
+}
+
+// SelectJSON returns the JSON-encoded subtree at a path like .outputs.vpc_id.value or .resources[0]
+func SelectJSON(data []byte, path string) ([]byte, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var root interface{}
+	if err := dec.Decode(&root); err != nil {
+		return nil, ErrNotJSON
+	}
+	sub, err := lookupJSONPath(root, steps)
+	if err != nil {
+		return nil, ErrUnresolved
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(sub); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonTree renders JSON as nested details/summary elements
+type jsonTree struct {
+	query  url.Values
+	filter string
+}
+
+// link makes a query string showing the subtree at the path
+func (t *jsonTree) link(path string, page int) string {
+	q := url.Values{}
+	for k, v := range t.query {
+		q[k] = v
+	}
+	q.Del("page")
+	q.Set("path", path)
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page))
+	}
+	return "?" + q.Encode()
+}
+
+// label writes the key of a node, highlighting it if it matches the filter
+func (t *jsonTree) label(buf *bytes.Buffer, key string) bool {
+	matched := t.filter != "" && strings.Contains(strings.ToLower(key), strings.ToLower(t.filter))
+	if matched {
+		fmt.Fprintf(buf, "<mark>%s</mark>", template.HTMLEscapeString(key))
+	} else {
+		buf.WriteString(template.HTMLEscapeString(key))
+	}
+	return matched
+}
+
+// children writes the items of a container (a page of an array), returning whether a key matched the filter
+func (t *jsonTree) children(buf *bytes.Buffer, path string, v interface{}, depth int, page int) bool {
+	matched := false
+	buf.WriteString(`<ul class="json-tree">`)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			matched = t.node(buf, k, jsonKeyPath(path, k), v[k], depth) || matched
+		}
+	case []interface{}:
+		start := min((max(page, 1)-1)*jsonTreePageSize, len(v))
+		end := min(start+jsonTreePageSize, len(v))
+		for i := start; i < end; i++ {
+			matched = t.node(buf, strconv.Itoa(i), fmt.Sprintf("%s[%d]", path, i), v[i], depth) || matched
+		}
+		if end-start < len(v) {
+			fmt.Fprintf(buf, `<li class="text-muted">showing %d-%d of %d items`, start+1, end, len(v))
+			if start > 0 {
+				fmt.Fprintf(buf, ` <a href="%s">prev</a>`, template.HTMLEscapeString(t.link(path, max(page, 1)-1)))
+			}
+			if end < len(v) {
+				fmt.Fprintf(buf, ` <a href="%s">next</a>`, template.HTMLEscapeString(t.link(path, max(page, 1)+1)))
+			}
+			buf.WriteString("</li>")
+		}
+	}
+	buf.WriteString("</ul>")
+	return matched
+}
+
+// node writes a key and its value, returning whether the subtree has a key matching the filter
+func (t *jsonTree) node(buf *bytes.Buffer, key string, path string, v interface{}, depth int) bool {
+	head := &bytes.Buffer{}
+	matched := t.label(head, key)
+	summary := ""
+	switch v := v.(type) {
+	case map[string]interface{}:
+		summary = fmt.Sprintf("{%d}", len(v))
+	case []interface{}:
+		summary = fmt.Sprintf("[%d]", len(v))
+	default:
+		b, _ := json.Marshal(v)
+		fmt.Fprintf(buf, `<li><span class="json-key">%s</span>: <span class="json-value">%s</span></li>`, head.String(), template.HTMLEscapeString(string(b)))
+		return matched
+	}
+	body := &bytes.Buffer{}
+	childMatched := t.children(body, path, v, depth+1, 1)
+	open := ""
+	if depth < jsonTreeOpenDepth || childMatched {
+		open = " open"
+	}
+	fmt.Fprintf(buf, `<li><details%s><summary><a class="json-key" href="%s">%s</a> <span class="text-muted">%s</span></summary>`,
+		open, template.HTMLEscapeString(t.link(path, 1)), head.String(), summary)
+	buf.Write(body.Bytes())
+	buf.WriteString("</details></li>")
+	return matched || childMatched
+}
+
+// RenderJSONTree renders the subtree of the JSON at the path as collapsible HTML
+func RenderJSONTree(data []byte, path string, filter string, page int, query url.Values) (template.HTML, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var root interface{}
+	if err := dec.Decode(&root); err != nil {
+		return "", err
+	}
+	sub, err := lookupJSONPath(root, steps)
+	if err != nil {
+		return "", err
+	}
+	t := &jsonTree{query: query, filter: filter}
+	buf := &bytes.Buffer{}
+	switch sub.(type) {
+	case map[string]interface{}, []interface{}:
+		t.children(buf, path, sub, 0, page)
+	default:
+		b, _ := json.Marshal(sub)
+		fmt.Fprintf(buf, `<span class="json-value">%s</span>`, template.HTMLEscapeString(string(b)))
+	}
+	return template.HTML(buf.String()), nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testTreeJSON = `{"version": 4, "serial": 12345678901234567890,
+ "resources": [{"type": "aws_instance", "instances": [{"attributes": {"ami": "ami-1", "tags": {"Name": "web"}}}]}],
+ "odd.key": {"x": 1}}`
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []jsonStep
+		err      error
+	}{
+		{"", []jsonStep{}, nil},
+		{".resources[3].name", []jsonStep{{key: "resources"}, {index: 3, isIdx: true}, {key: "name"}}, nil},
+		{`["odd.key"].x`, []jsonStep{{key: "odd.key"}, {key: "x"}}, nil},
+		{"resources", nil, ErrInvalidPath},
+		{".a..b", nil, ErrInvalidPath},
+		{".a[x]", nil, ErrInvalidPath},
+		{".a[1", nil, ErrInvalidPath},
+		{`.a["b`, nil, ErrInvalidPath},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			steps, err := parseJSONPath(test.path)
+			if err != test.err {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if fmt.Sprint(steps) != fmt.Sprint(test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, steps)
+			}
+		})
+	}
+}
+
+func TestRenderJSONTree(t *testing.T) {
+	out, err := RenderJSONTree([]byte(testTreeJSON), "", "", 1, url.Values{})
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	html := string(out)
+	for _, expected := range []string{
+		// depth 0 and 1 are expanded, deeper levels are collapsed
+		`<details open><summary><a class="json-key" href="?path=.resources">resources</a> <span class="text-muted">[1]</span>`,
+		`<details open><summary><a class="json-key" href="?path=.resources%5B0%5D">0</a>`,
+		`<details><summary><a class="json-key" href="?path=.resources%5B0%5D.instances">instances</a>`,
+		`<a class="json-key" href="?path=%5B%22odd.key%22%5D">odd.key</a>`,
+		`<span class="json-key">serial</span>: <span class="json-value">12345678901234567890</span>`,
+	} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("expected %q in %s", expected, html)
+		}
+	}
+
+	out, err = RenderJSONTree([]byte(testTreeJSON), ".resources[0].instances[0].attributes", "", 1, url.Values{"history": {"v1"}})
+	if err != nil {
+		t.Fatalf("render subtree failed: %v", err)
+	}
+	html = string(out)
+	if strings.Contains(html, ">resources<") || !strings.Contains(html, "&#34;ami-1&#34;") {
+		t.Errorf("expected only the subtree: %s", html)
+	}
+	if !strings.Contains(html, `href="?history=v1&amp;path=.resources%5B0%5D.instances%5B0%5D.attributes.tags"`) {
+		t.Errorf("expected links to keep the query: %s", html)
+	}
+
+	out, _ = RenderJSONTree([]byte(testTreeJSON), "", "name", 1, url.Values{})
+	html = string(out)
+	if !strings.Contains(html, "<mark>Name</mark>") {
+		t.Errorf("expected matching key highlighted: %s", html)
+	}
+	if !strings.Contains(html, `<details open><summary><a class="json-key" href="?path=.resources%5B0%5D.instances">`) {
+		t.Errorf("expected ancestors of matches expanded: %s", html)
+	}
+
+	for _, path := range []string{".missing", ".version.x", ".resources[1]", ".resources.x"} {
+		if _, err := RenderJSONTree([]byte(testTreeJSON), path, "", 1, url.Values{}); err != ErrNotFound {
+			t.Errorf("%s: expected ErrNotFound, got %v", path, err)
+		}
+	}
+}
+
+func TestRenderJSONTree_Paginate(t *testing.T) {
+	items := make([]string, 120)
+	for i := range items {
+		items[i] = fmt.Sprint(i)
+	}
+	data := []byte(`{"items": [` + strings.Join(items, ",") + `]}`)
+	out, _ := RenderJSONTree(data, "", "", 1, url.Values{})
+	if !strings.Contains(string(out), "showing 1-50 of 120 items") || !strings.Contains(string(out), `href="?page=2&amp;path=.items">next</a>`) {
+		t.Errorf("expected first page: %s", out)
+	}
+	out, _ = RenderJSONTree(data, ".items", "", 3, url.Values{"path": {".items"}, "page": {"3"}})
+	html := string(out)
+	if !strings.Contains(html, "showing 101-120 of 120 items") || !strings.Contains(html, ">prev</a>") || strings.Contains(html, ">next</a>") {
+		t.Errorf("expected last page: %s", html)
+	}
+	if !strings.Contains(html, `<span class="json-key">100</span>`) || strings.Contains(html, `<span class="json-key">99</span>`) {
+		t.Errorf("unexpected items on last page: %s", html)
+	}
+}
+
+func TestHTMLView_Path(t *testing.T) {
+	h := &HTMLHandler{ds: &mockDS{readBody: testTreeJSON}, basepath: "/html/"}
+	tests := []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"", http.StatusOK, `<ul class="json-tree">`},
+		{"?path=.resources%5B0%5D", http.StatusOK, "<code>.resources[0]</code>"},
+		{"?path=.nothing", http.StatusNotFound, ""},
+		{"?path=nothing", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			http.StripPrefix("/html/", h).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/view/a"+test.query, nil))
+			if rr.Code != test.code {
+				t.Fatalf("expected %d, got %d", test.code, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expected) {
+				t.Errorf("expected %q in %s", test.expected, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestSelectJSON(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+		err      error
+	}{
+		{".version", "4\n", nil},
+		{".serial", "12345678901234567890\n", nil},
+		{".resources[0].instances[0].attributes.tags", `{"Name":"web"}` + "\n", nil},
+		{".resources[0].type", `"aws_instance"` + "\n", nil},
+		{`["odd.key"].x`, "1\n", nil},
+		{"", "", nil},
+		{".outputs.vpc_id.value", "", ErrUnresolved},
+		{".resources[1]", "", ErrUnresolved},
+		{".version.x", "", ErrUnresolved},
+		{".resources.x", "", ErrUnresolved},
+		{"resources", "", ErrInvalidPath},
+		{".resources[-1]", "", ErrInvalidPath},
+	}
+	for _, test := range tests {
+		out, err := SelectJSON([]byte(testTreeJSON), test.path)
+		if err != test.err {
+			t.Errorf("SelectJSON(%q): expected error %v, got %v", test.path, test.err, err)
+			continue
+		}
+		if test.path != "" && err == nil && string(out) != test.expected {
+			t.Errorf("SelectJSON(%q) = %q, expected %q", test.path, out, test.expected)
+		}
+	}
+	if _, err := SelectJSON([]byte("plain text"), ".a"); err != ErrNotJSON {
+		t.Errorf("expected ErrNotJSON, got %v", err)
+	}
+}
+
+func TestAPIGet_Select(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for name, content := range map[string]string{"tf": testTreeJSON, "plain": "plain text"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader(content), []byte{}, ""); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	h := &APIHandler{ds: &ds}
+	tests := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"/tf?select=.resources[0].instances[0].attributes.ami", http.StatusOK, `"ami-1"` + "\n"},
+		{"/tf?select=.outputs.vpc_id.value", http.StatusUnprocessableEntity, ".outputs.vpc_id.value: path does not resolve\n"},
+		{"/tf?select=resources", http.StatusBadRequest, "resources: invalid path\n"},
+		{"/plain?select=.a", http.StatusUnprocessableEntity, ".a: not json\n"},
+		{"/missing?select=.a", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		// the selected value is not served compressed as stored
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != test.status || rr.Body.String() != test.body {
+			t.Errorf("%s: expected %d %q, got %d %q", test.url, test.status, test.body, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// defaultWait is the time a GET with ?wait= waits without ?timeout=
+const defaultWait = 30 * time.Second
+
+// defaultMaxWait caps ?timeout= of a GET with ?wait= unless the server sets another limit
+const defaultMaxWait = 60 * time.Second
+
+// waitRecheck is the interval of checking the current version while waiting, which catches writes made by other processes
+const waitRecheck = time.Second
+
+// waitTimeout returns the time a GET with ?wait= waits, ?timeout= capped by the server limit and the deadline of the request
+func (h *APIHandler) waitTimeout(r *http.Request) (time.Duration, error) {
+	timeout := defaultWait
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			slog.Error("invalid timeout", "timeout", s, "error", err)
+			return 0, ErrInvalidPath
+		}
+		timeout = d
+	}
+	limit := h.maxWait
+	if limit <= 0 {
+		limit = defaultMaxWait
+	}
+	timeout = min(timeout, limit)
+	if deadline, ok := r.Context().Deadline(); ok {
+		// answer before --request-timeout does
+		timeout = max(min(timeout, time.Until(deadline)-time.Second), 0)
+	}
+	return timeout, nil
+}
+
+// waitChange holds a GET with ?wait=<version> until the current version of the file differs from it
+//
+// it reports true if the version is the same when the timeout elapses or the client goes away; an empty version
+// waits for the file to be created.
+func (h *APIHandler) waitChange(path string, r *http.Request) (bool, error) {
+	if !contentRequest(path, r) || partialRequest(r) {
+		return false, ErrInvalidPath
+	}
+	if hist, err := h.requestedHistory(path, r); err != nil || hist != "" {
+		// versions do not change
+		return false, ErrInvalidPath
+	}
+	timeout, err := h.waitTimeout(r)
+	if err != nil {
+		return false, err
+	}
+	version := r.URL.Query().Get("wait")
+	if h.ds.CurrentVersion(path) != version {
+		return false, nil
+	}
+	defer trackOp(r.Context(), "wait")()
+	var changes chan Event
+	if h.events != nil {
+		changes = h.events.Subscribe()
+		defer h.events.Unsubscribe(changes)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(waitRecheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return true, nil
+		case <-timer.C:
+			return h.ds.CurrentVersion(path) == version, nil
+		case ev := <-changes:
+			if ev.Name != path {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if h.ds.CurrentVersion(path) != version {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIGet_Wait(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	versions := writeAt(t, &ds, "prod", time.Now())
+	h := &APIHandler{ds: &ds, events: NewEventBroker()}
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	// another version than the client has: answered at once
+	rr := get("/prod?wait=other")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"v":1}` {
+		t.Errorf("unexpected response: %d %s", rr.Code, rr.Body.String())
+	}
+
+	st := time.Now()
+	rr = get("/prod?wait=" + versions[0] + "&timeout=50ms")
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 || rr.Header().Get("Etag") != `"`+versions[0]+`"` {
+		t.Errorf("expected 304 on timeout: %d %s %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+	if elapsed := time.Since(st); elapsed < 50*time.Millisecond {
+		t.Errorf("answered before the timeout: %s", elapsed)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get("/prod?wait=" + versions[0] + "&timeout=10s") }()
+	time.Sleep(50 * time.Millisecond)
+	post := httptest.NewRecorder()
+	h.ServeHTTP(post, httptest.NewRequest(http.MethodPost, "/prod", strings.NewReader(`{"v":2}`)))
+	if post.Code != http.StatusOK {
+		t.Fatalf("write failed: %d", post.Code)
+	}
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusOK || rr.Body.String() != `{"v":2}` || rr.Header().Get("Etag") == `"`+versions[0]+`"` {
+			t.Errorf("expected the new version: %d %s %v", rr.Code, rr.Body.String(), rr.Header())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not woken by the write")
+	}
+	if n := h.events.Subscribers(); n != 0 {
+		t.Errorf("subscription left: %d", n)
+	}
+
+	for _, path := range []string{"/prod?wait=x&timeout=soon", "/prod?wait=x&history=" + versions[0], "/prod?wait=x&versions=true"} {
+		if rr := get(path); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestAPIGet_WaitCreate(t *testing.T) {
+	// without events, the version is checked at intervals, which also catches writes of other processes
+	ds := NewDatastore(t.TempDir())
+	h := &APIHandler{ds: &ds}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/new?wait=&timeout=10s", nil))
+		done <- rr
+	}()
+	time.Sleep(50 * time.Millisecond)
+	writeAt(t, &ds, "new", time.Now())
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusOK || rr.Body.String() != `{"v":1}` {
+			t.Errorf("expected the created file: %d %s", rr.Code, rr.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("creation not noticed")
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	h := &APIHandler{maxWait: time.Minute}
+	tests := []struct {
+		query    string
+		expected time.Duration
+	}{
+		{"", defaultWait},
+		{"timeout=5s", 5 * time.Second},
+		{"timeout=1h", time.Minute},
+		{"timeout=0s", 0},
+	}
+	for _, test := range tests {
+		got, err := h.waitTimeout(httptest.NewRequest(http.MethodGet, "/a?wait=x&"+test.query, nil))
+		if err != nil || got != test.expected {
+			t.Errorf("%q: expected %s, got %s %v", test.query, test.expected, got, err)
+		}
+	}
+	if _, err := h.waitTimeout(httptest.NewRequest(http.MethodGet, "/a?wait=x&timeout=-1s", nil)); err != ErrInvalidPath {
+		t.Errorf("negative timeout: %v", err)
+	}
+}
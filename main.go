@@ -1,16 +1,106 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 )
 
 var option struct {
-	Verbose bool   `short:"v" long:"verbose" description:"DEBUG level"`
-	Quiet   bool   `short:"q" long:"quiet" description:"WARNING level"`
-	Datadir string `short:"d" long:"data-dir" required:"true" env:"STSV_DATADIR" description:"data directory to store state"`
+	Verbose       bool          `short:"v" long:"verbose" description:"DEBUG level"`
+	Quiet         bool          `short:"q" long:"quiet" description:"WARNING level"`
+	Datadir       string        `short:"d" long:"data-dir" required:"true" env:"STSV_DATADIR" description:"data directory to store state"`
+	Fsync         bool          `long:"fsync" env:"STSV_FSYNC" description:"fsync data and directory before updating current"`
+	Compress      bool          `long:"compress" env:"STSV_COMPRESS" description:"store new versions compressed"`
+	CompressAlgo  string        `long:"compress-algo" env:"STSV_COMPRESS_ALGO" choice:"gzip" choice:"zstd" default:"gzip" description:"compression algorithm of --compress"`
+	CompressLevel int           `long:"compress-level" env:"STSV_COMPRESS_LEVEL" description:"compression level of --compress (gzip 1-9, zstd 1-22), 0 for the default"`
+	Strict        bool          `long:"strict" env:"STSV_STRICT" description:"fail listings on directories or files which cannot be read instead of skipping them with a warning"`
+	FailBusy      bool          `long:"fail-busy" env:"STSV_FAIL_BUSY" description:"fail a write, rollback, delete or lock with 409 instead of waiting while a write, rollback or delete of the same file is in progress"`
+	StrictLock    bool          `long:"strict-lock" env:"STSV_STRICT_LOCK" description:"fail re-lock and unlock of an unlocked file even with the same lock ID"`
+	Exclude       []string      `long:"exclude" env:"STSV_EXCLUDE" env-delim:"," description:"glob of directories to skip when listing (name, or path if it contains /)"`
+	ForceDatadir  bool          `long:"force-datadir" env:"STSV_FORCE_DATADIR" description:"use the data directory even if it does not look like a datastore, creating it if missing"`
+	Backup        bool          `long:"backup" env:"STSV_BACKUP" description:"keep a backup link to the previous version on each write, which prune does not remove"`
+	Shard         bool          `long:"shard" env:"STSV_SHARD" description:"store files under two levels of directories derived from the hash of their name (see reshard)"`
+	NoAutocreate  bool          `long:"no-autocreate" env:"STSV_NO_AUTOCREATE" description:"refuse new files in namespaces (parent directories) which were not created with mkns"`
+	MaxSize       ByteSize      `long:"max-size" env:"STSV_MAX_SIZE" description:"reject versions larger than this (e.g. 500MB) unless the file has a max-size tag, 0 for no limit"`
+	MinFreeBytes  ByteSize      `long:"min-free-bytes" env:"STSV_MIN_FREE_BYTES" description:"refuse writes with 507 while the data directory has less free space than this (e.g. 1GB), 0 for no check"`
+	Alias         []string      `long:"alias" env:"STSV_ALIAS" env-delim:"," description:"old=new: serve the file new, and the files under it, as old (repeatable)"`
+	AliasFile     string        `long:"alias-file" env:"STSV_ALIAS_FILE" description:"file of aliases, one old=new per line"`
+	Timezone      string        `long:"timezone" env:"STSV_TIMEZONE" description:"zone of the times shown, e.g. UTC or Asia/Tokyo (default: local)"`
+	Timeout       time.Duration `long:"timeout" env:"STSV_TIMEOUT" description:"give up any command but server after this duration, e.g. 5s (exit code 3)"`
+	ReplicaDir    string        `long:"replica-dir" env:"STSV_REPLICA_DIR" description:"copy of the data directory (e.g. kept by rsync) read when reading the data directory fails"`
+}
+
+// openDatastore creates the Datastore configured by the global options
+func openDatastore() Datastore {
+	ds := NewDatastore(option.Datadir)
+	ds.Fsync = option.Fsync
+	ds.StrictLock = option.StrictLock
+	ds.StrictWalk = option.Strict
+	ds.FailBusy = option.FailBusy
+	ds.Compress = option.Compress
+	ds.CompressAlgo = option.CompressAlgo
+	ds.CompressLevel = option.CompressLevel
+	ds.Backup = option.Backup
+	ds.Shard = option.Shard
+	ds.NoAutocreate = option.NoAutocreate
+	ds.MaxSize = int64(option.MaxSize)
+	ds.MinFreeBytes = int64(option.MinFreeBytes)
+	ds.Skip = append(append([]string{}, DefaultSkip...), option.Exclude...)
+	return ds
+}
+
+// commandContext returns a context cancelled by Ctrl-C or SIGTERM, or when --timeout elapses, so long operations stop cleanly
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if option.Timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, option.Timeout, ErrTimeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// timeoutGrace is the time a command has after --timeout to stop by itself before it is given up
+const timeoutGrace = 2 * time.Second
+
+// runWithTimeout runs the command, returning ErrTimeout if it has not returned timeoutGrace after the timeout
+//
+// commands stop at the deadline of commandContext, but a call blocked on a dead file system (e.g. NFS)
+// never returns; it is left behind and the process exits.
+func runWithTimeout(timeout time.Duration, run func() error) error {
+	if timeout <= 0 {
+		return run()
+	}
+	done := make(chan error, 1)
+	go func() { done <- run() }()
+	timer := time.NewTimer(timeout + timeoutGrace)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// needsDatastore reports whether the command uses the data directory
+func needsDatastore(command flags.Commander) bool {
+	switch cmd := command.(type) {
+	case *Sign:
+		return false
+	case *Doctor:
+		return cmd.URL == ""
+	}
+	return true
 }
 
 func init_log() {
@@ -25,10 +115,11 @@ func init_log() {
 }
 
 type SubCommand struct {
-	Name  string
-	Short string
-	Long  string
-	Data  interface{}
+	Name    string
+	Short   string
+	Long    string
+	Data    interface{}
+	Aliases []string
 }
 
 func realMain() int {
@@ -39,24 +130,86 @@ func realMain() int {
 		{Name: "cat", Short: "cat files", Long: "cat file contents", Data: &Cat{}},
 		{Name: "put", Short: "put files", Long: "put file contents", Data: &Put{}},
 		{Name: "history", Short: "list history", Long: "list history of files", Data: &History{}},
+		{Name: "browse", Short: "browse interactively", Long: "list files, their history and versions, and diff versions interactively", Data: &Browse{}},
+		{Name: "grep", Short: "find references", Long: "list files whose terraform state has matching resources or outputs", Data: &GrepCmd{}},
+		{Name: "diff", Short: "diff versions", Long: "show what would change from a version of a file to a local file (--local), or to another version; exit code 1 if they differ", Data: &DiffCmd{}},
+		{Name: "tree", Short: "show storage layout", Long: "show version files, current and lock of a file as stored on disk", Data: &Tree{}},
 		{Name: "hcat", Short: "cat history", Long: "cat history of files", Data: &HistoryCat{}},
 		{Name: "prune", Short: "prune history", Long: "remove old history", Data: &Prune{}},
 		{Name: "rollback", Short: "rollback to history", Long: "rollback to history", Data: &HistoryRollback{}},
 		{Name: "edit", Short: "edit file", Long: "edit file in editor", Data: &EditFile{}},
+		{Name: "info", Short: "show info", Long: "show file information and consistency of current", Data: &Info{}},
+		{Name: "rename", Short: "rename a file", Long: "move all versions of a file to a new name, or fix names breaking the name rules with --sanitize", Data: &RenameCmd{}},
+		{Name: "reshard", Short: "move into sharded layout", Long: "move files of the flat layout under directories derived from the hash of their name, for --shard", Data: &ReshardCmd{}},
+		{Name: "verify", Short: "verify datastore", Long: "check and recover interrupted operations", Data: &Verify{}},
+		{Name: "index", Short: "hash versions", Long: "record the md5 of the current versions, or all versions with --all, into hash sidecars; versions already hashed are skipped", Data: &IndexCmd{}},
+		{Name: "doctor", Short: "self-test", Long: "exercise write/read/lock/history/rollback/prune/delete end to end", Data: &Doctor{}, Aliases: []string{"selftest"}},
+		{Name: "protect", Short: "protect files", Long: "make files immutable: write, delete, rollback and prune are refused", Data: &ProtectCmd{}},
+		{Name: "unprotect", Short: "unprotect files", Long: "make protected files writable again", Data: &UnprotectCmd{}},
+		{Name: "hold", Short: "hold files", Long: "put files under a retention hold: prune and delete are refused until released", Data: &HoldCmd{}},
+		{Name: "release", Short: "release holds", Long: "release the retention hold of files", Data: &ReleaseCmd{}},
+		{Name: "meta", Short: "show or set tags", Long: "show the tags of a file, or set them with key=value (key= removes), e.g. max-size=500MB", Data: &MetaCmd{}},
+		{Name: "describe", Short: "show or set the description", Long: "show the description of a file, or set it (markdown, \"\" removes it); the view page and ls --long show it", Data: &DescribeCmd{}},
+		{Name: "notes", Short: "show or set notes", Long: "show the notes of a file, or set them from a markdown file; the view page shows them at the top", Data: &NotesCmd{}},
+		{Name: "mkns", Short: "create namespaces", Long: "create namespaces which files can be written into with --no-autocreate", Data: &MknsCmd{}},
+		{Name: "import-state", Short: "import terraform state", Long: "import a terraform state file, or each workspace of terraform.tfstate.d", Data: &ImportState{}},
+		{Name: "export-state", Short: "export a file", Long: "write all versions, sidecars and lock of a file into a bundle", Data: &ExportState{}},
+		{Name: "import-state-bundle", Short: "import a bundle", Long: "restore a bundle made by export-state", Data: &ImportStateBundle{}},
+		{Name: "replay", Short: "replay versions", Long: "write a directory of exported versions into a file, oldest first", Data: &Replay{}},
+		{Name: "sign", Short: "sign urls", Long: "print signed urls for temporary read access", Data: &Sign{}},
+		{Name: "locks", Short: "list locks", Long: "list locked files and lock age", Data: &LockList{}},
+		{Name: "openapi", Short: "print the api spec", Long: "print the OpenAPI document of the HTTP API under /api/, generated from the operations and parameters the server handles", Data: &OpenAPICmd{}},
 	}
 	parser := flags.NewParser(&option, flags.Default)
 	for _, cmd := range commands {
-		_, err = parser.AddCommand(cmd.Name, cmd.Short, cmd.Long, cmd.Data)
+		var c *flags.Command
+		c, err = parser.AddCommand(cmd.Name, cmd.Short, cmd.Long, cmd.Data)
 		if err != nil {
 			slog.Error(cmd.Name, "error", err)
 			return -1
 		}
+		c.Aliases = cmd.Aliases
+	}
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if err := setTimezone(option.Timezone); err != nil {
+			init_log()
+			slog.Error("invalid timezone", "timezone", option.Timezone, "error", err)
+			return err
+		}
+		if err := checkCompression(option.CompressAlgo, option.CompressLevel); err != nil {
+			init_log()
+			slog.Error("invalid compression", "error", err)
+			return err
+		}
+		if needsDatastore(command) {
+			if err := CheckRoot(option.Datadir, option.ForceDatadir); err != nil {
+				init_log()
+				slog.Error("invalid data directory", "root", option.Datadir, "error", err)
+				return err
+			}
+		}
+		if _, ok := command.(*WebServer); ok {
+			return command.Execute(args)
+		}
+		return runWithTimeout(option.Timeout, func() error { return command.Execute(args) })
 	}
 	if _, err := parser.Parse(); err != nil {
 		init_log()
 		if _, ok := err.(*flags.Error); ok {
 			return 0
 		}
+		if errors.Is(err, ErrTimeout) || (option.Timeout > 0 && errors.Is(err, context.DeadlineExceeded)) {
+			slog.Error("timed out", "timeout", option.Timeout.String(), "error", err)
+			return exitInterrupted
+		}
+		if err == ErrDifferent {
+			// diff found changes, which it has shown
+			return 1
+		}
+		if interrupted(err) {
+			slog.Error("interrupted", "error", err)
+			return exitInterrupted
+		}
 		if err != ErrNotChanged {
 			slog.Error("error exit", "error", err)
 			parser.WriteHelp(os.Stdout)
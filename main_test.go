@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestInitLog_DefaultLevel(t *testing.T) {
@@ -208,3 +210,56 @@ func TestSubCommand_Structure(t *testing.T) {
 		t.Errorf("expected Data to be non-nil")
 	}
 }
+
+func TestRunWithTimeout(t *testing.T) {
+	if err := runWithTimeout(0, func() error { return ErrNotFound }); err != ErrNotFound {
+		t.Errorf("expected the error of the command, got %v", err)
+	}
+	if err := runWithTimeout(time.Hour, func() error { return nil }); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	// a command blocked beyond the grace is given up
+	block := make(chan struct{})
+	defer close(block)
+	st := time.Now()
+	if err := runWithTimeout(time.Millisecond, func() error { <-block; return nil }); err != ErrTimeout {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(st); elapsed < timeoutGrace {
+		t.Errorf("given up before the grace: %s", elapsed)
+	}
+}
+
+func TestRealMain_Timeout(t *testing.T) {
+	origArgs := os.Args
+	origDatadir := option.Datadir
+	origTimeout := option.Timeout
+	defer func() {
+		os.Args = origArgs
+		option.Datadir = origDatadir
+		option.Timeout = origTimeout
+	}()
+
+	option.Datadir = t.TempDir()
+	ds := NewDatastore(option.Datadir)
+	writeAt(t, &ds, "a/b", time.Now())
+	os.Args = []string{"program", "-d", option.Datadir, "ls", "--timeout", "1ns"}
+	if code := realMain(); code != exitInterrupted {
+		t.Errorf("expected exit code %d, got %d", exitInterrupted, code)
+	}
+	ctx, stop := commandContext()
+	defer stop()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("no deadline")
+	}
+	<-ctx.Done()
+	if context.Cause(ctx) != ErrTimeout {
+		t.Errorf("expected ErrTimeout as the cause, got %v", context.Cause(ctx))
+	}
+
+	option.Timeout = 0
+	os.Args = []string{"program", "-d", option.Datadir, "ls"}
+	if code := realMain(); code != 0 {
+		t.Errorf("expected exit code 0 without the timeout, got %d", code)
+	}
+}
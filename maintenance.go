@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MaintenanceResult is the outcome of a maintenance run
+type MaintenanceResult struct {
+	Pruned       int
+	Reclaimed    int64
+	LocksExpired int
+	// Recovered is the number of interrupted operations cleaned up, with their partial versions
+	Recovered int
+	// Skipped is the number of files left alone because they were locked or being written
+	Skipped int
+	// UploadsExpired is the number of abandoned resumable uploads removed
+	UploadsExpired int
+	Errors         []string
+}
+
+// MaintenanceStatus is the state of the background maintenance shown on the admin page
+type MaintenanceStatus struct {
+	Running  bool
+	Runs     int
+	LastRun  time.Time
+	Duration time.Duration
+	NextRun  time.Time
+	MaintenanceResult
+}
+
+// Maintenance runs the maintenance function periodically or on request and keeps its status
+type Maintenance struct {
+	run      func(ctx context.Context) MaintenanceResult
+	interval time.Duration
+	trigger  chan struct{}
+	mu       sync.Mutex
+	status   MaintenanceStatus
+}
+
+// NewMaintenance creates a Maintenance; with zero interval it only runs on request
+func NewMaintenance(run func(ctx context.Context) MaintenanceResult, interval time.Duration) *Maintenance {
+	return &Maintenance{run: run, interval: interval, trigger: make(chan struct{}, 1)}
+}
+
+// Status returns a copy of the current status
+func (m *Maintenance) Status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := m.status
+	res.Errors = slices.Clone(m.status.Errors)
+	return res
+}
+
+// RunNow requests a run, it returns false if a run is already pending
+func (m *Maintenance) RunNow() bool {
+	select {
+	case m.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Loop runs the maintenance at the interval and on request until the context is done
+func (m *Maintenance) Loop(ctx context.Context) {
+	for {
+		var tick <-chan time.Time
+		if m.interval > 0 {
+			m.mu.Lock()
+			m.status.NextRun = time.Now().Add(m.interval)
+			m.mu.Unlock()
+			tick = time.After(m.interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-m.trigger:
+		}
+		m.Once(ctx)
+	}
+}
+
+// Once runs the maintenance and records the result
+func (m *Maintenance) Once(ctx context.Context) MaintenanceResult {
+	st := time.Now()
+	m.mu.Lock()
+	m.status.Running = true
+	m.mu.Unlock()
+	res := m.run(ctx)
+	elapsed := time.Since(st)
+	slog.Info("maintenance finished", "pruned", res.Pruned, "reclaimed", humanizeBytes(res.Reclaimed), "locks-expired", res.LocksExpired, "recovered", res.Recovered, "uploads-expired", res.UploadsExpired, "skipped", res.Skipped, "errors", len(res.Errors), "elapsed", elapsed)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.Running = false
+	m.status.Runs++
+	m.status.LastRun = st
+	m.status.Duration = elapsed
+	m.status.MaintenanceResult = res
+	return res
+}
+
+// Maintain cleans up interrupted operations and abandoned uploads, prunes all files to keep versions and removes locks held longer than lockExpire
+//
+// zero keep or lockExpire disables the step; protected and held files are not pruned,
+// and files which are locked or being written are skipped.
+func (d *Datastore) Maintain(ctx context.Context, keep int, lockExpire time.Duration) MaintenanceResult {
+	res := MaintenanceResult{}
+	d.recoverIdle(&res)
+	uploadExpire := d.UploadExpire
+	if uploadExpire == 0 {
+		uploadExpire = defaultUploadExpire
+	}
+	if n, err := d.ExpireUploads(uploadExpire); err != nil {
+		res.Errors = append(res.Errors, err.Error())
+	} else {
+		res.UploadsExpired = n
+	}
+	if lockExpire > 0 {
+		locks, err := d.Locks("/")
+		if err != nil {
+			res.Errors = append(res.Errors, err.Error())
+		}
+		for _, l := range StaleLocks(locks, lockExpire) {
+			lockinfo, err := d.LockRead(l.Path)
+			if err != nil {
+				// released meanwhile
+				continue
+			}
+			// the same lock only, it may have been taken again meanwhile
+			if err := d.Unlock(l.Path, lockinfo); err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", l.Path, err))
+				continue
+			}
+			slog.Warn("stale lock expired", "name", l.Path, "age", l.Age)
+			res.LocksExpired++
+		}
+	}
+	if keep <= 0 {
+		return res
+	}
+	names := []string{}
+	if err := d.Walk(ctx, "/", func(e FileEntry) error {
+		names = append(names, e.Name)
+		return nil
+	}); err != nil {
+		res.Errors = append(res.Errors, err.Error())
+	}
+	for _, name := range names {
+		if _, err := d.LockRead(name); err == nil {
+			slog.Debug("locked, not pruned", "name", name)
+			res.Skipped++
+			continue
+		}
+		release, ok := d.tryGuard(name)
+		if !ok {
+			slog.Debug("being written, not pruned", "name", name)
+			res.Skipped++
+			continue
+		}
+		pr, err := d.PruneDetail(ctx, name, keep, false)
+		release()
+		if err == ErrProtected || err == ErrHeld {
+			continue
+		}
+		res.Pruned += pr.Before - pr.After
+		res.Reclaimed += pr.Reclaimed
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", name, err))
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	return res
+}
+
+// recoverIdle recovers the interrupted operations, removing their partial versions,
+// except those of files with an operation in progress
+func (d *Datastore) recoverIdle(res *MaintenanceResult) {
+	journals, err := d.PendingJournals("/")
+	if err != nil {
+		res.Errors = append(res.Errors, err.Error())
+	}
+	for _, name := range journals {
+		release, ok := d.tryGuard(name)
+		if !ok {
+			res.Skipped++
+			continue
+		}
+		_, err := d.Recover(name)
+		release()
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		slog.Info("interrupted operation recovered", "name", name)
+		res.Recovered++
+	}
+}
+
+// newCSRFKey makes a random key for the tokens of forms
+func newCSRFKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// csrfToken returns the token of the user which must be posted with forms
+func (h *HTMLHandler) csrfToken(user string) string {
+	mac := hmac.New(sha256.New, h.csrfKey)
+	mac.Write([]byte(user))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Admin serves the maintenance status page
+func (h *HTMLHandler) Admin(path string, w io.Writer, r *http.Request) error {
+	if h.maintenance == nil {
+		return ErrNotFound
+	}
+	tmpl_files := []string{
+		"templates/admin.html",
+		"templates/_inline_style.html",
+	}
+	data := make(map[string]interface{})
+	data["Status"] = h.maintenance.Status()
+	data["Interval"] = h.maintenance.interval
+	data["PartialReads"] = partialReads.Load()
+	data["Requested"] = r.URL.Query().Get("requested") == "true"
+	data["csrf"] = h.csrfToken(RequestUser(r))
+	data["Title"] = "admin"
+	data["basepath"] = h.basepath
+	return h.render(w, "admin.html", tmpl_files, data)
+}
+
+// RunMaintenance requests a maintenance run from the admin page
+func (h *HTMLHandler) RunMaintenance(w http.ResponseWriter, r *http.Request) {
+	user := RequestUser(r)
+	if h.maintenance == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	token := r.PostFormValue("csrf")
+	if len(h.csrfKey) == 0 || !hmac.Equal([]byte(token), []byte(h.csrfToken(user))) {
+		slog.Warn("invalid csrf token", "user", user, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	queued := h.maintenance.RunNow()
+	slog.Info("maintenance requested", "user", user, "queued", queued)
+	http.Redirect(w, r, h.basepath+"admin?requested=true", http.StatusSeeOther)
+}
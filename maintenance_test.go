@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatastore_Maintain(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{"a", "b", "c"} {
+		for _, s := range []string{"v1", "v2", "v3"} {
+			if err := ds.Write(t.Context(), name, strings.NewReader(s), []byte{}, ""); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := ds.Protect("b"); err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	if err := ds.Lock("c", `{"ID":"1"}`); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	res := ds.Maintain(t.Context(), 0, time.Hour)
+	if res.Pruned != 0 || res.LocksExpired != 0 {
+		t.Errorf("expected nothing to do: %+v", res)
+	}
+	time.Sleep(10 * time.Millisecond)
+	res = ds.Maintain(t.Context(), 1, 5*time.Millisecond)
+	if res.Pruned != 4 || res.Reclaimed != 8 || res.LocksExpired != 1 || len(res.Errors) != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if _, err := ds.LockRead("c"); err != ErrUnlocked {
+		t.Errorf("stale lock not removed: %v", err)
+	}
+	if hist := ds.History(t.Context(), "b"); len(hist) != 3 {
+		t.Errorf("protected file pruned: %d", len(hist))
+	}
+}
+
+func TestDatastore_MaintainBusy(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{"locked", "writing", "idle"} {
+		for _, s := range []string{"v1", "v2", "v3"} {
+			if err := ds.Write(t.Context(), name, strings.NewReader(s), []byte{}, ""); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := ds.Lock("locked", `{"ID":"1"}`); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	release, err := ds.guard("writing")
+	if err != nil {
+		t.Fatalf("guard failed: %v", err)
+	}
+	crashed := ds
+	crashed.failpoint = crashAt(journalWrite, "data")
+	if err := crashed.Write(t.Context(), "interrupted", strings.NewReader("partial"), []byte{}, ""); err != errCrash {
+		t.Fatalf("expected crash, got %v", err)
+	}
+
+	res := ds.Maintain(t.Context(), 1, 0)
+	release()
+	if res.Pruned != 2 || res.Skipped != 2 || res.Recovered != 1 || len(res.Errors) != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	for name, expected := range map[string]int{"locked": 3, "writing": 3, "idle": 1, "interrupted": 0} {
+		if hist := ds.History(t.Context(), name); len(hist) != expected {
+			t.Errorf("%s: expected %d versions, got %d", name, expected, len(hist))
+		}
+	}
+	if journals, _ := ds.PendingJournals("/"); len(journals) != 0 {
+		t.Errorf("journals left: %v", journals)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	m := NewMaintenance(func(ctx context.Context) MaintenanceResult {
+		calls <- struct{}{}
+		return MaintenanceResult{Pruned: 3, Reclaimed: 2048, Errors: []string{"x: failed"}}
+	}, 0)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go m.Loop(ctx)
+	if !m.RunNow() {
+		t.Fatalf("run not requested")
+	}
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatalf("maintenance did not run")
+	}
+	deadline := time.Now().Add(time.Second)
+	for m.Status().Runs == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	st := m.Status()
+	if st.Runs != 1 || st.Pruned != 3 || st.LastRun.IsZero() || st.Running || !st.NextRun.IsZero() {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
+
+func TestHTMLAdmin(t *testing.T) {
+	m := NewMaintenance(nil, time.Hour)
+	m.status = MaintenanceStatus{
+		Runs:              2,
+		LastRun:           time.Now().Add(-time.Minute),
+		Duration:          1500 * time.Millisecond,
+		NextRun:           time.Now().Add(time.Hour + time.Minute),
+		MaintenanceResult: MaintenanceResult{Pruned: 7, Reclaimed: 3 * 1024 * 1024, LocksExpired: 2, Errors: []string{"prod/app: broken"}},
+	}
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: &mockDS{}, basepath: "/html/", maintenance: m, csrfKey: []byte("key")})
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/admin", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	body := rr.Body.String()
+	for _, s := range []string{"1m ago", "1.5s", "in 1h", "every 1h0m0s", "<td>7</td>", "3.0 MiB", "<td>2</td>", "prod/app: broken", `name="csrf"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("%q not shown: %s", s, body)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	http.StripPrefix("/html/", &HTMLHandler{ds: &mockDS{}, basepath: "/html/"}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/admin", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without maintenance, got %d", rr.Code)
+	}
+}
+
+func TestHTMLAdmin_RunNow(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	m := NewMaintenance(func(ctx context.Context) MaintenanceResult {
+		calls <- struct{}{}
+		return MaintenanceResult{}
+	}, 0)
+	go m.Loop(t.Context())
+	hh := &HTMLHandler{ds: &mockDS{}, basepath: "/html/", maintenance: m, csrfKey: []byte("key")}
+	h := http.StripPrefix("/html/", hh)
+	post := func(user string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/html/admin", strings.NewReader(url.Values{"csrf": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := post("alice", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without token, got %d", rr.Code)
+	}
+	if rr := post("bob", hh.csrfToken("alice")); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with the token of another user, got %d", rr.Code)
+	}
+	select {
+	case <-calls:
+		t.Fatalf("maintenance ran without a valid token")
+	default:
+	}
+	rr := post("alice", hh.csrfToken("alice"))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/html/admin?requested=true" {
+		t.Errorf("unexpected response: %d %v", rr.Code, rr.Header())
+	}
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Errorf("maintenance did not run")
+	}
+
+	hh.csrfKey = nil
+	if rr := post("", hh.csrfToken("")); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without csrf key, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memDS is an in-memory DsIf for handler tests, keeping versions and locks like Datastore does
+//
+// errs fails the operations by method name, e.g. "Write", and calls records them as "Write name".
+type memDS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	errs  map[string]error
+	calls []string
+	seq   int
+}
+
+type memFile struct {
+	versions  []memVersion
+	current   string
+	lock      string
+	locked    time.Time
+	ctype     string
+	protected bool
+	held      bool
+}
+
+type memVersion struct {
+	name      string
+	data      []byte
+	timestamp time.Time
+}
+
+func newMemDS() *memDS {
+	return &memDS{files: map[string]*memFile{}, errs: map[string]error{}}
+}
+
+// call records the operation and returns its scripted error
+func (m *memDS) call(op string, name string) error {
+	m.calls = append(m.calls, op+" "+name)
+	return m.errs[op]
+}
+
+// called returns the names given to the operation, in order
+func (m *memDS) called(op string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := []string{}
+	for _, c := range m.calls {
+		if name, ok := strings.CutPrefix(c, op+" "); ok {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// put stores a new version of the file without recording a call, for the setup of tests
+func (m *memDS) put(name string, data string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.add(m.file(name, true), []byte(data))
+}
+
+func memName(name string) string {
+	return strings.Trim(filepath.Clean("/"+name), "/")
+}
+
+func (m *memDS) file(name string, create bool) *memFile {
+	f := m.files[memName(name)]
+	if f == nil && create {
+		f = &memFile{}
+		m.files[memName(name)] = f
+	}
+	return f
+}
+
+func (m *memDS) add(f *memFile, data []byte) string {
+	m.seq++
+	v := memVersion{name: fmt.Sprintf("v%04d", m.seq), data: data, timestamp: time.Now().UTC()}
+	f.versions = append(f.versions, v)
+	f.current = v.name
+	return v.name
+}
+
+func (f *memFile) version(name string) (memVersion, bool) {
+	if name == "" || name == "current" {
+		name = f.current
+	}
+	for _, v := range f.versions {
+		if v.name == name {
+			return v, true
+		}
+	}
+	return memVersion{}, false
+}
+
+func (m *memDS) read(name string, version string) (memVersion, error) {
+	f := m.file(name, false)
+	if f == nil {
+		return memVersion{}, ErrNotFound
+	}
+	v, ok := f.version(version)
+	if !ok {
+		return memVersion{}, ErrNotFound
+	}
+	return v, nil
+}
+
+func (m *memDS) Read(ctx context.Context, name string, out io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Read", name); err != nil {
+		return err
+	}
+	v, err := m.read(name, "")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(v.data)
+	return err
+}
+
+func (m *memDS) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Delete", name); err != nil {
+		return err
+	}
+	f := m.file(name, false)
+	if f == nil {
+		return ErrNotFound
+	}
+	if f.protected {
+		return ErrProtected
+	}
+	if f.held {
+		return ErrHeld
+	}
+	delete(m.files, memName(name))
+	return nil
+}
+
+// check checks the protection, the lock and the digest of a write
+func (f *memFile) check(data []byte, hash []byte, lockid string) error {
+	if f.protected {
+		return ErrProtected
+	}
+	if f.lock != "" && lockID(f.lock) != lockid {
+		return ErrLocked
+	}
+	if sum := md5.Sum(data); len(hash) != 0 && !bytes.Equal(sum[:], hash) {
+		return ErrInvalidHash
+	}
+	return nil
+}
+
+func (m *memDS) Write(ctx context.Context, name string, input io.Reader, hash []byte, lockid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Write", name); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	f := m.file(name, true)
+	if err := f.check(data, hash, lockid); err != nil {
+		return err
+	}
+	m.add(f, data)
+	return nil
+}
+
+func (m *memDS) Replace(ctx context.Context, name string, input io.Reader, hash []byte, lockid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Replace", name); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	f := m.file(name, true)
+	if err := f.check(data, hash, lockid); err != nil {
+		return err
+	}
+	for i, v := range f.versions {
+		if v.name == f.current {
+			f.versions[i] = memVersion{name: v.name, data: data, timestamp: time.Now().UTC()}
+			return nil
+		}
+	}
+	m.add(f, data)
+	return nil
+}
+
+func (m *memDS) Lock(name string, lockinfo string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Lock", name); err != nil {
+		return err
+	}
+	f := m.file(name, true)
+	if f.lock != "" {
+		if id := lockID(lockinfo); id != "" && id == lockID(f.lock) {
+			return nil
+		}
+		return ErrLocked
+	}
+	f.lock, f.locked = lockinfo, time.Now().UTC()
+	return nil
+}
+
+func (m *memDS) Unlock(name string, lockinfo string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Unlock", name); err != nil {
+		return err
+	}
+	f := m.file(name, false)
+	if f == nil || f.lock == "" {
+		if lockID(lockinfo) != "" {
+			return nil
+		}
+		return ErrUnlocked
+	}
+	if lockinfo != "" && lockID(lockinfo) != lockID(f.lock) {
+		return ErrLocked
+	}
+	f.lock = ""
+	return nil
+}
+
+func (m *memDS) LockRead(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("LockRead", name); err != nil {
+		return "", err
+	}
+	if f := m.file(name, false); f != nil && f.lock != "" {
+		return f.lock, nil
+	}
+	return "", ErrUnlocked
+}
+
+// entries returns the files under the prefix, sorted by name
+func (m *memDS) entries(prefix string) []FileEntry {
+	prefix = memName(prefix)
+	res := []FileEntry{}
+	for name, f := range m.files {
+		if prefix != "" && name != prefix && !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		v, ok := f.version("")
+		if !ok {
+			continue
+		}
+		res = append(res, FileEntry{Name: "/" + name, Locked: f.lock != "", Timestamp: v.timestamp, Size: int64(len(v.data))})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func (m *memDS) Walk(ctx context.Context, prefix string, fn func(e FileEntry) error) error {
+	_, err := m.WalkSkipped(ctx, prefix, fn)
+	return err
+}
+
+func (m *memDS) WalkSkipped(ctx context.Context, prefix string, fn func(e FileEntry) error) ([]WalkFailure, error) {
+	m.mu.Lock()
+	err := m.call("Walk", prefix)
+	entries := m.entries(prefix)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err := fn(e); err == filepath.SkipAll {
+			return nil, nil
+		} else if err != nil && err != filepath.SkipDir {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (m *memDS) History(ctx context.Context, name string) []FileEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := []FileEntry{}
+	if m.call("History", name) != nil {
+		return res
+	}
+	f := m.file(name, false)
+	if f == nil {
+		return res
+	}
+	for _, v := range slices.Backward(f.versions) {
+		res = append(res, FileEntry{Name: v.name, Locked: v.name == f.current, Timestamp: v.timestamp, Size: int64(len(v.data))})
+	}
+	return res
+}
+
+func (m *memDS) ReadHistory(name string, history string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ReadHistory", name); err != nil {
+		return nil, err
+	}
+	v, err := m.read(name, history)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(v.data)), nil
+}
+
+func (m *memDS) ReadRaw(name string, history string) (RawVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ReadRaw", name); err != nil {
+		return RawVersion{}, err
+	}
+	v, err := m.read(name, history)
+	if err != nil {
+		return RawVersion{}, err
+	}
+	sum := md5.Sum(v.data)
+	return RawVersion{ReadCloser: io.NopCloser(bytes.NewReader(v.data)), MD5: sum[:]}, nil
+}
+
+func (m *memDS) Locks(prefix string) ([]LockEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Locks", prefix); err != nil {
+		return nil, err
+	}
+	res := []LockEntry{}
+	for name, f := range m.files {
+		if f.lock != "" && strings.HasPrefix("/"+name, "/"+memName(prefix)) {
+			res = append(res, LockEntry{Path: "/" + name, LockInfo: f.lock, Timestamp: f.locked, Age: time.Since(f.locked)})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+	return res, nil
+}
+
+func (m *memDS) Rollback(name string, history string) error {
+	return m.RollbackIf(name, history, "")
+}
+
+func (m *memDS) RollbackIf(name string, history string, current string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Rollback", name); err != nil {
+		return err
+	}
+	f := m.file(name, false)
+	if f == nil {
+		return ErrNotFound
+	}
+	if current != "" && current != f.current {
+		return ErrPrecondition
+	}
+	if f.protected {
+		return ErrProtected
+	}
+	if _, ok := f.version(history); !ok {
+		return ErrNotFound
+	}
+	f.current = history
+	return nil
+}
+
+func (m *memDS) CurrentVersion(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f := m.file(name, false); f != nil {
+		return f.current
+	}
+	return ""
+}
+
+func (m *memDS) Prune(ctx context.Context, name string, keep int, dry bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Prune", name); err != nil {
+		return err
+	}
+	f := m.file(name, false)
+	if f == nil {
+		return ErrNotFound
+	}
+	if f.protected || f.held {
+		return ErrProtected
+	}
+	if dry {
+		return nil
+	}
+	kept := []memVersion{}
+	for i, v := range f.versions {
+		if v.name == f.current || i >= len(f.versions)-keep {
+			kept = append(kept, v)
+		}
+	}
+	f.versions = kept
+	return nil
+}
+
+func (m *memDS) Protected(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.file(name, false)
+	return f != nil && f.protected
+}
+
+func (m *memDS) Held(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.file(name, false)
+	return f != nil && f.held
+}
+
+func (m *memDS) ContentType(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f := m.file(name, false); f != nil && f.ctype != "" {
+		return f.ctype
+	}
+	return defaultContentType
+}
+
+func (m *memDS) SetContentType(name string, ctype string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("SetContentType", name); err != nil {
+		return err
+	}
+	if ctype == defaultContentType {
+		ctype = ""
+	}
+	m.file(name, true).ctype = ctype
+	return nil
+}
+
+// newTestServer serves the handlers on the datastore at /api/ and /html/ like the server command
+func newTestServer(t *testing.T, ds DsIf) *httptest.Server {
+	t.Helper()
+	api := &APIHandler{ds: ds, basepath: "/api/"}
+	html := &HTMLHandler{ds: ds, fmap: templateFuncs(), basepath: "/html/", csrfKey: newCSRFKey()}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix(api.basepath, api))
+	mux.Handle("/html/", http.StripPrefix(html.basepath, html))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMemDS_History(t *testing.T) {
+	ds := newMemDS()
+	srv := newTestServer(t, ds)
+	for _, body := range []string{`{"v":1}`, `{"v":2}`, `{"v":3}`} {
+		if code, _ := request(t, srv, http.MethodPost, "/api/app", body); code != http.StatusOK {
+			t.Fatalf("POST %s: %d", body, code)
+		}
+	}
+	hist := ds.History(t.Context(), "app")
+	if len(hist) != 3 || !hist[0].Locked {
+		t.Fatalf("unexpected history %+v", hist)
+	}
+	if code, body := request(t, srv, http.MethodGet, "/api/app?history="+hist[2].Name, ""); code != http.StatusOK || body != `{"v":1}` {
+		t.Errorf("old version: %d %s", code, body)
+	}
+	if code, _ := request(t, srv, http.MethodPost, "/api/app?rollback="+hist[1].Name, ""); code != http.StatusOK {
+		t.Errorf("rollback: %d", code)
+	}
+	if code, body := request(t, srv, http.MethodGet, "/api/app", ""); code != http.StatusOK || body != `{"v":2}` {
+		t.Errorf("current after rollback: %d %s", code, body)
+	}
+	if code, _ := request(t, srv, http.MethodPost, "/api/app?prune=0", ""); code != http.StatusOK {
+		t.Errorf("prune: %d", code)
+	}
+	if hist := ds.History(t.Context(), "app"); len(hist) != 1 || hist[0].Name != ds.CurrentVersion("app") {
+		t.Errorf("current not kept by prune: %+v", hist)
+	}
+	if code, body := request(t, srv, http.MethodGet, "/html/", ""); code != http.StatusOK || !strings.Contains(body, ">/app<") {
+		t.Errorf("index: %d %s", code, body)
+	}
+	ds.errs["Read"] = ErrNotFound
+	if code, _ := request(t, srv, http.MethodGet, "/api/app", ""); code != http.StatusNotFound {
+		t.Errorf("scripted error: %d", code)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/afero"
+)
+
+// metaFile is the sidecar holding the tags of a file
+const metaFile = ".meta"
+
+// maxSizeTag limits the size of the versions written to a file, overriding Datastore.MaxSize; 0 for no limit
+const maxSizeTag = "max-size"
+
+// contentTypeTag is the media type of the contents of a file, JSON if not set
+const contentTypeTag = "content-type"
+
+// defaultContentType is the media type of files without a content-type tag
+const defaultContentType = "application/json"
+
+// isJSONType reports whether the media type is JSON
+func isJSONType(ctype string) bool {
+	return ctype == defaultContentType || strings.HasSuffix(ctype, "+json")
+}
+
+// ByteSize is a size option accepting units, e.g. 500MB
+type ByteSize int64
+
+// UnmarshalFlag parses the size with its unit
+func (b *ByteSize) UnmarshalFlag(value string) error {
+	n, err := humanize.ParseBytes(value)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+// MetaRead returns the tags of the file, empty if it has none
+func (d *Datastore) MetaRead(name string) (map[string]string, error) {
+	res := map[string]string{}
+	path, err := d.File(name, metaFile)
+	if err != nil {
+		return res, ErrInvalidPath
+	}
+	content, err := afero.ReadFile(d.RootDir, path)
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(content, &res); err != nil {
+		slog.Warn("invalid meta", "name", name, "error", err)
+		return res, err
+	}
+	return res, nil
+}
+
+// MetaSet sets the tags of the file, removing those with an empty value
+func (d *Datastore) MetaSet(name string, tags map[string]string) error {
+	if d.currentTarget(name) == "" {
+		slog.Error("not found", "name", name)
+		return ErrNotFound
+	}
+	if v := tags[maxSizeTag]; v != "" {
+		if _, err := humanize.ParseBytes(v); err != nil {
+			slog.Error("invalid size", "name", name, "tag", maxSizeTag, "value", v, "error", err)
+			return fmt.Errorf("%s=%s: %w", maxSizeTag, v, err)
+		}
+	}
+	res, err := d.MetaRead(name)
+	if err != nil {
+		return err
+	}
+	for k, v := range tags {
+		if v == "" {
+			delete(res, k)
+		} else {
+			res[k] = v
+		}
+	}
+	path, err := d.File(name, metaFile)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	if len(res) == 0 {
+		if err := d.RootDir.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return d.writeFile(path, bytes.NewReader(content))
+}
+
+// MaxSizeOf returns the size limit of the versions of the file, 0 for no limit
+func (d *Datastore) MaxSizeOf(name string) int64 {
+	tags, _ := d.MetaRead(name)
+	if v, ok := tags[maxSizeTag]; ok {
+		if n, err := humanize.ParseBytes(v); err == nil {
+			return int64(n)
+		}
+		slog.Warn("invalid size, using the default", "name", name, "tag", maxSizeTag, "value", v)
+	}
+	return d.MaxSize
+}
+
+// ContentType returns the media type of the file, application/json unless another one was recorded
+func (d *Datastore) ContentType(name string) string {
+	tags, _ := d.MetaRead(name)
+	if v := tags[contentTypeTag]; v != "" {
+		return v
+	}
+	return defaultContentType
+}
+
+// SetContentType records the media type of the file, parameters such as charset are dropped
+func (d *Datastore) SetContentType(name string, ctype string) error {
+	mediatype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		slog.Error("invalid content type", "name", name, "content-type", ctype, "error", err)
+		return ErrUnsupportedMedia
+	}
+	if mediatype == defaultContentType {
+		mediatype = ""
+	}
+	tags, _ := d.MetaRead(name)
+	if tags[contentTypeTag] == mediatype {
+		return nil
+	}
+	return d.MetaSet(name, map[string]string{contentTypeTag: mediatype})
+}
+
+// maxSizeReader fails with ErrTooLarge when more than max bytes are read
+type maxSizeReader struct {
+	rd   io.Reader
+	left int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.left < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > r.left+1 {
+		p = p[:r.left+1]
+	}
+	n, err := r.rd.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// limitInput limits the input written to the file to its size limit
+func (d *Datastore) limitInput(name string, input io.Reader) io.Reader {
+	if limit := d.MaxSizeOf(name); limit > 0 {
+		return &maxSizeReader{rd: input, left: limit}
+	}
+	return input
+}
+
+// MetaCmd shows or sets the tags of a file
+type MetaCmd struct {
+	File string `short:"f" long:"file" required:"true" description:"file name"`
+}
+
+func (cmd *MetaCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	if len(args) != 0 {
+		tags := map[string]string{}
+		for _, v := range args {
+			key, value, ok := strings.Cut(v, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("%s: expected key=value, or key= to remove", v)
+			}
+			tags[key] = value
+		}
+		return root.MetaSet(cmd.File, tags)
+	}
+	tags, err := root.MetaRead(cmd.File)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s=%s\n", k, tags[k])
+	}
+	return nil
+}
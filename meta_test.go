@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	var b ByteSize
+	if err := b.UnmarshalFlag("500MB"); err != nil || b != 500*1000*1000 {
+		t.Errorf("unexpected size %d %v", b, err)
+	}
+	if err := b.UnmarshalFlag("big"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestMetaSet(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.MetaSet("missing", map[string]string{"team": "a"}); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	writeAt(t, &ds, "a", time.Now())
+	if err := ds.MetaSet("a", map[string]string{maxSizeTag: "huge"}); err == nil {
+		t.Errorf("invalid size accepted")
+	}
+	if err := ds.MetaSet("a", map[string]string{"team": "a", maxSizeTag: "1KB"}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if tags, err := ds.MetaRead("a"); err != nil || len(tags) != 2 || tags["team"] != "a" {
+		t.Errorf("unexpected tags %v %v", tags, err)
+	}
+	if err := ds.MetaSet("a", map[string]string{"team": "", maxSizeTag: ""}); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if tags, err := ds.MetaRead("a"); err != nil || len(tags) != 0 {
+		t.Errorf("tags not removed: %v %v", tags, err)
+	}
+}
+
+func TestWrite_MaxSize(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ds.MaxSize = 10
+	writeAt(t, &ds, "big", time.Now())
+	writeAt(t, &ds, "small", time.Now())
+	if err := ds.MetaSet("big", map[string]string{maxSizeTag: "0"}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	large := strings.Repeat("x", 100)
+	if err := ds.Write(t.Context(), "big", strings.NewReader(large), []byte{}, ""); err != nil {
+		t.Errorf("write to unlimited file failed: %v", err)
+	}
+	for _, compress := range []bool{false, true} {
+		ds.Compress = compress
+		if err := ds.Write(t.Context(), "small", strings.NewReader(large), []byte{}, ""); err != ErrTooLarge {
+			t.Errorf("compress=%v: expected ErrTooLarge, got %v", compress, err)
+		}
+		if err := ds.Write(t.Context(), "other", strings.NewReader(large), []byte{}, ""); err != ErrTooLarge {
+			t.Errorf("compress=%v: default limit not applied: %v", compress, err)
+		}
+	}
+	ds.Compress = false
+	if got := ds.History(t.Context(), "small"); len(got) != 1 {
+		t.Errorf("rejected write left versions: %v", got)
+	}
+	if got := ds.History(t.Context(), "other"); len(got) != 0 {
+		t.Errorf("rejected write left versions: %v", got)
+	}
+	if err := ds.Write(t.Context(), "small", strings.NewReader("0123456789"), []byte{}, ""); err != nil {
+		t.Errorf("write at the limit failed: %v", err)
+	}
+	if err := ds.MetaSet("small", map[string]string{maxSizeTag: "1KB"}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if info, err := ds.Info("small"); err != nil || info.MaxSize != 1000 {
+		t.Errorf("unexpected info: %+v %v", info, err)
+	}
+	if info, err := ds.Info("big"); err != nil || info.MaxSize != 0 {
+		t.Errorf("unexpected info: %+v %v", info, err)
+	}
+
+	h := &APIHandler{ds: &ds}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/other", strings.NewReader(large)))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rr.Code)
+	}
+}
+
+func TestContentType_API(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	h := &APIHandler{ds: &ds}
+	payload := "PK\x03\x04\x00\x00binary\xff"
+	post := func(name string, ctype string, body string) {
+		req := httptest.NewRequest(http.MethodPost, "/"+name, strings.NewReader(body))
+		if ctype != "" {
+			req.Header.Set("Content-Type", ctype)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("POST %s: status %d", name, rr.Code)
+		}
+	}
+	post("snapshot", "application/octet-stream", payload)
+	post("legacy", "", "{}")
+	post("form", "application/x-www-form-urlencoded", "{}")
+	post("manifest", "application/json; charset=utf-8", "{}")
+
+	tests := []struct {
+		name  string
+		ctype string
+		body  string
+	}{
+		{"snapshot", "application/octet-stream", payload},
+		{"legacy", "application/json", "{}"},
+		{"form", "application/json", "{}"},
+		{"manifest", "application/json", "{}"},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+test.name, nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != test.body {
+			t.Errorf("%s: %d %q", test.name, rr.Code, rr.Body.String())
+		}
+		if got := rr.Header().Get("Content-Type"); got != test.ctype {
+			t.Errorf("%s: expected %s, got %s", test.name, test.ctype, got)
+		}
+	}
+	if tags, _ := ds.MetaRead("manifest"); len(tags) != 0 {
+		t.Errorf("default type recorded: %v", tags)
+	}
+
+	// a JSON upload to the same state switches it back
+	post("snapshot", "application/json", "{}")
+	if got := ds.ContentType("snapshot"); got != "application/json" {
+		t.Errorf("expected application/json, got %s", got)
+	}
+}
+
+func TestContentType_View(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, f := range []struct{ name, ctype, content string }{
+		{"dir/snapshot", "application/octet-stream", "\x00\x01"},
+		{"notes", "text/plain", "<b>"},
+	} {
+		if err := ds.Write(t.Context(), f.name, strings.NewReader(f.content), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if err := ds.SetContentType(f.name, f.ctype); err != nil {
+			t.Fatalf("SetContentType failed: %v", err)
+		}
+	}
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/"})
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"/html/view/dir/snapshot", []string{"<code>application/octet-stream</code>", `href="../../../api/dir/snapshot" download`}},
+		{"/html/view/notes", []string{"<code>text/plain</code>", "<pre>&lt;b&gt;</pre>"}},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, test.path, nil))
+		body := rr.Body.String()
+		if rr.Code != http.StatusOK || strings.Contains(body, "page template is broken") {
+			t.Errorf("%s: %d %s", test.path, rr.Code, body)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(body, expected) {
+				t.Errorf("%s: expected %q in %s", test.path, expected, body)
+			}
+		}
+		if strings.Contains(body, "invalid json") {
+			t.Errorf("%s: rendered as json: %s", test.path, body)
+		}
+	}
+}
+
+func TestContentType_CLI(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	payload := "\x89PNG\r\n\x1a\n\x00"
+	src := t.TempDir()
+	file := filepath.Join(src, "image")
+	if err := os.WriteFile(file, []byte(payload), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	ds := NewDatastore(tmp)
+	// not JSON: skipped by the validation
+	if err := (&Put{Prefix: "p/"}).Execute([]string{file}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if hist := ds.History(t.Context(), "p/"+file); len(hist) != 0 {
+		t.Fatalf("invalid json stored: %+v", hist)
+	}
+	if err := (&Put{Prefix: "p/", ContentType: "application/octet-stream"}).Execute([]string{file}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	name := "p/" + file
+	if got := ds.ContentType(name); got != "application/octet-stream" {
+		t.Errorf("expected application/octet-stream, got %s", got)
+	}
+	// the recorded type skips the validation of later versions
+	if err := (&Put{Prefix: "p/"}).Execute([]string{file}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if hist := ds.History(t.Context(), name); len(hist) != 2 {
+		t.Errorf("expected 2 versions, got %+v", hist)
+	}
+
+	out, err := captureStdout(func() error { return (&Cat{}).Execute([]string{name}) })
+	if err != nil || out != payload {
+		t.Errorf("cat: expected raw bytes, got %q %v", out, err)
+	}
+	if _, err := captureStdout(func() error { return (&Cat{JSON: true}).Execute([]string{name}) }); !errors.Is(err, ErrNotJSON) {
+		t.Errorf("cat --json: expected ErrNotJSON, got %v", err)
+	}
+}
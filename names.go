@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameLength is the longest file name in bytes
+const maxNameLength = 1024
+
+// maxComponentLength is the longest part of a file name between slashes in bytes, NAME_MAX of common filesystems
+const maxComponentLength = 255
+
+// maxNameDepth is the largest number of parts of a file name
+const maxNameDepth = 32
+
+// checkPart checks that a file of a state given to File after its name is a plain name in the directory of the state
+func checkPart(part string) error {
+	if part == "" || part == "." || part == ".." || strings.ContainsAny(part, `/\`) {
+		slog.Error("invalid file of a state", "part", part)
+		return ErrInvalidPath
+	}
+	return nil
+}
+
+// checkVersion checks that a version given by a client is the name of a version, not a path, a sidecar
+// or another file of the state
+func checkVersion(version string) error {
+	if err := checkPart(version); err != nil {
+		return err
+	}
+	if reservedNames[version] || strings.HasPrefix(version, ".") {
+		slog.Error("not a version", "version", version)
+		return ErrInvalidPath
+	}
+	return nil
+}
+
+// checkName checks that a file name is valid UTF-8 of printable characters and not too long
+//
+// the length of each part and the nesting are checked as well, as the filesystem would refuse them
+// only when the directories are made.
+func checkName(name string) error {
+	if len(name) > maxNameLength {
+		slog.Error("name too long", "length", len(name), "max", maxNameLength)
+		return ErrInvalidPath
+	}
+	depth := 0
+	for _, seg := range strings.Split(name, "/") {
+		if seg == "" {
+			continue
+		}
+		depth++
+		if len(seg) > maxComponentLength {
+			slog.Error("part of name too long", "part", seg[:32]+"...", "length", len(seg), "max", maxComponentLength)
+			return ErrInvalidPath
+		}
+	}
+	if depth > maxNameDepth {
+		slog.Error("name nested too deep", "depth", depth, "max", maxNameDepth)
+		return ErrInvalidPath
+	}
+	if !utf8.ValidString(name) {
+		slog.Error("name is not utf-8", "name", fmt.Sprintf("%q", name))
+		return ErrInvalidPath
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			slog.Error("unprintable character in name", "name", fmt.Sprintf("%q", name), "rune", fmt.Sprintf("%U", r))
+			return ErrInvalidPath
+		}
+	}
+	return nil
+}
+
+// sanitizeName maps a name which checkName refuses to a valid one
+//
+// invalid bytes and unprintable characters are percent-encoded, parts nested too deep are joined with %2F,
+// and a part or a name which is still too long is cut and suffixed with a hash of the original.
+func sanitizeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if (r == utf8.RuneError && size == 1) || !unicode.IsPrint(r) {
+			for _, c := range []byte(name[i : i+size]) {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		} else {
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	segs := strings.Split(b.String(), "/")
+	if len(segs) > maxNameDepth {
+		// the parts nested too deep stay in the last one
+		segs = append(segs[:maxNameDepth-1], strings.Join(segs[maxNameDepth-1:], "%2F"))
+	}
+	for i, seg := range segs {
+		if len(seg) > maxComponentLength {
+			segs[i] = cutName(seg, maxComponentLength, seg)
+		}
+	}
+	res := strings.Join(segs, "/")
+	if len(res) > maxNameLength {
+		res = cutName(res, maxNameLength, name)
+	}
+	return res
+}
+
+// cutName cuts s to max bytes at a character boundary, suffixed with a hash of orig
+func cutName(s string, max int, orig string) string {
+	suffix := fmt.Sprintf("~%x", md5.Sum([]byte(orig)))[:9]
+	cut := max - len(suffix)
+	for !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + suffix
+}
+
+// normalizeName cleans a file name given in a request
+//
+// doubled, leading and trailing slashes are dropped and "." or ".." segments are refused,
+// so that "foo", "foo/" and "/foo" address the same file.
+// With strict, a name which the cleaning would change is refused as well.
+func normalizeName(name string, strict bool) (string, error) {
+	segs := make([]string, 0, strings.Count(name, "/")+1)
+	for _, seg := range strings.Split(name, "/") {
+		switch seg {
+		case "":
+			continue
+		case ".", "..":
+			slog.Error("relative path segment", "name", name)
+			return "", ErrInvalidPath
+		}
+		segs = append(segs, seg)
+	}
+	res := strings.Join(segs, "/")
+	if strict && res != name {
+		slog.Error("ambiguous name", "name", name, "normalized", res)
+		return "", ErrInvalidPath
+	}
+	return res, nil
+}
+
+// normalizePrefix cleans the prefix of a listing like normalizeName,
+// keeping a trailing slash which limits the listing to the files in that directory
+func normalizePrefix(prefix string, strict bool) (string, error) {
+	trimmed, dir := strings.CutSuffix(prefix, "/")
+	res, err := normalizeName(trimmed, strict)
+	if err != nil {
+		return "", err
+	}
+	if dir && res != "" {
+		res += "/"
+	}
+	return res, nil
+}
+
+// checkPathConflict fails with ErrPathConflict when the directory of the file cannot be made or used,
+// because a part of the name is a file of another state (current of foo for foo/current), or the name
+// of a file of this state is taken by another state (foo/current for foo)
+func (d *Datastore) checkPathConflict(name string) error {
+	dir, err := d.File(name)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	name = strings.Trim(filepath.ToSlash(filepath.Clean("/"+name)), "/")
+	base := strings.TrimSuffix(dir, filepath.FromSlash(name))
+	segs := strings.Split(name, "/")
+	for i := len(segs); i > 0; i-- {
+		st, err := d.RootDir.Stat(filepath.Join(base, filepath.Join(segs[:i]...)))
+		if err != nil {
+			// missing, or under a file which the next part finds
+			continue
+		}
+		if st.IsDir() {
+			break
+		}
+		owner := strings.Join(segs[:i-1], "/")
+		slog.Error("name is a file of another state", "name", name, "state", owner, "file", segs[i-1])
+		return fmt.Errorf("%s: %w: %s is a file of the state %s", name, ErrPathConflict, segs[i-1], owner)
+	}
+	for reserved := range reservedNames {
+		if st, err := d.RootDir.Stat(filepath.Join(dir, reserved)); err == nil && st.IsDir() {
+			other := name + "/" + reserved
+			slog.Error("file of the state is another state", "name", name, "state", other)
+			return fmt.Errorf("%s: %w: the state %s takes the place of its %s", name, ErrPathConflict, other, reserved)
+		}
+	}
+	return nil
+}
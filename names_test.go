@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		invalid  bool
+		strict   bool
+	}{
+		{"foo", "foo", false, false},
+		{"foo/", "foo", false, true},
+		{"/foo", "foo", false, true},
+		{"foo//bar", "foo/bar", false, true},
+		{"//foo///bar//", "foo/bar", false, true},
+		{"foo/bar", "foo/bar", false, false},
+		{"", "", false, false},
+		{"/", "", false, true},
+		{"foo/./bar", "", true, true},
+		{"foo/../bar", "", true, true},
+		{"..", "", true, true},
+		{"foo/..", "", true, true},
+		{"foo/.bar", "foo/.bar", false, false},
+		{"foo/..bar", "foo/..bar", false, false},
+	}
+	for _, test := range tests {
+		got, err := normalizeName(test.name, false)
+		if test.invalid != (err == ErrInvalidPath) || got != test.expected {
+			t.Errorf("%q: expected %q (invalid=%v), got %q %v", test.name, test.expected, test.invalid, got, err)
+		}
+		_, err = normalizeName(test.name, true)
+		if (test.invalid || test.strict) != (err == ErrInvalidPath) {
+			t.Errorf("%q: unexpected strict result %v", test.name, err)
+		}
+	}
+}
+
+func TestAPIHandler_NormalizePath(t *testing.T) {
+	tests := []struct {
+		path   string
+		strict bool
+		status int
+	}{
+		{"/api/foo/bar", false, http.StatusOK},
+		{"/api/foo/bar/", false, http.StatusOK},
+		{"/api//foo//bar", false, http.StatusOK},
+		{"/api/foo/./bar", false, http.StatusBadRequest},
+		{"/api/foo/../bar", false, http.StatusBadRequest},
+		{"/api/foo/bar", true, http.StatusOK},
+		{"/api/foo/bar/", true, http.StatusBadRequest},
+		{"/api//foo/bar", true, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		ds := &mockDS{}
+		h := http.StripPrefix("/api/", &APIHandler{ds: ds, strictPaths: test.strict})
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, test.path, strings.NewReader("{}")))
+		if rr.Code != test.status {
+			t.Errorf("%s (strict=%v): expected %d, got %d", test.path, test.strict, test.status, rr.Code)
+			continue
+		}
+		if test.status == http.StatusOK && ds.lastName != "foo/bar" {
+			t.Errorf("%s: written to %q", test.path, ds.lastName)
+		}
+		if test.status != http.StatusOK && ds.lastName != "" {
+			t.Errorf("%s: rejected path written to %q", test.path, ds.lastName)
+		}
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected string
+		invalid  bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"prod", "prod", false},
+		{"prod/", "prod/", false},
+		{"//prod//", "prod/", false},
+		{"prod/../", "", true},
+	}
+	for _, test := range tests {
+		got, err := normalizePrefix(test.prefix, false)
+		if test.invalid != (err == ErrInvalidPath) || got != test.expected {
+			t.Errorf("%q: expected %q (invalid=%v), got %q %v", test.prefix, test.expected, test.invalid, got, err)
+		}
+	}
+}
+
+func TestAPIHandler_ListingPrefix(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{"prod/app", "production"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if err := ds.Lock(name, `{"ID":"x"}`); err != nil {
+			t.Fatalf("lock failed: %v", err)
+		}
+	}
+	h := http.StripPrefix("/api/", &APIHandler{ds: &ds, strictPaths: true})
+	for path, expected := range map[string]int{"/api/prod/?locks=true": 1, "/api/prod?locks=true": 2, "/api/?locks=true": 2} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		locks := []map[string]interface{}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &locks); err != nil || len(locks) != expected {
+			t.Errorf("%s: expected %d locks, got %d %s", path, expected, len(locks), rr.Body.String())
+		}
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete, "LOCK"} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, "/api/", strings.NewReader("{}")))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s of empty name: expected 400, got %d", method, rr.Code)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"", true},
+		{"prod/app", true},
+		{"prod/日本語/état", true},
+		{"a\nb", false},
+		{"a\x00b", false},
+		{"a\tb", false},
+		{"a\xffb", false},
+		{strings.Repeat(strings.Repeat("a", maxComponentLength)+"/", 4), true},
+		{strings.Repeat("a/", maxNameLength/2) + "a", false},
+		{strings.Repeat("a", maxComponentLength), true},
+		{"prod/" + strings.Repeat("a", maxComponentLength+1), false},
+		{strings.Repeat("a/", maxNameDepth), true},
+		{strings.Repeat("a/", maxNameDepth) + "a", false},
+		{strings.Repeat("a//", maxNameDepth), true},
+	}
+	for _, test := range tests {
+		if err := checkName(test.name); (err == nil) != test.valid {
+			t.Errorf("%q: expected valid=%v, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"prod/app", "prod/app"},
+		{"a\nb", "a%0Ab"},
+		{"a\xffb", "a%FFb"},
+		{"é\x7f", "é%7F"},
+	}
+	for _, test := range tests {
+		if got := sanitizeName(test.name); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+	long := strings.Repeat("日", maxNameLength)
+	got := sanitizeName(long)
+	if checkName(got) != nil || !strings.HasPrefix(got, "日") || !strings.Contains(got, "~") {
+		t.Errorf("long name: %q", got)
+	}
+	if sanitizeName(long+"x") == got {
+		t.Errorf("truncated names collide")
+	}
+	deep := strings.Repeat("a/", maxNameDepth) + "b/c"
+	if got := sanitizeName(deep); checkName(got) != nil || !strings.HasSuffix(got, "/a%2Fb%2Fc") {
+		t.Errorf("deep name: %q", got)
+	}
+}
+
+func TestWrite_LongName(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{
+		"prod/" + strings.Repeat("x", maxComponentLength+1),
+		strings.Repeat("a/", maxNameDepth+1) + "state",
+		strings.Repeat("a/", 2000) + "state",
+	} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != ErrInvalidPath {
+			t.Errorf("%d bytes: expected ErrInvalidPath, got %v", len(name), err)
+		}
+	}
+	if ents, err := os.ReadDir(ds.RootName); err != nil || len(ents) != 0 {
+		t.Errorf("directories made for invalid names: %v %v", ents, err)
+	}
+	if err := ds.Write(t.Context(), strings.Repeat("a/", maxNameDepth-1)+strings.Repeat("x", maxComponentLength), strings.NewReader("{}"), []byte{}, ""); err != nil {
+		t.Errorf("name at the limits: %v", err)
+	}
+	h := &APIHandler{ds: &ds}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/"+strings.Repeat("a/", maxNameDepth+1)+"state", strings.NewReader("{}")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("API: expected 400, got %d", rr.Code)
+	}
+}
+
+func TestWrite_InvalidName(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(t.Context(), "a\nb", strings.NewReader("{}"), []byte{}, ""); err != ErrInvalidPath {
+		t.Errorf("expected ErrInvalidPath, got %v", err)
+	}
+	h := &APIHandler{ds: &ds}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/a%01b", strings.NewReader("{}")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestRename(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	writeAt(t, &ds, "old/app", time.Now().Add(-time.Hour), time.Now())
+	writeAt(t, &ds, "taken", time.Now())
+	if err := ds.Rename("old/app", "taken"); err != ErrExists {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	if err := ds.Rename("missing", "new"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := ds.Rename("old/app", "new\n"); err != ErrInvalidPath {
+		t.Errorf("expected ErrInvalidPath, got %v", err)
+	}
+	if err := ds.Lock("old/app", `{"ID":"1"}`); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := ds.Rename("old/app", "new/app"); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	if err := ds.Unlock("old/app", ""); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	want, _ := readString(t, ds, "old/app")
+	if err := ds.Rename("old/app", "new/app"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	if got, err := readString(t, ds, "new/app"); err != nil || got != want {
+		t.Errorf("renamed content: %q %v", got, err)
+	}
+	if got := ds.History(t.Context(), "new/app"); len(got) != 2 {
+		t.Errorf("history not moved: %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "old")); !os.IsNotExist(err) {
+		t.Errorf("old directory left: %v", err)
+	}
+}
+
+func TestRenameCmd_Sanitize(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	legacy := NewDatastore(tmp)
+	legacy.legacyNames = true
+	for _, name := range []string{"ok", "bad\nname"} {
+		if err := legacy.Write(t.Context(), name, strings.NewReader(`{"name":"`+strings.ReplaceAll(name, "\n", "")+`"}`), []byte{}, ""); err != nil {
+			t.Fatalf("write %q failed: %v", name, err)
+		}
+	}
+	expected := "\"/bad\\nname\" -> /bad%0Aname\n"
+	out, err := captureStdout(func() error { return (&RenameCmd{Sanitize: true, DryRun: true}).Execute(nil) })
+	if err != nil || out != expected {
+		t.Errorf("dry run: %q %v", out, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "bad\nname")); err != nil {
+		t.Errorf("dry run renamed: %v", err)
+	}
+	out, err = captureStdout(func() error { return (&RenameCmd{Sanitize: true}).Execute(nil) })
+	if err != nil || out != expected {
+		t.Errorf("sanitize: %q %v", out, err)
+	}
+	ds := NewDatastore(tmp)
+	if got, err := readString(t, ds, "bad%0Aname"); err != nil || got != `{"name":"badname"}` {
+		t.Errorf("sanitized content: %q %v", got, err)
+	}
+	out, err = captureStdout(func() error { return (&RenameCmd{Sanitize: true}).Execute(nil) })
+	if err != nil || out != "" {
+		t.Errorf("second run: %q %v", out, err)
+	}
+}
+
+func TestWrite_PathConflict(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	versions := writeAt(t, &ds, "foo", time.Now())
+	// nesting under a state is fine
+	writeAt(t, &ds, "foo/bar", time.Now())
+	for _, name := range []string{"foo/current", "foo/" + versions[0], "foo/" + versions[0] + "/x"} {
+		err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, "")
+		if !errors.Is(err, ErrPathConflict) || !strings.Contains(err.Error(), "of the state foo") {
+			t.Errorf("%s: expected ErrPathConflict, got %v", name, err)
+		}
+	}
+	writeAt(t, &ds, "other/current", time.Now())
+	err := ds.Write(t.Context(), "other", strings.NewReader("{}"), []byte{}, "")
+	if !errors.Is(err, ErrPathConflict) || !strings.Contains(err.Error(), "the state other/current") {
+		t.Errorf("expected ErrPathConflict, got %v", err)
+	}
+	if got, err := readString(t, ds, "foo"); err != nil || got != `{"v":1}` {
+		t.Errorf("state changed by the conflict: %q %v", got, err)
+	}
+
+	// each state has its own directory in the sharded layout
+	ds = NewDatastore(t.TempDir())
+	ds.Shard = true
+	for _, name := range []string{"foo", "foo/current", "bar/current", "bar"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Errorf("shard %s: %v", name, err)
+		}
+	}
+}
+
+func TestAPIPost_PathConflict(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	writeAt(t, &ds, "foo", time.Now())
+	rr := httptest.NewRecorder()
+	(&APIHandler{ds: &ds}).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/foo/current", strings.NewReader("{}")))
+	if rr.Code != http.StatusConflict || rr.Body.String() != "foo/current: path conflict: current is a file of the state foo\n" {
+		t.Errorf("unexpected response %d %q", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// namespace returns the namespace of a name, the directory it is in ("" for the root)
+func namespace(name string) string {
+	return strings.TrimPrefix(filepath.Dir(filepath.Clean("/"+name)), "/")
+}
+
+// checkNamespace refuses a new file in a namespace which was not created, if NoAutocreate is set
+//
+// files which exist already are not checked.
+func (d *Datastore) checkNamespace(name string) error {
+	if !d.NoAutocreate {
+		return nil
+	}
+	ns := namespace(name)
+	if ns == "" {
+		return nil
+	}
+	if dir, err := d.File(name); err == nil {
+		if _, err := d.RootDir.Stat(dir); err == nil {
+			return nil
+		}
+	}
+	if fi, err := d.RootDir.Stat(ns); err == nil && fi.IsDir() {
+		return nil
+	}
+	slog.Error("namespace does not exist, create it with mkns", "name", name, "namespace", ns)
+	return ErrNoNamespace
+}
+
+// Mkns creates a namespace which files can be written into with NoAutocreate
+//
+// a namespace is a directory of the flat layout, also with Shard.
+func (d *Datastore) Mkns(ns string) error {
+	ns, err := normalizeName(ns, false)
+	if err != nil || ns == "" {
+		return ErrInvalidPath
+	}
+	if fi, err := d.RootDir.Stat(ns); err == nil {
+		if !fi.IsDir() {
+			return ErrExists
+		}
+		return nil
+	}
+	return d.RootDir.MkdirAll(ns, 0o755)
+}
+
+// MknsCmd creates namespaces
+type MknsCmd struct {
+}
+
+func (cmd *MknsCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	if len(args) == 0 {
+		return fmt.Errorf("namespace is required")
+	}
+	for _, v := range args {
+		if err := root.Mkns(v); err != nil {
+			slog.Error("mkns failed", "namespace", v, "error", err)
+			return err
+		}
+		fmt.Fprintln(os.Stdout, v)
+	}
+	return nil
+}
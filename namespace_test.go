@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	for _, test := range []struct{ name, ns string }{
+		{"state", ""},
+		{"/prod/network/state", "prod/network"},
+		{"prod//app", "prod"},
+	} {
+		if got := namespace(test.name); got != test.ns {
+			t.Errorf("%s: expected %q, got %q", test.name, test.ns, got)
+		}
+	}
+}
+
+func TestNoAutocreate(t *testing.T) {
+	for _, shard := range []bool{false, true} {
+		tmp := t.TempDir()
+		ds := NewDatastore(tmp)
+		ds.Shard = shard
+		if err := ds.Write(t.Context(), "old/state", strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		ds.NoAutocreate = true
+		if err := ds.Write(t.Context(), "state", strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Errorf("shard=%v: write in the root failed: %v", shard, err)
+		}
+		if err := ds.Write(t.Context(), "old/state", strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Errorf("shard=%v: write of an existing file failed: %v", shard, err)
+		}
+		if err := ds.Write(t.Context(), "prod/netwrok/state", strings.NewReader("{}"), []byte{}, ""); err != ErrNoNamespace {
+			t.Errorf("shard=%v: expected ErrNoNamespace, got %v", shard, err)
+		}
+		if err := ds.Lock("prod/netwrok/state", `{"ID":"1"}`); err != ErrNoNamespace {
+			t.Errorf("shard=%v: lock: expected ErrNoNamespace, got %v", shard, err)
+		}
+		if _, err := os.Stat(filepath.Join(tmp, "prod")); !os.IsNotExist(err) {
+			t.Errorf("shard=%v: directory created: %v", shard, err)
+		}
+		if err := ds.Mkns("prod/network"); err != nil {
+			t.Fatalf("mkns failed: %v", err)
+		}
+		if err := ds.Mkns("prod/network"); err != nil {
+			t.Errorf("mkns of an existing namespace failed: %v", err)
+		}
+		if err := ds.Write(t.Context(), "prod/network/state", strings.NewReader("{}"), []byte{}, ""); err != nil {
+			t.Errorf("shard=%v: write in the namespace failed: %v", shard, err)
+		}
+		if got := walkNames(t, &ds, "/"); len(got) != 3 {
+			t.Errorf("shard=%v: unexpected files: %v", shard, got)
+		}
+	}
+	ds := NewDatastore(t.TempDir())
+	for _, ns := range []string{"", "/", "../x"} {
+		if err := ds.Mkns(ns); err != ErrInvalidPath {
+			t.Errorf("%q: expected ErrInvalidPath, got %v", ns, err)
+		}
+	}
+}
+
+func TestAPIPost_NoAutocreate(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ds.NoAutocreate = true
+	h := http.StripPrefix("/api/", &APIHandler{ds: &ds})
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/prod/netwrok/state", strings.NewReader("{}")))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+func TestMknsCmd_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	out, err := captureStdout(func() error { return (&MknsCmd{}).Execute([]string{"prod/network", "dev"}) })
+	if err != nil || out != "prod/network\ndev\n" {
+		t.Errorf("unexpected output: %q %v", out, err)
+	}
+	if fi, err := os.Stat(filepath.Join(tmp, "prod", "network")); err != nil || !fi.IsDir() {
+		t.Errorf("namespace not created: %v", err)
+	}
+	if err := (&MknsCmd{}).Execute(nil); err == nil {
+		t.Errorf("expected error without namespace")
+	}
+}
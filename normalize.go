@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"io"
+	"log/slog"
+)
+
+// normalizeJSON re-serializes a JSON document with sorted keys, two space indentation
+// and a trailing newline, or returns false if the data is not a single JSON value
+func normalizeJSON(data []byte) ([]byte, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// normalizeNewline ends a JSON document with exactly one newline instead of the trailing whitespace
+// it has, or returns false if the data is not JSON
+func normalizeNewline(data []byte) ([]byte, bool) {
+	if !json.Valid(data) {
+		return nil, false
+	}
+	return append(bytes.TrimRight(data, " \t\r\n"), '\n'), true
+}
+
+// normalizeInput reads the input for NormalizeJSON or NormalizeNewline, checks the hash of the received bytes
+// and returns them normalized, or nil if they equal the current version
+func (d *Datastore) normalizeInput(ctx context.Context, name string, input io.Reader, hash []byte) ([]byte, error) {
+	data, err := io.ReadAll(ctxReader{ctx, input})
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != 0 {
+		if sum := md5.Sum(data); !bytes.Equal(hash, sum[:]) {
+			slog.Error("hash mismatch", "name", name)
+			return nil, ErrInvalidHash
+		}
+	}
+	normalize := normalizeNewline
+	if d.NormalizeJSON {
+		normalize = normalizeJSON
+	}
+	if res, ok := normalize(data); ok {
+		data = res
+	} else {
+		slog.Debug("not json, stored as is", "name", name)
+	}
+	if rd, err := d.ReadHistory(name, "current"); err == nil {
+		defer rd.Close()
+		if cur, err := io.ReadAll(rd); err == nil && bytes.Equal(cur, data) {
+			slog.Info("same as the current version, not written", "name", name)
+			return nil, nil
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeJSON(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		ok       bool
+	}{
+		{`{"b":1,"a":[1.50,"<x>"]}`, "{\n  \"a\": [\n    1.50,\n    \"<x>\"\n  ],\n  \"b\": 1\n}\n", true},
+		{"  {\n\"a\" :12345678901234567890}", "{\n  \"a\": 12345678901234567890\n}\n", true},
+		{`"str"`, "\"str\"\n", true},
+		{`{"a":1} {"b":2}`, "", false},
+		{`{"a":`, "", false},
+		{"plain text", "", false},
+	}
+	for _, test := range tests {
+		got, ok := normalizeJSON([]byte(test.input))
+		if ok != test.ok || string(got) != test.expected {
+			t.Errorf("%q: expected %q %v, got %q %v", test.input, test.expected, test.ok, got, ok)
+		}
+	}
+}
+
+func TestWrite_NormalizeJSON(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ds.NormalizeJSON = true
+	inputs := []string{
+		`{"version":4,"serial":1,"outputs":{}}`,
+		"{\n    \"outputs\": {},\n    \"serial\": 1,\n    \"version\": 4\n}",
+		"not json",
+		"not json",
+	}
+	for _, input := range inputs {
+		sum := md5.Sum([]byte(input))
+		if err := ds.Write(t.Context(), "a", strings.NewReader(input), sum[:], ""); err != nil {
+			t.Fatalf("write %q failed: %v", input, err)
+		}
+	}
+	if got := ds.History(t.Context(), "a"); len(got) != 2 {
+		t.Errorf("expected 2 versions, got %d", len(got))
+	}
+	if got, err := readString(t, ds, "a"); err != nil || got != "not json" {
+		t.Errorf("non-json changed: %q %v", got, err)
+	}
+
+	if err := ds.Write(t.Context(), "b", strings.NewReader(`{"b":1,"a":2}`), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if got, err := readString(t, ds, "b"); err != nil || got != "{\n  \"a\": 2,\n  \"b\": 1\n}\n" {
+		t.Errorf("not normalized: %q %v", got, err)
+	}
+	// the hash of the normalized form is not what the client sent
+	normalized := md5.Sum([]byte("{\n  \"c\": 1\n}\n"))
+	if err := ds.Write(t.Context(), "b", strings.NewReader(`{"c":1}`), normalized[:], ""); err != ErrInvalidHash {
+		t.Errorf("expected ErrInvalidHash, got %v", err)
+	}
+	if got := ds.History(t.Context(), "b"); len(got) != 1 {
+		t.Errorf("rejected write added a version: %d", len(got))
+	}
+}
+
+func TestNormalizeNewline(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		ok       bool
+	}{
+		{`{"b":1,"a":2}`, "{\"b\":1,\"a\":2}\n", true},
+		{"{\n  \"a\": 1\n}\r\n\n  \t", "{\n  \"a\": 1\n}\n", true},
+		{"[1]\n", "[1]\n", true},
+		{"plain text\n\n", "", false},
+		{`{"a":`, "", false},
+	}
+	for _, test := range tests {
+		got, ok := normalizeNewline([]byte(test.input))
+		if ok != test.ok || string(got) != test.expected {
+			t.Errorf("%q: expected %q %v, got %q %v", test.input, test.expected, test.ok, got, ok)
+		}
+	}
+}
+
+func TestWrite_NormalizeNewline(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ds.NormalizeNewline = true
+	ds.Compress = true
+	for _, input := range []string{`{"serial":1}`, "{\"serial\":1}\n", "{\"serial\":1}\r\n\n", "text\n\n", "text\n\n"} {
+		sum := md5.Sum([]byte(input))
+		if err := ds.Write(t.Context(), "a", strings.NewReader(input), sum[:], ""); err != nil {
+			t.Fatalf("write %q failed: %v", input, err)
+		}
+	}
+	if got := ds.History(t.Context(), "a"); len(got) != 2 {
+		t.Errorf("expected 2 versions, got %d", len(got))
+	}
+	if got, err := readString(t, ds, "a"); err != nil || got != "text\n\n" {
+		t.Errorf("non-json changed: %q %v", got, err)
+	}
+
+	if err := ds.Write(t.Context(), "b", strings.NewReader("{\"a\": 2}  \n\n"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if got, err := readString(t, ds, "b"); err != nil || got != "{\"a\": 2}\n" {
+		t.Errorf("not normalized: %q %v", got, err)
+	}
+	// the md5 served with the version is the one of the stored bytes
+	raw, err := ds.ReadRaw("b", "")
+	if err != nil {
+		t.Fatalf("ReadRaw failed: %v", err)
+	}
+	defer raw.Close()
+	if sum := md5.Sum([]byte("{\"a\": 2}\n")); !bytes.Equal(raw.MD5, sum[:]) {
+		t.Errorf("unexpected md5 %x", raw.MD5)
+	}
+}
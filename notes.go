@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// notesFile is the sidecar holding the notes of a file, markdown shown at the top of its view page
+const notesFile = ".notes.md"
+
+// maxNotesSize limits the size of the notes of a file
+const maxNotesSize = 64 * 1024
+
+// Notes is implemented by the datastores which keep notes of files
+type Notes interface {
+	NotesRead(name string) (string, error)
+	NotesWrite(name string, content string) error
+}
+
+// NotesRead returns the notes of the file, empty if it has none
+func (d *Datastore) NotesRead(name string) (string, error) {
+	path, err := d.File(name, notesFile)
+	if err != nil {
+		return "", ErrInvalidPath
+	}
+	if d.currentTarget(name) == "" {
+		return "", ErrNotFound
+	}
+	content, err := afero.ReadFile(d.RootDir, path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(content), err
+}
+
+// NotesWrite sets the notes of the file, removing them if empty
+func (d *Datastore) NotesWrite(name string, content string) error {
+	path, err := d.File(name, notesFile)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	if d.currentTarget(name) == "" {
+		slog.Error("not found", "name", name)
+		return ErrNotFound
+	}
+	if len(content) > maxNotesSize {
+		slog.Error("notes too large", "name", name, "size", len(content))
+		return ErrTooLarge
+	}
+	if strings.TrimSpace(content) == "" {
+		if err := d.RootDir.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return d.writeFile(path, strings.NewReader(content))
+}
+
+// APINotes handles ?notes=true: GET returns the notes of the file and PUT replaces them
+func (h *APIHandler) APINotes(path string, w io.Writer, r *http.Request) error {
+	notes, ok := h.ds.(Notes)
+	if !ok {
+		return ErrNotFound
+	}
+	switch r.Method {
+	case http.MethodGet:
+		content, err := notes.NotesRead(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, content)
+		return err
+	case http.MethodPut:
+		content, err := io.ReadAll(io.LimitReader(r.Body, maxNotesSize+1))
+		if err != nil {
+			return err
+		}
+		return notes.NotesWrite(path, string(content))
+	}
+	slog.Error("unsupported method for notes", "method", r.Method, "path", path)
+	return ErrInvalidPath
+}
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdItem    = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdBold    = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdEmph    = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+)
+
+// mdSafeURL reports whether a link target is relative or of a scheme which cannot run scripts
+func mdSafeURL(u string) bool {
+	lower := strings.ToLower(u)
+	for _, scheme := range []string{"http://", "https://", "mailto:"} {
+		if strings.HasPrefix(lower, scheme) {
+			return true
+		}
+	}
+	return !strings.Contains(lower, ":")
+}
+
+// mdInline renders code spans, links, bold and emphasis of a line; everything else is escaped
+func mdInline(line string) string {
+	buf := &strings.Builder{}
+	for i, part := range strings.Split(line, "`") {
+		part = template.HTMLEscapeString(part)
+		if i%2 == 1 {
+			buf.WriteString("<code>" + part + "</code>")
+			continue
+		}
+		part = mdLink.ReplaceAllStringFunc(part, func(s string) string {
+			m := mdLink.FindStringSubmatch(s)
+			if !mdSafeURL(m[2]) {
+				return m[1]
+			}
+			return `<a href="` + m[2] + `" rel="noopener noreferrer">` + m[1] + `</a>`
+		})
+		part = mdBold.ReplaceAllString(part, "<strong>$1</strong>")
+		part = mdEmph.ReplaceAllString(part, "<em>$1</em>")
+		buf.WriteString(part)
+	}
+	return buf.String()
+}
+
+// renderMarkdown renders headings, lists, fenced code, paragraphs and inline markup of the notes
+//
+// raw HTML is not passed through but shown as text, and links which could run scripts are dropped.
+func renderMarkdown(src string) template.HTML {
+	buf := &bytes.Buffer{}
+	para := []string{}
+	inList, inCode := false, false
+	flush := func() {
+		if len(para) != 0 {
+			fmt.Fprintf(buf, "<p>%s</p>\n", strings.Join(para, "\n"))
+			para = para[:0]
+		}
+		if inList {
+			buf.WriteString("</ul>\n")
+			inList = false
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inCode {
+				buf.WriteString("</code></pre>\n")
+			} else {
+				flush()
+				buf.WriteString("<pre><code>")
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			buf.WriteString(template.HTMLEscapeString(line) + "\n")
+			continue
+		}
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			flush()
+			fmt.Fprintf(buf, "<h%d>%s</h%d>\n", len(m[1]), mdInline(m[2]), len(m[1]))
+		} else if m := mdItem.FindStringSubmatch(line); m != nil {
+			if len(para) != 0 {
+				flush()
+			}
+			if !inList {
+				buf.WriteString("<ul>\n")
+				inList = true
+			}
+			fmt.Fprintf(buf, "<li>%s</li>\n", mdInline(m[1]))
+		} else if strings.TrimSpace(line) == "" {
+			flush()
+		} else {
+			if inList {
+				flush()
+			}
+			para = append(para, mdInline(line))
+		}
+	}
+	if inCode {
+		buf.WriteString("</code></pre>\n")
+	}
+	flush()
+	return template.HTML(buf.String())
+}
+
+// viewNotes returns the rendered notes of the file for its view page, empty if it has none
+func (h *HTMLHandler) viewNotes(name string) template.HTML {
+	notes, ok := h.ds.(Notes)
+	if !ok {
+		return ""
+	}
+	content, err := notes.NotesRead(name)
+	if err != nil || content == "" {
+		return ""
+	}
+	return renderMarkdown(content)
+}
+
+// NotesCmd shows or sets the notes of a file
+type NotesCmd struct {
+	Set  NotesSetCmd  `command:"set" description:"set the notes of a file from a markdown file, an empty one removes them"`
+	Show NotesShowCmd `command:"show" description:"show the notes of a file"`
+}
+
+// NotesSetCmd sets the notes of a file
+type NotesSetCmd struct {
+	Input string `short:"f" long:"file" required:"true" description:"markdown file, - for stdin"`
+}
+
+func (cmd *NotesSetCmd) Execute(args []string) error {
+	init_log()
+	if len(args) != 1 {
+		return fmt.Errorf("expected one file name, got %d", len(args))
+	}
+	root := openDatastore()
+	var content []byte
+	var err error
+	if cmd.Input == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(cmd.Input)
+	}
+	if err != nil {
+		return err
+	}
+	return root.NotesWrite(args[0], string(content))
+}
+
+// NotesShowCmd shows the notes of files
+type NotesShowCmd struct{}
+
+func (cmd *NotesShowCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	for _, name := range args {
+		content, err := root.NotesRead(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Print(content)
+	}
+	return nil
+}
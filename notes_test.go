@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotes_CLI(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	writeAt(t, &ds, "prod", time.Now().Add(-time.Hour), time.Now())
+	file := filepath.Join(t.TempDir(), "notes.md")
+	if err := os.WriteFile(file, []byte("owned by team-x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&NotesSetCmd{Input: file}).Execute([]string{"missing"}); err != ErrNotFound {
+		t.Errorf("notes of a missing file: %v", err)
+	}
+	if err := (&NotesSetCmd{Input: file}).Execute([]string{"prod"}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	out, err := captureStdout(func() error { return (&NotesShowCmd{}).Execute([]string{"prod"}) })
+	if err != nil || out != "owned by team-x\n" {
+		t.Errorf("unexpected notes %q %v", out, err)
+	}
+	// not a version: neither listed nor pruned
+	if hist := ds.History(t.Context(), "prod"); len(hist) != 2 {
+		t.Errorf("expected 2 versions, got %+v", hist)
+	}
+	if err := ds.Prune(t.Context(), "prod", 1, false); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	if got, _ := ds.NotesRead("prod"); got != "owned by team-x\n" {
+		t.Errorf("notes removed by prune: %q", got)
+	}
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&NotesSetCmd{Input: file}).Execute([]string{"prod"}); err != nil {
+		t.Fatalf("clear failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "prod", notesFile)); !os.IsNotExist(err) {
+		t.Errorf("notes not removed: %v", err)
+	}
+}
+
+func TestAPINotes(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	writeAt(t, &ds, "prod", time.Now())
+	h := &APIHandler{ds: &ds}
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+	if rr := do(http.MethodGet, "/prod?notes=true", ""); rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("no notes: %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodPut, "/prod?notes=true", "# prod\ndo not prune below 20 versions\n"); rr.Code != http.StatusOK {
+		t.Fatalf("put failed: %d %s", rr.Code, rr.Body.String())
+	}
+	rr := do(http.MethodGet, "/prod?notes=true", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != "# prod\ndo not prune below 20 versions\n" || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/markdown") {
+		t.Errorf("unexpected notes: %d %q %s", rr.Code, rr.Body.String(), rr.Header().Get("Content-Type"))
+	}
+	if rr := do(http.MethodGet, "/prod", ""); rr.Body.String() != `{"v":1}` {
+		t.Errorf("contents changed: %q", rr.Body.String())
+	}
+	if rr := do(http.MethodPut, "/missing?notes=true", "x"); rr.Code != http.StatusNotFound {
+		t.Errorf("notes of a missing file: %d", rr.Code)
+	}
+	if rr := do(http.MethodPut, "/prod?notes=true", strings.Repeat("x", maxNotesSize+1)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large notes: %d", rr.Code)
+	}
+	if rr := do(http.MethodPut, "/prod?notes=true", ""); rr.Code != http.StatusOK {
+		t.Errorf("clear failed: %d", rr.Code)
+	}
+	if got, err := ds.NotesRead("prod"); err != nil || got != "" {
+		t.Errorf("notes not cleared: %q %v", got, err)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{"# Owner\n", "<h1>Owner</h1>\n"},
+		{"owned by **team-x**\ncontact `#infra`\n", "<p>owned by <strong>team-x</strong>\ncontact <code>#infra</code></p>\n"},
+		{"- one\n- *two*\n", "<ul>\n<li>one</li>\n<li><em>two</em></li>\n</ul>\n"},
+		{"[runbook](https://example.com/a?b=1&c=2)", `<p><a href="https://example.com/a?b=1&amp;c=2" rel="noopener noreferrer">runbook</a></p>` + "\n"},
+		{"```\n<b>\n```\n", "<pre><code>&lt;b&gt;\n</code></pre>\n"},
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{`<img src=x onerror="alert(1)">`, "<p>&lt;img src=x onerror=&#34;alert(1)&#34;&gt;</p>\n"},
+		{"[click](javascript:void)", "<p>click</p>\n"},
+		{"[click](JavaScript:void)", "<p>click</p>\n"},
+		{`[x](https://a"onmouseover="alert(1))`, `<p><a href="https://a&#34;onmouseover=&#34;alert(1" rel="noopener noreferrer">x</a>)</p>` + "\n"},
+	}
+	for _, test := range tests {
+		if got := string(renderMarkdown(test.src)); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.src, test.expected, got)
+		}
+	}
+}
+
+func TestNotes_View(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	writeAt(t, &ds, "prod", time.Now())
+	if err := ds.NotesWrite("prod", "**owned by team-x**\n<script>alert(1)</script>\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/"})
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/view/prod", nil))
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, "<strong>owned by team-x</strong>") {
+		t.Errorf("notes not shown: %d %s", rr.Code, body)
+	}
+	if strings.Contains(body, "<script>alert") || !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("script not escaped: %s", body)
+	}
+}
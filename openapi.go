@@ -0,0 +1,466 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// apiParam is a query parameter or a header read by the API handler
+type apiParam struct {
+	Name string
+	// In is "query" or "header"
+	In          string
+	Type        string
+	Description string
+}
+
+// apiParams are the parameters of the API; every query parameter read by the API handler must be listed here
+var apiParams = []apiParam{
+	{"history", "query", "string", "version to read, as listed by ?versions=true"},
+	{"at", "query", "string", "read the version which was current at the time, RFC3339 or a date"},
+	{"backup", "query", "boolean", "read the version before the last write"},
+	{"select", "query", "string", "return the value at the JSON path, e.g. .outputs.vpc_id.value"},
+	{"outputs", "query", "boolean", "return the outputs of the terraform state"},
+	{"show-sensitive", "query", "boolean", "show the values of sensitive outputs, needs write permission on all files"},
+	{"versions", "query", "boolean", "list the versions of the file, newest first"},
+	{"locks", "query", "boolean", "list the locks under the path"},
+	{"stale", "query", "string", "with ?locks=true, only locks held at least for the duration, e.g. 2h"},
+	{"notes", "query", "boolean", "read or replace (PUT) the markdown notes of the file"},
+	{"wait", "query", "string", "wait until the current version differs from this one (long poll)"},
+	{"timeout", "query", "string", "longest wait of ?wait=, capped by the server, e.g. 30s"},
+	{"since", "query", "integer", "only the events after this id"},
+	{"prefix", "query", "string", "only the events of the files under the prefix"},
+	{"sig", "query", "string", "signature of a signed url"},
+	{"exp", "query", "integer", "expiry of a signed url, unix time"},
+	{"ID", "query", "string", "ID of the lock held by the writer"},
+	{"retain", "query", "boolean", "false replaces the current version instead of adding to the history"},
+	{"rollback", "query", "string", "make the version current instead of writing"},
+	{"prune", "query", "integer", "remove old versions, keeping this many, instead of writing"},
+	{"diff", "query", "boolean", "compare the body with the version instead of writing it"},
+	{"upload", "query", "string", "start or commit a resumable upload"},
+	{"id", "query", "string", "id of the upload to commit"},
+	{"lock", "query", "boolean", "lock, when the lock method is a standard method"},
+	{"unlock", "query", "boolean", "unlock, when the unlock method is a standard method"},
+	{"If-None-Match", "header", "string", "etag of the copy of the client"},
+	{"If-Match", "header", "string", "etag of the current version the rollback expects"},
+	{"Accept-Encoding", "header", "string", "versions stored compressed are served as they are to gzip clients"},
+	{"Content-MD5", "header", "string", "base64 md5 of the body, checked before it becomes current"},
+	{"Content-Range", "header", "string", "range of the chunk, bytes start-end/size"},
+	{"X-Statesaver-Retain", "header", "boolean", "the same as ?retain="},
+}
+
+// openAPIBody is the body of a request or a response: Schema is a value whose type gives the JSON schema, or
+// nil for contents of MediaType which are passed as they are
+type openAPIBody struct {
+	MediaType   string
+	Schema      any
+	Description string
+}
+
+// apiOperation is an operation of the API handler
+type apiOperation struct {
+	Path    string
+	Method  string
+	Summary string
+	Params  []string
+	Body    *openAPIBody
+	// Results are the bodies of 200, alternatives chosen by the parameters
+	Results []openAPIBody
+	// Errors give the other statuses, as errorStatus maps them
+	Errors []error
+	// Statuses are the statuses which are no error
+	Statuses map[int]string
+}
+
+// lockInfo is the lock info of terraform, which the server records the client into
+type lockInfo struct {
+	ID        string         `json:"ID"`
+	Operation string         `json:"Operation,omitempty"`
+	Info      string         `json:"Info,omitempty"`
+	Who       string         `json:"Who,omitempty"`
+	Version   string         `json:"Version,omitempty"`
+	Created   time.Time      `json:"Created,omitzero"`
+	Path      string         `json:"Path,omitempty"`
+	Server    LockServerInfo `json:"_server,omitzero"`
+}
+
+var (
+	contentsBody = openAPIBody{MediaType: "application/octet-stream", Description: "the contents of the version, JSON for terraform states"}
+	noBody       = []openAPIBody{{Description: "done"}}
+)
+
+// apiOperations are the operations of the API handler; name is the file, or the prefix of ?locks=true
+func apiOperations() []apiOperation {
+	readErrors := []error{ErrInvalidPath, ErrForbidden, ErrNotFound, ErrNotJSON, ErrUpstream}
+	writeErrors := []error{ErrInvalidPath, ErrInvalidHash, ErrProtected, ErrLocked, ErrBusy, ErrPathConflict, ErrNoNamespace, ErrPrecondition, ErrTooLarge, ErrUnsupportedMedia, ErrNotJSON}
+	return []apiOperation{
+		{
+			Path: "/{name}", Method: http.MethodGet, Summary: "read a version of the file, or list its versions or the locks",
+			Params: []string{"history", "at", "backup", "select", "outputs", "show-sensitive", "versions", "locks", "stale", "notes", "wait", "timeout", "sig", "exp", "If-None-Match", "Accept-Encoding"},
+			Results: []openAPIBody{
+				contentsBody,
+				{MediaType: "application/json", Schema: []FileEntry{}, Description: "the versions with ?versions=true"},
+				{MediaType: "application/json", Schema: []LockEntry{}, Description: "the locks with ?locks=true"},
+				{MediaType: "text/markdown", Description: "the notes with ?notes=true"},
+			},
+			Errors:   readErrors,
+			Statuses: map[int]string{http.StatusNotModified: "the copy of the client is current, or ?wait= timed out"},
+		},
+		{
+			Path: "/{name}", Method: http.MethodPost, Summary: "write a new version of the file, or roll back, prune or compare",
+			Params: []string{"ID", "retain", "rollback", "prune", "diff", "history", "at", "backup", "upload", "id", "Content-MD5", "If-Match", "X-Statesaver-Retain"},
+			Body:   &openAPIBody{MediaType: "application/octet-stream", Description: "the contents, a terraform state"},
+			Results: []openAPIBody{
+				{Description: "written, rolled back or pruned"},
+				{MediaType: "application/json", Schema: WriteReceipt{}, Description: "the version written, with --write-receipt"},
+				{MediaType: "application/json", Schema: DiffResult{}, Description: "the comparison with ?diff=true"},
+				{MediaType: "application/json", Schema: Upload{}, Description: "the upload started by ?upload=start"},
+			},
+			Errors: append(writeErrors, ErrNotFound),
+		},
+		{
+			Path: "/{name}", Method: http.MethodPut, Summary: "replace the notes of the file",
+			Params:  []string{"notes"},
+			Body:    &openAPIBody{MediaType: "text/markdown", Description: "the notes"},
+			Results: noBody,
+			Errors:  []error{ErrInvalidPath, ErrNotFound, ErrTooLarge},
+		},
+		{
+			Path: "/{name}", Method: http.MethodDelete, Summary: "delete the file with its history",
+			Results: noBody,
+			Errors:  []error{ErrInvalidPath, ErrNotFound, ErrProtected, ErrHeld, ErrLocked},
+		},
+		{
+			Path: "/{name}", Method: "LOCK", Summary: "lock the file",
+			Body:    &openAPIBody{MediaType: "application/json", Schema: lockInfo{}},
+			Results: noBody,
+			Errors:  []error{ErrInvalidPath, ErrLocked, ErrBusy},
+		},
+		{
+			Path: "/{name}", Method: "UNLOCK", Summary: "unlock the file, forced by a body which is no lock info",
+			Body:    &openAPIBody{MediaType: "application/json", Schema: lockInfo{}},
+			Results: noBody,
+			Errors:  []error{ErrInvalidPath, ErrLocked, ErrUnlocked},
+		},
+		{
+			Path: "/+events", Method: http.MethodGet, Summary: "recent events",
+			Params:  []string{"since"},
+			Results: []openAPIBody{{MediaType: "application/json", Schema: []Event{}}},
+			Errors:  []error{ErrInvalidPath},
+		},
+		{
+			Path: "/+watch", Method: http.MethodGet, Summary: "stream the events as server-sent events",
+			Params:  []string{"prefix"},
+			Results: []openAPIBody{{MediaType: "text/event-stream", Description: "events named by their type, with an Event in the data"}},
+		},
+		{
+			Path: "/+capabilities", Method: http.MethodGet, Summary: "what the server supports",
+			Results: []openAPIBody{{MediaType: "application/json", Schema: Capabilities{}}},
+		},
+		{
+			Path: "/+webhooks", Method: http.MethodGet, Summary: "delivery statistics of the webhooks",
+			Results: []openAPIBody{{MediaType: "application/json", Schema: []WebhookStats{}}},
+		},
+		{
+			Path: "/+bulk", Method: http.MethodPost, Summary: "read, delete or prune many files",
+			Body: &openAPIBody{MediaType: "application/json", Schema: bulkRequest{}},
+			Results: []openAPIBody{
+				{MediaType: "application/x-ndjson", Schema: BulkResult{}, Description: "a result per line for read"},
+				{MediaType: "application/json", Schema: []BulkResult{}, Description: "the results of delete and prune"},
+			},
+			Errors: []error{ErrInvalidPath},
+		},
+		{
+			Path: "/+uploads/{id}", Method: http.MethodGet, Summary: "the offset to resume the upload from",
+			Results: []openAPIBody{{MediaType: "application/json", Schema: Upload{}}},
+			Errors:  []error{ErrNotFound},
+		},
+		{
+			Path: "/+uploads/{id}", Method: http.MethodPut, Summary: "append a chunk to the upload",
+			Params:  []string{"Content-Range"},
+			Body:    &openAPIBody{MediaType: "application/octet-stream"},
+			Results: []openAPIBody{{MediaType: "application/json", Schema: Upload{}}},
+			Errors:  []error{ErrInvalidPath, ErrNotFound, ErrRange, ErrTooLarge},
+		},
+		{
+			Path: "/+uploads/{id}", Method: http.MethodDelete, Summary: "abort the upload",
+			Results: noBody,
+			Errors:  []error{ErrNotFound},
+		},
+		{
+			Path: "/_lock-batch", Method: http.MethodPost, Summary: "lock several files at once, all or none",
+			Body:    &openAPIBody{MediaType: "application/json", Schema: batchRequest{}},
+			Results: []openAPIBody{{MediaType: "application/json", Schema: map[string]any{}}},
+			Errors:  []error{ErrInvalidPath, ErrLocked},
+		},
+		{
+			Path: "/_unlock-batch", Method: http.MethodPost, Summary: "unlock several files at once",
+			Body:    &openAPIBody{MediaType: "application/json", Schema: batchRequest{}},
+			Results: []openAPIBody{{MediaType: "application/json", Schema: map[string]any{}}},
+			Errors:  []error{ErrInvalidPath, ErrLocked, ErrUnlocked},
+		},
+	}
+}
+
+// openAPIGen builds an OpenAPI document, collecting the schemas of the named types
+type openAPIGen struct {
+	schemas map[string]any
+}
+
+// schemaName is the name of the schema of a named type
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// schemaOf returns the JSON schema of the values of the type as encoding/json marshals them
+func (g *openAPIGen) schemaOf(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeFor[time.Time]():
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeFor[time.Duration]():
+		return map[string]any{"type": "number", "description": "seconds"}
+	case reflect.TypeFor[json.RawMessage]():
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schemaOf(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := g.schemas[name]; !ok {
+			// before the fields, for recursive types
+			g.schemas[name] = nil
+			props, required := map[string]any{}, []string{}
+			g.fields(t, props, &required)
+			schema := map[string]any{"type": "object", "properties": props}
+			if len(required) != 0 {
+				schema["required"] = required
+			}
+			g.schemas[name] = schema
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// fields adds the properties of the fields of a struct, embedded ones inlined like encoding/json does
+func (g *openAPIGen) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		props[cmp.Or(name, f.Name)] = g.schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, cmp.Or(name, f.Name))
+		}
+	}
+}
+
+// content returns the content of a body by media type
+func (g *openAPIGen) content(bodies []openAPIBody) map[string]any {
+	res := map[string]any{}
+	for _, b := range bodies {
+		if b.MediaType == "" {
+			continue
+		}
+		schema := map[string]any{}
+		if b.Schema != nil {
+			schema = g.schemaOf(reflect.TypeOf(b.Schema))
+		}
+		if b.Description != "" {
+			schema = map[string]any{"allOf": []any{schema}, "description": b.Description}
+		}
+		if prev, ok := res[b.MediaType]; ok {
+			// alternatives of the same media type
+			prevSchema := prev.(map[string]any)["schema"].(map[string]any)
+			if alts, ok := prevSchema["oneOf"].([]any); ok {
+				schema = map[string]any{"oneOf": append(alts, schema)}
+			} else {
+				schema = map[string]any{"oneOf": []any{prevSchema, schema}}
+			}
+		}
+		res[b.MediaType] = map[string]any{"schema": schema}
+	}
+	return res
+}
+
+// operation returns the operation object of an API operation
+func (g *openAPIGen) operation(h *APIHandler, op apiOperation) map[string]any {
+	params := []any{}
+	if strings.Contains(op.Path, "{name}") {
+		params = append(params, map[string]any{"name": "name", "in": "path", "required": true, "description": "name of the file, may contain /", "schema": map[string]any{"type": "string"}})
+	}
+	if strings.Contains(op.Path, "{id}") {
+		params = append(params, map[string]any{"name": "id", "in": "path", "required": true, "description": "id of the upload", "schema": map[string]any{"type": "string"}})
+	}
+	for _, name := range op.Params {
+		idx := slices.IndexFunc(apiParams, func(p apiParam) bool { return p.Name == name })
+		p := apiParams[idx]
+		params = append(params, map[string]any{"name": p.Name, "in": p.In, "description": p.Description, "schema": map[string]any{"type": p.Type}})
+	}
+	descs := []string{}
+	for _, b := range op.Results {
+		descs = append(descs, cmp.Or(b.Description, "ok"))
+	}
+	ok := map[string]any{"description": strings.Join(descs, "; ")}
+	if content := g.content(op.Results); len(content) != 0 {
+		ok["content"] = content
+	}
+	responses := map[string]any{"200": ok}
+	for status, desc := range op.Statuses {
+		responses[fmt.Sprint(status)] = map[string]any{"description": desc}
+	}
+	errs := map[int][]string{}
+	for _, err := range op.Errors {
+		status := h.errorStatus(err)
+		errs[status] = append(errs[status], err.Error())
+	}
+	for status, msgs := range errs {
+		resp := map[string]any{"description": strings.Join(msgs, ", ")}
+		if slices.Contains(op.Errors, ErrLocked) && status == h.errorStatus(ErrLocked) {
+			resp["content"] = g.content([]openAPIBody{{MediaType: "application/json", Schema: lockInfo{}, Description: "the lock info of the holder"}})
+		}
+		responses[fmt.Sprint(status)] = resp
+	}
+	responses["500"] = map[string]any{"description": "internal error"}
+	res := map[string]any{
+		"summary":     op.Summary,
+		"operationId": strings.ToLower(op.Method) + strings.NewReplacer("/", "_", "+", "", "{", "", "}", "", "-", "_").Replace(op.Path),
+		"parameters":  params,
+		"responses":   responses,
+	}
+	if op.Body != nil {
+		res["requestBody"] = map[string]any{"content": g.content([]openAPIBody{*op.Body})}
+	}
+	return res
+}
+
+// OpenAPI returns the OpenAPI document of the API handler
+//
+// HEAD is the same as GET without the body. Lock and unlock are additional operations of their methods, or
+// with standard methods, the parameter ?lock=1 or ?unlock=1 of the operation of that method.
+func (h *APIHandler) OpenAPI() map[string]any {
+	ops := []apiOperation{}
+	for _, op := range apiOperations() {
+		flag := map[string]string{"LOCK": "lock", "UNLOCK": "unlock"}[op.Method]
+		if flag == "" {
+			ops = append(ops, op)
+			continue
+		}
+		op.Method = cmp.Or(map[string]string{"lock": h.lockMethods.Lock, "unlock": h.lockMethods.Unlock}[flag], op.Method)
+		if !slices.Contains(standardMethods, op.Method) {
+			ops = append(ops, op)
+			continue
+		}
+		op.Params = append(op.Params, flag)
+		idx := slices.IndexFunc(ops, func(o apiOperation) bool { return o.Path == op.Path && o.Method == op.Method })
+		if idx == -1 {
+			ops = append(ops, op)
+			continue
+		}
+		// the same method with the flag
+		other := &ops[idx]
+		other.Summary += "; with ?" + flag + "=1, " + op.Summary + " with the lock info in the body"
+		other.Params = append(slices.Clone(other.Params), flag)
+		for _, err := range op.Errors {
+			if !slices.Contains(other.Errors, err) {
+				other.Errors = append(slices.Clone(other.Errors), err)
+			}
+		}
+	}
+	g := &openAPIGen{schemas: map[string]any{}}
+	paths := map[string]any{}
+	for _, op := range ops {
+		item, ok := paths[op.Path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		if !slices.Contains(standardMethods, op.Method) {
+			extra, ok := item["additionalOperations"].(map[string]any)
+			if !ok {
+				extra = map[string]any{}
+				item["additionalOperations"] = extra
+			}
+			extra[op.Method] = g.operation(h, op)
+			continue
+		}
+		item[strings.ToLower(op.Method)] = g.operation(h, op)
+		if op.Method == http.MethodGet {
+			head := g.operation(h, op)
+			for _, resp := range head["responses"].(map[string]any) {
+				delete(resp.(map[string]any), "content")
+			}
+			head["operationId"] = "head" + strings.TrimPrefix(head["operationId"].(string), "get")
+			item["head"] = head
+		}
+	}
+	return map[string]any{
+		"openapi": "3.2.0",
+		"info": map[string]any{
+			"title":       "statesaver",
+			"version":     serverVersion(),
+			"description": "terraform http backend with the history of the states",
+		},
+		"servers":    []any{map[string]any{"url": h.basepath}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": g.schemas},
+	}
+}
+
+// OpenAPICmd prints the OpenAPI document of the HTTP API
+type OpenAPICmd struct {
+	Server       string `long:"server" default:"/api" description:"url of the api in the document"`
+	LockMethod   string `long:"lock-method" env:"STSV_LOCK_METHOD" default:"LOCK" description:"HTTP method of lock requests, as the server"`
+	UnlockMethod string `long:"unlock-method" env:"STSV_UNLOCK_METHOD" default:"UNLOCK" description:"HTTP method of unlock requests, as the server"`
+	LockConflict int    `long:"lock-conflict-status" env:"STSV_LOCK_CONFLICT_STATUS" choice:"409" choice:"423" default:"409" description:"status of requests refused because the file is locked, as the server"`
+}
+
+func (cmd *OpenAPICmd) Execute(args []string) error {
+	init_log()
+	srv := &WebServer{LockMethod: cmd.LockMethod, UnlockMethod: cmd.UnlockMethod}
+	methods := srv.lockMethods()
+	if err := methods.check(); err != nil {
+		return err
+	}
+	h := &APIHandler{basepath: cmd.Server, lockMethods: methods, lockConflict: cmd.LockConflict}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(h.OpenAPI())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// queryParams returns the query parameters read by the functions of the files, except the pages of HTMLHandler
+func queryParams(t *testing.T) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]string{}
+	fset := token.NewFileSet()
+	for _, fn := range files {
+		if strings.HasSuffix(fn, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, fn, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Name.Name == "indexSort" {
+				continue
+			}
+			if fd.Recv != nil {
+				if star, ok := fd.Recv.List[0].Type.(*ast.StarExpr); ok && fmt.Sprint(star.X) == "HTMLHandler" {
+					continue
+				}
+			}
+			ast.Inspect(fd, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok || len(call.Args) != 1 {
+					return true
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				lit, isLit := call.Args[0].(*ast.BasicLit)
+				if !ok || !isLit || lit.Kind != token.STRING || (sel.Sel.Name != "Get" && sel.Sel.Name != "Has") {
+					return true
+				}
+				query := false
+				switch x := sel.X.(type) {
+				case *ast.CallExpr:
+					fun, ok := x.Fun.(*ast.SelectorExpr)
+					query = ok && fun.Sel.Name == "Query"
+				case *ast.Ident:
+					query = x.Name == "query"
+				}
+				if query {
+					name, _ := strconv.Unquote(lit.Value)
+					res[name] = fn + ": " + fd.Name.Name
+				}
+				return true
+			})
+		}
+	}
+	return res
+}
+
+func TestOpenAPI_Params(t *testing.T) {
+	params := queryParams(t)
+	if len(params) < 20 {
+		t.Fatalf("too few parameters found: %v", params)
+	}
+	for name, where := range params {
+		if !slices.ContainsFunc(apiParams, func(p apiParam) bool { return p.Name == name && p.In == "query" }) {
+			t.Errorf("?%s= read by %s is not in apiParams", name, where)
+		}
+	}
+	used := map[string]bool{"lock": true, "unlock": true}
+	for _, op := range apiOperations() {
+		for _, name := range op.Params {
+			used[name] = true
+			if !slices.ContainsFunc(apiParams, func(p apiParam) bool { return p.Name == name }) {
+				t.Errorf("%s %s: unknown parameter %s", op.Method, op.Path, name)
+			}
+		}
+	}
+	for _, p := range apiParams {
+		if !used[p.Name] {
+			t.Errorf("%s is in no operation", p.Name)
+		}
+	}
+}
+
+func TestOpenAPI_Document(t *testing.T) {
+	out, err := captureStdout(func() error { return (&OpenAPICmd{Server: "/api"}).Execute(nil) })
+	if err != nil {
+		t.Fatalf("openapi failed: %v", err)
+	}
+	doc := struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]struct {
+			Get  map[string]any `json:"get"`
+			Head struct {
+				Responses map[string]map[string]any `json:"responses"`
+			} `json:"head"`
+			Post struct {
+				Parameters []struct {
+					Name string `json:"name"`
+				} `json:"parameters"`
+				Responses map[string]any `json:"responses"`
+			} `json:"post"`
+			Delete     map[string]any            `json:"delete"`
+			Additional map[string]map[string]any `json:"additionalOperations"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any `json:"properties"`
+				Required   []string       `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("invalid document %s: %v", out, err)
+	}
+	file := doc.Paths["/{name}"]
+	if doc.OpenAPI != "3.2.0" || file.Get == nil || file.Delete == nil || file.Additional["LOCK"] == nil || file.Additional["UNLOCK"] == nil {
+		t.Errorf("unexpected operations %+v", file)
+	}
+	for status, resp := range file.Head.Responses {
+		if resp["content"] != nil {
+			t.Errorf("HEAD %s has a body", status)
+		}
+	}
+	for _, status := range []string{"200", "400", "409", "412", "413", "415", "422"} {
+		if file.Post.Responses[status] == nil {
+			t.Errorf("POST has no %s: %v", status, file.Post.Responses)
+		}
+	}
+	for _, path := range []string{"/+events", "/+watch", "/+capabilities", "/+bulk", "/+uploads/{id}", "/_lock-batch"} {
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("%s missing", path)
+		}
+	}
+	schemas := doc.Components.Schemas
+	if _, ok := schemas["LockInfo"].Properties["_server"]; !ok || !slices.Contains(schemas["LockInfo"].Required, "ID") {
+		t.Errorf("unexpected lock info schema %+v", schemas["LockInfo"])
+	}
+	if _, ok := schemas["FileEntry"].Properties["Terraform"]; !ok {
+		t.Errorf("unexpected file entry schema %+v", schemas["FileEntry"])
+	}
+	if _, ok := schemas["TerraformState"].Properties["terraform_version"]; !ok {
+		t.Errorf("unexpected terraform state schema %+v", schemas["TerraformState"])
+	}
+
+	// the lock of the terraform http backend with lock_method = "POST"
+	h := &APIHandler{lockMethods: LockMethods{Lock: "POST", Unlock: "UNLOCK"}, lockConflict: 423}
+	b, err := json.Marshal(h.OpenAPI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Paths = nil
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	file = doc.Paths["/{name}"]
+	if file.Additional["LOCK"] != nil || file.Additional["UNLOCK"] == nil || file.Post.Responses["423"] == nil ||
+		!slices.ContainsFunc(file.Post.Parameters, func(p struct {
+			Name string `json:"name"`
+		}) bool {
+			return p.Name == "lock"
+		}) {
+		t.Errorf("lock not merged into POST: %+v", file)
+	}
+	if err := (&OpenAPICmd{LockMethod: "LOCK", UnlockMethod: "LOCK"}).Execute(nil); err == nil {
+		t.Error("expected an error of the same lock and unlock methods")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofHandler serves the net/http/pprof handlers under /debug/pprof/
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// checkPprofListen refuses a pprof address on the port of the API
+func checkPprofListen(listen string, pprofListen string) error {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return err
+	}
+	_, pport, err := net.SplitHostPort(pprofListen)
+	if err != nil {
+		return err
+	}
+	if port == pport {
+		return fmt.Errorf("--pprof-listen %s must use another port than --listen %s", pprofListen, listen)
+	}
+	return nil
+}
+
+// servePprof serves pprof on its own address, without authentication
+func servePprof(listen string) {
+	slog.Warn("serving pprof without authentication", "address", listen)
+	if err := http.ListenAndServe(listen, pprofHandler()); err != nil {
+		slog.Error("pprof server failed", "address", listen, "error", err)
+	}
+}
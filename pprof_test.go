@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckPprofListen(t *testing.T) {
+	tests := []struct {
+		listen string
+		pprof  string
+		valid  bool
+	}{
+		{":3000", "127.0.0.1:6060", true},
+		{":3000", "127.0.0.1:3000", false},
+		{"0.0.0.0:3000", ":3000", false},
+		{":3000", "6060", false},
+	}
+	for _, test := range tests {
+		if err := checkPprofListen(test.listen, test.pprof); (err == nil) != test.valid {
+			t.Errorf("%s %s: expected valid=%v, got %v", test.listen, test.pprof, test.valid, err)
+		}
+	}
+}
+
+func TestPprofHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	pprofHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	pprofHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/cmdline", nil))
+	if rr.Code != http.StatusOK || rr.Body.Len() == 0 {
+		t.Errorf("expected the command line, got %d", rr.Code)
+	}
+}
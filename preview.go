@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// previewLimit is the maximum number of bytes read to make a preview
+const previewLimit = 64 * 1024
+
+// Preview is a short summary of file contents
+type Preview struct {
+	Terraform        bool     `json:"terraform,omitempty"`
+	TerraformVersion string   `json:"terraform_version,omitempty"`
+	Serial           string   `json:"serial,omitempty"`
+	Resources        int      `json:"resources,omitempty"`
+	Keys             []string `json:"keys,omitempty"`
+	Text             string   `json:"text,omitempty"`
+	Partial          bool     `json:"partial,omitempty"`
+}
+
+// String formats the preview in one line
+func (p Preview) String() string {
+	more := ""
+	if p.Partial {
+		more = "+"
+	}
+	if p.Terraform {
+		return fmt.Sprintf("terraform %s, serial %s, %d%s resources", p.TerraformVersion, p.Serial, p.Resources, more)
+	}
+	if p.Keys != nil {
+		return fmt.Sprintf("keys: %s%s", strings.Join(p.Keys, ", "), more)
+	}
+	return strconv.Quote(p.Text)
+}
+
+// MakePreview summarizes the contents, reading at most previewLimit bytes
+func MakePreview(rd io.Reader) (Preview, error) {
+	head := &bytes.Buffer{}
+	n, err := io.Copy(head, io.LimitReader(rd, previewLimit))
+	if err != nil {
+		return Preview{}, err
+	}
+	res := Preview{}
+	if p, ok := previewJSON(head.Bytes()); ok {
+		res = p
+	} else {
+		text := head.Bytes()
+		if len(text) > 80 {
+			text = text[:80]
+		}
+		res.Text = string(text)
+	}
+	if n == previewLimit {
+		res.Partial = true
+	}
+	return res, nil
+}
+
+// previewJSON scans the top-level of a JSON object, tolerating truncated input
+func previewJSON(data []byte) (Preview, bool) {
+	res := Preview{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return res, false
+	}
+	keys := []string{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return res, false
+		}
+		if len(keys) < 5 {
+			keys = append(keys, key)
+		}
+		switch key {
+		case "terraform_version":
+			res.Terraform = true
+			var v string
+			if dec.Decode(&v) != nil {
+				return finishPreview(res, keys)
+			}
+			res.TerraformVersion = v
+		case "serial":
+			var v json.Number
+			if dec.Decode(&v) != nil {
+				return finishPreview(res, keys)
+			}
+			res.Serial = v.String()
+		case "resources":
+			if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+				return finishPreview(res, keys)
+			}
+			for dec.More() {
+				var v json.RawMessage
+				if dec.Decode(&v) != nil {
+					return finishPreview(res, keys)
+				}
+				res.Resources++
+			}
+			if _, err := dec.Token(); err != nil {
+				return finishPreview(res, keys)
+			}
+		default:
+			var v json.RawMessage
+			if dec.Decode(&v) != nil {
+				return finishPreview(res, keys)
+			}
+		}
+	}
+	res.Keys = keys
+	return res, true
+}
+
+// finishPreview returns what was found before the input ended
+func finishPreview(res Preview, keys []string) (Preview, bool) {
+	res.Keys = keys
+	res.Partial = true
+	return res, true
+}
+
+// PreviewFile summarizes the current version of a file
+func PreviewFile(ds DsIf, name string) (Preview, error) {
+	rd, err := ds.ReadHistory(name, "current")
+	if err != nil {
+		slog.Error("cannot read", "name", name, "error", err)
+		return Preview{}, ErrNotFound
+	}
+	defer rd.Close()
+	return MakePreview(rd)
+}
+
+// previewKey identifies a version of a file by its listing attributes
+type previewKey struct {
+	name      string
+	timestamp time.Time
+	size      int64
+}
+
+// PreviewCache keeps previews of files until they change
+type PreviewCache struct {
+	mu    sync.Mutex
+	items map[previewKey]Preview
+}
+
+// Get returns the preview of the file entry, making it if not cached
+func (c *PreviewCache) Get(ds DsIf, e FileEntry) (Preview, error) {
+	key := previewKey{name: e.Name, timestamp: e.Timestamp, size: e.Size}
+	c.mu.Lock()
+	if p, ok := c.items[key]; ok {
+		c.mu.Unlock()
+		return p, nil
+	}
+	c.mu.Unlock()
+	p, err := PreviewFile(ds, e.Name)
+	if err != nil {
+		return p, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.items = make(map[previewKey]Preview)
+	}
+	// drop entries of older versions of the same file
+	for k := range c.items {
+		if k.name == e.Name {
+			delete(c.items, k)
+		}
+	}
+	c.items[key] = p
+	return p, nil
+}
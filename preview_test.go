@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMakePreview(t *testing.T) {
+	tfstate := `{
+  "version": 4,
+  "terraform_version": "1.5.7",
+  "serial": 12,
+  "lineage": "0f2c0c1e-3c0a-4b55-9a55-3f0c8d0e8a10",
+  "outputs": {},
+  "resources": [
+    {"mode": "managed", "type": "null_resource", "name": "a", "instances": []},
+    {"mode": "managed", "type": "null_resource", "name": "b", "instances": []}
+  ]
+}`
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR" + strings.Repeat("\x00", 100)
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"terraform", tfstate, "terraform 1.5.7, serial 12, 2 resources"},
+		{"json", `{"a": 1, "b": [1, 2], "c": {"d": 1}, "e": null, "f": "x", "g": true}`, "keys: a, b, c, e, f"},
+		{"empty json", `{}`, "keys: "},
+		{"json array", `[1, 2, 3]`, `"[1, 2, 3]"`},
+		{"text", "hello\tworld\n", `"hello\tworld\n"`},
+		{"binary", png, fmt.Sprintf("%q", png[:80])},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := MakePreview(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatalf("MakePreview failed: %v", err)
+			}
+			if got := p.String(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	rd *strings.Reader
+	n  int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestMakePreview_Bounded(t *testing.T) {
+	resources := make([]string, 0)
+	for i := 0; i < 2000; i++ {
+		resources = append(resources, fmt.Sprintf(`{"mode": "managed", "type": "null_resource", "name": "r%d", "instances": []}`, i))
+	}
+	tfstate := `{"version": 4, "terraform_version": "1.6.0", "serial": 3, "resources": [` + strings.Join(resources, ",") + `]}`
+	if len(tfstate) <= previewLimit {
+		t.Fatalf("fixture too small: %d", len(tfstate))
+	}
+	rd := &countingReader{rd: strings.NewReader(tfstate)}
+	p, err := MakePreview(rd)
+	if err != nil {
+		t.Fatalf("MakePreview failed: %v", err)
+	}
+	if rd.n > previewLimit {
+		t.Errorf("read %d bytes, limit is %d", rd.n, previewLimit)
+	}
+	if !p.Terraform || p.TerraformVersion != "1.6.0" || p.Serial != "3" {
+		t.Errorf("unexpected preview: %+v", p)
+	}
+	if !p.Partial || p.Resources == 0 || p.Resources >= 2000 {
+		t.Errorf("expected partial resource count, got %+v", p)
+	}
+	if !strings.Contains(p.String(), "+ resources") {
+		t.Errorf("expected partial marker, got %q", p.String())
+	}
+}
+
+func TestPreviewCache(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(t.Context(), "a", strings.NewReader(`{"x": 1}`), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	cache := &PreviewCache{}
+	get := func() string {
+		var res string
+		ds.Walk(t.Context(), "/", func(e FileEntry) error {
+			p, err := cache.Get(&ds, e)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			res = p.String()
+			return nil
+		})
+		return res
+	}
+	if got := get(); got != "keys: x" {
+		t.Errorf("expected keys: x, got %q", got)
+	}
+	if err := ds.Write(t.Context(), "a", bytes.NewReader([]byte(`{"y": 1, "z": 2}`)), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := get(); got != "keys: y, z" {
+		t.Errorf("expected keys: y, z, got %q", got)
+	}
+	if len(cache.items) != 1 {
+		t.Errorf("expected 1 cached item, got %d", len(cache.items))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// exitInterrupted is the exit code of a command stopped by --timeout or a signal
+const exitInterrupted = 3
+
+// interrupted reports whether the error is from a cancelled or timed out context
+func interrupted(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// withTimeout bounds the context by the timeout, if not 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// progressOutput returns where progress is shown, nil unless stderr is a terminal
+var progressOutput = func() io.Writer {
+	if st, err := os.Stderr.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+		return os.Stderr
+	}
+	return nil
+}
+
+// progressInterval is the minimum interval between updates of the progress line
+const progressInterval = 200 * time.Millisecond
+
+// progress shows the bytes copied of a transfer on one line, a nil progress shows nothing
+type progress struct {
+	out   io.Writer
+	label string
+	total int64
+	done  int64
+	last  time.Time
+}
+
+// newProgress returns the progress of a transfer of total bytes (0 if unknown), or nil without a terminal
+func newProgress(label string, total int64) *progress {
+	out := progressOutput()
+	if out == nil {
+		return nil
+	}
+	return &progress{out: out, label: label, total: total}
+}
+
+// Write counts the bytes copied
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.last) >= progressInterval {
+		p.show()
+	}
+	return len(b), nil
+}
+
+func (p *progress) show() {
+	p.last = time.Now()
+	if p.total > 0 {
+		fmt.Fprintf(p.out, "\r%s %s / %s (%d%%)", p.label, humanizeBytes(p.done), humanizeBytes(p.total), p.done*100/p.total)
+	} else {
+		fmt.Fprintf(p.out, "\r%s %s", p.label, humanizeBytes(p.done))
+	}
+}
+
+// writer returns the writer which also counts into the progress
+func (p *progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return io.MultiWriter(w, p)
+}
+
+// reader returns the reader which also counts into the progress
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return io.TeeReader(r, p)
+}
+
+// finish shows the final count and ends the line
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.show()
+	fmt.Fprintln(p.out)
+}
+
+// versionSize returns the size of the contents of a version (current if empty) for the progress,
+// 0 if unknown as for compressed versions
+func (d *Datastore) versionSize(name string, version string) int64 {
+	if version == "" || version == "current" {
+		version = d.CurrentVersion(name)
+	}
+	if version == "" || versionEncoding(version) != "" {
+		return 0
+	}
+	ent, err := d.blobs().StatVersion(name, version)
+	if err != nil {
+		return 0
+	}
+	return ent.Size
+}
+
+// copyContext copies until the end of src or the context is done, showing the progress
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader, p *progress) (int64, error) {
+	defer p.finish()
+	written, err := io.Copy(p.writer(dst), ctxReader{ctx, src})
+	if ctx.Err() != nil {
+		return written, ctx.Err()
+	}
+	return written, err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowReader returns one byte per read after a delay
+type slowReader struct {
+	delay time.Duration
+	left  int
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	r.left--
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestCopyContext(t *testing.T) {
+	out := &bytes.Buffer{}
+	origOutput := progressOutput
+	progressOutput = func() io.Writer { return out }
+	defer func() { progressOutput = origOutput }()
+
+	buf := &bytes.Buffer{}
+	written, err := copyContext(t.Context(), buf, strings.NewReader("abc"), newProgress("a", 3))
+	if err != nil || written != 3 || buf.String() != "abc" {
+		t.Errorf("unexpected copy %d %v %q", written, err, buf.String())
+	}
+	if !strings.HasSuffix(out.String(), "\ra 3 B / 3 B (100%)\n") {
+		t.Errorf("unexpected progress %q", out.String())
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	written, err = copyContext(ctx, io.Discard, &slowReader{delay: 5 * time.Millisecond, left: 1000}, nil)
+	if !interrupted(err) || written == 0 || written >= 1000 {
+		t.Errorf("expected an interrupted copy, got %d %v", written, err)
+	}
+}
+
+func TestInterrupted(t *testing.T) {
+	if !interrupted(fmt.Errorf("put: %w", context.DeadlineExceeded)) || !interrupted(context.Canceled) || interrupted(ErrNotFound) {
+		t.Errorf("unexpected result")
+	}
+}
+
+func TestWrite_Timeout(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	err := ds.Write(ctx, "a", &slowReader{delay: 5 * time.Millisecond, left: 1000}, []byte{}, "")
+	if !interrupted(err) {
+		t.Errorf("expected an interrupted write, got %v", err)
+	}
+	if got := ds.History(t.Context(), "a"); len(got) != 0 || ds.CurrentVersion("a") != "" {
+		t.Errorf("partial version left: %v", got)
+	}
+	if journals, err := ds.PendingJournals("/"); err != nil || len(journals) != 0 {
+		t.Errorf("journal left: %v %v", journals, err)
+	}
+}
+
+func TestCat_Timeout(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+	ds := NewDatastore(tmp)
+	writeAt(t, &ds, "a", time.Now())
+
+	if _, err := captureStdout(func() error { return (&Cat{Timeout: time.Nanosecond}).Execute([]string{"a"}) }); !interrupted(err) {
+		t.Errorf("expected an interrupted cat, got %v", err)
+	}
+	if _, err := captureStdout(func() error { return (&Cat{Timeout: time.Minute}).Execute([]string{"a"}) }); err != nil {
+		t.Errorf("cat failed: %v", err)
+	}
+}
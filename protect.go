@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// protectFile is the marker which makes a file immutable
+const protectFile = ".protected"
+
+// Protected reports whether the file is immutable
+func (d *Datastore) Protected(name string) bool {
+	path, err := d.File(name, protectFile)
+	if err != nil {
+		return false
+	}
+	_, err = d.RootDir.Stat(path)
+	return err == nil
+}
+
+// checkProtected refuses modification of an immutable file
+func (d *Datastore) checkProtected(name string) error {
+	if d.Protected(name) {
+		slog.Warn("file is protected", "name", name)
+		return ErrProtected
+	}
+	return nil
+}
+
+// Protect makes the file immutable; reads and history remain available
+func (d *Datastore) Protect(name string) error {
+	cur, err := d.File(name, "current")
+	if err != nil {
+		slog.Error("invalid filename?", "name", name, "error", err)
+		return ErrInvalidPath
+	}
+	// not in the middle of a write which checked the marker
+	release, err := d.guard(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if _, err := d.RootDir.Stat(cur); err != nil {
+		slog.Error("not found", "name", name, "error", err)
+		return ErrNotFound
+	}
+	path, err := d.File(name, protectFile)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	fp, err := d.RootDir.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		slog.Error("cannot create marker", "name", name, "error", err)
+		return err
+	}
+	return fp.Close()
+}
+
+// Unprotect makes the file writable again
+func (d *Datastore) Unprotect(name string) error {
+	path, err := d.File(name, protectFile)
+	if err != nil {
+		slog.Error("invalid filename?", "name", name, "error", err)
+		return ErrInvalidPath
+	}
+	if err := d.RootDir.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// versionRefs counts the readers of the versions open in this process, so that removing a version while it is
+// read waits for its last reader: an in-flight read of an old version is not broken by a concurrent prune on
+// filesystems which refuse to remove open files (or serve them truncated)
+//
+// readers in other processes are not counted.
+type versionRefs struct {
+	mu      sync.Mutex
+	readers map[string]int
+	pending map[string]func()
+}
+
+func newVersionRefs() *versionRefs {
+	return &versionRefs{readers: map[string]int{}, pending: map[string]func(){}}
+}
+
+// acquire counts a reader of the version
+func (r *versionRefs) acquire(key string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readers[key]++
+}
+
+// release uncounts a reader, running the removal deferred for the last one
+func (r *versionRefs) release(key string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.readers[key]--
+	var remove func()
+	if r.readers[key] <= 0 {
+		delete(r.readers, key)
+		remove = r.pending[key]
+		delete(r.pending, key)
+	}
+	r.mu.Unlock()
+	if remove != nil {
+		remove()
+	}
+}
+
+// removeOrDefer runs remove now if nobody reads the version, or defers later to the close of the last reader
+//
+// it reports whether the removal was deferred.
+func (r *versionRefs) removeOrDefer(key string, remove func(), later func()) bool {
+	if r == nil {
+		remove()
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.readers[key] > 0 {
+		r.pending[key] = later
+		return true
+	}
+	// under the lock, so that a reader opening it meanwhile finds it gone
+	remove()
+	return false
+}
+
+// pendingRemoval reports whether the removal of the version waits for its readers
+func (r *versionRefs) pendingRemoval(key string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.pending[key]
+	return ok
+}
+
+// refReadCloser releases its version once when closed
+type refReadCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *refReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// openTracked opens the version with open, counting the reader until it is closed
+//
+// the reader is counted before the version is opened, so a removal either happens before and the open fails,
+// or waits for the close.
+func (d *Datastore) openTracked(name string, version string, open func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	key, err := d.File(name, version)
+	if err != nil || d.refs == nil {
+		return open()
+	}
+	d.refs.acquire(key)
+	release := func() { d.refs.release(key) }
+	rc, err := open()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &refReadCloser{ReadCloser: rc, release: release}, nil
+}
+
+// unlinkVersion removes a version and its sidecars, after its readers in this process have closed it
+func (d *Datastore) unlinkVersion(name string, version string) error {
+	key, err := d.File(name, version)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	var removeErr error
+	remove := func() {
+		if err := d.blobs().RemoveVersion(name, version); err != nil {
+			slog.Error("cannot remove", "name", name, "history", version, "error", err)
+			removeErr = err
+			return
+		}
+		for _, sidecar := range []string{hashSidecar(version), stateSidecar(version)} {
+			if path, err := d.File(name, sidecar); err == nil {
+				d.RootDir.Remove(path)
+			}
+		}
+	}
+	deferred := d.refs.removeOrDefer(key, remove, func() { d.removeDeferred(name, version, remove) })
+	if deferred {
+		slog.Info("version is being read, removed when closed", "name", name, "history", version)
+	}
+	return removeErr
+}
+
+// removeDeferred runs the removal deferred to the close of the last reader under the guard of the file,
+// unless the version became current again meanwhile
+//
+// the reader may be closed by an operation holding the guard, then the removal waits for it in the background.
+func (d *Datastore) removeDeferred(name string, version string, remove func()) {
+	run := func(release func()) {
+		defer release()
+		if d.currentTarget(name) == version {
+			slog.Warn("version is current again, not removed", "name", name, "history", version)
+			return
+		}
+		remove()
+	}
+	if release, ok := d.tryGuard(name); ok {
+		run(release)
+		return
+	}
+	go func() { run(d.waitGuard(name)) }()
+}
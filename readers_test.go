@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrune_OpenReader(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	ds.Compress = true
+	contents := []string{}
+	for i := range 3 {
+		content := `{"v":"` + strings.Repeat(string(rune('a'+i)), 1<<20) + `"}`
+		if err := ds.Write(t.Context(), "a", strings.NewReader(content), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		contents = append(contents, content)
+	}
+	hist := ds.History(t.Context(), "a")
+	oldest := hist[len(hist)-1].Name
+	rd, err := ds.ReadHistory("a", oldest)
+	if err != nil {
+		t.Fatalf("ReadHistory failed: %v", err)
+	}
+	other, err := ds.ReadHistory("a", oldest)
+	if err != nil {
+		t.Fatalf("ReadHistory failed: %v", err)
+	}
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(rd, head); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- ds.Prune(t.Context(), "a", 1, false) }()
+	if err := <-done; err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	path := filepath.Join(tmp, "a", oldest)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("version removed while read: %v", err)
+	}
+	rest, err := io.ReadAll(rd)
+	if err != nil || string(head)+string(rest) != contents[0] {
+		t.Errorf("read broken by prune: %d bytes, %v", len(head)+len(rest), err)
+	}
+	rd.Close()
+	// closing twice releases once
+	rd.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("version removed before its last reader closed: %v", err)
+	}
+	other.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("version not removed after the readers closed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "a", hashSidecar(oldest))); !os.IsNotExist(err) {
+		t.Errorf("hash sidecar not removed: %v", err)
+	}
+	if _, err := ds.ReadHistory("a", oldest); err != ErrNotFound {
+		t.Errorf("expected the removed version not found, got %v", err)
+	}
+	// versions nobody reads are removed at once
+	if hist := ds.History(t.Context(), "a"); len(hist) != 1 {
+		t.Errorf("expected 1 version, got %+v", hist)
+	}
+}
+
+func TestPrune_ConcurrentReaders(t *testing.T) {
+	ds := NewMemDatastore()
+	contents := map[string]string{}
+	for i := range 20 {
+		content := `{"v":` + strings.Repeat("1", i+1) + `}`
+		if err := ds.Write(t.Context(), "a", strings.NewReader(content), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		contents[ds.CurrentVersion("a")] = content
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	for version, content := range contents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				raw, err := ds.ReadRaw("a", version)
+				if err == ErrNotFound {
+					return
+				} else if err != nil {
+					errs <- version + ": " + err.Error()
+					return
+				}
+				got, err := io.ReadAll(raw)
+				raw.Close()
+				if err != nil || !bytes.Equal(got, []byte(content)) {
+					errs <- version + ": broken read"
+					return
+				}
+			}
+		}()
+	}
+	if err := ds.Prune(t.Context(), "a", 1, false); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if versions, _ := ds.blobs().ListVersions("a"); len(versions) != 1 || len(ds.refs.readers) != 0 || len(ds.refs.pending) != 0 {
+		t.Errorf("versions left: %+v, readers %v", versions, ds.refs.readers)
+	}
+}
+
+func TestPrune_RollbackToRead(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	versions := writeAt(t, &ds, "a", time.Now().Add(-time.Hour), time.Now())
+	rd, err := ds.ReadHistory("a", versions[0])
+	if err != nil {
+		t.Fatalf("ReadHistory failed: %v", err)
+	}
+	if err := ds.Prune(t.Context(), "a", 1, false); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	// the version waits for its reader to be removed, it is no target of a rollback
+	if err := ds.RollbackIf("a", versions[0], ""); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	rd.Close()
+	if got, err := readString(t, ds, "a"); err != nil || ds.CurrentVersion("a") != versions[1] {
+		t.Errorf("read after the reader closed: %q %v", got, err)
+	}
+
+	// the deferred removal waits for the operation holding the guard
+	rd, err = ds.ReadHistory("a", versions[1])
+	if err != nil {
+		t.Fatalf("ReadHistory failed: %v", err)
+	}
+	if err := ds.unlinkVersion("a", versions[1]); err != nil {
+		t.Fatalf("unlinkVersion failed: %v", err)
+	}
+	release, err := ds.guard("a")
+	if err != nil {
+		t.Fatalf("guard failed: %v", err)
+	}
+	rd.Close()
+	path := filepath.Join(tmp, "a", versions[1])
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("removed while the guard is held: %v", err)
+	}
+	release()
+	// and does not remove the current version
+	if release, err = ds.guard("a"); err != nil {
+		t.Fatalf("guard failed: %v", err)
+	}
+	release()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("current version removed: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Rename moves all versions, sidecars and current of a file to a new name
+//
+// the old name may break the name rules, so files created before them can be renamed.
+// locked, protected and held files are refused, as is a new name which is already in use.
+func (d *Datastore) Rename(from string, to string) error {
+	src := *d
+	src.legacyNames = true
+	if _, err := src.File(from); err != nil {
+		return ErrInvalidPath
+	}
+	if _, err := d.File(to); err != nil {
+		return ErrInvalidPath
+	}
+	src.recoverIfNeeded(from)
+	if src.currentTarget(from) == "" {
+		return ErrNotFound
+	}
+	if _, err := src.LockRead(from); err == nil {
+		return ErrLocked
+	}
+	if err := src.checkProtected(from); err != nil {
+		return err
+	}
+	if err := src.checkHeld(from); err != nil {
+		return err
+	}
+	if vers, _ := d.blobs().ListVersions(to); len(vers) != 0 || d.currentTarget(to) != "" {
+		slog.Error("new name is in use", "name", to)
+		return ErrExists
+	}
+	if err := d.moveState(&src, from, d, to); err != nil {
+		slog.Error("cannot move", "name", fmt.Sprintf("%q", from), "to", to, "error", err)
+		return err
+	}
+	for dir, _ := src.File(from); dir != "." && dir != ""; dir = filepath.Dir(dir) {
+		if d.RootDir.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// SanitizeNames renames the files under the prefix whose names break the name rules
+//
+// it returns the renames, done unless dry is set, and the errors of the files which could not be renamed.
+func (d *Datastore) SanitizeNames(ctx context.Context, prefix string, dry bool) (map[string]string, WalkResult, error) {
+	src := *d
+	src.legacyNames = true
+	names := []string{}
+	if err := src.Walk(ctx, prefix, func(e FileEntry) error {
+		if checkName(e.Name) != nil {
+			names = append(names, e.Name)
+		}
+		return nil
+	}); err != nil {
+		return nil, WalkResult{}, err
+	}
+	res := map[string]string{}
+	walk := WalkResult{Failed: []WalkFailure{}}
+	for _, name := range names {
+		walk.Visited++
+		to := sanitizeName(name)
+		if !dry {
+			if err := d.Rename(name, to); err != nil {
+				walk.Failed = append(walk.Failed, WalkFailure{Name: name, Error: err.Error(), err: err})
+				continue
+			}
+		}
+		res[name] = to
+	}
+	return res, walk, nil
+}
+
+// RenameCmd renames a file, or fixes the names which break the name rules
+type RenameCmd struct {
+	Sanitize bool `long:"sanitize" description:"rename the files under the prefixes (default /) whose names have control characters, invalid utf-8 or are too long"`
+	DryRun   bool `short:"n" long:"dry-run" description:"only show the renames of --sanitize"`
+}
+
+func (cmd *RenameCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	if !cmd.Sanitize {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: rename <old name> <new name>")
+		}
+		return root.Rename(args[0], args[1])
+	}
+	ctx, stop := commandContext()
+	defer stop()
+	if len(args) == 0 {
+		args = append(args, "/")
+	}
+	var errs []error
+	for _, v := range args {
+		renames, res, err := root.SanitizeNames(ctx, v, cmd.DryRun)
+		if err != nil {
+			return err
+		}
+		for _, from := range slices.Sorted(maps.Keys(renames)) {
+			fmt.Fprintf(os.Stdout, "%q -> %s\n", from, renames[from])
+		}
+		for _, f := range res.Failed {
+			fmt.Fprintf(os.Stdout, "%q: failed: %s\n", f.Name, f.Error)
+		}
+		errs = append(errs, res.Err())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// readFailed reports whether a read failed with an IO error, not because of the request or a missing file
+func readFailed(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	switch err {
+	case ErrNotFound, ErrInvalidPath, ErrInvalidHash, ErrLocked, ErrUnlocked, ErrNotJSON, ErrUnresolved:
+		return false
+	}
+	return true
+}
+
+// openReplica returns the datastore of the replica directory, or nil if none is configured
+func openReplica() *Datastore {
+	if option.ReplicaDir == "" {
+		return nil
+	}
+	ds := NewDatastore(option.ReplicaDir)
+	ds.Shard = option.Shard
+	ds.Skip = append(append([]string{}, DefaultSkip...), option.Exclude...)
+	return &ds
+}
+
+// readReplica serves a GET request of file contents from the replica after the primary failed
+func (h *APIHandler) readReplica(path string, w io.Writer, r *http.Request, err error) error {
+	slog.Warn("primary read failed, reading replica", "path", path, "error", err)
+	replica := &APIHandler{ds: h.replica, basepath: h.basepath, strictPaths: h.strictPaths}
+	return replica.APIGet(path, w, r)
+}
+
+// readWithReplica reads the current version of a file, or of the replica if the primary read fails
+func readWithReplica(ctx context.Context, ds *Datastore, replica *Datastore, name string, out io.Writer) error {
+	if replica == nil {
+		return ds.Read(ctx, name, out)
+	}
+	// nothing of a failed read reaches the output
+	buf := &bytes.Buffer{}
+	err := ds.Read(ctx, name, buf)
+	if readFailed(err) {
+		slog.Warn("primary read failed, reading replica", "name", name, "error", err)
+		buf.Reset()
+		err = replica.Read(ctx, name, buf)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, buf)
+	return err
+}
+
+// readHistoryWithReplica opens a version of a file, or of the replica if the primary fails to open it
+func readHistoryWithReplica(ds *Datastore, replica *Datastore, name string, history string) (io.ReadCloser, error) {
+	rc, err := ds.ReadHistory(name, history)
+	if replica != nil && readFailed(err) {
+		slog.Warn("primary read failed, reading replica", "name", name, "history", history, "error", err)
+		return replica.ReadHistory(name, history)
+	}
+	return rc, err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// breakCurrent makes the current version of the file unreadable, even for root, with a symlink loop
+func breakCurrent(t *testing.T, ds *Datastore, name string) string {
+	t.Helper()
+	version := ds.currentTarget(name)
+	path := filepath.Join(ds.RootName, name, version)
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if err := os.Symlink(version, path); err != nil {
+		t.Fatalf("symlink failed: %v", err)
+	}
+	return version
+}
+
+// replicate makes a copy of the current version of the file with other contents, as a replica
+func replicate(t *testing.T, ds *Datastore, dir string, name string, content string) {
+	t.Helper()
+	version := ds.currentTarget(name)
+	if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name, version), []byte(content), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := os.Symlink(version, filepath.Join(dir, name, "current")); err != nil {
+		t.Fatalf("symlink failed: %v", err)
+	}
+}
+
+func TestAPIGet_ReplicaFallback(t *testing.T) {
+	primary := NewDatastore(t.TempDir())
+	replica := NewDatastore(t.TempDir())
+	if err := primary.Write(t.Context(), "state", strings.NewReader(`{"from":"primary"}`), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	replicate(t, &primary, replica.RootName, "state", `{"from":"replica"}`)
+	version := breakCurrent(t, &primary, "state")
+	if !readFailed(primary.Read(t.Context(), "state", &strings.Builder{})) {
+		t.Fatalf("expected an IO error from the broken primary")
+	}
+
+	get := func(h http.Handler, target string, gzip bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/")
+		if gzip {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := get(&APIHandler{ds: &primary}, "/state", false); rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 without fallback, got %d", rr.Code)
+	}
+	h := &APIHandler{ds: &primary, replica: &replica}
+	for _, target := range []string{"/state", "/state?history=" + version} {
+		for _, gzip := range []bool{false, true} {
+			rr := get(h, target, gzip)
+			if rr.Code != http.StatusOK || rr.Body.String() != `{"from":"replica"}` {
+				t.Errorf("%s gzip=%v: unexpected response %d %q", target, gzip, rr.Code, rr.Body.String())
+			}
+			if rr.Header().Get("X-Statesaver-Source") != "replica" || rr.Header().Get("Content-Encoding") != "" {
+				t.Errorf("%s gzip=%v: unexpected headers %v", target, gzip, rr.Header())
+			}
+		}
+	}
+	rr := get(h, "/missing", false)
+	if rr.Code != http.StatusNotFound || rr.Header().Get("X-Statesaver-Source") != "" {
+		t.Errorf("missing file must not be read from the replica: %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestCat_ReplicaFallback(t *testing.T) {
+	tmp := t.TempDir()
+	replicaDir := t.TempDir()
+	origDatadir, origReplica := option.Datadir, option.ReplicaDir
+	option.Datadir = tmp
+	defer func() { option.Datadir, option.ReplicaDir = origDatadir, origReplica }()
+
+	primary := NewDatastore(tmp)
+	if err := primary.Write(t.Context(), "a", strings.NewReader("primary"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	replicate(t, &primary, replicaDir, "a", "replica")
+	version := breakCurrent(t, &primary, "a")
+	if _, err := captureStdout(func() error { return (&Cat{}).Execute([]string{"a"}) }); err == nil {
+		t.Errorf("expected error without replica")
+	}
+	option.ReplicaDir = replicaDir
+	out, err := captureStdout(func() error { return (&Cat{}).Execute([]string{"a"}) })
+	if err != nil || out != "replica" {
+		t.Errorf("unexpected cat output: %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&HistoryCat{File: "a"}).Execute([]string{version}) })
+	if err != nil || out != "replica" {
+		t.Errorf("unexpected hcat output: %q %v", out, err)
+	}
+}
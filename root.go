@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// formatFile marks the root directory of a datastore
+const formatFile = "format.json"
+
+// datastoreFormat is the layout version recorded in formatFile
+const datastoreFormat = 1
+
+// rootEntryLimit is the number of entries a root without states may have before it is refused
+var rootEntryLimit = 20
+
+// rootScanLimit bounds the directories looked at when searching for states in the root
+var rootScanLimit = 1000
+
+// errStateFound stops the search for states
+var errStateFound = errors.New("state found")
+
+// looksLikeDatastore searches a few levels of the root for a state directory
+func looksLikeDatastore(root string) bool {
+	scanned := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Name() == "current" && d.Type()&fs.ModeSymlink != 0 {
+			return errStateFound
+		}
+		if d.IsDir() {
+			scanned++
+			if scanned > rootScanLimit {
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	})
+	return err == errStateFound
+}
+
+// CheckRoot validates the data directory before use
+//
+// a missing directory, a file, or a crowded directory without any state is refused unless force is set;
+// with force a missing directory is created.
+func CheckRoot(root string, force bool) error {
+	fi, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		if !force {
+			return fmt.Errorf("data directory %s does not exist (use --force-datadir to create it): %w", root, ErrNotDatastore)
+		}
+		slog.Info("creating data directory", "root", root)
+		return os.MkdirAll(root, 0o755)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("data directory %s is not a directory: %w", root, ErrNotDatastore)
+	}
+	if force {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(root, formatFile)); err == nil {
+		return nil
+	}
+	ents, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	if len(ents) <= rootEntryLimit || looksLikeDatastore(root) {
+		return nil
+	}
+	return fmt.Errorf("data directory %s has %d entries and no state, it does not look like a datastore (use --force-datadir): %w", root, len(ents), ErrNotDatastore)
+}
+
+// markRoot records the format of the datastore in its root if not yet done
+func (d *Datastore) markRoot() error {
+	// in the root whatever the layout
+	path := formatFile
+	if _, err := d.RootDir.Stat(path); err == nil {
+		return nil
+	}
+	content, err := json.Marshal(map[string]int{"format": datastoreFormat})
+	if err != nil {
+		return err
+	}
+	return d.writeFile(path, bytes.NewReader(content))
+}
+
+// Stats counts the files and the total size of all versions
+func (d *Datastore) Stats() (int, int64, error) {
+	states := 0
+	var size int64
+	err := d.Walk(context.Background(), "/", func(e FileEntry) error {
+		states++
+		for _, v := range d.History(context.Background(), e.Name) {
+			size += v.Size
+		}
+		return nil
+	})
+	return states, size, err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRoot(t *testing.T) {
+	crowded := func(t *testing.T) string {
+		dir := t.TempDir()
+		for i := 0; i <= rootEntryLimit; i++ {
+			if err := os.Mkdir(filepath.Join(dir, fmt.Sprintf("user%d", i)), 0o755); err != nil {
+				t.Fatalf("mkdir failed: %v", err)
+			}
+		}
+		return dir
+	}
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T) string
+		force   bool
+		invalid bool
+	}{
+		{"empty", func(t *testing.T) string { return t.TempDir() }, false, false},
+		{"missing", func(t *testing.T) string { return filepath.Join(t.TempDir(), "data") }, false, true},
+		{"missing forced", func(t *testing.T) string { return filepath.Join(t.TempDir(), "data") }, true, false},
+		{"file", func(t *testing.T) string {
+			path := filepath.Join(t.TempDir(), "file")
+			os.WriteFile(path, []byte("x"), 0o644)
+			return path
+		}, true, true},
+		{"crowded", crowded, false, true},
+		{"crowded forced", crowded, true, false},
+		{"crowded with state", func(t *testing.T) string {
+			dir := crowded(t)
+			ds := NewDatastore(dir)
+			if err := ds.Write(t.Context(), "user3/app", strings.NewReader("{}"), []byte{}, ""); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			return dir
+		}, false, false},
+		{"crowded with format", func(t *testing.T) string {
+			dir := crowded(t)
+			ds := NewDatastore(dir)
+			if err := ds.markRoot(); err != nil {
+				t.Fatalf("markRoot failed: %v", err)
+			}
+			return dir
+		}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := test.setup(t)
+			err := CheckRoot(root, test.force)
+			if test.invalid != errors.Is(err, ErrNotDatastore) {
+				t.Fatalf("unexpected result: %v", err)
+			}
+			if err == nil {
+				if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+					t.Errorf("root is not a directory: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	for _, name := range []string{"a", "b/c", "b/c"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("1234"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	states, size, err := ds.Stats()
+	if err != nil || states != 2 || size != 12 {
+		t.Errorf("unexpected stats: %d %d %v", states, size, err)
+	}
+}
+
+func TestNeedsDatastore(t *testing.T) {
+	if needsDatastore(&Sign{}) || needsDatastore(&Doctor{URL: "http://localhost:3000"}) {
+		t.Errorf("commands without data directory should not be checked")
+	}
+	if !needsDatastore(&Doctor{}) || !needsDatastore(&LsTree{}) {
+		t.Errorf("commands using the data directory should be checked")
+	}
+}
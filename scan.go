@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// scanProgressInterval is how often a running scan logs its progress
+var scanProgressInterval = 10 * time.Second
+
+// errScanDeadline stops the walk when the scan runs out of time
+var errScanDeadline = errors.New("scan deadline exceeded")
+
+// ScanSummary is the result of a consistency scan
+type ScanSummary struct {
+	Checked    int            `json:"checked"`
+	Repaired   []VerifyResult `json:"repaired"`
+	Unrepaired []VerifyResult `json:"unrepaired"`
+	// Incomplete is set when the deadline was reached before all files were checked
+	Incomplete bool          `json:"incomplete"`
+	Elapsed    time.Duration `json:"elapsed"`
+}
+
+// scanTargets lists files under the prefix which have a current pointer or a journal
+func (d *Datastore) scanTargets(prefix string, deadline time.Time) ([]string, error) {
+	res := []string{}
+	seen := map[string]bool{}
+	err := afero.Walk(d.RootDir, d.walkBase(prefix), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			slog.Error("walkdir", "error", err, "path", path)
+			return err
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return errScanDeadline
+		}
+		if d.skipDir(path, info) {
+			return filepath.SkipDir
+		}
+		lpath, ok := d.layoutPath(path)
+		if !ok || !strings.HasPrefix(lpath, prefix) || (info.Name() != "current" && info.Name() != "journal") {
+			return nil
+		}
+		if name := filepath.Dir(lpath); !seen[name] {
+			seen[name] = true
+			res = append(res, name)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// scanOne applies the safe repairs to a file and returns the problems found
+func (d *Datastore) scanOne(name string) []VerifyResult {
+	res := []VerifyResult{}
+	if ent := d.journalRead(name); ent != nil {
+		result := VerifyResult{Name: name, Problem: "interrupted " + ent.Op}
+		if _, err := d.Recover(name); err == nil {
+			result.Fixed = true
+		}
+		res = append(res, result)
+	}
+	target := d.currentTarget(name)
+	if target == "" || d.versionExists(name, target) {
+		return res
+	}
+	result := VerifyResult{Name: name, Problem: "dangling current -> " + target}
+	if hist := d.History(context.Background(), name); len(hist) != 0 {
+		if err := d.set_current(name, hist[0].Name); err != nil {
+			slog.Error("cannot fix current", "name", name, "error", err)
+		} else {
+			result.Fixed = true
+			result.Problem += " (now " + hist[0].Name + ")"
+		}
+	}
+	return append(res, result)
+}
+
+// Scan checks files under the prefix with workers in parallel, rolling forward interrupted
+// operations and pointing dangling current to the newest version. A zero timeout means no limit.
+func (d *Datastore) Scan(prefix string, workers int, timeout time.Duration) (ScanSummary, error) {
+	res := ScanSummary{Repaired: []VerifyResult{}, Unrepaired: []VerifyResult{}}
+	start := time.Now()
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = start.Add(timeout)
+	}
+	targets, err := d.scanTargets(prefix, deadline)
+	if errors.Is(err, errScanDeadline) {
+		res.Incomplete = true
+	} else if err != nil {
+		return res, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	var checked atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(scanProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				slog.Info("scanning", "checked", checked.Load(), "total", len(targets), "elapsed", time.Since(start))
+			}
+		}
+	}()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				results := d.scanOne(name)
+				checked.Add(1)
+				mu.Lock()
+				for _, r := range results {
+					if r.Fixed {
+						res.Repaired = append(res.Repaired, r)
+					} else {
+						res.Unrepaired = append(res.Unrepaired, r)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, name := range targets {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			res.Incomplete = true
+			break
+		}
+		queue <- name
+	}
+	close(queue)
+	wg.Wait()
+	close(done)
+	res.Checked = int(checked.Load())
+	res.Elapsed = time.Since(start)
+	return res, nil
+}
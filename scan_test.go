@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedCorruption makes an interrupted write on a, a dangling current with an older
+// version on b, and optionally a dangling current without any version on c
+func seedCorruption(t *testing.T, tmp string, unrepairable bool) {
+	t.Helper()
+	ds := NewDatastore(tmp)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ds.Write(t.Context(), name, strings.NewReader("v1"), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	if err := ds.Write(t.Context(), "b", strings.NewReader("v2"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	ds.failpoint = crashAt(journalWrite, "pointer")
+	if err := ds.Write(t.Context(), "a", strings.NewReader("v2"), []byte{}, ""); err != errCrash {
+		t.Fatalf("expected crash, got %v", err)
+	}
+	hist := ds.History(t.Context(), "b")
+	if err := os.Remove(filepath.Join(tmp, "b", hist[0].Name)); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if unrepairable {
+		hist = ds.History(t.Context(), "c")
+		if err := os.Remove(filepath.Join(tmp, "c", hist[0].Name)); err != nil {
+			t.Fatalf("remove failed: %v", err)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	tmp := t.TempDir()
+	seedCorruption(t, tmp, true)
+	ds := NewDatastore(tmp)
+	res, err := ds.Scan("/", 2, 0)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if res.Checked != 3 || res.Incomplete {
+		t.Errorf("unexpected summary: %+v", res)
+	}
+	if len(res.Repaired) != 2 || len(res.Unrepaired) != 1 || res.Unrepaired[0].Name != "/c" {
+		t.Fatalf("unexpected results: %+v", res)
+	}
+	if content, _ := readString(t, ds, "a"); content != "v2" {
+		t.Errorf("expected roll forward, got %q", content)
+	}
+	if content, _ := readString(t, ds, "b"); content != "v1" {
+		t.Errorf("expected current to point to the newest remaining version, got %q", content)
+	}
+
+	res, err = ds.Scan("/", 2, 0)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(res.Repaired) != 0 || len(res.Unrepaired) != 1 {
+		t.Errorf("expected only the unrepairable problem left: %+v", res)
+	}
+}
+
+func TestScan_Timeout(t *testing.T) {
+	tmp := t.TempDir()
+	seedCorruption(t, tmp, false)
+	ds := NewDatastore(tmp)
+	res, err := ds.Scan("/", 1, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if !res.Incomplete {
+		t.Errorf("expected incomplete scan: %+v", res)
+	}
+}
+
+func TestWebServer_StartupCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		cmd          WebServer
+		unrepairable bool
+		expected     error
+		current      string
+	}{
+		{"recover only", WebServer{}, true, nil, ""},
+		{"scan", WebServer{ScanOnStart: true, ScanWorkers: 2}, true, nil, "v1"},
+		{"strict repaired", WebServer{ScanStrict: true, ScanWorkers: 2}, false, nil, "v1"},
+		{"strict unrepairable", WebServer{ScanStrict: true, ScanWorkers: 2}, true, ErrInconsistent, "v1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			seedCorruption(t, tmp, test.unrepairable)
+			ds := NewDatastore(tmp)
+			if err := test.cmd.startupCheck(&ds); err != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+			if _, err := os.Stat(filepath.Join(tmp, "a", "journal")); !os.IsNotExist(err) {
+				t.Errorf("journal not recovered: %v", err)
+			}
+			// without the scan, dangling current is left alone
+			content, _ := readString(t, ds, "b")
+			if content != test.current {
+				t.Errorf("expected %q, got %q", test.current, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// shardDir returns the fan-out directories of a name in the sharded layout, e.g. 3f/a2
+func shardDir(name string) string {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	sum := md5.Sum([]byte(name))
+	h := hex.EncodeToString(sum[:2])
+	return filepath.Join(h[:2], h[2:4])
+}
+
+// walkBase returns the directory a walk of the prefix starts from
+func (d *Datastore) walkBase(prefix string) string {
+	if d.Shard {
+		// the names under a prefix are spread over all shards
+		return "/"
+	}
+	return filepath.Dir(prefix)
+}
+
+// layoutPath returns a path found by a walk as the path of the name, i.e. without the shard directories
+//
+// in the sharded layout, the path belongs to the layout only if the shard directories match the name of its directory.
+func (d *Datastore) layoutPath(path string) (string, bool) {
+	if !d.Shard {
+		return path, true
+	}
+	segs := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(path), "/"), "/", 3)
+	if len(segs) < 3 {
+		return "/", false
+	}
+	res := "/" + segs[2]
+	return res, filepath.Join(segs[0], segs[1]) == shardDir(filepath.Dir(res))
+}
+
+// Reshard moves the files of the flat layout into the sharded layout and returns their names
+//
+// the versions and sidecars of a file are moved first and current last, so an interrupted run
+// leaves each file complete in one of the layouts and can be run again.
+func (d *Datastore) Reshard(ctx context.Context, dry bool) ([]string, error) {
+	flat := *d
+	flat.Shard = false
+	sharded := *d
+	sharded.Shard = true
+	if journals, err := flat.PendingJournals("/"); err != nil {
+		return nil, err
+	} else if len(journals) != 0 {
+		slog.Error("interrupted operations, run verify --fix first", "names", journals)
+		return nil, ErrInconsistent
+	}
+	names := []string{}
+	err := flat.Walk(ctx, "/", func(e FileEntry) error {
+		if _, ok := sharded.layoutPath(filepath.Join(e.Name, "current")); ok {
+			// already moved
+			return nil
+		}
+		names = append(names, e.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if _, err := flat.LockRead(name); err == nil {
+			slog.Error("file is locked", "name", name)
+			return nil, fmt.Errorf("%s: %w", name, ErrLocked)
+		}
+		dst, err := sharded.File(name, "current")
+		if err != nil {
+			return nil, ErrInvalidPath
+		}
+		if _, _, err := d.RootDir.LstatIfPossible(dst); err == nil {
+			slog.Error("file exists in both layouts", "name", name)
+			return nil, fmt.Errorf("%s: %w", name, ErrExists)
+		}
+	}
+	if dry {
+		return names, nil
+	}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := d.moveState(&flat, name, &sharded, name); err != nil {
+			slog.Error("cannot move", "name", name, "error", err)
+			return nil, err
+		}
+	}
+	// deepest first, nested files have been moved out of their parents
+	dirs := append([]string{}, names...)
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, name := range dirs {
+		for dir, _ := flat.File(name); dir != "." && dir != ""; dir = filepath.Dir(dir) {
+			if d.RootDir.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// moveState moves the entries of a file into another file or layout, current last
+func (d *Datastore) moveState(from *Datastore, name string, to *Datastore, newname string) error {
+	src, err := from.File(name)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	dst, err := to.File(newname)
+	if err != nil {
+		return ErrInvalidPath
+	}
+	if err := d.RootDir.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+	ents, err := afero.ReadDir(d.RootDir, src)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(ents, func(i, j int) bool { return ents[i].Name() != "current" && ents[j].Name() == "current" })
+	for _, ent := range ents {
+		if ent.IsDir() {
+			// another file, or a directory which is not part of this one
+			continue
+		}
+		slog.Debug("moving", "name", name, "entry", ent.Name(), "to", dst)
+		if err := d.RootDir.Rename(filepath.Join(src, ent.Name()), filepath.Join(dst, ent.Name())); err != nil {
+			return err
+		}
+	}
+	return d.syncDir(dst)
+}
+
+// ReshardCmd moves files into the sharded layout
+type ReshardCmd struct {
+	DryRun bool `short:"n" long:"dry-run" description:"only show the files to move"`
+}
+
+func (cmd *ReshardCmd) Execute(args []string) error {
+	init_log()
+	root := openDatastore()
+	ctx, stop := commandContext()
+	defer stop()
+	names, err := root.Reshard(ctx, cmd.DryRun)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintf(os.Stdout, "%s -> %s\n", name, filepath.Join(shardDir(name), name))
+	}
+	return nil
+}
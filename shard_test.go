@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// walkNames lists the names found by Walk under the prefix
+func walkNames(t *testing.T, ds *Datastore, prefix string) []string {
+	t.Helper()
+	res := []string{}
+	if err := ds.Walk(t.Context(), prefix, func(e FileEntry) error {
+		res = append(res, e.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	slices.Sort(res)
+	return res
+}
+
+func TestShardDir(t *testing.T) {
+	if shardDir("prod/app") != shardDir("/prod/app") || shardDir("prod/app") != shardDir("prod//app/") {
+		t.Errorf("shard depends on the form of the name")
+	}
+	segs := strings.Split(shardDir("prod/app"), "/")
+	if len(segs) != 2 || len(segs[0]) != 2 || len(segs[1]) != 2 {
+		t.Errorf("unexpected shard: %s", shardDir("prod/app"))
+	}
+}
+
+func TestShard(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	ds.Shard = true
+	names := []string{"dev/x", "prod", "prod/app"}
+	for _, name := range names {
+		for _, s := range []string{"v1", "v2"} {
+			if err := ds.Write(t.Context(), name, strings.NewReader(name+s), []byte{}, ""); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for _, name := range names {
+		if _, err := os.Lstat(filepath.Join(tmp, shardDir(name), name, "current")); err != nil {
+			t.Errorf("%s not in its shard: %v", name, err)
+		}
+		buf := &bytes.Buffer{}
+		if err := ds.Read(t.Context(), name, buf); err != nil || buf.String() != name+"v2" {
+			t.Errorf("read %s: %q %v", name, buf.String(), err)
+		}
+		if hist := ds.History(t.Context(), name); len(hist) != 2 {
+			t.Errorf("history %s: %+v", name, hist)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "prod")); !os.IsNotExist(err) {
+		t.Errorf("flat directory created: %v", err)
+	}
+	if got := walkNames(t, &ds, "/"); !slices.Equal(got, []string{"/dev/x", "/prod", "/prod/app"}) {
+		t.Errorf("unexpected walk: %v", got)
+	}
+	if got := walkNames(t, &ds, "/dev/"); !slices.Equal(got, []string{"/dev/x"}) {
+		t.Errorf("unexpected walk of prefix: %v", got)
+	}
+	if err := ds.Lock("prod/app", `{"ID":"1"}`); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if locks, err := ds.Locks("/"); err != nil || len(locks) != 1 || locks[0].Path != "/prod/app" {
+		t.Errorf("unexpected locks: %+v %v", locks, err)
+	}
+	if res, err := ds.Verify("/", false); err != nil || len(res) != 0 {
+		t.Errorf("unexpected verify: %+v %v", res, err)
+	}
+
+	// files of the flat layout are not part of the sharded one
+	flat := NewDatastore(tmp)
+	if err := flat.Write(t.Context(), "stray", strings.NewReader("x"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if got := walkNames(t, &ds, "/"); len(got) != 3 {
+		t.Errorf("flat file listed in sharded layout: %v", got)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	tmp := t.TempDir()
+	flat := NewDatastore(tmp)
+	names := []string{"dev/x", "prod", "prod/app"}
+	for _, name := range names {
+		for _, s := range []string{"v1", "v2", "v3"} {
+			if err := flat.Write(t.Context(), name, strings.NewReader(name+s), []byte{}, ""); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := flat.Protect("prod"); err != nil {
+		t.Fatalf("protect failed: %v", err)
+	}
+	history := flat.History(t.Context(), "prod/app")
+
+	if err := flat.Lock("dev/x", `{"ID":"1"}`); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if _, err := flat.Reshard(t.Context(), false); err == nil {
+		t.Errorf("expected error for locked file")
+	}
+	if err := flat.Unlock("dev/x", ""); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	res, err := flat.Reshard(t.Context(), true)
+	if err != nil || len(res) != 3 {
+		t.Fatalf("dry run: %v %v", res, err)
+	}
+	if got := walkNames(t, &flat, "/"); len(got) != 3 {
+		t.Errorf("dry run moved files: %v", got)
+	}
+
+	res, err = flat.Reshard(t.Context(), false)
+	if err != nil || len(res) != 3 {
+		t.Fatalf("reshard failed: %v %v", res, err)
+	}
+	for _, dir := range []string{"dev", "prod"} {
+		if _, err := os.Stat(filepath.Join(tmp, dir)); !os.IsNotExist(err) {
+			t.Errorf("flat directory %s left: %v", dir, err)
+		}
+	}
+	ds := NewDatastore(tmp)
+	ds.Shard = true
+	if got := walkNames(t, &ds, "/"); !slices.Equal(got, []string{"/dev/x", "/prod", "/prod/app"}) {
+		t.Errorf("unexpected walk after reshard: %v", got)
+	}
+	for _, name := range names {
+		buf := &bytes.Buffer{}
+		if err := ds.Read(t.Context(), name, buf); err != nil || buf.String() != name+"v3" {
+			t.Errorf("read %s: %q %v", name, buf.String(), err)
+		}
+	}
+	if got := ds.History(t.Context(), "prod/app"); !slices.Equal(got, history) {
+		t.Errorf("history changed: %+v %+v", got, history)
+	}
+	if !ds.Protected("prod") {
+		t.Errorf("sidecar not moved")
+	}
+	if res, err := ds.Reshard(t.Context(), false); err != nil || len(res) != 0 {
+		t.Errorf("expected nothing to move again: %v %v", res, err)
+	}
+}
+
+func TestReshardCmd_Execute(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	if err := ds.Write(t.Context(), "a", strings.NewReader("{}"), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	out, err := captureStdout(func() error { return (&ReshardCmd{}).Execute(nil) })
+	if err != nil || out != "/a -> "+filepath.Join(shardDir("a"), "a")+"\n" {
+		t.Errorf("unexpected output: %q %v", out, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signedUser is the user name recorded for requests authorized by a signed URL
+const signedUser = "signed-url"
+
+// urlSignature computes the signature of a GET request of the path and version
+func urlSignature(key string, path string, version string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "GET\n%s\n%s\n%d", path, version, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL makes a URL which allows to read the file (and version) until it expires
+func SignURL(key string, base string, name string, version string, expires time.Time) string {
+	path := "/api/" + strings.TrimPrefix(name, "/")
+	exp := expires.Unix()
+	query := url.Values{}
+	if version != "" {
+		query.Set("history", version)
+	}
+	query.Set("exp", strconv.FormatInt(exp, 10))
+	query.Set("sig", urlSignature(key, path, version, exp))
+	u := url.URL{Path: path, RawQuery: query.Encode()}
+	return strings.TrimSuffix(base, "/") + u.String()
+}
+
+// VerifySignedRequest checks that the request is the one which was signed and has not expired
+func VerifySignedRequest(key string, r *http.Request, now time.Time) error {
+	if r.Method != http.MethodGet {
+		return ErrForbidden
+	}
+	query := r.URL.Query()
+	for k := range query {
+		if k != "history" && k != "exp" && k != "sig" {
+			return ErrForbidden
+		}
+	}
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return ErrForbidden
+	}
+	expected := urlSignature(key, r.URL.Path, query.Get("history"), exp)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		return ErrForbidden
+	}
+	if now.Unix() > exp {
+		return ErrExpired
+	}
+	return nil
+}
+
+// SignedURL serves requests with a valid signature without other authentication
+type SignedURL struct {
+	handler  http.Handler
+	fallback http.Handler
+	key      string
+}
+
+// ServeHTTP verifies signed requests and passes the others to the fallback handler
+func (s *SignedURL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("sig") {
+		s.fallback.ServeHTTP(w, r)
+		return
+	}
+	if err := VerifySignedRequest(s.key, r, time.Now()); err != nil {
+		slog.Warn("signed url rejected", "error", err, "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	s.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, signedUser)))
+}
+
+// Sign prints signed URLs for temporary read access
+type Sign struct {
+	URLBase    string        `long:"url-base" required:"true" description:"server url, e.g. https://host"`
+	Expires    time.Duration `long:"expires" default:"24h" description:"lifetime of the url"`
+	SigningKey string        `long:"signing-key" required:"true" env:"STSV_SIGNING_KEY" description:"key shared with the server"`
+}
+
+func (cmd *Sign) Execute(args []string) error {
+	init_log()
+	expires := time.Now().Add(cmd.Expires)
+	for _, v := range args {
+		name, version := v, ""
+		if idx := strings.LastIndex(v, "@"); idx != -1 {
+			name, version = v[:idx], v[idx+1:]
+		}
+		fmt.Fprintln(os.Stdout, SignURL(cmd.SigningKey, cmd.URLBase, name, version, expires))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignedRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := SignURL("key1", "https://host/", "prod/app", "1abc", now.Add(time.Hour))
+	if !strings.HasPrefix(valid, "https://host/api/prod/app?") {
+		t.Fatalf("unexpected url: %s", valid)
+	}
+	u, _ := url.Parse(valid)
+	tampered := *u
+	tampered.Path = "/api/prod/other"
+	otherVersion := *u
+	q := otherVersion.Query()
+	q.Set("history", "2def")
+	otherVersion.RawQuery = q.Encode()
+	extra := *u
+	q = extra.Query()
+	q.Set("versions", "true")
+	extra.RawQuery = q.Encode()
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		key      string
+		now      time.Time
+		expected error
+	}{
+		{"valid", http.MethodGet, u.String(), "key1", now, nil},
+		{"expired", http.MethodGet, u.String(), "key1", now.Add(2 * time.Hour), ErrExpired},
+		{"tampered path", http.MethodGet, tampered.String(), "key1", now, ErrForbidden},
+		{"other version", http.MethodGet, otherVersion.String(), "key1", now, ErrForbidden},
+		{"extra parameter", http.MethodGet, extra.String(), "key1", now, ErrForbidden},
+		{"wrong key", http.MethodGet, u.String(), "key2", now, ErrForbidden},
+		{"not get", http.MethodPost, u.String(), "key1", now, ErrForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.url, nil)
+			if err := VerifySignedRequest(test.key, req, test.now); err != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	var gotUser string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser = RequestUser(r)
+	})
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	h := &SignedURL{handler: inner, fallback: fallback, key: "key1"}
+
+	signed := SignURL("key1", "", "prod/app", "", time.Now().Add(time.Minute))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, signed, nil))
+	if rr.Code != http.StatusOK || gotUser != signedUser {
+		t.Errorf("expected signed request to pass, got %d user=%q", rr.Code, gotUser)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, strings.Replace(signed, "app", "db", 1), nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for tampered url, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/prod/app", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected unsigned request to fall back, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"syscall"
+)
+
+// SpaceStatus is the free space of the data directory, served at /readyz
+type SpaceStatus struct {
+	Status string `json:"status"`
+	Free   int64  `json:"free_bytes"`
+	Min    int64  `json:"min_free_bytes"`
+	// Low is set while the free space is below Min, and writes are refused
+	Low bool `json:"low"`
+}
+
+// Space returns the free space of the data directory
+func (d *Datastore) Space() (SpaceStatus, error) {
+	res := SpaceStatus{Status: "ok", Min: d.MinFreeBytes}
+	free := d.diskFree
+	if free == nil {
+		free = diskFree
+	}
+	n, err := free(d.RootName)
+	if err != nil {
+		return res, err
+	}
+	res.Free = int64(min(n, math.MaxInt64))
+	if d.MinFreeBytes > 0 && res.Free < d.MinFreeBytes {
+		res.Status, res.Low = "low-space", true
+	}
+	return res, nil
+}
+
+// checkSpace refuses a write with ErrNoSpace while the free space is below MinFreeBytes
+//
+// a free space which cannot be read does not refuse anything.
+func (d *Datastore) checkSpace() error {
+	if d.MinFreeBytes <= 0 {
+		return nil
+	}
+	st, err := d.Space()
+	if err != nil {
+		slog.Debug("cannot read free space", "root", d.RootName, "error", err)
+		return nil
+	}
+	if st.Low {
+		slog.Warn("free space below the minimum, write refused", "root", d.RootName, "free", humanizeBytes(st.Free), "min", humanizeBytes(st.Min))
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// noSpace returns ErrNoSpace for an error of a full disk, other errors as they are
+func noSpace(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		slog.Error("no space left in the data directory", "error", err)
+		return ErrNoSpace
+	}
+	return err
+}
+
+// SpaceChecker is implemented by the datastores which know the free space of their directory
+type SpaceChecker interface {
+	Space() (SpaceStatus, error)
+}
+
+// Readiness serves /readyz: 200 while the data directory has the free space of --min-free-bytes, 503 when not
+type Readiness struct {
+	ds *Datastore
+}
+
+func (h *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st, err := h.ds.Space()
+	if err != nil {
+		slog.Debug("cannot read free space", "error", err)
+		st.Status = "ok"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if st.Low {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
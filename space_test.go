@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// fullFs is an OsFs which fails writes with ENOSPC once left bytes have been written
+type fullFs struct {
+	*afero.OsFs
+	mu   sync.Mutex
+	left int64
+}
+
+func (fs *fullFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (fs *fullFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.OsFs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &fullFile{File: f, fs: fs}, nil
+}
+
+// setLeft sets the bytes which can still be written
+func (fs *fullFs) setLeft(n int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.left = n
+}
+
+type fullFile struct {
+	afero.File
+	fs *fullFs
+}
+
+func (f *fullFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	n := min(int64(len(p)), f.fs.left)
+	f.fs.left -= n
+	f.fs.mu.Unlock()
+	written, err := f.File.Write(p[:n])
+	if err == nil && written < len(p) {
+		err = &os.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+	}
+	return written, err
+}
+
+func newFullDatastore(t *testing.T) (Datastore, *fullFs) {
+	tmp := t.TempDir()
+	fs := &fullFs{OsFs: &afero.OsFs{}, left: 1 << 30}
+	ds := NewDatastore(tmp)
+	ds.RootDir = afero.NewBasePathFs(fs, tmp).(*afero.BasePathFs)
+	return ds, fs
+}
+
+// checkUnchanged checks that the failed write left the file as it was
+func checkUnchanged(t *testing.T, ds Datastore, name string, version string) {
+	t.Helper()
+	if cur := ds.CurrentVersion(name); cur != version {
+		t.Errorf("current changed: %q, expected %q", cur, version)
+	}
+	if hist := ds.History(t.Context(), name); len(hist) != 1 {
+		t.Errorf("version left behind: %+v", hist)
+	}
+	if got, err := readString(t, ds, name); err != nil || got != `{"v":1}` {
+		t.Errorf("unexpected contents %q %v", got, err)
+	}
+	dir, _ := ds.File(name)
+	ents, err := afero.ReadDir(ds.RootDir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range ents {
+		if ent.Name() == "journal" || (strings.HasPrefix(ent.Name(), ".") && !strings.Contains(ent.Name(), version)) {
+			t.Errorf("%s left behind", ent.Name())
+		}
+	}
+}
+
+func TestWrite_NoSpace(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		ds, fs := newFullDatastore(t)
+		ds.Compress = compress
+		if err := ds.Write(t.Context(), "a", strings.NewReader(`{"v":1}`), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		version := ds.CurrentVersion("a")
+		// the journal fits, the data does not
+		fs.setLeft(1000)
+		big := `{"v":"` + strings.Repeat("x", 1<<20) + `"}`
+		if err := ds.Write(t.Context(), "a", strings.NewReader(big), []byte{}, ""); err != ErrNoSpace {
+			t.Errorf("compress=%v: expected ErrNoSpace, got %v", compress, err)
+		}
+		checkUnchanged(t, ds, "a", version)
+		// nothing fits
+		fs.setLeft(0)
+		if err := ds.Write(t.Context(), "a", strings.NewReader(`{"v":2}`), []byte{}, ""); err != ErrNoSpace {
+			t.Errorf("compress=%v: expected ErrNoSpace, got %v", compress, err)
+		}
+		checkUnchanged(t, ds, "a", version)
+	}
+}
+
+func TestWrite_NoSpaceForCurrent(t *testing.T) {
+	ds, _ := newFullDatastore(t)
+	if err := ds.Write(t.Context(), "a", strings.NewReader(`{"v":1}`), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	version := ds.CurrentVersion("a")
+	// the new link cannot be made after the old one is gone, once
+	failed := false
+	ds.failpoint = func(op string, step string) error {
+		if op == "set_current" && step == "unlink" && !failed {
+			failed = true
+			return &os.LinkError{Op: "symlink", Err: syscall.ENOSPC}
+		}
+		return nil
+	}
+	if err := ds.Write(t.Context(), "a", strings.NewReader(`{"v":2}`), []byte{}, ""); err != ErrNoSpace {
+		t.Errorf("expected ErrNoSpace, got %v", err)
+	}
+	ds.failpoint = nil
+	checkUnchanged(t, ds, "a", version)
+}
+
+func TestUpload_NoSpace(t *testing.T) {
+	ds, fs := newFullDatastore(t)
+	upload, err := ds.UploadStart("a")
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	fs.setLeft(10)
+	if _, err := ds.UploadAppend(upload.ID, 0, strings.NewReader(strings.Repeat("x", 100)), 100); err != ErrNoSpace {
+		t.Errorf("expected ErrNoSpace, got %v", err)
+	}
+	if st, err := ds.UploadStatus(upload.ID); err != nil || st.Offset != 0 {
+		t.Errorf("partial chunk kept: %+v %v", st, err)
+	}
+}
+
+func TestMinFreeBytes(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	writeAt(t, &ds, "a", time.Now())
+	free := int64(10 << 20)
+	ds.diskFree = func(path string) (uint64, error) { return uint64(free), nil }
+	ds.MinFreeBytes = 20 << 20
+	h := &APIHandler{ds: &ds}
+	post := func() int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/a", strings.NewReader(`{"v":9}`)))
+		return rr.Code
+	}
+	if code := post(); code != http.StatusInsufficientStorage {
+		t.Errorf("expected 507, got %d", code)
+	}
+	if _, err := ds.UploadStart("b"); err != ErrNoSpace {
+		t.Errorf("expected the upload refused, got %v", err)
+	}
+	// reads go on
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/a", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("read refused: %d", rr.Code)
+	}
+
+	ready := func() (int, SpaceStatus) {
+		rr := httptest.NewRecorder()
+		(&Readiness{ds: &ds}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		st := SpaceStatus{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+			t.Fatalf("invalid readyz %s: %v", rr.Body.String(), err)
+		}
+		return rr.Code, st
+	}
+	if code, st := ready(); code != http.StatusServiceUnavailable || !st.Low || st.Free != free || st.Status != "low-space" {
+		t.Errorf("unexpected readyz %d %+v", code, st)
+	}
+	html := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/"})
+	rr = httptest.NewRecorder()
+	html.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/", nil))
+	if !strings.Contains(rr.Body.String(), "the data directory has 10 MiB free, below the minimum of 20 MiB: writes are refused") {
+		t.Errorf("no warning on the index: %s", rr.Body.String())
+	}
+
+	free = 30 << 20
+	if code := post(); code != http.StatusOK {
+		t.Errorf("expected the write accepted, got %d", code)
+	}
+	if code, st := ready(); code != http.StatusOK || st.Low || st.Status != "ok" {
+		t.Errorf("unexpected readyz %d %+v", code, st)
+	}
+	rr = httptest.NewRecorder()
+	html.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/", nil))
+	if strings.Contains(rr.Body.String(), "writes are refused") {
+		t.Errorf("warning with enough space: %s", rr.Body.String())
+	}
+}
+
+func TestDiskFree(t *testing.T) {
+	free, err := diskFree(t.TempDir())
+	if err == nil && free == 0 {
+		t.Errorf("no free space reported")
+	}
+	ds := NewDatastore(filepath.Join(t.TempDir(), "missing"))
+	ds.MinFreeBytes = 1
+	// unknown free space refuses nothing
+	if err := ds.checkSpace(); err != nil {
+		t.Errorf("unexpected %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/afero"
+)
+
+// stateHeadSize is the head of the contents scanned for the header of a terraform state when written;
+// terraform writes the header fields before the outputs and resources
+const stateHeadSize = 8 << 10
+
+// stateSidecar is the name of the file holding the header of a version which is a terraform state
+func stateSidecar(version string) string {
+	return "." + version + ".state"
+}
+
+// String shows the header in listings, like "serial 147, tf 1.7.4"
+func (s TerraformState) String() string {
+	res := fmt.Sprintf("serial %d", s.Serial)
+	if s.TerraformVersion != "" {
+		res += ", tf " + s.TerraformVersion
+	}
+	return res
+}
+
+// headBuffer keeps the first max bytes written to it and discards the rest
+type headBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if rest := b.max - b.Len(); rest > 0 {
+		b.Buffer.Write(p[:min(rest, len(p))])
+	}
+	return len(p), nil
+}
+
+// scanStateHeader reads the header of a terraform state from the head of its contents without parsing the rest
+//
+// ok is false if the header is not found there, which is the case for anything but a terraform state.
+func scanStateHeader(head []byte) (res TerraformState, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(head))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return res, false
+	}
+	seen := map[string]bool{}
+	for !(seen["version"] && seen["terraform_version"] && seen["serial"] && seen["lineage"]) && dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, _ := tok.(string)
+		// a value cut by the end of the head stops the scan
+		var target any = &json.RawMessage{}
+		switch key {
+		case "version":
+			target = &res.Version
+		case "terraform_version":
+			target = &res.TerraformVersion
+		case "serial":
+			target = &res.Serial
+		case "lineage":
+			target = &res.Lineage
+		}
+		if dec.Decode(target) != nil {
+			break
+		}
+		seen[key] = true
+	}
+	ok = seen["version"] && seen["serial"] && seen["lineage"] && res.Version >= 1 && res.Lineage != ""
+	return res, ok
+}
+
+// writeStateHeader records the header of a version if its head is a terraform state
+func (d *Datastore) writeStateHeader(name string, version string, head []byte) error {
+	state, ok := scanStateHeader(head)
+	if !ok {
+		return nil
+	}
+	path, err := d.File(name, stateSidecar(version))
+	if err != nil {
+		return ErrInvalidPath
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(d.RootDir, path, content, 0o644)
+}
+
+// StateHeader returns the recorded header of a version which is a terraform state, current if empty, or nil
+func (d *Datastore) StateHeader(name string, version string) *TerraformState {
+	if version == "" {
+		version = d.currentTarget(name)
+	}
+	path, err := d.File(name, stateSidecar(version))
+	if err != nil || version == "" {
+		return nil
+	}
+	content, err := afero.ReadFile(d.RootDir, path)
+	if err != nil {
+		return nil
+	}
+	res := TerraformState{}
+	if err := json.Unmarshal(content, &res); err != nil {
+		return nil
+	}
+	return &res
+}
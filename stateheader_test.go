@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTFStateOld = `{
+    "version": 3,
+    "terraform_version": "0.11.14",
+    "serial": 5,
+    "lineage": "5f0bc6c1-46b6-9a3c-35a5-27a2d1d3e0e1",
+    "modules": [
+        {"path": ["root"], "outputs": {}, "resources": {}}
+    ]
+}
+`
+
+const testTFStateNew = `{
+  "version": 4,
+  "terraform_version": "1.7.4",
+  "serial": 147,
+  "lineage": "5f0bc6c1-46b6-9a3c-35a5-27a2d1d3e0e1",
+  "outputs": {},
+  "resources": []
+}
+`
+
+func TestScanStateHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		ok    bool
+		want  TerraformState
+	}{
+		{"v3", testTFStateOld, true, TerraformState{Version: 3, TerraformVersion: "0.11.14", Serial: 5, Lineage: "5f0bc6c1-46b6-9a3c-35a5-27a2d1d3e0e1"}},
+		{"v4", testTFStateNew, true, TerraformState{Version: 4, TerraformVersion: "1.7.4", Serial: 147, Lineage: "5f0bc6c1-46b6-9a3c-35a5-27a2d1d3e0e1"}},
+		{"other order", `{"outputs": {"a": {"value": [1]}}, "lineage": "x", "serial": 2, "version": 4}`, true, TerraformState{Version: 4, Serial: 2, Lineage: "x"}},
+		{"not terraform", `{"v": 1}`, false, TerraformState{}},
+		{"not json", "hello", false, TerraformState{}},
+		{"no lineage", `{"version": 4, "serial": 1, "resources": []}`, false, TerraformState{}},
+		// the header after the head is not looked for
+		{"cut", `{"resources": ["` + strings.Repeat("x", stateHeadSize) + `"], "version": 4, "serial": 1, "lineage": "x"}`, false, TerraformState{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			head := &headBuffer{max: stateHeadSize}
+			head.Write([]byte(test.input))
+			got, ok := scanStateHeader(head.Bytes())
+			if ok != test.ok || (ok && got != test.want) {
+				t.Errorf("unexpected %+v %v", got, ok)
+			}
+		})
+	}
+}
+
+func TestStateHeader_Listings(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+
+	ds := NewDatastore(tmp)
+	ds.Compress = true
+	for _, content := range []string{testTFStateOld, testTFStateNew} {
+		if err := ds.Write(t.Context(), "prod/app", strings.NewReader(content), []byte{}, ""); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := ds.Write(t.Context(), "other", strings.NewReader(`{"v": 1}`), []byte{}, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	hist := ds.History(t.Context(), "prod/app")
+	if len(hist) != 2 || hist[0].Terraform == nil || hist[0].Terraform.String() != "serial 147, tf 1.7.4" ||
+		hist[1].Terraform == nil || hist[1].Terraform.String() != "serial 5, tf 0.11.14" {
+		t.Fatalf("unexpected history %+v", hist)
+	}
+	if hist := ds.History(t.Context(), "other"); len(hist) != 1 || hist[0].Terraform != nil || ds.StateHeader("other", "") != nil {
+		t.Errorf("unexpected header of non-terraform contents %+v", hist)
+	}
+
+	out, err := captureStdout(func() error { return (&LsTree{Long: true}).Execute(nil) })
+	if err != nil || !strings.Contains(out, "/prod/app  serial 147, tf 1.7.4\n") || !strings.Contains(out, "/other\n") {
+		t.Errorf("unexpected ls --long %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&LsTree{JSON: true}).Execute(nil) })
+	if err != nil || !strings.Contains(out, `"Terraform":{"version":4,"terraform_version":"1.7.4","serial":147,`) {
+		t.Errorf("unexpected ls --json %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&History{}).Execute([]string{"prod/app"}) })
+	if err != nil || !strings.Contains(out, " (current)  serial 147, tf 1.7.4\n") || !strings.Contains(out, "  serial 5, tf 0.11.14\n") {
+		t.Errorf("unexpected history %q %v", out, err)
+	}
+	out, err = captureStdout(func() error { return (&History{JSON: true}).Execute([]string{"prod/app", "other"}) })
+	res := []HistoryEntry{}
+	if err != nil || json.Unmarshal([]byte(out), &res) != nil || len(res) != 3 || res[0].Terraform.Serial != 147 || res[2].Terraform != nil {
+		t.Errorf("unexpected history --json %q %v", out, err)
+	}
+
+	api := &APIHandler{ds: &ds}
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/prod/app?versions=true", nil))
+	if !strings.Contains(rr.Body.String(), `"terraform_version":"0.11.14"`) {
+		t.Errorf("unexpected versions %s", rr.Body.String())
+	}
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/"})
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/", nil))
+	if body := rr.Body.String(); !strings.Contains(body, "2 versions, serial 147, tf 1.7.4)") || strings.Contains(body, "1 versions, serial") {
+		t.Errorf("serial not on the index: %s", body)
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/view/prod/app", nil))
+	if body := rr.Body.String(); !strings.Contains(body, ", serial 147, tf 1.7.4)</a>") || !strings.Contains(body, ", serial 5, tf 0.11.14)</a>") {
+		t.Errorf("serial not on the view: %s", body)
+	}
+
+	// the sidecar goes with the version
+	if err := ds.Prune(t.Context(), "prod/app", 1, false); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "prod", "app", stateSidecar(hist[1].Name))); !os.IsNotExist(err) {
+		t.Errorf("state sidecar not removed: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/dustin/go-humanize"
+)
+
+// templateNow is the clock of the time helpers
+var templateNow = time.Now
+
+// templateFuncs returns the functions available in all templates
+func templateFuncs() template.FuncMap {
+	fmap := sprig.FuncMap()
+	fmap["mytime"] = mytime
+	fmap["mybytes"] = humanizeBytes
+	fmap["humanizeBytes"] = humanizeBytes
+	fmap["shortHash"] = shortHash
+	fmap["lockAge"] = lockAge
+	return fmap
+}
+
+// shortDuration formats a duration with its largest unit, e.g. 45s, 3m, 5h, 12d, 2y
+func shortDuration(d time.Duration) string {
+	if d < 0 {
+		d = -d
+	}
+	day := 24 * time.Hour
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", d/time.Second)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d < 2*day:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d < 365*day:
+		return fmt.Sprintf("%dd", d/day)
+	default:
+		return fmt.Sprintf("%dy", d/(365*day))
+	}
+}
+
+// relTime describes the time relative to now: "3m ago", "in 3m", "just now" or "never"
+func relTime(now time.Time, ts time.Time) string {
+	if ts.IsZero() {
+		return "never"
+	}
+	d := now.Sub(ts)
+	switch {
+	case d > -time.Second && d < time.Second:
+		return "just now"
+	case d < 0:
+		return "in " + shortDuration(d)
+	default:
+		return shortDuration(d) + " ago"
+	}
+}
+
+var timeTemplate = template.Must(template.New("time").Parse(`<abbr title="{{.Title}}" class="default">{{.Text}}</abbr>`))
+
+// mytime renders the time relative to now with the exact time as tooltip
+func mytime(ts time.Time) template.HTML {
+	title := ""
+	if !ts.IsZero() {
+		title = showTime(ts)
+	}
+	buf := &bytes.Buffer{}
+	timeTemplate.Execute(buf, map[string]string{"Title": title, "Text": relTime(templateNow(), ts)})
+	return template.HTML(buf.String())
+}
+
+// humanizeBytes formats a size in IEC units; negative sizes keep their sign
+func humanizeBytes(b int64) string {
+	if b < 0 {
+		return "-" + humanize.IBytes(uint64(-(b+1))+1)
+	}
+	return humanize.IBytes(uint64(b))
+}
+
+// shortHash shortens a digest (hex string or bytes) to 8 characters
+func shortHash(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case []byte:
+		s = hex.EncodeToString(v)
+	case string:
+		s = strings.Trim(v, `"`)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if len(s) > 8 {
+		return s[:8]
+	}
+	return s
+}
+
+// lockAge describes how long a lock taken at the time has been held
+func lockAge(since time.Time) string {
+	if since.IsZero() {
+		return "unknown"
+	}
+	d := templateNow().Sub(since)
+	if d < 0 {
+		// clock skew between servers
+		return "just now"
+	}
+	return shortDuration(d)
+}
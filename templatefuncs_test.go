@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelTime(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		ts       time.Time
+		expected string
+	}{
+		{time.Time{}, "never"},
+		{now, "just now"},
+		{now.Add(-500 * time.Millisecond), "just now"},
+		{now.Add(-45 * time.Second), "45s ago"},
+		{now.Add(3 * time.Minute), "in 3m"},
+		{now.Add(-5 * time.Hour), "5h ago"},
+		{now.Add(-47 * time.Hour), "47h ago"},
+		{now.Add(-12 * 24 * time.Hour), "12d ago"},
+		{now.Add(-3 * 365 * 24 * time.Hour), "3y ago"},
+		{now.Add(math.MaxInt64), "in 292y"},
+	}
+	for _, test := range tests {
+		if got := relTime(now, test.ts); got != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.ts, test.expected, got)
+		}
+	}
+}
+
+func TestMytime(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	defer func(orig func() time.Time) { templateNow = orig }(templateNow)
+	templateNow = func() time.Time { return now }
+	got := string(mytime(now.Add(-time.Minute)))
+	if got != `<abbr title="2025-01-02T03:03:05Z" class="default">1m ago</abbr>` {
+		t.Errorf("unexpected: %s", got)
+	}
+	if got := string(mytime(now.Add(90 * time.Second))); !strings.Contains(got, ">in 1m<") {
+		t.Errorf("unexpected future time: %s", got)
+	}
+	if got := string(mytime(time.Time{})); got != `<abbr title="" class="default">never</abbr>` {
+		t.Errorf("unexpected: %s", got)
+	}
+}
+
+func TestHumanizeBytes(t *testing.T) {
+	tests := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{-2048, "-2.0 KiB"},
+		{math.MaxInt64, "8.0 EiB"},
+		{math.MinInt64, "-8.0 EiB"},
+	}
+	for _, test := range tests {
+		if got := humanizeBytes(test.size); got != test.expected {
+			t.Errorf("%d: expected %q, got %q", test.size, test.expected, got)
+		}
+	}
+}
+
+func TestShortHash(t *testing.T) {
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{"0123456789abcdef", "01234567"},
+		{`"0123456789abcdef"`, "01234567"},
+		{"abc", "abc"},
+		{"", ""},
+		{[]byte{0xde, 0xad, 0xbe, 0xef, 0x01}, "deadbeef"},
+		{12345678901, "12345678"},
+	}
+	for _, test := range tests {
+		if got := shortHash(test.input); got != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.input, test.expected, got)
+		}
+	}
+}
+
+func TestLockAge(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	defer func(orig func() time.Time) { templateNow = orig }(templateNow)
+	templateNow = func() time.Time { return now }
+	tests := []struct {
+		since    time.Time
+		expected string
+	}{
+		{time.Time{}, "unknown"},
+		{now.Add(time.Minute), "just now"},
+		{now.Add(-90 * time.Minute), "1h"},
+		{now.Add(-400 * 24 * time.Hour), "1y"},
+	}
+	for _, test := range tests {
+		if got := lockAge(test.since); got != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.since, test.expected, got)
+		}
+	}
+}
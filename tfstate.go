@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// TerraformState is the header of a terraform state file
+type TerraformState struct {
+	Version          int    `json:"version"`
+	TerraformVersion string `json:"terraform_version"`
+	Serial           int64  `json:"serial"`
+	Lineage          string `json:"lineage"`
+}
+
+// ParseTerraformState checks that the data is a terraform state and returns its header
+func ParseTerraformState(data []byte) (TerraformState, error) {
+	res := TerraformState{}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		slog.Error("json parse error", "error", err)
+		return res, ErrInvalidState
+	}
+	for _, k := range []string{"version", "serial", "lineage"} {
+		if _, ok := fields[k]; !ok {
+			slog.Error("missing field", "field", k)
+			return res, ErrInvalidState
+		}
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		slog.Error("invalid field", "error", err)
+		return res, ErrInvalidState
+	}
+	if res.Version < 1 || res.Lineage == "" {
+		slog.Error("invalid state", "version", res.Version, "lineage", res.Lineage)
+		return res, ErrInvalidState
+	}
+	return res, nil
+}
+
+// redactedOutput replaces the values of sensitive outputs
+const redactedOutput = `"<sensitive>"`
+
+// StateOutputs returns the values of the outputs of a terraform state by name
+//
+// the values of sensitive outputs are replaced by "<sensitive>" unless showSensitive is set.
+func StateOutputs(data []byte, showSensitive bool) (map[string]json.RawMessage, error) {
+	if _, err := ParseTerraformState(data); err != nil {
+		return nil, err
+	}
+	state := struct {
+		Outputs map[string]struct {
+			Value     json.RawMessage `json:"value"`
+			Sensitive bool            `json:"sensitive"`
+		} `json:"outputs"`
+	}{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		slog.Error("invalid outputs", "error", err)
+		return nil, ErrInvalidState
+	}
+	res := map[string]json.RawMessage{}
+	for name, output := range state.Outputs {
+		if output.Sensitive && !showSensitive {
+			res[name] = json.RawMessage(redactedOutput)
+		} else {
+			res[name] = output.Value
+		}
+	}
+	return res, nil
+}
+
+// NewLineage generates a random lineage in the same format as terraform (UUID v4)
+func NewLineage() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// SetLineage rewrites the lineage of a terraform state, keeping numbers as they are
+func SetLineage(data []byte, lineage string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	state := map[string]interface{}{}
+	if err := dec.Decode(&state); err != nil {
+		return nil, ErrInvalidState
+	}
+	state["lineage"] = lineage
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
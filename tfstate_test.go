@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testTFState = `{
+  "version": 4,
+  "terraform_version": "1.5.7",
+  "serial": 12345678901234567,
+  "lineage": "27074632-8326-ecfb-b44c-84addb04459f",
+  "outputs": {},
+  "resources": []
+}
+`
+
+func TestParseTerraformState(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   error
+	}{
+		{"valid", testTFState, nil},
+		{"not json", "hello", ErrInvalidState},
+		{"not object", "[1]", ErrInvalidState},
+		{"no lineage", `{"version": 4, "serial": 1}`, ErrInvalidState},
+		{"empty lineage", `{"version": 4, "serial": 1, "lineage": ""}`, ErrInvalidState},
+		{"string serial", `{"version": 4, "serial": "1", "lineage": "x"}`, ErrInvalidState},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseTerraformState([]byte(test.input))
+			if err != test.err {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+	state, _ := ParseTerraformState([]byte(testTFState))
+	if state.Serial != 12345678901234567 || state.Lineage != "27074632-8326-ecfb-b44c-84addb04459f" || state.TerraformVersion != "1.5.7" {
+		t.Errorf("unexpected state: %+v", state)
+	}
+}
+
+func TestSetLineage(t *testing.T) {
+	lineage := NewLineage()
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(lineage) {
+		t.Errorf("invalid lineage: %s", lineage)
+	}
+	if lineage == NewLineage() {
+		t.Errorf("lineage should be random")
+	}
+	out, err := SetLineage([]byte(testTFState), lineage)
+	if err != nil {
+		t.Fatalf("SetLineage failed: %v", err)
+	}
+	state, err := ParseTerraformState(out)
+	if err != nil || state.Lineage != lineage {
+		t.Errorf("lineage not rewritten: %+v %v", state, err)
+	}
+	// large serials must not be rounded through float64
+	if !strings.Contains(string(out), "12345678901234567") {
+		t.Errorf("serial changed: %s", out)
+	}
+}
+
+const testOutputsState = `{
+  "version": 4,
+  "serial": 3,
+  "lineage": "27074632-8326-ecfb-b44c-84addb04459f",
+  "outputs": {
+    "vpc_id": {"value": "vpc-123", "type": "string"},
+    "subnets": {"value": ["a", "b"], "type": ["list", "string"]},
+    "db_password": {"value": "hunter2", "type": "string", "sensitive": true}
+  },
+  "resources": []
+}`
+
+func TestStateOutputs(t *testing.T) {
+	outputs, err := StateOutputs([]byte(testOutputsState), false)
+	if err != nil {
+		t.Fatalf("StateOutputs failed: %v", err)
+	}
+	expected := map[string]string{"vpc_id": `"vpc-123"`, "subnets": `["a", "b"]`, "db_password": `"<sensitive>"`}
+	if len(outputs) != len(expected) {
+		t.Errorf("unexpected outputs %s", outputs)
+	}
+	for k, v := range expected {
+		if string(outputs[k]) != v {
+			t.Errorf("%s: expected %s, got %s", k, v, outputs[k])
+		}
+	}
+	if outputs, _ := StateOutputs([]byte(testOutputsState), true); string(outputs["db_password"]) != `"hunter2"` {
+		t.Errorf("sensitive value not shown: %s", outputs["db_password"])
+	}
+	for _, data := range []string{`{"outputs":{}}`, `[1]`, `not json`} {
+		if _, err := StateOutputs([]byte(data), false); err != ErrInvalidState {
+			t.Errorf("%s: expected ErrInvalidState, got %v", data, err)
+		}
+	}
+}
+
+func TestAPIGet_Outputs(t *testing.T) {
+	ds := newMemDS()
+	ds.put("prod", testOutputsState)
+	ds.put("plain", `{"a":1}`)
+	h := &APIHandler{ds: ds}
+	get := func(path string, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := get("/prod?outputs=1", "")
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"db_password":"<sensitive>","subnets":["a","b"],"vpc_id":"vpc-123"}` {
+		t.Errorf("unexpected outputs: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/plain?outputs=1", ""); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("not a state: expected 422, got %d", rr.Code)
+	}
+	if rr := get("/missing?outputs=1", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("missing: expected 404, got %d", rr.Code)
+	}
+
+	aclfile := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(aclfile, []byte("admin * rwl\nalice * r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := NewACL(h, aclfile)
+	if err != nil {
+		t.Fatalf("NewACL failed: %v", err)
+	}
+	h.acl = acl
+	if rr := get("/prod?outputs=1&show-sensitive=1", "alice"); rr.Code != http.StatusForbidden || strings.Contains(rr.Body.String(), "hunter2") {
+		t.Errorf("sensitive outputs shown to a reader: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/prod?outputs=1&show-sensitive=1", "admin"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"db_password":"hunter2"`) {
+		t.Errorf("sensitive outputs not shown to an admin: %d %s", rr.Code, rr.Body.String())
+	}
+}
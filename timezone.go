@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+	// the zones of --timezone also in containers without a tz database
+	_ "time/tzdata"
+)
+
+// displayZone is the zone of the times shown to users, set by --timezone; times are kept in UTC otherwise
+var displayZone = time.Local
+
+// localLayout is the humanized form of the times in the display zone
+const localLayout = "2006-01-02 15:04:05 MST"
+
+// setTimezone sets the display zone to a zone of the tz database such as Asia/Tokyo or UTC,
+// the local zone if empty or "Local"
+func setTimezone(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	displayZone = loc
+	return nil
+}
+
+// showTime formats the time in RFC 3339 in the display zone
+func showTime(ts time.Time) string {
+	return ts.In(displayZone).Format(time.RFC3339)
+}
+
+// localTime formats the time in the humanized form in the display zone, empty for the zero time
+func localTime(ts time.Time) string {
+	if ts.IsZero() {
+		return ""
+	}
+	return ts.In(displayZone).Format(localLayout)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTimezone sets the display zone for the test
+func useTimezone(t *testing.T, name string) {
+	t.Helper()
+	orig := displayZone
+	t.Cleanup(func() { displayZone = orig })
+	if err := setTimezone(name); err != nil {
+		t.Fatalf("setTimezone(%s): %v", name, err)
+	}
+}
+
+func TestSetTimezone(t *testing.T) {
+	useTimezone(t, "")
+	if displayZone != time.UTC && displayZone.String() != time.Local.String() {
+		t.Errorf("empty is not the local zone: %s", displayZone)
+	}
+	if err := setTimezone("Nowhere/City"); err == nil {
+		t.Errorf("unknown zone accepted")
+	}
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	useTimezone(t, "Asia/Tokyo")
+	if got := showTime(ts); got != "2024-06-01T21:00:00+09:00" {
+		t.Errorf("showTime: %s", got)
+	}
+	if got := localTime(ts); got != "2024-06-01 21:00:00 JST" {
+		t.Errorf("localTime: %s", got)
+	}
+	if got := localTime(time.Time{}); got != "" {
+		t.Errorf("zero time: %q", got)
+	}
+	if got := string(mytime(ts)); !strings.Contains(got, `title="2024-06-01T21:00:00&#43;09:00"`) {
+		t.Errorf("mytime: %s", got)
+	}
+}
+
+func TestHistory_ExecuteTimezone(t *testing.T) {
+	tmp := t.TempDir()
+	origDatadir := option.Datadir
+	option.Datadir = tmp
+	defer func() { option.Datadir = origDatadir }()
+	ds := NewDatastore(tmp)
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.FixedZone("PDT", -7*3600))
+	versions := writeAt(t, &ds, "app", ts)
+
+	tests := []struct {
+		zone string
+		cmd  *History
+		out  string
+	}{
+		{"UTC", &History{}, "app\n2024-06-01T19:00:00Z      7 " + versions[0] + " (current)\n"},
+		{"Asia/Tokyo", &History{}, "app\n2024-06-02T04:00:00+09:00      7 " + versions[0] + " (current)\n"},
+		{"Asia/Tokyo", &History{JSON: true}, `[{"state":"app","version":"` + versions[0] + `","timestamp":"2024-06-01T19:00:00Z","size":7,"current":true,"timestamp_local":"2024-06-02 04:00:00 JST"}]` + "\n"},
+	}
+	for _, test := range tests {
+		useTimezone(t, test.zone)
+		out, err := captureStdout(func() error { return test.cmd.Execute([]string{"app"}) })
+		if err != nil {
+			t.Fatalf("%s: %v", test.zone, err)
+		}
+		if out != test.out {
+			t.Errorf("%s json=%v: expected\n%s\ngot\n%s", test.zone, test.cmd.JSON, test.out, out)
+		}
+	}
+}
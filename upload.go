@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// uploadDir keeps the uploads in progress, by id
+const uploadDir = ".uploads"
+
+// defaultUploadExpire is the age after which an upload with no new chunk is removed by Maintain
+const defaultUploadExpire = 24 * time.Hour
+
+// Upload is a resumable upload of a new version, whose chunks are appended to a sidecar of the file
+type Upload struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Offset  int64     `json:"offset"`
+	Created time.Time `json:"created"`
+}
+
+// Uploads is implemented by the datastores which accept resumable uploads
+type Uploads interface {
+	UploadStart(name string) (Upload, error)
+	UploadStatus(id string) (Upload, error)
+	UploadAppend(id string, start int64, input io.Reader, size int64) (Upload, error)
+	UploadCommit(ctx context.Context, name string, id string, hash []byte, lockid string) error
+	UploadAbort(id string) error
+}
+
+// uploadFile is the sidecar holding the chunks of the upload
+func uploadFile(id string) string {
+	return ".upload-" + id
+}
+
+// validUploadID checks that the id was made by UploadStart
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// uploadRead reads the upload and the path of its data
+func (d *Datastore) uploadRead(id string) (Upload, string, error) {
+	res := Upload{}
+	if !validUploadID(id) {
+		return res, "", ErrNotFound
+	}
+	content, err := afero.ReadFile(d.RootDir, filepath.Join(uploadDir, id))
+	if err != nil {
+		return res, "", ErrNotFound
+	}
+	if err := json.Unmarshal(content, &res); err != nil {
+		slog.Error("invalid upload", "id", id, "error", err)
+		return res, "", err
+	}
+	path, err := d.File(res.Name, uploadFile(id))
+	if err != nil {
+		return res, "", ErrInvalidPath
+	}
+	st, err := d.RootDir.Stat(path)
+	if err != nil {
+		return res, "", ErrNotFound
+	}
+	res.Offset = st.Size()
+	return res, path, nil
+}
+
+// UploadStart begins an upload of a new version of the file
+func (d *Datastore) UploadStart(name string) (Upload, error) {
+	res := Upload{Name: name, Created: time.Now().UTC()}
+	if _, err := d.File(name, "current"); err != nil {
+		return res, ErrInvalidPath
+	}
+	if err := d.checkProtected(name); err != nil {
+		return res, err
+	}
+	if err := d.checkNamespace(name); err != nil {
+		return res, err
+	}
+	if err := d.checkPathConflict(name); err != nil {
+		return res, err
+	}
+	if err := d.checkSpace(); err != nil {
+		return res, err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	res.ID = hex.EncodeToString(id)
+	path, err := d.File(name, uploadFile(res.ID))
+	if err != nil {
+		return res, ErrInvalidPath
+	}
+	if err := d.writeFile(path, strings.NewReader("")); err != nil {
+		return res, noSpace(err)
+	}
+	content, err := json.Marshal(res)
+	if err != nil {
+		return res, err
+	}
+	if err := d.writeFile(filepath.Join(uploadDir, res.ID), strings.NewReader(string(content))); err != nil {
+		d.RootDir.Remove(path)
+		return res, noSpace(err)
+	}
+	slog.Info("upload started", "name", name, "id", res.ID)
+	return res, nil
+}
+
+// UploadStatus returns the upload with the number of bytes received so far
+func (d *Datastore) UploadStatus(id string) (Upload, error) {
+	res, _, err := d.uploadRead(id)
+	return res, err
+}
+
+// UploadAppend appends a chunk of size bytes, which must start where the data received so far ends
+//
+// it returns ErrRange for a chunk at another offset; a chunk which fails midway is discarded.
+func (d *Datastore) UploadAppend(id string, start int64, input io.Reader, size int64) (Upload, error) {
+	release, err := d.guard(filepath.Join(uploadDir, id))
+	if err != nil {
+		return Upload{}, err
+	}
+	defer release()
+	res, path, err := d.uploadRead(id)
+	if err != nil {
+		return res, err
+	}
+	if start != res.Offset {
+		slog.Warn("upload out of order", "id", id, "start", start, "offset", res.Offset)
+		return res, ErrRange
+	}
+	if limit := d.MaxSizeOf(res.Name); limit > 0 && start+size > limit {
+		return res, ErrTooLarge
+	}
+	if err := d.checkSpace(); err != nil {
+		return res, err
+	}
+	fp, err := d.RootDir.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return res, err
+	}
+	written, err := io.Copy(fp, io.LimitReader(input, size+1))
+	if err == nil && written != size {
+		slog.Error("chunk size mismatch", "id", id, "expected", size, "received", written)
+		err = ErrInvalidPath
+	}
+	if err == nil && d.Fsync {
+		err = fp.Sync()
+	}
+	if err != nil {
+		if err1 := fp.Truncate(start); err1 != nil {
+			slog.Error("cannot discard the chunk", "id", id, "error", err1)
+		}
+	}
+	if err1 := fp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return res, noSpace(err)
+	}
+	res.Offset += written
+	return res, nil
+}
+
+// UploadCommit verifies the digest of the upload and stores it as a new version of the file like Write
+func (d *Datastore) UploadCommit(ctx context.Context, name string, id string, hash []byte, lockid string) error {
+	if len(hash) == 0 {
+		slog.Error("commit without digest", "name", name, "id", id)
+		return ErrInvalidHash
+	}
+	release, err := d.guard(filepath.Join(uploadDir, id))
+	if err != nil {
+		return err
+	}
+	defer release()
+	upload, path, err := d.uploadRead(id)
+	if err != nil {
+		return err
+	}
+	if upload.Name != name {
+		slog.Error("upload of another file", "name", name, "id", id, "upload", upload.Name)
+		return ErrNotFound
+	}
+	fp, err := d.RootDir.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Write(ctx, name, fp, hash, lockid)
+	fp.Close()
+	if err != nil {
+		return err
+	}
+	slog.Info("upload committed", "name", name, "id", id, "size", upload.Offset)
+	return d.uploadRemove(upload)
+}
+
+// UploadAbort removes the upload and its data
+func (d *Datastore) UploadAbort(id string) error {
+	release, err := d.guard(filepath.Join(uploadDir, id))
+	if err != nil {
+		return err
+	}
+	defer release()
+	upload, _, err := d.uploadRead(id)
+	if err != nil {
+		return err
+	}
+	return d.uploadRemove(upload)
+}
+
+func (d *Datastore) uploadRemove(upload Upload) error {
+	if path, err := d.File(upload.Name, uploadFile(upload.ID)); err == nil {
+		if err := d.RootDir.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := d.RootDir.Remove(filepath.Join(uploadDir, upload.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ExpireUploads removes the uploads which received no chunk for longer than maxAge
+func (d *Datastore) ExpireUploads(maxAge time.Duration) (int, error) {
+	ents, err := afero.ReadDir(d.RootDir, uploadDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, ent := range ents {
+		id := ent.Name()
+		release, ok := d.tryGuard(filepath.Join(uploadDir, id))
+		if !ok {
+			continue
+		}
+		upload, path, err := d.uploadRead(id)
+		last := ent.ModTime()
+		if err == nil {
+			if st, err := d.RootDir.Stat(path); err == nil {
+				last = st.ModTime()
+			}
+		} else {
+			// the data is gone, remove the record
+			upload = Upload{ID: id}
+		}
+		if time.Since(last) > maxAge {
+			if err := d.uploadRemove(upload); err != nil {
+				slog.Error("cannot remove upload", "id", id, "error", err)
+			} else {
+				slog.Info("upload expired", "name", upload.Name, "id", id, "received", upload.Offset)
+				expired++
+			}
+		}
+		release()
+	}
+	return expired, nil
+}
+
+// parseContentRange parses "bytes <start>-<end>/<total or *>" into the start and the size of the chunk
+func parseContentRange(s string) (int64, int64, error) {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%s", &start, &end, &total); err != nil || start < 0 || end < start {
+		slog.Error("invalid content-range", "content-range", s, "error", err)
+		return 0, 0, ErrInvalidPath
+	}
+	return start, end - start + 1, nil
+}
+
+// APIUploadPost starts an upload with ?upload=start, or stores it with ?upload=commit&id=<id> and the Content-Md5 of the whole
+func (h *APIHandler) APIUploadPost(path string, step string, w io.Writer, r *http.Request) error {
+	uploads, ok := h.ds.(Uploads)
+	if !ok {
+		return ErrNotFound
+	}
+	switch step {
+	case "start":
+		upload, err := uploads.UploadStart(path)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(upload)
+	case "commit":
+		hash, err := base64.StdEncoding.DecodeString(r.Header.Get("Content-Md5"))
+		if err != nil {
+			return ErrInvalidHash
+		}
+		return uploads.UploadCommit(r.Context(), path, r.URL.Query().Get("id"), hash, r.URL.Query().Get("ID"))
+	}
+	slog.Error("unknown upload step", "upload", step)
+	return ErrInvalidPath
+}
+
+// APIUpload serves +uploads/<id>: PUT appends the chunk of the Content-Range, GET returns the offset to resume from
+// and DELETE aborts the upload
+func (h *APIHandler) APIUpload(id string, w io.Writer, r *http.Request) error {
+	uploads, ok := h.ds.(Uploads)
+	if !ok {
+		return ErrNotFound
+	}
+	var upload Upload
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		upload, err = uploads.UploadStatus(id)
+	case http.MethodPut:
+		start, size, err1 := parseContentRange(r.Header.Get("Content-Range"))
+		if err1 != nil {
+			return err1
+		}
+		upload, err = uploads.UploadAppend(id, start, r.Body, size)
+	case http.MethodDelete:
+		return uploads.UploadAbort(id)
+	default:
+		return ErrInvalidPath
+	}
+	if err != nil && err != ErrRange {
+		return err
+	}
+	// the offset to continue from, also for a chunk out of order
+	if err1 := json.NewEncoder(w).Encode(upload); err1 != nil {
+		return err1
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value string
+		start int64
+		size  int64
+		ok    bool
+	}{
+		{"bytes 0-9/100", 0, 10, true},
+		{"bytes 10-19/*", 10, 10, true},
+		{"bytes 10-9/*", 0, 0, false},
+		{"items 0-9/10", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, size, err := parseContentRange(test.value)
+		if (err == nil) != test.ok || start != test.start || size != test.size {
+			t.Errorf("%q: got %d %d %v", test.value, start, size, err)
+		}
+	}
+}
+
+func TestAPIUpload(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	broker := NewEventBroker()
+	h := &APIHandler{ds: &ds, events: broker}
+	content := `{"resources":["` + strings.Repeat("x", 100) + `"]}`
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/big?upload=start", nil))
+	upload := Upload{}
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &upload) != nil || upload.Name != "big" {
+		t.Fatalf("start failed: %d %s", rr.Code, rr.Body.String())
+	}
+	put := func(start int, end int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/+uploads/"+upload.ID, strings.NewReader(content[start:end]))
+		req.Header.Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(end-1)+"/*")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := put(0, 50); rr.Code != http.StatusOK {
+		t.Fatalf("first chunk failed: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = put(60, len(content))
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("chunk out of order: %d", rr.Code)
+	}
+	if json.Unmarshal(rr.Body.Bytes(), &upload) != nil || upload.Offset != 50 {
+		t.Errorf("offset to resume from not returned: %s", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/+uploads/"+upload.ID, nil))
+	if json.Unmarshal(rr.Body.Bytes(), &upload) != nil || upload.Offset != 50 {
+		t.Errorf("unexpected status: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := put(50, len(content)); rr.Code != http.StatusOK {
+		t.Fatalf("second chunk failed: %d %s", rr.Code, rr.Body.String())
+	}
+	commit := func(content string) int {
+		hash := md5.Sum([]byte(content))
+		req := httptest.NewRequest(http.MethodPost, "/big?upload=commit&id="+upload.ID, nil)
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(hash[:]))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := commit("other"); code != http.StatusBadRequest {
+		t.Errorf("commit with another digest: %d", code)
+	}
+	if evs := broker.Recent(0); len(evs) != 0 {
+		t.Errorf("event before the commit: %+v", evs)
+	}
+	if code := commit(content); code != http.StatusOK {
+		t.Fatalf("commit failed: %d", code)
+	}
+	if evs := broker.Recent(0); len(evs) != 1 || evs[0].Type != "write" || evs[0].Name != "big" || evs[0].Version != ds.CurrentVersion("big") {
+		t.Errorf("unexpected events of the upload: %+v", evs)
+	}
+	if got, err := readString(t, ds, "big"); err != nil || got != content {
+		t.Errorf("unexpected contents %q %v", got, err)
+	}
+	if _, err := ds.UploadStatus(upload.ID); err != ErrNotFound {
+		t.Errorf("upload not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(ds.RootName, "big", uploadFile(upload.ID))); !os.IsNotExist(err) {
+		t.Errorf("upload data not removed: %v", err)
+	}
+	if code := commit(content); code != http.StatusNotFound {
+		t.Errorf("commit twice: %d", code)
+	}
+}
+
+func TestDatastore_ExpireUploads(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	old, err := ds.UploadStart("old")
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	recent, err := ds.UploadStart("recent")
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if _, err := ds.UploadAppend(old.ID, 0, strings.NewReader("{}"), 2); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(ds.RootName, "old", uploadFile(old.ID)), past, past); err != nil {
+		t.Fatal(err)
+	}
+	res := ds.Maintain(t.Context(), 0, 0)
+	if res.UploadsExpired != 1 {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if _, err := ds.UploadStatus(old.ID); err != ErrNotFound {
+		t.Errorf("old upload not removed: %v", err)
+	}
+	if _, err := ds.UploadStatus(recent.ID); err != nil {
+		t.Errorf("recent upload removed: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultUpstreamTimeout is the time a fetch from the upstream may take unless another is set
+const defaultUpstreamTimeout = 10 * time.Second
+
+// upstreamHeader marks the requests of the proxy; a request with it is never proxied again,
+// so that two servers reading through each other do not loop
+const upstreamHeader = "X-Statesaver-Proxied"
+
+// maxUpstreamSize limits the contents read from the upstream for files without a size limit
+const maxUpstreamSize = 64 << 20
+
+// SizeLimiter is implemented by the datastores which limit the size of the versions of files
+type SizeLimiter interface {
+	MaxSizeOf(name string) int64
+}
+
+// Upstream is the HTTP backend which GETs of files missing here are read from, e.g. while migrating from it
+type Upstream struct {
+	base *url.URL
+	// Cache stores the fetched contents as the first version of the file here
+	Cache  bool
+	client *http.Client
+}
+
+// NewUpstream creates an Upstream of the base URL, the files being under it
+func NewUpstream(base string, cache bool, timeout time.Duration) (*Upstream, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream url %q", base)
+	}
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	return &Upstream{base: u, Cache: cache, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// Fetch reads the contents of the file from the upstream; ErrNotFound if the upstream does not have it,
+// ErrTooLarge if they are larger than limit bytes
+func (u *Upstream) Fetch(r *http.Request, path string, w io.Writer, limit int64) error {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.base.JoinPath(path).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(upstreamHeader, "1")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		slog.Error("upstream read failed", "upstream", u.base.Redacted(), "path", path, "error", err)
+		return fmt.Errorf("%w: %w", ErrUpstream, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		slog.Error("upstream read failed", "upstream", u.base.Redacted(), "path", path, "status", resp.Status)
+		return fmt.Errorf("%w: %s", ErrUpstream, resp.Status)
+	}
+	n, err := io.Copy(w, io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUpstream, err)
+	}
+	if n > limit {
+		slog.Error("upstream contents too large", "upstream", u.base.Redacted(), "path", path, "limit", limit)
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// readUpstream serves a GET of a file missing here from the upstream, storing it here with Cache
+//
+// it returns the version stored, empty if not stored.
+func (h *APIHandler) readUpstream(path string, w io.Writer, r *http.Request) (string, error) {
+	if r.Header.Get(upstreamHeader) != "" {
+		// already proxied by another server
+		return "", ErrNotFound
+	}
+	var limit int64 = maxUpstreamSize
+	if sl, ok := h.ds.(SizeLimiter); ok && sl.MaxSizeOf(path) > 0 {
+		limit = sl.MaxSizeOf(path)
+	}
+	buf := &bytes.Buffer{}
+	if err := h.upstream.Fetch(r, path, buf, limit); err != nil {
+		return "", err
+	}
+	slog.Info("read from upstream", "path", path, "size", buf.Len(), "cache", h.upstream.Cache)
+	if h.upstream.Cache {
+		sum := md5.Sum(buf.Bytes())
+		if err := h.ds.Write(r.Context(), path, bytes.NewReader(buf.Bytes()), sum[:], ""); err != nil {
+			slog.Warn("upstream contents not stored", "path", path, "error", err)
+		}
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return h.ds.CurrentVersion(path), nil
+}
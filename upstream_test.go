@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUpstream serves states from a map, counting the requests
+type fakeUpstream struct {
+	mu       sync.Mutex
+	states   map[string]string
+	requests []string
+	proxied  bool
+	status   int
+	delay    time.Duration
+}
+
+func (u *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.requests = append(u.requests, r.Method+" "+r.URL.Path)
+	u.proxied = r.Header.Get(upstreamHeader) != ""
+	body, ok := u.states[r.URL.Path]
+	status := u.status
+	u.mu.Unlock()
+	time.Sleep(u.delay)
+	switch {
+	case status != 0:
+		w.WriteHeader(status)
+	case !ok:
+		http.NotFound(w, r)
+	default:
+		w.Write([]byte(body))
+	}
+}
+
+func (u *fakeUpstream) count() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.requests)
+}
+
+func upstreamHandler(t *testing.T, up *fakeUpstream, cache bool, timeout time.Duration) (*APIHandler, *Datastore) {
+	t.Helper()
+	srv := httptest.NewServer(up)
+	t.Cleanup(srv.Close)
+	upstream, err := NewUpstream(srv.URL+"/old/", cache, timeout)
+	if err != nil {
+		t.Fatalf("NewUpstream failed: %v", err)
+	}
+	ds := NewDatastore(t.TempDir())
+	return &APIHandler{ds: &ds, upstream: upstream}, &ds
+}
+
+func serve(h http.Handler, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestUpstream_Cache(t *testing.T) {
+	up := &fakeUpstream{states: map[string]string{"/old/prod/app": `{"serial":3}`}}
+	h, ds := upstreamHandler(t, up, true, 0)
+
+	rr := serve(h, http.MethodGet, "/prod/app", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"serial":3}` || rr.Header().Get("X-Statesaver-Source") != "upstream" {
+		t.Fatalf("unexpected response %d %s %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+	if version := ds.CurrentVersion("prod/app"); version == "" || rr.Header().Get("Etag") != `"`+version+`"` {
+		t.Errorf("not stored: %q %v", version, rr.Header())
+	}
+	if !up.proxied {
+		t.Errorf("request of the proxy not marked")
+	}
+	// stored here, so served without the upstream
+	rr = serve(h, http.MethodGet, "/prod/app", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"serial":3}` || rr.Header().Get("X-Statesaver-Source") != "" || up.count() != 1 {
+		t.Errorf("not served locally: %d %s %v %v", rr.Code, rr.Body.String(), rr.Header(), up.requests)
+	}
+	// writes and locks stay here
+	if rr := serve(h, http.MethodPost, "/prod/app", `{"serial":4}`); rr.Code != http.StatusOK {
+		t.Errorf("write failed: %d", rr.Code)
+	}
+	if rr := serve(h, "LOCK", "/prod/other", `{"ID":"x"}`); rr.Code != http.StatusOK {
+		t.Errorf("lock failed: %d", rr.Code)
+	}
+	if len(ds.History(t.Context(), "prod/app")) != 2 || up.count() != 1 {
+		t.Errorf("unexpected history or upstream requests: %v", up.requests)
+	}
+}
+
+func TestUpstream_NoCache(t *testing.T) {
+	up := &fakeUpstream{states: map[string]string{"/old/a": `{}`}}
+	h, ds := upstreamHandler(t, up, false, 0)
+	for range 2 {
+		if rr := serve(h, http.MethodGet, "/a", ""); rr.Code != http.StatusOK || rr.Body.String() != `{}` || rr.Header().Get("Etag") != "" {
+			t.Errorf("unexpected response %d %s %v", rr.Code, rr.Body.String(), rr.Header())
+		}
+	}
+	if up.count() != 2 || ds.CurrentVersion("a") != "" {
+		t.Errorf("expected every read from the upstream and nothing stored: %v", up.requests)
+	}
+	// only the current contents are read through
+	if rr := serve(h, http.MethodGet, "/a?history=x", ""); rr.Code != http.StatusNotFound || up.count() != 2 {
+		t.Errorf("history read through: %d %v", rr.Code, up.requests)
+	}
+}
+
+func TestUpstream_Errors(t *testing.T) {
+	up := &fakeUpstream{states: map[string]string{"/old/a": `{}`}}
+	h, ds := upstreamHandler(t, up, true, 100*time.Millisecond)
+	if rr := serve(h, http.MethodGet, "/missing", ""); rr.Code != http.StatusNotFound || up.count() != 1 {
+		t.Errorf("expected 404 of the upstream: %d %v", rr.Code, up.requests)
+	}
+	// loop protection: a request of another proxy is not proxied again
+	if rr := serve(h, http.MethodGet, "/a", "", upstreamHeader, "1"); rr.Code != http.StatusNotFound || up.count() != 1 {
+		t.Errorf("proxied request read through: %d %v", rr.Code, up.requests)
+	}
+	up.status = http.StatusInternalServerError
+	if rr := serve(h, http.MethodGet, "/a", ""); rr.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", rr.Code)
+	}
+	up.status, up.delay = 0, time.Second
+	if rr := serve(h, http.MethodGet, "/a", ""); rr.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 on timeout, got %d", rr.Code)
+	}
+	if ds.CurrentVersion("a") != "" {
+		t.Errorf("failed read stored")
+	}
+
+	for _, base := range []string{"", "old-backend", "ftp://host/"} {
+		if _, err := NewUpstream(base, false, 0); err == nil {
+			t.Errorf("%q: expected an error", base)
+		}
+	}
+}
+
+func TestUpstream_TooLarge(t *testing.T) {
+	up := &fakeUpstream{states: map[string]string{"/old/big": `{"v":"` + strings.Repeat("x", 100) + `"}`, "/old/small": `{}`}}
+	h, ds := upstreamHandler(t, up, true, 0)
+	ds.MaxSize = 50
+	if rr := serve(h, http.MethodGet, "/big", ""); rr.Code != http.StatusRequestEntityTooLarge || rr.Body.Len() != 0 {
+		t.Errorf("expected 413 without the contents, got %d %q", rr.Code, rr.Body.String())
+	}
+	if ds.CurrentVersion("big") != "" {
+		t.Errorf("too large contents stored")
+	}
+	if rr := serve(h, http.MethodGet, "/small", ""); rr.Code != http.StatusOK || rr.Body.String() != `{}` {
+		t.Errorf("unexpected read of a small state: %d %q", rr.Code, rr.Body.String())
+	}
+}
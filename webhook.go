@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// defaultWebhookBatchSize is the largest batch of a webhook unless another is set
+const defaultWebhookBatchSize = 100
+
+// webhookQueue is the number of batches waiting for delivery, after which new batches are dropped
+const webhookQueue = 100
+
+// webhookTimeout is the time a delivery may take
+const webhookTimeout = 10 * time.Second
+
+// WebhookStats counts the events and the deliveries of a webhook
+type WebhookStats struct {
+	URL      string `json:"url"`
+	Batching bool   `json:"batching"`
+	// Events is the number of events received, Coalesced and Dropped the ones which were not delivered
+	Events    int64 `json:"events"`
+	Coalesced int64 `json:"coalesced"`
+	Dropped   int64 `json:"dropped"`
+	// Requests is the number of deliveries, Failed the ones which did not get a 2xx, Delivered the events of the others
+	Requests     int64     `json:"requests"`
+	Failed       int64     `json:"failed"`
+	Delivered    int64     `json:"delivered"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastDelivery time.Time `json:"last_delivery,omitzero"`
+}
+
+// Webhook POSTs the events of a broker to a URL, one JSON object per event, or with a flush interval,
+// batches of events as a JSON array
+//
+// a batch is delivered when the flush interval has passed since its first event or when it has the batch size;
+// within a batch only the latest write of a state is kept. Batches are delivered one at a time in order,
+// so the events of a state arrive in the order they happened.
+type Webhook struct {
+	url           string
+	flushInterval time.Duration
+	batchSize     int
+	client        *http.Client
+	broker        *EventBroker
+	events        chan Event
+	batches       chan []Event
+	done          chan struct{}
+	mu            sync.Mutex
+	stats         WebhookStats
+}
+
+// NewWebhook creates a Webhook delivering to the URL, in batches if flushInterval is positive
+func NewWebhook(target string, flushInterval time.Duration, batchSize int) (*Webhook, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q", target)
+	}
+	if batchSize <= 0 {
+		batchSize = defaultWebhookBatchSize
+	}
+	return &Webhook{
+		url:           target,
+		flushInterval: flushInterval,
+		batchSize:     batchSize,
+		client:        &http.Client{Timeout: webhookTimeout},
+		stats:         WebhookStats{URL: u.Redacted(), Batching: flushInterval > 0},
+	}, nil
+}
+
+// Start subscribes to the broker and delivers its events until Close
+func (wh *Webhook) Start(broker *EventBroker) {
+	wh.broker = broker
+	wh.events = broker.Subscribe()
+	wh.batches = make(chan []Event, webhookQueue)
+	wh.done = make(chan struct{})
+	go wh.collect()
+	go wh.send()
+}
+
+// Close unsubscribes and returns when the pending events are delivered
+func (wh *Webhook) Close() {
+	wh.broker.Unsubscribe(wh.events)
+	<-wh.done
+}
+
+// Stats returns the counters of the webhook
+func (wh *Webhook) Stats() WebhookStats {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	return wh.stats
+}
+
+// collect groups the events into batches
+func (wh *Webhook) collect() {
+	defer close(wh.batches)
+	var pending []Event
+	var flush <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-wh.events:
+			if !ok {
+				if len(pending) != 0 {
+					wh.queue(pending)
+				}
+				return
+			}
+			wh.count(func(s *WebhookStats) { s.Events++ })
+			if wh.flushInterval <= 0 {
+				wh.queue([]Event{ev})
+				continue
+			}
+			var coalesced bool
+			if pending, coalesced = coalesceEvent(pending, ev); coalesced {
+				wh.count(func(s *WebhookStats) { s.Coalesced++ })
+			}
+			if len(pending) >= wh.batchSize {
+				wh.queue(pending)
+				pending, flush = nil, nil
+			} else if flush == nil {
+				flush = time.After(wh.flushInterval)
+			}
+		case <-flush:
+			wh.queue(pending)
+			pending, flush = nil, nil
+		}
+	}
+}
+
+// coalesceEvent adds the event to the batch; a write replaces an earlier write of the same state,
+// reporting true, and moves to the end so that it stays after the other events of the state
+func coalesceEvent(batch []Event, ev Event) ([]Event, bool) {
+	if ev.Type == "write" {
+		for i, prev := range batch {
+			if prev.Type == "write" && prev.Name == ev.Name {
+				return append(append(batch[:i:i], batch[i+1:]...), ev), true
+			}
+		}
+	}
+	return append(batch, ev), false
+}
+
+// queue hands the batch to the sender, dropping it if too many batches wait
+func (wh *Webhook) queue(batch []Event) {
+	select {
+	case wh.batches <- batch:
+	default:
+		slog.Warn("webhook too slow, events dropped", "url", wh.stats.URL, "events", len(batch))
+		wh.count(func(s *WebhookStats) { s.Dropped += int64(len(batch)) })
+	}
+}
+
+// send delivers the batches in order
+func (wh *Webhook) send() {
+	defer close(wh.done)
+	for batch := range wh.batches {
+		var body any = batch
+		if wh.flushInterval <= 0 {
+			body = batch[0]
+		}
+		err := wh.post(body)
+		wh.count(func(s *WebhookStats) {
+			s.Requests++
+			if err != nil {
+				s.Failed++
+				s.LastError = err.Error()
+				return
+			}
+			s.Delivered += int64(len(batch))
+			s.LastDelivery = time.Now().UTC()
+		})
+		if err != nil {
+			slog.Error("webhook delivery failed", "url", wh.stats.URL, "events", len(batch), "error", err)
+		}
+	}
+}
+
+// post sends the body as JSON
+func (wh *Webhook) post(body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (wh *Webhook) count(f func(*WebhookStats)) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	f(&wh.stats)
+}
+
+// APIWebhooks handles GET +webhooks returning the counters of the webhooks
+func (h *APIHandler) APIWebhooks(w io.Writer) error {
+	res := []WebhookStats{}
+	for _, wh := range h.webhooks {
+		res = append(res, wh.Stats())
+	}
+	return json.NewEncoder(w).Encode(res)
+}
@@ -1,37 +1,274 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
-	"github.com/Masterminds/sprig/v3"
-	"github.com/dustin/go-humanize"
 	"github.com/yudai/gojsondiff"
 	"github.com/yudai/gojsondiff/formatter"
 )
 
 // APIHandler serves API requests for terraform state backends
 type APIHandler struct {
-	ds       DsIf
-	basepath string
+	ds           DsIf
+	basepath     string
+	events       *EventBroker
+	rejectBinary bool
+	strictPaths  bool
+	// replica is read when reading ds fails
+	replica DsIf
+	// capabilities is served at +capabilities
+	capabilities *Capabilities
+	// missingBody is served with 200 for GET of a missing file instead of 404 if not nil
+	missingBody []byte
+	// lockConflict is the status of ErrLocked, 409 if 0
+	lockConflict int
+	// aliases resolve the names of requests
+	aliases Aliases
+	// writeReceipt answers successful writes with a WriteReceipt
+	writeReceipt bool
+	// lockMethods are the methods of lock and unlock requests
+	lockMethods LockMethods
+	// accessLog samples the log of requests, all are logged if nil
+	accessLog *AccessLog
+	// maxWait caps the time a GET with ?wait= is held, defaultMaxWait if 0
+	maxWait time.Duration
+	// bulkWorkers is the number of paths of a +bulk request handled in parallel, defaultBulkWorkers if 0
+	bulkWorkers int
+	// acl checks the paths of +bulk requests and filters the lock listing, if not nil
+	acl *ACL
+	// webhooks are described at +webhooks
+	webhooks []*Webhook
+	// upstream is read for GETs of missing files, if not nil
+	upstream *Upstream
+}
+
+// LockMethods are the HTTP methods of lock and unlock requests, LOCK and UNLOCK if empty
+//
+// standard methods such as POST are taken as a lock or unlock request only with ?lock=1 or ?unlock=1,
+// so that they keep their meaning otherwise.
+type LockMethods struct {
+	Lock   string
+	Unlock string
+}
+
+// standardMethods are the methods which have another meaning without the query flag
+var standardMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// op returns "lock" or "unlock" for lock and unlock requests, empty for others
+func (m LockMethods) op(r *http.Request) string {
+	for _, v := range []struct{ op, method string }{{"lock", cmp.Or(m.Lock, "LOCK")}, {"unlock", cmp.Or(m.Unlock, "UNLOCK")}} {
+		if r.Method != v.method {
+			continue
+		}
+		if !slices.Contains(standardMethods, v.method) {
+			return v.op
+		}
+		if flag, _ := strconv.ParseBool(r.URL.Query().Get(v.op)); flag {
+			return v.op
+		}
+	}
+	return ""
+}
+
+// check fails when lock and unlock requests cannot be told apart from each other or from reads
+func (m LockMethods) check() error {
+	if m.Lock == m.Unlock && !slices.Contains(standardMethods, m.Lock) {
+		return fmt.Errorf("--lock-method and --unlock-method are both %s", m.Lock)
+	}
+	for _, method := range []string{m.Lock, m.Unlock} {
+		if method == http.MethodGet || method == http.MethodHead {
+			return fmt.Errorf("%s requests cannot lock or unlock", method)
+		}
+	}
+	return nil
+}
+
+// lockConflictStatus returns the status of ErrLocked, 409 Conflict unless configured
+func lockConflictStatus(status int) int {
+	if status == 0 {
+		return http.StatusConflict
+	}
+	return status
+}
+
+// currentVersion returns the version name which current points to
+func currentVersion(ctx context.Context, ds DsIf, path string) string {
+	for _, e := range ds.History(ctx, path) {
+		if e.Locked {
+			return e.Name
+		}
+	}
+	return ""
+}
+
+// publish notifies subscribers of a successful change
+func (h *APIHandler) publish(path string, r *http.Request) {
+	if h.events == nil || strings.HasPrefix(path, "_") || strings.HasPrefix(path, "+") {
+		return
+	}
+	ev := Event{Name: path, User: RequestUser(r)}
+	switch op := h.lockMethods.op(r); {
+	case op != "":
+		ev.Type = op
+	case r.Method == http.MethodPost && r.URL.Query().Get("diff") == "true":
+		// nothing written
+		return
+	case r.Method == http.MethodPost && r.URL.Query().Has("upload") && r.URL.Query().Get("upload") != "commit":
+		// an upload writes the version on the commit only
+		return
+	case r.Method == http.MethodPost:
+		switch {
+		case r.URL.Query().Get("rollback") != "":
+			ev.Type = "rollback"
+		case r.URL.Query().Get("prune") != "":
+			ev.Type = "prune"
+		default:
+			ev.Type = "write"
+		}
+		// the change is done even if the client has gone away
+		ev.Version = currentVersion(context.WithoutCancel(r.Context()), h.ds, path)
+	case r.Method == http.MethodDelete:
+		ev.Type = "delete"
+	default:
+		return
+	}
+	h.events.Publish(ev)
+}
+
+// APILocks handles GET requests listing the locks under the path
+func (h *APIHandler) APILocks(path string, w io.Writer, r *http.Request) error {
+	locks, err := h.ds.Locks("/" + path)
+	if err != nil {
+		slog.Error("cannot list locks", "error", err, "path", path)
+		return err
+	}
+	if stale := r.URL.Query().Get("stale"); stale != "" {
+		dur, err := time.ParseDuration(stale)
+		if err != nil {
+			slog.Error("invalid duration", "stale", stale, "error", err)
+			return ErrInvalidPath
+		}
+		locks = StaleLocks(locks, dur)
+	}
+	// the listing is not restricted by the path, only the locks of readable files are shown
+	if h.acl != nil {
+		user := RequestUser(r)
+		locks = slices.DeleteFunc(locks, func(l LockEntry) bool {
+			return !h.acl.Allowed(user, l.Path, aclRead)
+		})
+	}
+	return json.NewEncoder(w).Encode(locks)
+}
+
+// APIActivity handles GET requests of the recent events, optionally after the given id
+func (h *APIHandler) APIActivity(path string, w io.Writer, r *http.Request) error {
+	var since uint64
+	if sincestr := r.URL.Query().Get("since"); sincestr != "" {
+		var err error
+		if since, err = strconv.ParseUint(sincestr, 10, 64); err != nil {
+			slog.Error("invalid since", "since", sincestr, "error", err)
+			return ErrInvalidPath
+		}
+	}
+	return json.NewEncoder(w).Encode(readableEvents(h.acl, r, h.events.Recent(since)))
+}
+
+// partialRequest reports whether the GET returns a part of the contents, with ?select= or ?outputs=1
+func partialRequest(r *http.Request) bool {
+	outputs, _ := strconv.ParseBool(r.URL.Query().Get("outputs"))
+	return r.URL.Query().Get("select") != "" || outputs
 }
 
 // APIGet handles GET requests to retrieve file contents
 func (h *APIHandler) APIGet(path string, w io.Writer, r *http.Request) error {
-	hist := r.URL.Query().Get("history")
+	if !partialRequest(r) || !contentRequest(path, r) {
+		return h.apiGet(path, w, r)
+	}
+	buf := &bytes.Buffer{}
+	if err := h.apiGet(path, buf, r); err != nil {
+		return err
+	}
+	sel := r.URL.Query().Get("select")
+	if sel == "" {
+		return h.apiOutputs(path, buf.Bytes(), w, r)
+	}
+	out, err := SelectJSON(buf.Bytes(), sel)
+	if err != nil {
+		slog.Error("cannot select", "path", path, "select", sel, "error", err)
+		fmt.Fprintf(w, "%s: %v\n", sel, err)
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// apiOutputs writes the outputs of the terraform state read for ?outputs=1
+//
+// sensitive values are redacted unless ?show-sensitive=1 is given, which needs write permission on all files with an ACL.
+func (h *APIHandler) apiOutputs(path string, data []byte, w io.Writer, r *http.Request) error {
+	show, _ := strconv.ParseBool(r.URL.Query().Get("show-sensitive"))
+	if show && h.acl != nil && !h.acl.Allowed(RequestUser(r), "*", aclWrite) {
+		slog.Warn("sensitive outputs denied", "path", path, "user", RequestUser(r))
+		return ErrForbidden
+	}
+	outputs, err := StateOutputs(data, show)
+	if err != nil {
+		slog.Error("cannot read outputs", "path", path, "error", err)
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(outputs)
+}
+
+func (h *APIHandler) apiGet(path string, w io.Writer, r *http.Request) error {
+	if path == "+events" {
+		return h.APIActivity(path, w, r)
+	}
+	if path == "+webhooks" {
+		return h.APIWebhooks(w)
+	}
+	if path == "+capabilities" {
+		if h.capabilities == nil {
+			return ErrNotFound
+		}
+		return json.NewEncoder(w).Encode(h.capabilities)
+	}
+	if r.URL.Query().Get("locks") == "true" {
+		return h.APILocks(path, w, r)
+	}
+	if r.URL.Query().Get("versions") == "true" {
+		return json.NewEncoder(w).Encode(h.ds.History(r.Context(), path))
+	}
+	hist, err := h.requestedHistory(path, r)
+	if err != nil {
+		return err
+	}
 	if hist == "" {
-		return h.ds.Read(path, w)
+		return h.ds.Read(r.Context(), path, w)
 	}
 	if ior, err := h.ds.ReadHistory(path, hist); err != nil {
 		slog.Error("cannot read history", "error", err, "path", path, "history", hist)
@@ -43,94 +280,674 @@ func (h *APIHandler) APIGet(path string, w io.Writer, r *http.Request) error {
 	}
 }
 
+// acceptsGzip reports whether the client accepts gzip content encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// contentRequest reports whether the GET request reads the contents of a version
+func contentRequest(path string, r *http.Request) bool {
+	query := r.URL.Query()
+	return !strings.HasPrefix(path, "+") && !strings.HasPrefix(path, "_") && query.Get("locks") == "" && query.Get("versions") == "" && query.Get("notes") == ""
+}
+
+// missingState reports whether the GET request reads the current version of a file which does not exist
+func (h *APIHandler) missingState(path string, r *http.Request) bool {
+	if !contentRequest(path, r) || partialRequest(r) {
+		return false
+	}
+	if hist, err := h.requestedHistory(path, r); err != nil || hist != "" {
+		return false
+	}
+	return h.ds.CurrentVersion(path) == ""
+}
+
+// requestedHistory returns the version given by ?history=, the one current at ?at=, or the backup link with ?backup=1
+func (h *APIHandler) requestedHistory(path string, r *http.Request) (string, error) {
+	query := r.URL.Query()
+	if hist := query.Get("history"); hist != "" {
+		return hist, nil
+	}
+	if atstr := query.Get("at"); atstr != "" {
+		at, err := parseTime(atstr)
+		if err != nil {
+			slog.Error("invalid time", "at", atstr, "error", err)
+			return "", ErrInvalidPath
+		}
+		ent, err := VersionAt(r.Context(), h.ds, path, at)
+		return ent.Name, err
+	}
+	if backup, _ := strconv.ParseBool(query.Get("backup")); backup {
+		return backupLink, nil
+	}
+	return "", nil
+}
+
+// APIGetRaw handles GET requests of file contents, passing versions stored with gzip as they are
+//
+// it returns the content encoding and the md5 of the uncompressed contents.
+func (h *APIHandler) APIGetRaw(path string, w io.Writer, r *http.Request) (string, []byte, error) {
+	hist, err := h.requestedHistory(path, r)
+	if err != nil {
+		return "", nil, err
+	}
+	raw, err := h.ds.ReadRaw(path, hist)
+	if err != nil {
+		slog.Error("cannot read", "error", err, "path", path)
+		return "", nil, err
+	}
+	defer raw.Close()
+	if raw.Encoding != "gzip" || raw.MD5 == nil {
+		return "", nil, h.APIGet(path, w, r)
+	}
+	_, err = io.Copy(w, raw)
+	return raw.Encoding, raw.MD5, err
+}
+
+// cacheHeaders sets caching headers for file contents and reports whether the client copy is still valid
+//
+// history versions are immutable and cached for a long time; the current version must always be revalidated.
+// the etag of the current version is its version ID, which If-Match of a rollback compares.
+// ?history=current and ?history=backup follow the file, they are revalidated with the digest as the etag.
+func cacheHeaders(w http.ResponseWriter, r *http.Request, md5sum []byte, version string) bool {
+	etag := hex.EncodeToString(md5sum)
+	history := r.URL.Query().Get("history")
+	switch {
+	case history == "":
+		w.Header().Set("Cache-Control", "no-cache")
+		if version == "" {
+			return false
+		}
+		etag = version
+	case reservedNames[history]:
+		w.Header().Set("Cache-Control", "no-cache")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		etag += "-" + enc
+	}
+	etag = `"` + etag + `"`
+	w.Header().Set("Etag", etag)
+	return etagMatch(r.Header.Get("If-None-Match"), etag)
+}
+
+// etagMatch reports whether the If-Match or If-None-Match header lists the etag, weakly compared
+func etagMatch(header string, etag string) bool {
+	for _, match := range strings.Split(header, ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == etag || match == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// currentIfMatch returns the current version if the If-Match header lists its etag, in any encoding,
+// empty without If-Match, or ErrPrecondition
+func (h *APIHandler) currentIfMatch(path string, r *http.Request) (string, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return "", nil
+	}
+	cur := h.ds.CurrentVersion(path)
+	if cur != "" && (etagMatch(header, `"`+cur+`"`) || etagMatch(header, `"`+cur+`-gzip"`)) {
+		return cur, nil
+	}
+	slog.Warn("current version does not match", "path", path, "if-match", header, "current", cur)
+	return "", ErrPrecondition
+}
+
 // APIDelete handles DELETE requests to remove files
 func (h *APIHandler) APIDelete(path string, w io.Writer, r *http.Request) error {
 	return h.ds.Delete(path)
 }
 
+// batchRequest is the body of _lock-batch and _unlock-batch requests
+type batchRequest struct {
+	Names    []string        `json:"names"`
+	LockInfo json.RawMessage `json:"lockinfo"`
+}
+
+// APIBatch handles POST requests to lock or unlock several files at once
+func (h *APIHandler) APIBatch(path string, w io.Writer, r *http.Request) error {
+	req := batchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("invalid batch request", "error", err, "path", path)
+		return ErrInvalidPath
+	}
+	lockdata := map[string]interface{}{}
+	if err := json.Unmarshal(req.LockInfo, &lockdata); err != nil || lockdata["ID"] == nil || len(req.Names) == 0 {
+		slog.Error("batch request requires names and lockinfo with ID", "path", path, "error", err)
+		return ErrInvalidPath
+	}
+	for i, name := range req.Names {
+		var err error
+		if req.Names[i], err = normalizeName(name, h.strictPaths); err != nil {
+			return err
+		}
+		req.Names[i] = h.aliases.Resolve(req.Names[i])
+	}
+	lockinfo := string(req.LockInfo)
+	evtype := "lock"
+	var failed string
+	var err error
+	if path == "_lock-batch" {
+		failed, err = LockBatch(h.ds, req.Names, string(enrichLockInfo(req.LockInfo, r)))
+	} else {
+		evtype = "unlock"
+		failed, err = UnlockBatch(h.ds, req.Names, lockinfo)
+	}
+	res := map[string]interface{}{"names": req.Names}
+	if err != nil {
+		res["failed"] = failed
+		res["error"] = err.Error()
+	} else {
+		for _, name := range req.Names {
+			h.events.Publish(Event{Name: name, Type: evtype})
+		}
+	}
+	if err1 := json.NewEncoder(w).Encode(res); err1 != nil {
+		return err1
+	}
+	return err
+}
+
 // APIPost handles POST requests to write file contents
+//
+// ?rollback=<history> and ?prune=<keep> manage the history instead.
 func (h *APIHandler) APIPost(path string, w io.Writer, r *http.Request) error {
+	if path == "_lock-batch" || path == "_unlock-batch" {
+		return h.APIBatch(path, w, r)
+	}
+	if step := r.URL.Query().Get("upload"); step != "" {
+		return h.APIUploadPost(path, step, w, r)
+	}
+	if hist := r.URL.Query().Get("rollback"); hist != "" {
+		cur, err := h.currentIfMatch(path, r)
+		if err != nil {
+			return err
+		}
+		return h.ds.RollbackIf(path, hist, cur)
+	}
+	if keepstr := r.URL.Query().Get("prune"); keepstr != "" {
+		keep, err := strconv.Atoi(keepstr)
+		if err != nil || keep < 0 {
+			slog.Error("invalid keep", "prune", keepstr, "error", err)
+			return ErrInvalidPath
+		}
+		return h.ds.Prune(r.Context(), path, keep, false)
+	}
 	hashb, err0 := base64.StdEncoding.DecodeString(r.Header.Get("content-md5"))
 	if err0 != nil {
 		hashb = []byte{}
 	}
 	lockid := r.URL.Query().Get("ID")
-	return h.ds.Write(path, r.Body, hashb, lockid)
+	retain, err := retainHistory(r)
+	if err != nil {
+		return err
+	}
+	var body io.Reader = r.Body
+	if h.rejectBinary {
+		rd := bufio.NewReader(r.Body)
+		if err := checkTextContent(rd); err != nil {
+			return err
+		}
+		body = rd
+	}
+	if !retain {
+		err = h.ds.Replace(r.Context(), path, body, hashb, lockid)
+	} else {
+		err = h.ds.Write(r.Context(), path, body, hashb, lockid)
+	}
+	if err != nil {
+		return err
+	}
+	if ctype := r.Header.Get("Content-Type"); ctype != "" && ctype != "application/x-www-form-urlencoded" {
+		// curl -d sends the form type, which is no content type of a state
+		if err := h.ds.SetContentType(path, ctype); err != nil {
+			slog.Warn("content type not recorded", "name", path, "content-type", ctype, "error", err)
+		}
+	}
+	if !h.writeReceipt {
+		return nil
+	}
+	return h.receipt(path, w)
+}
+
+// WriteReceipt describes the version stored by a POST, returned with --write-receipt
+type WriteReceipt struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	MD5     string `json:"md5"`
 }
 
-// APILock handles LOCK requests to lock a file
+// receipt writes the receipt of the current version, read back as stored
+func (h *APIHandler) receipt(path string, w io.Writer) error {
+	version := h.ds.CurrentVersion(path)
+	rd, err := h.ds.ReadHistory(path, version)
+	if err != nil {
+		slog.Error("cannot read the written version", "name", path, "version", version, "error", err)
+		return err
+	}
+	defer rd.Close()
+	hash := md5.New()
+	size, err := io.Copy(hash, rd)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(WriteReceipt{
+		Name:    path,
+		Version: version,
+		Size:    size,
+		MD5:     hex.EncodeToString(hash.Sum(nil)),
+	})
+}
+
+// retainHistory reports whether a write keeps the current version in the history
+//
+// the X-Statesaver-Retain header or ?retain=false opts out of versioning.
+func retainHistory(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("retain")
+	if value == "" {
+		value = r.Header.Get("X-Statesaver-Retain")
+	}
+	if value == "" {
+		return true, nil
+	}
+	retain, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Error("invalid retain", "retain", value, "error", err)
+		return true, ErrInvalidPath
+	}
+	return retain, nil
+}
+
+// checkTextContent sniffs the head of the body and rejects anything but text or JSON
+func checkTextContent(rd *bufio.Reader) error {
+	head, err := rd.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	ctype := http.DetectContentType(head)
+	if strings.HasPrefix(ctype, "text/") || strings.HasPrefix(ctype, "application/json") {
+		return nil
+	}
+	slog.Error("binary content rejected", "content-type", ctype)
+	return ErrUnsupportedMedia
+}
+
+// APILock handles lock requests, LOCK by default
 func (h *APIHandler) APILock(path string, w io.Writer, r *http.Request) error {
 	body, err0 := io.ReadAll(r.Body)
 	if err0 != nil {
 		slog.Error("read body", "error", err0, "url", r.URL)
 	}
-	slog.Debug("lock", "content", string(body))
-	return h.ds.Lock(path, string(body))
+	slog.Debug("lock", "content", string(body), "user", RequestUser(r))
+	return h.ds.Lock(path, string(enrichLockInfo(body, r)))
+}
+
+// lockServerKey is the key of the lock info which the server records the client into
+const lockServerKey = "_server"
+
+// LockServerInfo describes the client which took a lock
+type LockServerInfo struct {
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
 }
 
-// APIUnlock handles UNLOCK requests to unlock a file
+// enrichLockInfo records the client of the request into a lock info of a JSON object
+//
+// the fields of the client are kept, other lock info is returned as it is.
+func enrichLockInfo(lockinfo []byte, r *http.Request) []byte {
+	info := map[string]json.RawMessage{}
+	if err := json.Unmarshal(lockinfo, &info); err != nil || info == nil {
+		return lockinfo
+	}
+	srv, err := json.Marshal(LockServerInfo{
+		RemoteAddr: r.RemoteAddr,
+		User:       RequestUser(r),
+		UserAgent:  r.UserAgent(),
+		ReceivedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return lockinfo
+	}
+	info[lockServerKey] = srv
+	res, err := json.Marshal(info)
+	if err != nil {
+		slog.Warn("cannot record client into lock info", "error", err)
+		return lockinfo
+	}
+	return res
+}
+
+// APIUnlock handles unlock requests, UNLOCK by default
 func (h *APIHandler) APIUnlock(path string, w io.Writer, r *http.Request) error {
 	body, err0 := io.ReadAll(r.Body)
 	if err0 != nil {
 		slog.Error("read body", "error", err0, "url", r.URL)
 	}
-	slog.Debug("unlock", "content", string(body))
+	slog.Debug("unlock", "content", string(body), "user", RequestUser(r))
 	return h.ds.Unlock(path, string(body))
 }
 
+// requestName returns the normalized file name of the request, or the prefix of a lock listing
+func (h *APIHandler) requestName(r *http.Request) (string, error) {
+	if r.Method == http.MethodGet && r.URL.Query().Get("locks") == "true" {
+		return normalizePrefix(r.URL.Path, h.strictPaths)
+	}
+	name, err := normalizeName(r.URL.Path, h.strictPaths)
+	if err == nil && name == "" {
+		slog.Error("empty name", "method", r.Method, "path", r.URL.Path)
+		return "", ErrInvalidPath
+	}
+	return h.aliases.Resolve(name), err
+}
+
 // ServeHTTP routes HTTP requests to the appropriate API handler methods
 func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	st := time.Now()
-	slog.Info("access", "method", r.Method, "path", r.URL.Path, "params", r.URL.Query(), "headers", r.Header)
-	var err error
+	ctx, ops := withOpStats(r.Context())
+	r = r.WithContext(ctx)
+	h.accessLog.access(r)
+	orig := r
+	if r.Method == http.MethodHead {
+		// the same as GET, writeResponse leaves out the body
+		r = r.Clone(ctx)
+		r.Method = http.MethodGet
+	}
+	var encoding, version string
+	var origsum []byte
 	buf := &bytes.Buffer{}
-	path := r.URL.Path
-	switch r.Method {
-	case http.MethodGet:
-		err = h.APIGet(path, buf, r)
-	case http.MethodDelete:
-		err = h.APIDelete(path, buf, r)
-	case http.MethodPost:
-		err = h.APIPost(path, buf, r)
-	case "LOCK":
+	path, err := h.requestName(r)
+	lockOp := h.lockMethods.op(r)
+	unchanged := false
+	if err == nil && lockOp == "" && r.Method == http.MethodGet && r.URL.Query().Has("wait") {
+		unchanged, err = h.waitChange(path, r)
+	}
+	switch {
+	case err != nil:
+	case unchanged:
+		// still the version the client has
+		version = r.URL.Query().Get("wait")
+	case lockOp == "lock":
 		err = h.APILock(path, buf, r)
-	case "UNLOCK":
+	case lockOp == "unlock":
 		err = h.APIUnlock(path, buf, r)
+	case path == "+bulk" && r.Method == http.MethodPost:
+		var ctype string
+		if ctype, err = h.APIBulk(buf, r); err == nil {
+			w.Header().Set("Content-Type", ctype)
+		}
+	case strings.HasPrefix(path, "+uploads/"):
+		err = h.APIUpload(strings.TrimPrefix(path, "+uploads/"), buf, r)
+	case r.URL.Query().Get("notes") == "true":
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		}
+		err = h.APINotes(path, buf, r)
+	case r.Method == http.MethodGet:
+		if contentRequest(path, r) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if hist, _ := h.requestedHistory(path, r); hist == "" {
+				// before reading, so that a version written meanwhile fails If-Match rather than passes
+				version = h.ds.CurrentVersion(path)
+			}
+		}
+		if acceptsGzip(r) && contentRequest(path, r) && !partialRequest(r) {
+			encoding, origsum, err = h.APIGetRaw(path, buf, r)
+		} else {
+			err = h.APIGet(path, buf, r)
+		}
+		if h.replica != nil && contentRequest(path, r) && readFailed(err) {
+			encoding, origsum, version = "", nil, ""
+			buf.Reset()
+			if err = h.readReplica(path, buf, r, err); err == nil {
+				w.Header().Set("X-Statesaver-Source", "replica")
+			}
+		}
+		if err == ErrNotFound && h.upstream != nil && h.missingState(path, r) {
+			encoding, origsum = "", nil
+			buf.Reset()
+			if version, err = h.readUpstream(path, buf, r); err == nil {
+				w.Header().Set("X-Statesaver-Source", "upstream")
+			}
+		}
+		if err == ErrNotFound && h.missingBody != nil && h.missingState(path, r) {
+			buf.Reset()
+			buf.Write(h.missingBody)
+			err = nil
+		}
+	case r.Method == http.MethodDelete:
+		err = h.APIDelete(path, buf, r)
+	case r.Method == http.MethodPost && r.URL.Query().Get("diff") == "true":
+		w.Header().Set("Content-Type", "application/json")
+		err = h.APIDiff(path, buf, r)
+	case r.Method == http.MethodPost:
+		err = h.APIPost(path, buf, r)
+	}
+	if err == nil {
+		h.publish(path, r)
+	}
+	if err != nil && clientGone(r, st, err) {
+		return
+	}
+	if err != nil && r.Method == http.MethodGet && contentRequest(path, r) && buf.Len() != 0 && h.errorStatus(err) == http.StatusInternalServerError {
+		// never serve the part of the contents read before the error
+		slog.Error("read failed, dropping partial contents", "path", path, "dropped", buf.Len(), "error", err)
+		buf.Reset()
+	}
+	if errors.Is(err, ErrPathConflict) && buf.Len() == 0 {
+		// tell the client which state is in the way
+		fmt.Fprintln(buf, err)
+	}
+	if err == ErrLocked && buf.Len() == 0 {
+		// tell the client who holds the lock
+		if holder, err1 := h.ds.LockRead(path); err1 == nil {
+			buf.WriteString(holder)
+		}
 	}
-	w.Header().Add("Content-Length", strconv.Itoa(buf.Len()))
 	md5sum := md5.Sum(buf.Bytes())
-	w.Header().Add("Content-Md5", base64.StdEncoding.EncodeToString(md5sum[:]))
-	var statuscode int
+	if err == nil && encoding != "" {
+		// the md5 is of the contents which the client gets after decoding
+		copy(md5sum[:], origsum)
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	if err == nil && r.Method == http.MethodGet && contentRequest(path, r) && !partialRequest(r) {
+		w.Header().Set("Content-Type", h.ds.ContentType(path))
+	}
+	notModified := unchanged
+	if unchanged {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Etag", `"`+version+`"`)
+	} else if err == nil && r.Method == http.MethodGet && r.URL.Query().Get("locks") == "" {
+		notModified = cacheHeaders(w, r, md5sum[:], version)
+	}
+	statuscode := http.StatusOK
+	if notModified {
+		statuscode = http.StatusNotModified
+	} else if err != nil {
+		statuscode = h.errorStatus(err)
+	}
+	writeResponse(w, orig, statuscode, buf.Bytes(), md5sum[:])
+	h.accessLog.response(orig, statuscode, time.Since(st), ops)
+}
+
+// writeResponse writes the status and the body of a response
+//
+// Content-Md5 describes successful bodies only, error bodies get their Content-Length alone, and responses
+// without a body such as 304 get neither. HEAD gets the headers of GET without the body.
+func writeResponse(w http.ResponseWriter, r *http.Request, statuscode int, body []byte, md5sum []byte) {
+	noBody := statuscode < http.StatusOK || statuscode == http.StatusNoContent || statuscode == http.StatusNotModified
+	if !noBody {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if !noBody && statuscode < http.StatusMultipleChoices && len(body) != 0 {
+		if md5sum == nil {
+			sum := md5.Sum(body)
+			md5sum = sum[:]
+		}
+		w.Header().Set("Content-Md5", base64.StdEncoding.EncodeToString(md5sum))
+	}
+	w.WriteHeader(statuscode)
+	if noBody || r.Method == http.MethodHead {
+		return
+	}
+	if written, err := w.Write(body); err != nil {
+		slog.Warn("write response", "written", written, "error", err, "path", r.URL.Path)
+	}
+}
+
+// errorStatus returns the status of the error of a request
+func (h *APIHandler) errorStatus(err error) int {
+	return errorStatus(err, h.lockConflict)
+}
+
+// errorStatus returns the status of an error of the API or the html pages, lockConflict for ErrLocked
+func errorStatus(err error, lockConflict int) int {
+	if errors.Is(err, ErrPathConflict) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, ErrUpstream) {
+		return http.StatusBadGateway
+	}
+	if errors.Is(err, ErrNoSpace) || errors.Is(err, syscall.ENOSPC) {
+		return http.StatusInsufficientStorage
+	}
 	switch err {
-	case nil:
-		statuscode = http.StatusOK
 	case ErrLocked:
-		statuscode = http.StatusConflict
-	case ErrUnlocked:
-		statuscode = http.StatusConflict
+		return lockConflictStatus(lockConflict)
+	case ErrUnlocked, ErrBusy:
+		return http.StatusConflict
 	case ErrInvalidPath:
-		statuscode = http.StatusBadRequest
+		return http.StatusBadRequest
 	case ErrInvalidHash:
-		statuscode = http.StatusBadRequest
-	case ErrNotFound:
-		statuscode = http.StatusNotFound
+		return http.StatusBadRequest
+	case ErrNotFound, ErrNoNamespace:
+		return http.StatusNotFound
+	case ErrProtected, ErrHeld, ErrForbidden:
+		return http.StatusForbidden
+	case ErrUnsupportedMedia:
+		return http.StatusUnsupportedMediaType
+	case ErrPrecondition:
+		return http.StatusPreconditionFailed
+	case ErrTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrRange:
+		return http.StatusRequestedRangeNotSatisfiable
+	case ErrNotJSON, ErrUnresolved, ErrInvalidState:
+		return http.StatusUnprocessableEntity
 	default:
-		statuscode = http.StatusInternalServerError
+		return http.StatusInternalServerError
 	}
-	w.WriteHeader(statuscode)
-	written, err1 := io.Copy(w, buf)
-	if err1 != nil {
-		slog.Warn("write response", "written", written, "error", err1, "path", path)
+}
+
+// clientGone reports whether the request was cancelled or timed out while it was handled
+func clientGone(r *http.Request, st time.Time, err error) bool {
+	if r.Context().Err() == nil {
+		return false
 	}
-	elapsed := time.Since(st)
-	slog.Info("response", "status", http.StatusText(statuscode), "method", r.Method, "path", r.URL.Path, "elapsed", elapsed)
+	slog.Warn("client gone", "method", r.Method, "path", r.URL.Path, "elapsed", time.Since(st), "error", err, "cause", context.Cause(r.Context()))
+	return true
 }
 
 // HTMLHandler serves HTML pages for the web interface
 type HTMLHandler struct {
-	ds       DsIf
-	fmap     template.FuncMap
-	basepath string
+	ds DsIf
+	// accessLog samples the log of requests, all are logged if nil
+	accessLog *AccessLog
+	fmap      template.FuncMap
+	basepath  string
+	previews  PreviewCache
+	events    *EventBroker
+	// templates overrides the embedded templates
+	templates fs.FS
+	// maintenance is shown on the admin page
+	maintenance *Maintenance
+	csrfKey     []byte
+	// lockConflict is the status of ErrLocked, 409 if 0
+	lockConflict int
+	// aliases are listed on the index and resolve the names of pages
+	aliases Aliases
+	// acl hides the links the user has no permission for, if not nil
+	acl *ACL
+}
+
+// templateFS returns the templates in use
+func (h *HTMLHandler) templateFS() fs.FS {
+	if h.templates != nil {
+		return h.templates
+	}
+	return template_files
+}
+
+// fallbackTemplate renders a minimal page when a page template is broken
+var fallbackTemplate = template.Must(template.New("fallback").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>page template is broken, showing a minimal page</p>
+{{if .Links}}<ul>{{range .Links}}<li><a href="{{.Href}}">{{.Text}}</a></li>{{end}}</ul>{{end}}
+{{if .Data}}<pre>{{.Data}}</pre>{{end}}
+</body></html>
+`))
+
+// fallbackLink is a link shown on the minimal page
+type fallbackLink struct {
+	Href string
+	Text string
+}
+
+// render executes the page template, or the minimal page if the template fails to load or execute
+func (h *HTMLHandler) render(w io.Writer, name string, files []string, data map[string]interface{}) error {
+	fmap := h.fmap
+	if fmap == nil {
+		fmap = templateFuncs()
+	}
+	tmpl, err := template.New(name).Funcs(fmap).ParseFS(h.templateFS(), files...)
+	if err == nil {
+		buf := &bytes.Buffer{}
+		if err = tmpl.Execute(buf, data); err == nil {
+			_, err = io.Copy(w, buf)
+			return err
+		}
+		slog.Error("template execute failed", "template", name, "error", err)
+	} else {
+		slog.Error("template load failed", "template", name, "error", err)
+	}
+	page := map[string]interface{}{"Title": data["Title"]}
+	links := []fallbackLink{}
+	if entries, ok := data["Files"].([]indexRow); ok {
+		for _, e := range entries {
+			links = append(links, fallbackLink{Href: h.basepath + "view/" + strings.TrimPrefix(e.Name, "/"), Text: e.Name})
+		}
+	}
+	if entries, ok := data["history"].([]FileEntry); ok {
+		for _, e := range entries {
+			links = append(links, fallbackLink{Href: "?history=" + url.QueryEscape(e.Name), Text: e.Name})
+		}
+	}
+	page["Links"] = links
+	if content, ok := data["data"]; ok {
+		if b, err := json.MarshalIndent(content, "", "  "); err == nil {
+			page["Data"] = string(b)
+		}
+	} else if diff, ok := data["diff"]; ok {
+		page["Data"] = diff
+	}
+	return fallbackTemplate.Execute(w, page)
 }
 
 // Index serves the index page listing all files
@@ -139,36 +956,192 @@ func (h *HTMLHandler) Index(path string, w io.Writer, r *http.Request) error {
 		"templates/list.html",
 		"templates/_inline_style.html",
 	}
-	tmpl, err := template.New("list.html").Funcs(h.fmap).ParseFS(template_files, tmpl_files...)
+	prefix, err := normalizePrefix(r.URL.Query().Get("prefix"), false)
 	if err != nil {
-		slog.Error("template load failed", "path", path, "error", err)
 		return err
 	}
-	prefix := r.URL.Query().Get("prefix")
-	if prefix == "" {
-		prefix = "/"
-	}
+	prefix = "/" + prefix
+	lockedOnly := r.URL.Query().Get("locked") == "true"
+	preview := r.URL.Query().Get("preview") == "true"
 	files := make([]FileEntry, 0)
-	h.ds.Walk(prefix, func(e FileEntry) error {
+	previews := make(map[string]string)
+	protected := make(map[string]bool)
+	held := make(map[string]bool)
+	skipped, err := h.ds.WalkSkipped(r.Context(), prefix, func(e FileEntry) error {
+		if lockedOnly && !e.Locked {
+			return nil
+		}
 		files = append(files, e)
+		if h.ds.Protected(e.Name) {
+			protected[e.Name] = true
+		}
+		if h.ds.Held(e.Name) {
+			held[e.Name] = true
+		}
+		// previews show the contents, only to those who can read them
+		if preview && h.allowed(r, e.Name, aclRead) {
+			if p, err := h.previews.Get(h.ds, e); err == nil {
+				previews[e.Name] = p.String()
+			}
+		}
 		return nil
 	})
+	if err != nil {
+		slog.Error("walk error", "prefix", prefix, "error", err)
+		return err
+	}
+	sortKey, desc := indexSort(r.URL.Query())
+	sortFiles(files, sortKey, desc)
+	rows := make([]indexRow, 0, len(files))
+	for _, e := range files {
+		rows = append(rows, h.indexRow(r, e))
+	}
 	entries := make(map[string]interface{})
-	entries["Files"] = files
+	entries["Files"] = rows
+	entries["CanMaintain"] = h.allowed(r, "*", aclWrite)
+	entries["Skipped"] = skipped
+	entries["Aliases"] = h.aliases.Entries(prefix)
+	entries["SortLinks"] = sortLinks(r.URL.Query(), sortKey, desc)
+	entries["SortQuery"] = ""
+	if r.URL.Query().Has("sort") {
+		entries["SortQuery"] = "&sort=" + sortKey + "&order=" + map[bool]string{false: "asc", true: "desc"}[desc]
+	}
+	entries["LockedOnly"] = lockedOnly
+	entries["Preview"] = preview
+	entries["Previews"] = previews
+	entries["Protected"] = protected
+	entries["Held"] = held
+	if sc, ok := h.ds.(SpaceChecker); ok {
+		if st, err := sc.Space(); err == nil && st.Low {
+			entries["LowSpace"] = st
+		}
+	}
+	entries["Activity"] = recentActivity(readableEvents(h.acl, r, h.events.Recent(0)), 10)
+	entries["Live"] = h.events != nil
 	entries["Title"] = "index"
 	entries["basepath"] = h.basepath
 	slog.Debug("entries", "files", files)
+	return h.render(w, "list.html", tmpl_files, entries)
+}
 
-	if err := tmpl.Execute(w, entries); err != nil {
-		slog.Error("template execute failed", "path", path, "error", err)
-		return err
+// indexRow is a file on the index with the summary of its history and the actions the user may take
+type indexRow struct {
+	FileEntry
+	Versions int
+	// Previous is the version before current, empty if there is none
+	Previous string
+	Current  string
+	// CanRead shows the links to the contents
+	CanRead bool
+}
+
+// indexRow summarizes the history of the file for the index
+func (h *HTMLHandler) indexRow(r *http.Request, e FileEntry) indexRow {
+	res := indexRow{FileEntry: e, CanRead: h.allowed(r, e.Name, aclRead)}
+	hist := h.ds.History(r.Context(), e.Name)
+	res.Versions = len(hist)
+	for i, v := range hist {
+		if v.Locked {
+			res.Current = v.Name
+			if res.CanRead {
+				res.Terraform = v.Terraform
+			}
+			if i+1 < len(hist) {
+				res.Previous = hist[i+1].Name
+			}
+			break
+		}
 	}
-	return nil
+	return res
+}
+
+// allowed checks the permission of the user of the request on the file, everything is allowed without an ACL
+func (h *HTMLHandler) allowed(r *http.Request, name string, perm byte) bool {
+	return h.acl == nil || h.acl.Allowed(RequestUser(r), name, perm)
+}
+
+// indexSortKeys are the columns the index can be sorted by, the first is the default
+var indexSortKeys = []string{"name", "size", "modified", "locked"}
+
+// indexSort returns the sort key and order of the index from ?sort= and ?order=, unknown keys sort by name
+func indexSort(query url.Values) (string, bool) {
+	key := query.Get("sort")
+	if !slices.Contains(indexSortKeys, key) {
+		key = indexSortKeys[0]
+	}
+	return key, query.Get("order") == "desc"
+}
+
+// sortFiles sorts the files by the key, files with the same value by name
+func sortFiles(files []FileEntry, key string, desc bool) {
+	slices.SortStableFunc(files, func(a, b FileEntry) int {
+		res := 0
+		switch key {
+		case "size":
+			res = cmp.Compare(a.Size, b.Size)
+		case "modified":
+			res = a.Timestamp.Compare(b.Timestamp)
+		case "locked":
+			// locked first in ascending order, as it is what one looks for
+			res = cmp.Compare(boolInt(b.Locked), boolInt(a.Locked))
+		}
+		if desc {
+			res = -res
+		}
+		if res == 0 {
+			res = strings.Compare(a.Name, b.Name)
+			if desc && key == "name" {
+				res = -res
+			}
+		}
+		return res
+	})
+}
+
+// boolInt returns 1 for true
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sortLink is a column header of the index
+type sortLink struct {
+	Key    string
+	Href   string
+	Active bool
+	Desc   bool
+}
+
+// sortLinks returns the column headers of the index, the active one reverses its order
+func sortLinks(query url.Values, key string, desc bool) []sortLink {
+	res := make([]sortLink, 0, len(indexSortKeys))
+	for _, k := range indexSortKeys {
+		q := url.Values{}
+		maps.Copy(q, query)
+		q.Set("sort", k)
+		q.Set("order", "asc")
+		if k == key && !desc {
+			q.Set("order", "desc")
+		}
+		res = append(res, sortLink{Key: k, Href: "?" + q.Encode(), Active: k == key, Desc: desc})
+	}
+	return res
+}
+
+// recentActivity returns up to n of the events, newest first
+func recentActivity(evs []Event, n int) []Event {
+	res := make([]Event, 0, min(len(evs), n))
+	for i := len(evs) - 1; i >= 0 && len(res) < n; i-- {
+		res = append(res, evs[i])
+	}
+	return res
 }
 
 // Resource serves static resources like CSS and JS files
 func (h *HTMLHandler) Resource(path string, w io.Writer, r *http.Request) error {
-	buf, err := template_files.ReadFile(filepath.Join("templates", path))
+	buf, err := fs.ReadFile(h.templateFS(), filepath.Join("templates", path))
 	if err != nil {
 		slog.Error("no such assets", "path", path, "error", err)
 		return err
@@ -185,12 +1158,7 @@ func (h *HTMLHandler) ViewFile(name string, w io.Writer, r *http.Request) error
 		"templates/_footer.html",
 		"templates/_inline_style.html",
 	}
-	tmpl, err := template.New("view.html").Funcs(h.fmap).ParseFS(template_files, tmpl_files...)
-	if err != nil {
-		slog.Error("template load failed", "name", name, "error", err)
-		return err
-	}
-	historyfiles := h.ds.History(name)
+	historyfiles := h.ds.History(r.Context(), name)
 	buf := &bytes.Buffer{}
 	target := r.URL.Query().Get("history")
 	slog.Debug("reading target", "history", target)
@@ -198,7 +1166,7 @@ func (h *HTMLHandler) ViewFile(name string, w io.Writer, r *http.Request) error
 		rdc, err := h.ds.ReadHistory(name, target)
 		if err != nil {
 			slog.Error("cannot read history", "name", name, "target", target, "error", err)
-			return ErrNotFound
+			return err
 		}
 		defer rdc.Close()
 		if _, err := io.Copy(buf, rdc); err != nil {
@@ -206,28 +1174,76 @@ func (h *HTMLHandler) ViewFile(name string, w io.Writer, r *http.Request) error
 			return err
 		}
 	} else {
-		if err := h.ds.Read(name, buf); err != nil {
+		if err := h.ds.Read(r.Context(), name, buf); err != nil {
 			slog.Error("read failes", "name", name, "error", err)
-			return ErrNotFound
+			return err
 		}
 	}
+	if ctype := h.ds.ContentType(name); !isJSONType(ctype) {
+		return h.viewRaw(name, target, ctype, historyfiles, buf.Bytes(), w)
+	}
 	target_data := make(map[string]interface{})
 	if err := json.Unmarshal(buf.Bytes(), &target_data); err != nil {
 		slog.Error("json decode", "name", name, "error", err)
 		target_data["invalid json"] = buf.String()
 	}
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	tree, err := RenderJSONTree(buf.Bytes(), query.Get("path"), query.Get("filter"), page, query)
+	if err == ErrInvalidPath || err == ErrNotFound {
+		slog.Error("json path", "name", name, "path", query.Get("path"), "error", err)
+		return err
+	}
 	data := make(map[string]interface{})
+	data["tree"] = tree
+	data["path"] = query.Get("path")
+	data["filter"] = query.Get("filter")
 	data["name"] = target
 	data["file"] = name
 	data["data"] = target_data
 	data["history"] = historyfiles
+	data["protected"] = h.ds.Protected(name)
+	data["held"] = h.ds.Held(name)
+	data["lock"] = h.lockPanel(name)
+	data["notes"] = h.viewNotes(name)
+	data["description"] = h.viewDescription(name)
 	data["Title"] = name
 	data["basepath"] = h.basepath
-	if err := tmpl.Execute(w, data); err != nil {
-		slog.Error("template", "name", name, "error", err)
-		return err
+	return h.render(w, "view.html", tmpl_files, data)
+}
+
+// viewRaw serves the view of a file which is not JSON, showing text as is and only the size of anything else
+func (h *HTMLHandler) viewRaw(name string, target string, ctype string, historyfiles []FileEntry, content []byte, w io.Writer) error {
+	tmpl_files := []string{
+		"templates/view.html",
+		"templates/_header.html",
+		"templates/_footer.html",
+		"templates/_inline_style.html",
 	}
-	return nil
+	data := make(map[string]interface{})
+	data["contentType"] = ctype
+	data["size"] = int64(len(content))
+	if strings.HasPrefix(ctype, "text/") && utf8.Valid(content) {
+		data["text"] = string(content)
+	}
+	// relative to /html/view/<name>
+	file := strings.TrimPrefix(name, "/")
+	download := strings.Repeat("../", strings.Count(file, "/")+2) + "api/" + file
+	if target != "" {
+		download += "?history=" + url.QueryEscape(target)
+	}
+	data["download"] = download
+	data["name"] = target
+	data["file"] = name
+	data["history"] = historyfiles
+	data["protected"] = h.ds.Protected(name)
+	data["held"] = h.ds.Held(name)
+	data["lock"] = h.lockPanel(name)
+	data["notes"] = h.viewNotes(name)
+	data["description"] = h.viewDescription(name)
+	data["Title"] = name
+	data["basepath"] = h.basepath
+	return h.render(w, "view.html", tmpl_files, data)
 }
 
 // ViewFile serves the detailed view of a specific file
@@ -238,12 +1254,7 @@ func (h *HTMLHandler) DiffFile(name string, w io.Writer, r *http.Request) error
 		"templates/_footer.html",
 		"templates/_inline_style.html",
 	}
-	tmpl, err := template.New("diff.html").Funcs(h.fmap).ParseFS(template_files, tmpl_files...)
-	if err != nil {
-		slog.Error("template load failed", "name", name, "error", err)
-		return err
-	}
-	historyfiles := h.ds.History(name)
+	historyfiles := h.ds.History(r.Context(), name)
 	ab := []map[string]interface{}{}
 	keys := []string{"a", "b"}
 	for _, keyname := range keys {
@@ -255,7 +1266,7 @@ func (h *HTMLHandler) DiffFile(name string, w io.Writer, r *http.Request) error
 		rdc, err := h.ds.ReadHistory(name, target)
 		if err != nil {
 			slog.Error("cannot read history", "name", name, "target", target, "error", err)
-			return ErrNotFound
+			return err
 		}
 		defer rdc.Close()
 		if _, err := io.Copy(buf, rdc); err != nil {
@@ -269,14 +1280,7 @@ func (h *HTMLHandler) DiffFile(name string, w io.Writer, r *http.Request) error
 		}
 		ab = append(ab, target_data)
 	}
-	differ := gojsondiff.New()
-	diffs := differ.CompareObjects(ab[0], ab[1])
-	diffconfig := formatter.AsciiFormatterConfig{
-		ShowArrayIndex: true,
-		Coloring:       false,
-	}
-	fmter := formatter.NewAsciiFormatter(ab[0], diffconfig)
-	diffString, err := fmter.Format(diffs)
+	diffString, err := asciiDiff(ab[0], ab[1])
 	if err != nil {
 		slog.Error("diff format", "name", name, "error", err)
 		return err
@@ -290,103 +1294,342 @@ func (h *HTMLHandler) DiffFile(name string, w io.Writer, r *http.Request) error
 	data["b"] = ab[1]
 	data["diff"] = diffString
 	data["history"] = historyfiles
+	data["protected"] = h.ds.Protected(name)
+	data["held"] = h.ds.Held(name)
+	data["lock"] = h.lockPanel(name)
 	data["Title"] = name
 	data["basepath"] = h.basepath
-	if err := tmpl.Execute(w, data); err != nil {
-		slog.Error("template", "name", name, "error", err)
-		return err
+	return h.render(w, "diff.html", tmpl_files, data)
+}
+
+// asciiDiff formats the differences between two JSON objects
+func asciiDiff(a map[string]interface{}, b map[string]interface{}) (string, error) {
+	diffs := gojsondiff.New().CompareObjects(a, b)
+	diffconfig := formatter.AsciiFormatterConfig{
+		ShowArrayIndex: true,
+		Coloring:       false,
 	}
-	return nil
+	return formatter.NewAsciiFormatter(a, diffconfig).Format(diffs)
+}
+
+// lockPanel returns the lock info of the file shown in the header, or nil if it is not locked
+func (h *HTMLHandler) lockPanel(name string) map[string]interface{} {
+	content, err := h.ds.LockRead(name)
+	if err != nil {
+		return nil
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(content), &res); err != nil || res == nil {
+		return map[string]interface{}{"Info": content}
+	}
+	return res
+}
+
+// pageName returns the normalized file name of a view or diff page
+func pageName(name string) (string, error) {
+	res, err := normalizeName(name, false)
+	if err == nil && res == "" {
+		return "", ErrInvalidPath
+	}
+	return res, err
 }
 
 // ServeHTTP routes HTTP requests to the appropriate HTML handler methods
 func (h *HTMLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	st := time.Now()
-	slog.Info("access", "method", r.Method, "path", r.URL.Path, "params", r.URL.Query(), "headers", r.Header)
+	ctx, ops := withOpStats(r.Context())
+	r = r.WithContext(ctx)
+	h.accessLog.access(r)
 	var err error
 	buf := &bytes.Buffer{}
 	path := r.URL.Path
-	if r.Method != http.MethodGet {
+	if r.Method == http.MethodPost && path == "admin" {
+		h.RunMaintenance(w, r)
+		return
+	}
+	// HEAD renders the page as GET does, writeResponse leaves out the body
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 	if path == "" {
 		err = h.Index(path, buf, r)
-	} else if strings.HasPrefix(path, "view/") {
-		name := strings.TrimPrefix(path, "view/")
-		err = h.ViewFile(name, buf, r)
-	} else if strings.HasPrefix(path, "diff/") {
-		name := strings.TrimPrefix(path, "diff/")
-		err = h.DiffFile(name, buf, r)
+	} else if path == "admin" {
+		err = h.Admin(path, buf, r)
+	} else if name, ok := strings.CutPrefix(path, "view/"); ok {
+		if name, err = pageName(name); err == nil {
+			err = h.ViewFile(h.aliases.Resolve(name), buf, r)
+		}
+	} else if name, ok := strings.CutPrefix(path, "diff/"); ok {
+		if name, err = pageName(name); err == nil {
+			err = h.DiffFile(h.aliases.Resolve(name), buf, r)
+		}
 	} else {
 		err = h.Resource(path, buf, r)
 	}
-	w.Header().Add("Content-Length", strconv.Itoa(buf.Len()))
-	md5sum := md5.Sum(buf.Bytes())
-	w.Header().Add("Content-Md5", base64.StdEncoding.EncodeToString(md5sum[:]))
-	var statuscode int
-	switch err {
-	case nil:
-		statuscode = http.StatusOK
-	case ErrLocked:
-		statuscode = http.StatusConflict
-	case ErrUnlocked:
-		statuscode = http.StatusConflict
-	case ErrInvalidPath:
-		statuscode = http.StatusBadRequest
-	case ErrInvalidHash:
-		statuscode = http.StatusBadRequest
-	case ErrNotFound:
-		statuscode = http.StatusNotFound
-	default:
+	if clientGone(r, st, err) {
+		return
+	}
+	statuscode := http.StatusOK
+	if err != nil {
+		statuscode = errorStatus(err, h.lockConflict)
+	}
+	if statuscode == http.StatusInternalServerError {
 		slog.Info("unknown error", "error", err)
-		statuscode = http.StatusInternalServerError
 	}
-	w.WriteHeader(statuscode)
-	written, err1 := io.Copy(w, buf)
-	if err1 != nil {
-		slog.Warn("write response", "written", written, "error", err1, "path", path)
+	writeResponse(w, r, statuscode, buf.Bytes(), nil)
+	h.accessLog.response(r, statuscode, time.Since(st), ops)
+}
+
+// RequestTimeout wraps a handler with http.TimeoutHandler, which answers 503 when it does not finish before
+// the deadline; a long-poll sees the deadline in its context and answers a second before it
+type RequestTimeout struct {
+	handler http.Handler
+	timeout time.Duration
+}
+
+// ServeHTTP runs the wrapped handler with a request-scoped deadline
+func (h *RequestTimeout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.timeout <= 0 {
+		h.handler.ServeHTTP(w, r)
+		return
 	}
-	elapsed := time.Since(st)
-	slog.Info("response", "status", http.StatusText(statuscode), "method", r.Method, "path", r.URL.Path, "elapsed", elapsed)
+	http.TimeoutHandler(h.handler, h.timeout, "request timeout\n").ServeHTTP(w, r)
 }
 
 // WebServer represents the web server command
 type WebServer struct {
-	Listen        string `short:"l" long:"listen" default:":3000" env:"STSV_LISTEN" description:"listen address"`
-	Auth          string `short:"u" long:"user" description:"basic auth username:password"`
-	OpenTelemetry bool   `long:"opentelemetry"`
-	server        *http.ServeMux
-	apihandler    *APIHandler
-	htmlhandler   *HTMLHandler
+	Listen           string        `short:"l" long:"listen" default:":3000" env:"STSV_LISTEN" description:"listen address"`
+	Auth             string        `short:"u" long:"user" description:"basic auth username:password"`
+	AuthFile         string        `long:"auth-file" env:"STSV_AUTH_FILE" description:"htpasswd file for basic auth (reloaded on SIGHUP)"`
+	OpenTelemetry    bool          `long:"opentelemetry"`
+	PprofListen      string        `long:"pprof-listen" env:"STSV_PPROF_LISTEN" description:"serve net/http/pprof on this address, e.g. 127.0.0.1:6060; no authentication, keep it internal"`
+	RequestTimeout   time.Duration `long:"request-timeout" env:"STSV_REQUEST_TIMEOUT" description:"deadline for each request, answered with 503 after it (0: no limit)"`
+	RejectBinary     bool          `long:"reject-binary" env:"STSV_REJECT_BINARY" description:"reject uploads which do not look like text or JSON"`
+	RecentEvents     int           `long:"recent-events" default:"100" env:"STSV_RECENT_EVENTS" description:"number of events kept for the activity feed"`
+	NoRecover        bool          `long:"no-recover" description:"do not recover interrupted operations on startup"`
+	ScanOnStart      bool          `long:"scan-on-start" env:"STSV_SCAN_ON_START" description:"check the datastore and repair what is safe before listening"`
+	ScanStrict       bool          `long:"scan-strict" env:"STSV_SCAN_STRICT" description:"refuse to start if the scan finds problems it cannot repair (implies --scan-on-start)"`
+	ScanWorkers      int           `long:"scan-workers" default:"4" description:"number of files checked in parallel by the scan"`
+	ScanTimeout      time.Duration `long:"scan-timeout" default:"5m" description:"give up the scan after this duration (0: no limit)"`
+	SigningKey       string        `long:"signing-key" env:"STSV_SIGNING_KEY" description:"key to verify signed urls made by the sign command"`
+	ACLFile          string        `long:"acl-file" env:"STSV_ACL_FILE" description:"per-file access rules of users (reloaded on SIGHUP)"`
+	MaxWatchers      int           `long:"max-watchers" default:"100" env:"STSV_MAX_WATCHERS" description:"maximum number of open event streams (0: no limit)"`
+	RequireLock      bool          `long:"require-lock" env:"STSV_REQUIRE_LOCK" description:"reject writes to a locked file without its lock ID, even if no ID is given"`
+	NormalizeJSON    bool          `long:"normalize-json" env:"STSV_NORMALIZE_JSON" description:"store JSON uploads with sorted keys and fixed indentation, skipping uploads equal to the current version"`
+	NormalizeNewline bool          `long:"normalize-newline" env:"STSV_NORMALIZE_NEWLINE" description:"end JSON uploads with exactly one newline, skipping uploads equal to the current version"`
+	MissingAsEmpty   bool          `long:"missing-state-as-empty" env:"STSV_MISSING_STATE_AS_EMPTY" description:"answer GET of a missing file with 200 and an empty document instead of 404"`
+	MissingBody      string        `long:"missing-state-body" env:"STSV_MISSING_STATE_BODY" choice:"json" choice:"none" default:"json" description:"the empty document of --missing-state-as-empty: {} or no content"`
+	StrictPaths      bool          `long:"strict-paths" env:"STSV_STRICT_PATHS" description:"reject API paths with doubled or trailing slashes instead of normalizing them"`
+	ReplicaFallback  bool          `long:"replica-read-fallback" env:"STSV_REPLICA_READ_FALLBACK" description:"serve reads from --replica-dir when reading the data directory fails"`
+	GCInterval       time.Duration `long:"gc-interval" env:"STSV_GC_INTERVAL" description:"run maintenance at this interval (0: only on request from the admin page)"`
+	GCKeep           int           `long:"gc-keep" env:"STSV_GC_KEEP" description:"number of versions kept by maintenance (0: do not prune)"`
+	WriteReceipt     bool          `long:"write-receipt" env:"STSV_WRITE_RECEIPT" description:"answer successful writes with the name, version, size and md5 of the stored version as JSON"`
+	LockMethod       string        `long:"lock-method" env:"STSV_LOCK_METHOD" default:"LOCK" description:"HTTP method of lock requests, like lock_method of the terraform http backend; POST and other standard methods also need ?lock=1"`
+	UnlockMethod     string        `long:"unlock-method" env:"STSV_UNLOCK_METHOD" default:"UNLOCK" description:"HTTP method of unlock requests, like unlock_method of the terraform http backend; standard methods also need ?unlock=1"`
+	LockConflict     int           `long:"lock-conflict-status" env:"STSV_LOCK_CONFLICT_STATUS" choice:"409" choice:"423" default:"409" description:"status of requests refused because the file is locked by another ID"`
+	UploadExpire     time.Duration `long:"upload-expire" env:"STSV_UPLOAD_EXPIRE" default:"24h" description:"maintenance removes resumable uploads which received nothing for longer than this"`
+	LogSample        float64       `long:"log-sample" env:"STSV_LOG_SAMPLE" default:"1" description:"fraction of successful requests logged, e.g. 0.1; errors and slow requests are always logged"`
+	MaxWait          time.Duration `long:"max-wait" env:"STSV_MAX_WAIT" default:"60s" description:"longest time a GET with ?wait= is held open, whatever its ?timeout="`
+	BulkWorkers      int           `long:"bulk-workers" env:"STSV_BULK_WORKERS" default:"4" description:"number of paths of a +bulk request handled in parallel"`
+	Upstream         string        `long:"upstream" env:"STSV_UPSTREAM" description:"URL of the backend which GETs of files missing here are read from, e.g. while migrating from it"`
+	UpstreamCache    bool          `long:"upstream-cache" env:"STSV_UPSTREAM_CACHE" description:"store the files read from --upstream here, so that their history starts here"`
+	UpstreamTimeout  time.Duration `long:"upstream-timeout" env:"STSV_UPSTREAM_TIMEOUT" default:"10s" description:"give up reading from --upstream after this duration"`
+	Webhook          []string      `long:"webhook" env:"STSV_WEBHOOK" env-delim:"," description:"URL which the events are POSTed to as JSON (repeatable)"`
+	WebhookFlush     time.Duration `long:"webhook-flush-interval" env:"STSV_WEBHOOK_FLUSH_INTERVAL" description:"collect the events of this duration and deliver them as a JSON array, keeping only the latest write of a state (0: one request per event)"`
+	WebhookBatch     int           `long:"webhook-batch-size" env:"STSV_WEBHOOK_BATCH_SIZE" default:"100" description:"deliver a batch of --webhook-flush-interval early once it has this many events"`
+	SlowThreshold    time.Duration `long:"slow-threshold" env:"STSV_SLOW_THRESHOLD" default:"2s" description:"log requests taking longer as slow, with the time spent in the datastore (0: never)"`
+	GCLockExpire     time.Duration `long:"gc-lock-expire" env:"STSV_GC_LOCK_EXPIRE" description:"maintenance removes locks held longer than this (0: keep locks)"`
+	server           *http.ServeMux
+	events           *EventBroker
+	apihandler       *APIHandler
+	htmlhandler      *HTMLHandler
 }
 
-func mytime(ts *time.Time) template.HTML {
-	duration := humanize.RelTime(time.Now(), *ts, "", "")
-	return template.HTML(fmt.Sprintf("<abbr title=\"%s\" class=\"default\">%s</abbr>", ts.Format(time.RFC3339), duration))
+// lockMethods returns the methods of lock and unlock requests
+func (cmd *WebServer) lockMethods() LockMethods {
+	return LockMethods{Lock: strings.ToUpper(cmp.Or(cmd.LockMethod, "LOCK")), Unlock: strings.ToUpper(cmp.Or(cmd.UnlockMethod, "UNLOCK"))}
+}
+
+// missingBody returns the body for GET of a missing file, nil to answer 404
+func (cmd *WebServer) missingBody() []byte {
+	if !cmd.MissingAsEmpty {
+		return nil
+	}
+	if cmd.MissingBody == "none" {
+		return []byte{}
+	}
+	return []byte("{}")
 }
 
-func mybytes(b int64) string {
-	return humanize.IBytes(uint64(b))
+// startupCheck recovers interrupted operations, or runs the consistency scan if enabled
+func (cmd *WebServer) startupCheck(d *Datastore) error {
+	if cmd.ScanOnStart || cmd.ScanStrict {
+		res, err := d.Scan("/", cmd.ScanWorkers, cmd.ScanTimeout)
+		if err != nil {
+			slog.Error("scan failed", "error", err)
+			return err
+		}
+		for _, v := range res.Repaired {
+			slog.Warn("repaired", "name", v.Name, "problem", v.Problem)
+		}
+		for _, v := range res.Unrepaired {
+			slog.Error("cannot repair", "name", v.Name, "problem", v.Problem)
+		}
+		slog.Info("scan finished", "checked", res.Checked, "repaired", len(res.Repaired), "unrepaired", len(res.Unrepaired), "incomplete", res.Incomplete, "elapsed", res.Elapsed)
+		if res.Incomplete {
+			slog.Warn("scan did not finish in time, remaining files are recovered on access", "timeout", cmd.ScanTimeout)
+		}
+		if cmd.ScanStrict && len(res.Unrepaired) != 0 {
+			return ErrInconsistent
+		}
+		return nil
+	}
+	if cmd.NoRecover {
+		return nil
+	}
+	res, err := d.RecoverAll("/")
+	if err != nil {
+		slog.Error("recovery failed", "error", err)
+		return err
+	}
+	for _, v := range res {
+		slog.Warn("recovered", "name", v.Name, "problem", v.Problem, "fixed", v.Fixed)
+	}
+	return nil
 }
 
 func (cmd *WebServer) Execute(args []string) error {
 	init_log()
+	if cmd.PprofListen != "" {
+		if err := checkPprofListen(cmd.Listen, cmd.PprofListen); err != nil {
+			slog.Error("invalid pprof address", "error", err)
+			return err
+		}
+	}
+	if err := cmd.lockMethods().check(); err != nil {
+		slog.Error("invalid lock methods", "error", err)
+		return err
+	}
+	if cmd.LogSample < 0 || cmd.LogSample > 1 {
+		return fmt.Errorf("--log-sample %v: expected a fraction from 0 to 1", cmd.LogSample)
+	}
+	accessLog := &AccessLog{Sample: cmd.LogSample, Slow: cmd.SlowThreshold}
 	cmd.server = http.NewServeMux()
-	d := NewDatastore(option.Datadir)
+	d := openDatastore()
+	d.RequireLock = cmd.RequireLock
+	d.NormalizeJSON = cmd.NormalizeJSON
+	d.NormalizeNewline = cmd.NormalizeNewline
+	d.UploadExpire = cmd.UploadExpire
+	if err := cmd.startupCheck(&d); err != nil {
+		return err
+	}
+	if err := d.markRoot(); err != nil {
+		slog.Warn("cannot mark data directory", "root", d.RootName, "error", err)
+	}
+	if states, size, err := d.Stats(); err != nil {
+		slog.Warn("cannot scan data directory", "root", d.RootName, "error", err)
+	} else {
+		slog.Info("datastore", "root", d.RootName, "states", states, "size", humanizeBytes(size))
+	}
+	aliases, err := openAliases()
+	if err != nil {
+		slog.Error("invalid aliases", "error", err)
+		return err
+	}
+	aliases.shadowed(&d)
+	cmd.events = NewEventBroker()
+	cmd.events.SetRecentSize(cmd.RecentEvents)
 	cmd.apihandler = &APIHandler{
-		ds:       &d,
-		basepath: "/api/",
+		ds:           &d,
+		basepath:     "/api/",
+		events:       cmd.events,
+		rejectBinary: cmd.RejectBinary,
+		strictPaths:  cmd.StrictPaths,
+		capabilities: cmd.capabilities(&d),
+		missingBody:  cmd.missingBody(),
+		lockConflict: cmd.LockConflict,
+		aliases:      aliases,
+		writeReceipt: cmd.WriteReceipt,
+		lockMethods:  cmd.lockMethods(),
+		accessLog:    accessLog,
+		maxWait:      cmd.MaxWait,
+		bulkWorkers:  cmd.BulkWorkers,
+	}
+	for _, target := range cmd.Webhook {
+		wh, err := NewWebhook(target, cmd.WebhookFlush, cmd.WebhookBatch)
+		if err != nil {
+			return err
+		}
+		wh.Start(cmd.events)
+		cmd.apihandler.webhooks = append(cmd.apihandler.webhooks, wh)
+	}
+	if cmd.Upstream != "" {
+		upstream, err := NewUpstream(cmd.Upstream, cmd.UpstreamCache, cmd.UpstreamTimeout)
+		if err != nil {
+			return err
+		}
+		slog.Info("read through upstream", "upstream", upstream.base.Redacted(), "cache", upstream.Cache)
+		cmd.apihandler.upstream = upstream
 	}
+	if replica := openReplica(); replica != nil && cmd.ReplicaFallback {
+		slog.Info("replica read fallback", "replica", replica.RootName)
+		cmd.apihandler.replica = replica
+	}
+	maintenance := NewMaintenance(func(ctx context.Context) MaintenanceResult {
+		return d.Maintain(ctx, cmd.GCKeep, cmd.GCLockExpire)
+	}, cmd.GCInterval)
+	go maintenance.Loop(context.Background())
 	cmd.htmlhandler = &HTMLHandler{
-		ds:       &d,
-		fmap:     sprig.FuncMap(),
-		basepath: "/html/",
-	}
-	cmd.htmlhandler.fmap["mytime"] = mytime
-	cmd.htmlhandler.fmap["mybytes"] = mybytes
-	cmd.server.Handle("/api/", http.StripPrefix(cmd.apihandler.basepath, cmd.apihandler))
-	cmd.server.Handle("/html/", http.StripPrefix(cmd.htmlhandler.basepath, cmd.htmlhandler))
+		ds:           &d,
+		fmap:         templateFuncs(),
+		basepath:     "/html/",
+		events:       cmd.events,
+		maintenance:  maintenance,
+		csrfKey:      newCSRFKey(),
+		lockConflict: cmd.LockConflict,
+		aliases:      aliases,
+		accessLog:    accessLog,
+	}
+	cmd.server.Handle("/api/", http.StripPrefix(cmd.apihandler.basepath, &RequestTimeout{handler: cmd.apihandler, timeout: cmd.RequestTimeout}))
+	watch := &EventHandler{broker: cmd.events, maxWatchers: cmd.MaxWatchers}
+	cmd.server.Handle("/api/_events", watch)
+	cmd.server.Handle("/api/+watch", watch)
+	cmd.server.Handle("/html/", http.StripPrefix(cmd.htmlhandler.basepath, &RequestTimeout{handler: cmd.htmlhandler, timeout: cmd.RequestTimeout}))
+	var handler http.Handler = cmd.server
+	if cmd.ACLFile != "" {
+		acl, err := NewACL(cmd.server, cmd.ACLFile)
+		if err != nil {
+			return err
+		}
+		acl.ReloadOnSignal()
+		acl.lockMethods = cmd.lockMethods()
+		acl.aliases = aliases
+		cmd.htmlhandler.acl = acl
+		cmd.apihandler.acl = acl
+		watch.acl = acl
+		handler = acl
+	}
+	if cmd.Auth != "" || cmd.AuthFile != "" {
+		auth, err := NewBasicAuth(handler, cmd.Auth, cmd.AuthFile)
+		if err != nil {
+			return err
+		}
+		if cmd.AuthFile != "" {
+			auth.ReloadOnSignal()
+		}
+		handler = auth
+	}
+	if cmd.SigningKey != "" {
+		handler = &SignedURL{handler: cmd.server, fallback: handler, key: cmd.SigningKey}
+	}
+	if cmd.PprofListen != "" {
+		go servePprof(cmd.PprofListen)
+	}
+	// probes need no credentials
+	root := http.NewServeMux()
+	root.Handle("/readyz", &Readiness{ds: &d})
+	root.Handle("/", handler)
 	slog.Info("starting server", "address", cmd.Listen)
-	return http.ListenAndServe(cmd.Listen, cmd.server)
+	return http.ListenAndServe(cmd.Listen, root)
 }
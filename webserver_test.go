@@ -1,27 +1,53 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 type mockDS struct {
-	readBody    string
-	readErr     error
-	deleteErr   error
-	writeErr    error
-	lockErr     error
-	unlockErr   error
-	lastWrite   string
-	lastLockArg string
+	readBody     string
+	readErr      error
+	deleteErr    error
+	writeErr     error
+	lockErr      error
+	unlockErr    error
+	lastWrite    string
+	lastName     string
+	replaced     bool
+	lastLockArg  string
+	delay        time.Duration
+	locks        []LockEntry
+	lastRollback string
+	current      string
+	lastPrune    int
+	protected    bool
+	held         bool
+	lockHolder   string
+	entries      []FileEntry
+	skipped      []WalkFailure
+	history      []FileEntry
+	contentType  string
+	walked       int
 }
 
-func (m *mockDS) Read(name string, out io.Writer) error {
+func (m *mockDS) Read(ctx context.Context, name string, out io.Writer) error {
+	time.Sleep(m.delay)
 	if m.readErr != nil {
 		return m.readErr
 	}
@@ -31,78 +57,177 @@ func (m *mockDS) Read(name string, out io.Writer) error {
 
 func (m *mockDS) Delete(name string) error { return m.deleteErr }
 
-func (m *mockDS) Write(name string, input io.Reader, hash []byte, lockid string) error {
+func (m *mockDS) Protected(name string) bool { return m.protected }
+
+func (m *mockDS) Held(name string) bool { return m.held }
+
+func (m *mockDS) ContentType(name string) string {
+	if m.contentType == "" {
+		return defaultContentType
+	}
+	return m.contentType
+}
+
+func (m *mockDS) SetContentType(name string, ctype string) error {
+	m.contentType = ctype
+	return nil
+}
+
+func (m *mockDS) Write(ctx context.Context, name string, input io.Reader, hash []byte, lockid string) error {
 	if m.writeErr != nil {
 		return m.writeErr
 	}
 	b, _ := io.ReadAll(input)
+	m.lastName = name
 	m.lastWrite = string(b)
 	return nil
 }
 
+func (m *mockDS) Replace(ctx context.Context, name string, input io.Reader, hash []byte, lockid string) error {
+	m.replaced = true
+	return m.Write(ctx, name, input, hash, lockid)
+}
+
 func (m *mockDS) Lock(name string, lockinfo string) error {
 	m.lastLockArg = lockinfo
 	return m.lockErr
 }
 
+func (m *mockDS) ReadRaw(name string, history string) (RawVersion, error) {
+	if m.readErr != nil {
+		return RawVersion{}, m.readErr
+	}
+	return RawVersion{ReadCloser: io.NopCloser(strings.NewReader(m.readBody))}, nil
+}
+
+func (m *mockDS) LockRead(name string) (string, error) {
+	if m.lockHolder == "" {
+		return "", ErrUnlocked
+	}
+	return m.lockHolder, nil
+}
+
 func (m *mockDS) Unlock(name string, lockinfo string) error {
 	m.lastLockArg = lockinfo
 	return m.unlockErr
 }
 
-func (m *mockDS) History(name string) []FileEntry {
-	return nil
+func (m *mockDS) History(ctx context.Context, name string) []FileEntry {
+	return m.history
 }
 
 func (m *mockDS) ReadHistory(name string, target string) (io.ReadCloser, error) {
-	return nil, nil
+	if m.readErr != nil {
+		return nil, m.readErr
+	}
+	return io.NopCloser(strings.NewReader(m.readBody)), nil
 }
 
-func (m *mockDS) Walk(prefix string, fn func(entry FileEntry) error) error {
+func (m *mockDS) Walk(ctx context.Context, prefix string, fn func(entry FileEntry) error) error {
+	for _, e := range m.entries {
+		time.Sleep(m.delay)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		m.walked++
+		if err := fn(e); err == filepath.SkipAll {
+			return nil
+		} else if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
 	return nil
 }
 
-func TestAPIGet_Success(t *testing.T) {
-	ds := &mockDS{readBody: "hello"}
-	h := &APIHandler{ds: ds}
+func (m *mockDS) WalkSkipped(ctx context.Context, prefix string, fn func(entry FileEntry) error) ([]WalkFailure, error) {
+	return m.skipped, m.Walk(ctx, prefix, fn)
+}
 
-	req := httptest.NewRequest(http.MethodGet, "/api/foo", nil)
-	rr := httptest.NewRecorder()
-	h.ServeHTTP(rr, req)
+func (m *mockDS) Locks(prefix string) ([]LockEntry, error) {
+	return m.locks, nil
+}
 
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected 200, got %d", rr.Code)
+func (m *mockDS) Rollback(name string, history string) error {
+	return m.RollbackIf(name, history, "")
+}
+
+func (m *mockDS) RollbackIf(name string, history string, current string) error {
+	if current != "" && current != m.current {
+		return ErrPrecondition
+	}
+	m.lastRollback = history
+	return m.writeErr
+}
+
+func (m *mockDS) CurrentVersion(name string) string {
+	return m.current
+}
+
+func (m *mockDS) Prune(ctx context.Context, name string, keep int, dry bool) error {
+	m.lastPrune = keep
+	return m.writeErr
+}
+
+// request sends a request to the test server and returns the status and the body
+func request(t *testing.T, srv *httptest.Server, method string, path string, body string, header ...string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(b)
+}
+
+func TestAPIGet_Success(t *testing.T) {
+	ds := newMemDS()
+	ds.put("foo", "hello")
+	srv := newTestServer(t, ds)
+
+	res, err := srv.Client().Get(srv.URL + "/api/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
 	}
-	if rr.Body.String() != "hello" {
-		t.Fatalf("unexpected body: %q", rr.Body.String())
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body: %q", body)
 	}
 	// verify md5 header
 	sum := md5.Sum([]byte("hello"))
 	expect := base64.StdEncoding.EncodeToString(sum[:])
-	if got := rr.Header().Get("content-md5"); got != expect {
+	if got := res.Header.Get("content-md5"); got != expect {
 		t.Fatalf("content-md5 mismatch: %s vs %s", got, expect)
 	}
 }
 
 func TestAPIGet_NotFound(t *testing.T) {
-	ds := &mockDS{readErr: ErrNotFound}
-	h := &APIHandler{ds: ds}
-	req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
-	rr := httptest.NewRecorder()
-	h.ServeHTTP(rr, req)
-	if rr.Code != http.StatusNotFound {
-		t.Fatalf("expected 404, got %d", rr.Code)
+	srv := newTestServer(t, newMemDS())
+	if code, _ := request(t, srv, http.MethodGet, "/api/x", ""); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
 	}
 }
 
 func TestAPIDelete(t *testing.T) {
-	ds := &mockDS{deleteErr: nil}
-	h := &APIHandler{ds: ds}
-	req := httptest.NewRequest(http.MethodDelete, "/api/a", nil)
-	rr := httptest.NewRecorder()
-	h.ServeHTTP(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected 200, got %d", rr.Code)
+	ds := newMemDS()
+	ds.put("a", "x")
+	srv := newTestServer(t, ds)
+	if code, _ := request(t, srv, http.MethodDelete, "/api/a", ""); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code, _ := request(t, srv, http.MethodGet, "/api/a", ""); code != http.StatusNotFound {
+		t.Errorf("deleted file still served: %d", code)
 	}
 }
 
@@ -111,63 +236,120 @@ func TestAPIPost_Write(t *testing.T) {
 	sum := md5.Sum([]byte(body))
 	md5b64 := base64.StdEncoding.EncodeToString(sum[:])
 
-	ds := &mockDS{}
-	h := &APIHandler{ds: ds}
-	req := httptest.NewRequest(http.MethodPost, "/api/f", strings.NewReader(body))
-	req.Header.Set("content-md5", md5b64)
-	rr := httptest.NewRecorder()
-	h.ServeHTTP(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected 200, got %d", rr.Code)
+	ds := newMemDS()
+	srv := newTestServer(t, ds)
+	if code, _ := request(t, srv, http.MethodPost, "/api/f", body, "content-md5", md5b64); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code, got := request(t, srv, http.MethodGet, "/api/f", ""); code != http.StatusOK || got != body {
+		t.Fatalf("write not received by datastore: %d %q", code, got)
 	}
-	if ds.lastWrite != body {
-		t.Fatalf("write not received by datastore: %q", ds.lastWrite)
+	if got := ds.called("Write"); len(got) != 1 || got[0] != "f" {
+		t.Errorf("unexpected writes %v", got)
 	}
 }
 
 func TestAPIPost_InvalidHash(t *testing.T) {
-	ds := &mockDS{writeErr: ErrInvalidHash}
-	h := &APIHandler{ds: ds}
-	req := httptest.NewRequest(http.MethodPost, "/api/f", strings.NewReader("x"))
-	rr := httptest.NewRecorder()
-	h.ServeHTTP(rr, req)
-	if rr.Code != http.StatusBadRequest {
-		t.Fatalf("expected 400, got %d", rr.Code)
+	srv := newTestServer(t, newMemDS())
+	sum := md5.Sum([]byte("other"))
+	if code, _ := request(t, srv, http.MethodPost, "/api/f", "x", "content-md5", base64.StdEncoding.EncodeToString(sum[:])); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
 	}
 }
 
 func TestAPILockUnlock(t *testing.T) {
-	ds := &mockDS{lockErr: nil, unlockErr: nil}
-	h := &APIHandler{ds: ds}
+	ds := newMemDS()
+	srv := newTestServer(t, ds)
 
-	// LOCK
-	req := httptest.NewRequest("LOCK", "/api/z", strings.NewReader("{\"ID\":\"1\"}"))
-	rr := httptest.NewRecorder()
-	h.ServeHTTP(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected 200 for LOCK, got %d", rr.Code)
+	if code, _ := request(t, srv, "LOCK", "/api/z", "{\"ID\":\"1\"}"); code != http.StatusOK {
+		t.Fatalf("expected 200 for LOCK, got %d", code)
 	}
-	if ds.lastLockArg != "{\"ID\":\"1\"}" {
-		t.Fatalf("lock arg mismatch: %q", ds.lastLockArg)
+	holder, err := ds.LockRead("z")
+	stored := map[string]interface{}{}
+	if err != nil || json.Unmarshal([]byte(holder), &stored) != nil || stored["ID"] != "1" || stored[lockServerKey] == nil {
+		t.Fatalf("lock arg mismatch: %q %v", holder, err)
 	}
-
-	// UNLOCK
-	req2 := httptest.NewRequest("UNLOCK", "/api/z", strings.NewReader("{\"ID\":\"1\"}"))
-	rr2 := httptest.NewRecorder()
-	h.ServeHTTP(rr2, req2)
-	if rr2.Code != http.StatusOK {
-		t.Fatalf("expected 200 for UNLOCK, got %d", rr2.Code)
+	if code, _ := request(t, srv, http.MethodPost, "/api/z", "{}"); code != http.StatusConflict {
+		t.Errorf("write without the lock ID: %d", code)
+	}
+	if code, _ := request(t, srv, http.MethodPost, "/api/z?ID=1", "{}"); code != http.StatusOK {
+		t.Errorf("write with the lock ID: %d", code)
+	}
+	if code, _ := request(t, srv, "UNLOCK", "/api/z", "{\"ID\":\"1\"}"); code != http.StatusOK {
+		t.Fatalf("expected 200 for UNLOCK, got %d", code)
 	}
 }
 
 func TestAPILock_Conflict(t *testing.T) {
-	ds := &mockDS{lockErr: ErrLocked}
-	h := &APIHandler{ds: ds}
-	req := httptest.NewRequest("LOCK", "/api/z", strings.NewReader("{\"ID\":\"1\"}"))
+	ds := newMemDS()
+	srv := newTestServer(t, ds)
+	if code, _ := request(t, srv, "LOCK", "/api/z", "{\"ID\":\"1\"}"); code != http.StatusOK {
+		t.Fatalf("expected 200 for LOCK, got %d", code)
+	}
+	code, body := request(t, srv, "LOCK", "/api/z", "{\"ID\":\"2\"}")
+	if code != http.StatusConflict {
+		t.Fatalf("expected 409 for LOCK conflict, got %d", code)
+	}
+	if !strings.Contains(body, `"ID":"1"`) {
+		t.Errorf("holder not returned: %s", body)
+	}
+	ds.errs["Lock"] = ErrLocked
+	if code, _ := request(t, srv, "LOCK", "/api/y", "{\"ID\":\"1\"}"); code != http.StatusConflict {
+		t.Errorf("scripted conflict: %d", code)
+	}
+}
+
+func TestAPIPost_WriteReceipt(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		ds := NewDatastore(t.TempDir())
+		ds.Compress = compress
+		h := &APIHandler{ds: &ds, writeReceipt: true}
+		content := `{"serial": 1}`
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/dir/state", strings.NewReader(content)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("compress=%v: status %d", compress, rr.Code)
+		}
+		receipt := WriteReceipt{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &receipt); err != nil {
+			t.Fatalf("compress=%v: invalid receipt %q: %v", compress, rr.Body.String(), err)
+		}
+		sum := md5.Sum([]byte(content))
+		expected := WriteReceipt{Name: "dir/state", Version: ds.CurrentVersion("dir/state"), Size: int64(len(content)), MD5: hex.EncodeToString(sum[:])}
+		if receipt != expected || expected.Version == "" {
+			t.Errorf("compress=%v: expected %+v, got %+v", compress, expected, receipt)
+		}
+	}
+
+	ds := NewDatastore(t.TempDir())
 	rr := httptest.NewRecorder()
-	h.ServeHTTP(rr, req)
-	if rr.Code != http.StatusConflict {
-		t.Fatalf("expected 409 for LOCK conflict, got %d", rr.Code)
+	(&APIHandler{ds: &ds}).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/state", strings.NewReader("{}")))
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("expected an empty body without --write-receipt, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAPILock_ConflictStatus(t *testing.T) {
+	holder := `{"ID":"other"}`
+	for _, status := range []int{http.StatusConflict, http.StatusLocked} {
+		tests := []struct {
+			method string
+			ds     *mockDS
+		}{
+			{"LOCK", &mockDS{lockErr: ErrLocked, lockHolder: holder}},
+			{http.MethodPost, &mockDS{writeErr: ErrLocked, lockHolder: holder}},
+		}
+		for _, test := range tests {
+			h := &APIHandler{ds: test.ds, lockConflict: status}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(test.method, "/api/z?ID=1", strings.NewReader(`{"ID":"1"}`)))
+			if rr.Code != status {
+				t.Errorf("%d %s: got %d", status, test.method, rr.Code)
+			}
+			if rr.Body.String() != holder {
+				t.Errorf("%d %s: expected the holder, got %q", status, test.method, rr.Body.String())
+			}
+		}
 	}
 }
 
@@ -214,3 +396,898 @@ func TestAPIGet_InvalidPath(t *testing.T) {
 		t.Fatalf("expected 400 for GET invalid path, got %d", rr.Code)
 	}
 }
+
+func TestRequestTimeout_Expired(t *testing.T) {
+	ds := &mockDS{readBody: "slow", delay: 200 * time.Millisecond}
+	h := &RequestTimeout{handler: &APIHandler{ds: ds}, timeout: 20 * time.Millisecond}
+	req := httptest.NewRequest(http.MethodGet, "/api/slow", nil)
+	rr := httptest.NewRecorder()
+	st := time.Now()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rr.Code)
+	}
+	if elapsed := time.Since(st); elapsed > 150*time.Millisecond {
+		t.Errorf("timeout not enforced, elapsed %s", elapsed)
+	}
+	if rr.Body.String() != "request timeout\n" {
+		t.Errorf("unexpected body: %q", rr.Body.String())
+	}
+}
+
+func TestRequestTimeout_Wait(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	versions := writeAt(t, &ds, "prod", time.Now())
+	h := &RequestTimeout{handler: &APIHandler{ds: &ds, events: NewEventBroker()}, timeout: 1100 * time.Millisecond}
+	rr := httptest.NewRecorder()
+	st := time.Now()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/prod?wait="+versions[0]+"&timeout=10s", nil))
+	// the long-poll answers before the deadline instead of timing out
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d %q", rr.Code, rr.Body.String())
+	}
+	if elapsed := time.Since(st); elapsed > time.Second {
+		t.Errorf("wait not capped by the deadline, elapsed %s", elapsed)
+	}
+}
+
+func TestRequestTimeout_InTime(t *testing.T) {
+	ds := &mockDS{readBody: "fast"}
+	h := &RequestTimeout{handler: &APIHandler{ds: ds}, timeout: time.Second}
+	req := httptest.NewRequest(http.MethodGet, "/api/fast", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if rr.Body.String() != "fast" {
+		t.Errorf("unexpected body: %q", rr.Body.String())
+	}
+	if rr.Header().Get("Content-Md5") == "" {
+		t.Errorf("headers not copied")
+	}
+}
+
+func TestRequestTimeout_Disabled(t *testing.T) {
+	ds := &mockDS{readBody: "x", delay: 10 * time.Millisecond}
+	h := &RequestTimeout{handler: &APIHandler{ds: ds}}
+	req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+}
+
+func TestAPIGet_Locks(t *testing.T) {
+	ds := &mockDS{locks: []LockEntry{
+		{Path: "/old", LockInfo: map[string]interface{}{"ID": "1"}, Age: 3 * time.Hour},
+		{Path: "/new", LockInfo: map[string]interface{}{"ID": "2"}, Age: time.Minute},
+	}}
+	h := &APIHandler{ds: ds}
+	req := httptest.NewRequest(http.MethodGet, "/?locks=true&stale=2h", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var res []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if len(res) != 1 || res[0]["path"] != "/old" {
+		t.Fatalf("unexpected locks: %+v", res)
+	}
+	if res[0]["age"].(float64) != 3*3600 {
+		t.Errorf("unexpected age: %v", res[0]["age"])
+	}
+}
+
+func TestAPIGet_LocksInvalidStale(t *testing.T) {
+	h := &APIHandler{ds: &mockDS{}}
+	req := httptest.NewRequest(http.MethodGet, "/?locks=true&stale=xyz", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestAPIGet_CacheHeaders(t *testing.T) {
+	ds := &mockDS{readBody: "hello"}
+	h := &APIHandler{ds: ds}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/foo", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if cc := rr.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("current read should not be cached: %q", cc)
+	}
+	if rr.Header().Get("ETag") != "" {
+		t.Errorf("unexpected etag for current read")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/foo?history=abc", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+		t.Fatalf("unexpected response: %d %q", rr.Code, rr.Body.String())
+	}
+	if cc := rr.Header().Get("Cache-Control"); !strings.Contains(cc, "max-age=") || !strings.Contains(cc, "public") {
+		t.Errorf("history read should be cached: %q", cc)
+	}
+	etag := rr.Header().Get("ETag")
+	sum := md5.Sum([]byte("hello"))
+	if etag != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Fatalf("unexpected etag: %q", etag)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/foo?history=abc", nil)
+	req.Header.Set("If-None-Match", `"other", `+etag)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("304 must not have a body: %q", rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/foo?history=abc", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for stale etag, got %d", rr.Code)
+	}
+
+	// the names which follow the file are not immutable
+	for _, history := range []string{"current", "backup"} {
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/foo?history="+history, nil))
+		if cc := rr.Header().Get("Cache-Control"); rr.Code != http.StatusOK || cc != "no-cache" {
+			t.Errorf("%s should not be cached: %d %q", history, rr.Code, cc)
+		}
+	}
+}
+
+func TestAPIPost_RollbackPrune(t *testing.T) {
+	ds := &mockDS{}
+	h := &APIHandler{ds: ds}
+	req := httptest.NewRequest(http.MethodPost, "/f?rollback=abc", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || ds.lastRollback != "abc" {
+		t.Fatalf("rollback not called: %d %q", rr.Code, ds.lastRollback)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/f?prune=3", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || ds.lastPrune != 3 {
+		t.Fatalf("prune not called: %d %d", rr.Code, ds.lastPrune)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/f?prune=-1", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid keep, got %d", rr.Code)
+	}
+}
+
+func TestAPIPost_RollbackIfMatch(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	versions := writeAt(t, &ds, "f", time.Now().Add(-time.Hour), time.Now())
+	h := &APIHandler{ds: &ds}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/f", nil))
+	etag := rr.Header().Get("Etag")
+	if etag != `"`+versions[1]+`"` || rr.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("unexpected etag %q", etag)
+	}
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/f", nil)
+	req.Header.Set("If-None-Match", etag)
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", rr.Code)
+	}
+
+	tests := []struct {
+		ifMatch string
+		status  int
+		current string
+	}{
+		{`"other"`, http.StatusPreconditionFailed, versions[1]},
+		{etag, http.StatusOK, versions[0]},
+		// stale: current changed by the rollback above
+		{etag, http.StatusPreconditionFailed, versions[0]},
+		{`W/"` + versions[0] + `-gzip"`, http.StatusOK, versions[0]},
+		{"*", http.StatusOK, versions[0]},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/f?rollback="+versions[0], nil)
+		req.Header.Set("If-Match", test.ifMatch)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != test.status || ds.CurrentVersion("f") != test.current {
+			t.Errorf("%s: expected %d %s, got %d %s", test.ifMatch, test.status, test.current, rr.Code, ds.CurrentVersion("f"))
+		}
+	}
+	// current is no version to roll back to, it would point to itself
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/f?rollback=current", nil))
+	if rr.Code != http.StatusBadRequest || ds.CurrentVersion("f") != versions[0] {
+		t.Errorf("rollback to current: %d %s", rr.Code, ds.CurrentVersion("f"))
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/f", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("read after rollback to current: %d", rr.Code)
+	}
+}
+
+func TestAPIGet_MissingState(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	writeAt(t, &ds, "exists", time.Now())
+	tests := []struct {
+		mode   *WebServer
+		path   string
+		method string
+		status int
+		body   string
+	}{
+		{&WebServer{}, "/missing", http.MethodGet, http.StatusNotFound, ""},
+		{&WebServer{MissingAsEmpty: true, MissingBody: "json"}, "/missing", http.MethodGet, http.StatusOK, "{}"},
+		{&WebServer{MissingAsEmpty: true, MissingBody: "none"}, "/missing", http.MethodGet, http.StatusOK, ""},
+		{&WebServer{MissingAsEmpty: true, MissingBody: "json"}, "/missing?history=abc", http.MethodGet, http.StatusNotFound, ""},
+		{&WebServer{MissingAsEmpty: true, MissingBody: "json"}, "/exists?history=abc", http.MethodGet, http.StatusNotFound, ""},
+		{&WebServer{MissingAsEmpty: true, MissingBody: "json"}, "/missing?select=a", http.MethodGet, http.StatusNotFound, ""},
+		// unaffected, deleting a missing file succeeds anyway
+		{&WebServer{MissingAsEmpty: true, MissingBody: "json"}, "/missing", http.MethodDelete, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		h := &APIHandler{ds: &ds, missingBody: test.mode.missingBody()}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(test.method, test.path, nil))
+		if rr.Code != test.status {
+			t.Errorf("%s %s (%+v): expected %d, got %d", test.method, test.path, test.mode, test.status, rr.Code)
+		}
+		if test.status == http.StatusOK && (rr.Body.String() != test.body || rr.Header().Get("Content-Length") != strconv.Itoa(len(test.body))) {
+			t.Errorf("%s %s: unexpected body %q, length %s", test.method, test.path, rr.Body.String(), rr.Header().Get("Content-Length"))
+		}
+	}
+}
+
+func TestAPIBatchLock(t *testing.T) {
+	tmp := t.TempDir()
+	ds := NewDatastore(tmp)
+	h := http.StripPrefix("/api/", &APIHandler{ds: &ds})
+
+	body := `{"names":["x","y"],"lockinfo":{"ID":"b1","Who":"me"}}`
+	req := httptest.NewRequest(http.MethodPost, "/api/_lock-batch", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	body = `{"names":["y","z"],"lockinfo":{"ID":"b2"}}`
+	req = httptest.NewRequest(http.MethodPost, "/api/_lock-batch", strings.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rr.Code)
+	}
+	res := map[string]interface{}{}
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	if res["failed"] != "y" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+	if _, err := ds.LockRead("z"); err != ErrUnlocked {
+		t.Errorf("z must be released: %v", err)
+	}
+
+	body = `{"names":["x","y"],"lockinfo":{"ID":"b1"}}`
+	req = httptest.NewRequest(http.MethodPost, "/api/_unlock-batch", strings.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := ds.LockRead("x"); err != ErrUnlocked {
+		t.Errorf("x must be unlocked: %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/_lock-batch", strings.NewReader(`{"names":["x"]}`))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without lockinfo, got %d", rr.Code)
+	}
+}
+
+func TestAPIPost_RejectBinary(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01"
+	tfstate := `{"version": 4, "terraform_version": "1.5.7", "serial": 1}`
+	tests := []struct {
+		name   string
+		reject bool
+		body   string
+		status int
+	}{
+		{"png rejected", true, png, http.StatusUnsupportedMediaType},
+		{"json accepted", true, tfstate, http.StatusOK},
+		{"empty accepted", true, "", http.StatusOK},
+		{"png allowed by default", false, png, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ds := &mockDS{}
+			h := &APIHandler{ds: ds, rejectBinary: test.reject}
+			req := httptest.NewRequest(http.MethodPost, "/api/f", strings.NewReader(test.body))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, rr.Code)
+			}
+			if test.status == http.StatusOK && ds.lastWrite != test.body {
+				t.Errorf("body not passed through: %q", ds.lastWrite)
+			}
+			if test.status != http.StatusOK && ds.lastWrite != "" {
+				t.Errorf("rejected body was written: %q", ds.lastWrite)
+			}
+		})
+	}
+}
+
+func TestAPI_Protected(t *testing.T) {
+	ds := &mockDS{writeErr: ErrProtected, deleteErr: ErrProtected, readBody: "data", protected: true}
+	h := &APIHandler{ds: ds}
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		req := httptest.NewRequest(method, "/api/f", strings.NewReader("x"))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", method, rr.Code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/f", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "data" {
+		t.Errorf("read should be allowed: %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAPILock_ConflictHolder(t *testing.T) {
+	holder := `{"ID":"1","Who":"alice@host"}`
+	ds := &mockDS{lockErr: ErrLocked, lockHolder: holder}
+	h := &APIHandler{ds: ds}
+	req := httptest.NewRequest("LOCK", "/api/z", strings.NewReader(`{"ID":"2"}`))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rr.Code)
+	}
+	if rr.Body.String() != holder {
+		t.Errorf("expected holder info in body, got %q", rr.Body.String())
+	}
+}
+
+func TestHTMLHandler_ClientGone(t *testing.T) {
+	ds := &mockDS{delay: 5 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		ds.entries = append(ds.entries, FileEntry{Name: fmt.Sprintf("state%d", i)})
+	}
+	h := &HTMLHandler{ds: ds, basepath: "/html/"}
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Millisecond)
+	defer cancel()
+	rr := httptest.NewRecorder()
+	http.StripPrefix("/html/", h).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/", nil).WithContext(ctx))
+	if ds.walked == 0 || ds.walked >= len(ds.entries) {
+		t.Errorf("walk was not stopped early: %d of %d", ds.walked, len(ds.entries))
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("unexpected response to a gone client: %s", rr.Body.String())
+	}
+}
+
+func TestHTMLHandler_BrokenTemplate(t *testing.T) {
+	templates := fstest.MapFS{}
+	ents, _ := fs.ReadDir(template_files, "templates")
+	for _, ent := range ents {
+		content, _ := fs.ReadFile(template_files, "templates/"+ent.Name())
+		templates["templates/"+ent.Name()] = &fstest.MapFile{Data: content}
+	}
+	// syntax error on load, and error on execution
+	templates["templates/list.html"] = &fstest.MapFile{Data: []byte(`{{ .Files `)}
+	templates["templates/view.html"] = &fstest.MapFile{Data: []byte(`{{ index .history 100 }}`)}
+
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(t.Context(), "dir/state", strings.NewReader(`{"key": "value"}`), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	h := &HTMLHandler{ds: &ds, basepath: "/html/", templates: templates}
+	tests := []struct {
+		name     string
+		path     string
+		expected []string
+	}{
+		{"index", "/html/", []string{`<a href="/html/view/dir/state">`}},
+		{"view", "/html/view/dir/state", []string{"&#34;key&#34;: &#34;value&#34;", `href="?history=`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			http.StripPrefix("/html/", h).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", rr.Code)
+			}
+			body := rr.Body.String()
+			if !strings.Contains(body, "page template is broken") {
+				t.Errorf("expected minimal page: %s", body)
+			}
+			for _, expected := range test.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("expected %q in %s", expected, body)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIPost_RequireLock(t *testing.T) {
+	for _, require := range []bool{false, true} {
+		ds := NewDatastore(t.TempDir())
+		ds.RequireLock = require
+		h := http.StripPrefix("/api/", &APIHandler{ds: &ds})
+		post := func(path string) int {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+			return rr.Code
+		}
+		if code := post("/api/state"); code != http.StatusOK {
+			t.Fatalf("write to unlocked state: expected 200, got %d", code)
+		}
+		if err := ds.Lock("state", `{"ID":"abc"}`); err != nil {
+			t.Fatalf("lock failed: %v", err)
+		}
+		expected := http.StatusOK
+		if require {
+			expected = http.StatusConflict
+		}
+		if code := post("/api/state"); code != expected {
+			t.Errorf("require=%v: write without ID: expected %d, got %d", require, expected, code)
+		}
+		if code := post("/api/state?ID=other"); code != http.StatusConflict {
+			t.Errorf("require=%v: write with another ID: expected 409, got %d", require, code)
+		}
+		if code := post("/api/state?ID=abc"); code != http.StatusOK {
+			t.Errorf("require=%v: write with the lock ID: expected 200, got %d", require, code)
+		}
+	}
+}
+
+func TestAPIPost_Retain(t *testing.T) {
+	tests := []struct {
+		path     string
+		header   string
+		status   int
+		replaced bool
+	}{
+		{"/api/state", "", http.StatusOK, false},
+		{"/api/state?retain=false", "", http.StatusOK, true},
+		{"/api/state?retain=true", "false", http.StatusOK, false},
+		{"/api/state", "false", http.StatusOK, true},
+		{"/api/state", "0", http.StatusOK, true},
+		{"/api/state?retain=maybe", "", http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		ds := &mockDS{}
+		h := http.StripPrefix("/api/", &APIHandler{ds: ds})
+		req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader("{}"))
+		if test.header != "" {
+			req.Header.Set("X-Statesaver-Retain", test.header)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != test.status || ds.replaced != test.replaced {
+			t.Errorf("%s %q: expected %d replaced=%v, got %d replaced=%v", test.path, test.header, test.status, test.replaced, rr.Code, ds.replaced)
+		}
+	}
+}
+
+func TestAPILock_Enrich(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	h := http.StripPrefix("/api/", &APIHandler{ds: &ds})
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("User-Agent", "Terraform/1.5.7")
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, "alice"))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	if err := ds.Write(t.Context(), "a", strings.NewReader(`{"version":4}`), nil, ""); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if rr := do("LOCK", "/api/a", `{"ID":"abc","Who":"bob@host","_server":{"user":"mallory"}}`); rr.Code != http.StatusOK {
+		t.Fatalf("lock failed: %d", rr.Code)
+	}
+	content, err := ds.LockRead("a")
+	if err != nil {
+		t.Fatalf("LockRead failed: %v", err)
+	}
+	info := struct {
+		ID     string
+		Who    string
+		Server LockServerInfo `json:"_server"`
+	}{}
+	if err := json.Unmarshal([]byte(content), &info); err != nil {
+		t.Fatalf("invalid lock info %q: %v", content, err)
+	}
+	if info.ID != "abc" || info.Who != "bob@host" {
+		t.Errorf("client fields not kept: %+v", info)
+	}
+	if info.Server.User != "alice" || info.Server.RemoteAddr != "192.0.2.1:1234" || info.Server.UserAgent != "Terraform/1.5.7" || info.Server.ReceivedAt.IsZero() {
+		t.Errorf("unexpected server info: %+v", info.Server)
+	}
+
+	rr := httptest.NewRecorder()
+	http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/"}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/view/a", nil))
+	if body := rr.Body.String(); rr.Code != 200 || !strings.Contains(body, "<code>abc</code> by bob@host") || !strings.Contains(body, "received from 192.0.2.1:1234 as alice using Terraform/1.5.7") {
+		t.Errorf("lock panel not shown: %d %s", rr.Code, body)
+	}
+
+	if rr := do("UNLOCK", "/api/a", `{"ID":"abc"}`); rr.Code != http.StatusOK {
+		t.Errorf("unlock with the client lock info failed: %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/_lock-batch", `{"names":["b"],"lockinfo":{"ID":"x"}}`); rr.Code != http.StatusOK {
+		t.Fatalf("batch lock failed: %d", rr.Code)
+	}
+	if content, _ := ds.LockRead("b"); !strings.Contains(content, `"user":"alice"`) {
+		t.Errorf("batch lock not enriched: %q", content)
+	}
+	if got := string(enrichLockInfo([]byte("plain text"), httptest.NewRequest("LOCK", "/", nil))); got != "plain text" {
+		t.Errorf("non-JSON lock info changed: %q", got)
+	}
+}
+
+func TestSortFiles(t *testing.T) {
+	now := time.Now()
+	files := func() []FileEntry {
+		return []FileEntry{
+			{Name: "/b", Size: 10, Timestamp: now},
+			{Name: "/a", Size: 30, Timestamp: now.Add(-time.Hour), Locked: true},
+			{Name: "/c", Size: 10, Timestamp: now.Add(-2 * time.Hour)},
+		}
+	}
+	tests := []struct {
+		key      string
+		desc     bool
+		expected string
+	}{
+		{"name", false, "/a /b /c"},
+		{"name", true, "/c /b /a"},
+		{"size", false, "/b /c /a"},
+		{"size", true, "/a /b /c"},
+		{"modified", false, "/c /a /b"},
+		{"modified", true, "/b /a /c"},
+		{"locked", false, "/a /b /c"},
+		{"locked", true, "/b /c /a"},
+	}
+	for _, test := range tests {
+		fs := files()
+		sortFiles(fs, test.key, test.desc)
+		names := []string{}
+		for _, f := range fs {
+			names = append(names, f.Name)
+		}
+		if got := strings.Join(names, " "); got != test.expected {
+			t.Errorf("%s desc=%v: expected %s, got %s", test.key, test.desc, test.expected, got)
+		}
+	}
+}
+
+func TestHTMLHandler_IndexSkipped(t *testing.T) {
+	ds := &mockDS{
+		entries: []FileEntry{{Name: "/a", Size: 1}},
+		skipped: []WalkFailure{{Name: "/secret", Error: "permission denied"}},
+	}
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: ds, basepath: "/html/"})
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/", nil))
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status %d", rr.Code)
+	}
+	if !strings.Contains(body, "1 entries could not be read") || !strings.Contains(body, "/secret: permission denied") {
+		t.Errorf("warning not found: %s", body)
+	}
+	if !strings.Contains(body, ">/a<") {
+		t.Errorf("readable entry not listed: %s", body)
+	}
+}
+
+func TestHTMLHandler_IndexRow(t *testing.T) {
+	defer func(orig func() time.Time) { templateNow = orig }(templateNow)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	templateNow = func() time.Time { return now }
+	ds := &mockDS{
+		entries: []FileEntry{{Name: "/team/app", Size: 2048, Timestamp: now.Add(-2 * time.Hour), Locked: true}},
+		history: []FileEntry{{Name: "v2", Locked: true}, {Name: "v1"}},
+	}
+	when := `<abbr title="2024-06-01T10:00:00Z" class="default">2h ago</abbr>`
+	readable := `<li><a href="view/team/app">/team/app</a> <span class="badge text-bg-danger">locked</span> (2.0 KiB, ` + when + `, 2 versions)
+                <span class="small">
+                    <a href="view/team/app">view</a> | <a href="diff/team/app?a=v1&amp;b=v2">last change</a>
+                    | <a href="../api/team/app?versions=true">history</a>
+                    | <a href="../api/team/app" download>download</a>
+                </span>
+            </li>`
+	hidden := `<li>/team/app <span class="badge text-bg-danger">locked</span> (2.0 KiB, ` + when + `, 2 versions)
+            </li>`
+	acl := &ACL{rules: []ACLRule{
+		{Users: []string{"admin"}, Pattern: "*", Perms: "rwl"},
+		{Users: []string{"reader"}, Pattern: "team/*", Perms: "r"},
+	}}
+	tests := []struct {
+		name     string
+		acl      *ACL
+		user     string
+		row      string
+		maintain bool
+	}{
+		{"no acl", nil, "", readable, true},
+		{"admin", acl, "admin", readable, true},
+		{"reader", acl, "reader", readable, false},
+		{"no permission", acl, "other", hidden, false},
+	}
+	for _, test := range tests {
+		h := http.StripPrefix("/html/", &HTMLHandler{ds: ds, basepath: "/html/", acl: test.acl})
+		req := httptest.NewRequest(http.MethodGet, "/html/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, test.user))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		body := rr.Body.String()
+		if !strings.Contains(body, test.row) {
+			t.Errorf("%s: expected row\n%s\nin\n%s", test.name, test.row, body)
+		}
+		if strings.Contains(body, `href="admin"`) != test.maintain {
+			t.Errorf("%s: maintenance link shown: %v", test.name, !test.maintain)
+		}
+	}
+}
+
+func TestHTMLHandler_IndexSort(t *testing.T) {
+	ds := newMemDS()
+	ds.put("b", "1")
+	ds.put("a", "22")
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: ds, basepath: "/html/"})
+	tests := []struct {
+		query string
+		first string
+		link  string
+	}{
+		{"", "/a", "?order=desc&amp;sort=name"},
+		{"?sort=size&order=desc", "/a", "?order=asc&amp;sort=size"},
+		{"?sort=size", "/b", "?order=desc&amp;sort=size"},
+		{"?sort=unknown&preview=true", "/a", "?order=asc&amp;preview=true&amp;sort=size"},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/html/"+test.query, nil))
+		body := rr.Body.String()
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: status %d", test.query, rr.Code)
+			continue
+		}
+		a, b := strings.Index(body, ">/a<"), strings.Index(body, ">/b<")
+		if (test.first == "/a") != (a < b) {
+			t.Errorf("%s: expected %s first", test.query, test.first)
+		}
+		if !strings.Contains(body, test.link) {
+			t.Errorf("%s: link %s not found: %s", test.query, test.link, body)
+		}
+	}
+}
+
+func TestAPILock_Method(t *testing.T) {
+	ds := newMemDS()
+	h := &APIHandler{ds: ds, lockMethods: LockMethods{Lock: http.MethodPost, Unlock: http.MethodDelete}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	if code, _ := request(t, srv, http.MethodPost, "/app?lock=1", `{"ID":"1"}`); code != http.StatusOK {
+		t.Fatalf("POST lock: %d", code)
+	}
+	if holder, err := ds.LockRead("app"); err != nil || lockID(holder) != "1" {
+		t.Fatalf("not locked: %q %v", holder, err)
+	}
+	if ds.CurrentVersion("app") != "" {
+		t.Errorf("lock request written as a state")
+	}
+	if code, _ := request(t, srv, http.MethodPost, "/app?lock=true", `{"ID":"2"}`); code != http.StatusConflict {
+		t.Errorf("POST lock by another ID: %d", code)
+	}
+	if code, _ := request(t, srv, http.MethodPost, "/app?ID=1", `{"v":1}`); code != http.StatusOK || ds.CurrentVersion("app") == "" {
+		t.Errorf("POST without ?lock is a write: %d", code)
+	}
+	locks := len(ds.called("Lock"))
+	request(t, srv, "LOCK", "/other", `{"ID":"1"}`)
+	if got := ds.called("Lock"); len(got) != locks {
+		t.Errorf("LOCK still locks: %v", got)
+	}
+	if code, _ := request(t, srv, http.MethodDelete, "/app?unlock=1", `{"ID":"1"}`); code != http.StatusOK {
+		t.Fatalf("DELETE unlock: %d", code)
+	}
+	if _, err := ds.LockRead("app"); err != ErrUnlocked {
+		t.Errorf("not unlocked: %v", err)
+	}
+	if got := ds.called("Delete"); len(got) != 0 {
+		t.Errorf("unlock request deleted the state: %v", got)
+	}
+}
+
+func TestLockMethods_Check(t *testing.T) {
+	tests := []struct {
+		lock, unlock string
+		valid        bool
+	}{
+		{"LOCK", "UNLOCK", true},
+		{"POST", "POST", true},
+		{"POST", "DELETE", true},
+		{"PURGE", "PURGE", false},
+		{"GET", "UNLOCK", false},
+	}
+	for _, test := range tests {
+		cmd := &WebServer{LockMethod: test.lock, UnlockMethod: test.unlock}
+		if err := cmd.lockMethods().check(); (err == nil) != test.valid {
+			t.Errorf("%s/%s: %v", test.lock, test.unlock, err)
+		}
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	sum := md5.Sum([]byte("{}"))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		method string
+		status int
+		body   string
+		md5    string
+		length string
+		sent   string
+	}{
+		{http.MethodGet, http.StatusOK, "{}", digest, "2", "{}"},
+		{http.MethodHead, http.StatusOK, "{}", digest, "2", ""},
+		{http.MethodPost, http.StatusOK, "", "", "0", ""},
+		{http.MethodGet, http.StatusNotFound, "", "", "0", ""},
+		{http.MethodGet, http.StatusConflict, "{}", "", "2", "{}"},
+		{http.MethodHead, http.StatusConflict, "{}", "", "2", ""},
+		{http.MethodGet, http.StatusInternalServerError, "", "", "0", ""},
+		{http.MethodGet, http.StatusNotModified, "{}", "", "", ""},
+		{http.MethodDelete, http.StatusNoContent, "", "", "", ""},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		writeResponse(rr, httptest.NewRequest(test.method, "/a", nil), test.status, []byte(test.body), nil)
+		if rr.Code != test.status || rr.Body.String() != test.sent {
+			t.Errorf("%s %d: unexpected response %d %q", test.method, test.status, rr.Code, rr.Body.String())
+		}
+		if got := rr.Header().Get("Content-Md5"); got != test.md5 {
+			t.Errorf("%s %d: expected Content-Md5 %q, got %q", test.method, test.status, test.md5, got)
+		}
+		if got := rr.Header().Get("Content-Length"); got != test.length {
+			t.Errorf("%s %d: expected Content-Length %q, got %q", test.method, test.status, test.length, got)
+		}
+	}
+	// the digest of the decoded contents is kept for encoded bodies
+	rr := httptest.NewRecorder()
+	writeResponse(rr, httptest.NewRequest(http.MethodGet, "/a", nil), http.StatusOK, []byte("gzipped"), sum[:])
+	if rr.Header().Get("Content-Md5") != digest {
+		t.Errorf("given digest not used: %s", rr.Header().Get("Content-Md5"))
+	}
+}
+
+func TestAPIHead(t *testing.T) {
+	ds := newMemDS()
+	version := ds.put("prod", `{"v":1}`)
+	h := &APIHandler{ds: ds}
+	head := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, path, nil))
+		return rr
+	}
+	rr := head("/prod")
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "7" || rr.Header().Get("Etag") != `"`+version+`"` || rr.Header().Get("Content-Md5") == "" {
+		t.Errorf("unexpected HEAD: %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+	if rr := head("/missing"); rr.Code != http.StatusNotFound || rr.Header().Get("Content-Md5") != "" {
+		t.Errorf("unexpected HEAD of a missing file: %d %v", rr.Code, rr.Header())
+	}
+	if ds.file("prod", false) == nil || len(ds.called("Delete")) != 0 {
+		t.Errorf("HEAD changed the file")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/prod", nil)
+	req.Header.Set("If-None-Match", `"`+version+`"`)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified || rr.Header().Get("Content-Md5") != "" || rr.Header().Get("Content-Length") != "" {
+		t.Errorf("unexpected 304: %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestHTMLHandler_Head(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(t.Context(), "dir/state", strings.NewReader(`{"key": "value"}`), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/"})
+	for _, path := range []string{"/html/", "/html/view/dir/state", "/html/view/missing"} {
+		t.Run(path, func(t *testing.T) {
+			get := httptest.NewRecorder()
+			h.ServeHTTP(get, httptest.NewRequest(http.MethodGet, path, nil))
+			head := httptest.NewRecorder()
+			h.ServeHTTP(head, httptest.NewRequest(http.MethodHead, path, nil))
+			if head.Code != get.Code || head.Body.Len() != 0 {
+				t.Errorf("unexpected HEAD %d with %d bytes, GET %d", head.Code, head.Body.Len(), get.Code)
+			}
+			if length := head.Header().Get("Content-Length"); length == "" || length != get.Header().Get("Content-Length") || length != strconv.Itoa(get.Body.Len()) {
+				t.Errorf("unexpected Content-Length %q, GET %q", length, get.Header().Get("Content-Length"))
+			}
+		})
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/html/", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", rr.Code)
+	}
+}
+
+func TestHTMLHandler_IndexHidesContents(t *testing.T) {
+	ds := NewDatastore(t.TempDir())
+	if err := ds.Write(t.Context(), "secret/app", strings.NewReader(testTFStateNew), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := ds.Write(t.Context(), "open", strings.NewReader(`{"password": "hunter2"}`), []byte{}, ""); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	acl := &ACL{rules: []ACLRule{
+		{Users: []string{"admin"}, Pattern: "*", Perms: "rwl"},
+		{Users: []string{"*"}, Pattern: "open", Perms: "r"},
+	}}
+	h := http.StripPrefix("/html/", &HTMLHandler{ds: &ds, basepath: "/html/", acl: acl})
+	index := func(user string) string {
+		req := httptest.NewRequest(http.MethodGet, "/html/?preview=true", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+	if body := index("admin"); !strings.Contains(body, "serial 147, tf 1.7.4") || !strings.Contains(body, "terraform 1.7.4") {
+		t.Errorf("contents not shown to a reader: %s", body)
+	}
+	body := index("other")
+	if strings.Contains(body, "serial 147") || strings.Contains(body, "1.7.4") || strings.Contains(body, "lineage") {
+		t.Errorf("contents shown without read permission: %s", body)
+	}
+	if !strings.Contains(body, "/secret/app") || !strings.Contains(body, "password") {
+		t.Errorf("unexpected index: %s", body)
+	}
+}
+
+func TestHTMLHandler_ErrorStatus(t *testing.T) {
+	for _, err := range []error{ErrNotFound, ErrForbidden, ErrBusy, ErrTooLarge, ErrNoSpace, ErrLocked,
+		fmt.Errorf("a: %w", ErrPathConflict), errors.New("other")} {
+		ds := &mockDS{readErr: err}
+		html := httptest.NewRecorder()
+		http.StripPrefix("/html/", &HTMLHandler{ds: ds, basepath: "/html/", lockConflict: http.StatusLocked}).ServeHTTP(html, httptest.NewRequest(http.MethodGet, "/html/view/a", nil))
+		api := httptest.NewRecorder()
+		(&APIHandler{ds: ds, lockConflict: http.StatusLocked}).ServeHTTP(api, httptest.NewRequest(http.MethodGet, "/a", nil))
+		if html.Code != api.Code || html.Code != errorStatus(err, http.StatusLocked) {
+			t.Errorf("%v: html %d, api %d", err, html.Code, api.Code)
+		}
+	}
+}